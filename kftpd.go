@@ -2,42 +2,162 @@ package kftpd
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/list"
 	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awscreds "github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/yaml.v3"
 )
 
 // FtpdConfig - ftpd configure
 type FtpdConfig struct {
-	Bind    string `yaml:"Bind,omitempty"`
-	Driver  string `yaml:"Driver,omitempty"`
-	HomeDir bool   `yaml:"HomeDir,omitempty"`
-	Debug   bool   `yaml:"Debug,omitempty"`
+	Bind         string `yaml:"Bind,omitempty"`
+	Driver       string `yaml:"Driver,omitempty"`
+	HomeDir      bool   `yaml:"HomeDir,omitempty"`
+	HomeTemplate string `yaml:"HomeTemplate,omitempty"`
+	Debug        bool   `yaml:"Debug,omitempty"`
+	Stealth      bool   `yaml:"Stealth,omitempty"`
+	Banner       string `yaml:"Banner,omitempty"`
+	Syst         string `yaml:"Syst,omitempty"`
+
+	BounceProtection bool `yaml:"BounceProtection,omitempty"`
+
+	LogLevel  string `yaml:"LogLevel,omitempty"`
+	logLevel  LogLevel
+	LogFormat string `yaml:"LogFormat,omitempty"`
+
+	UploadNamePattern    string `yaml:"UploadNamePattern,omitempty"`
+	uploadNameRegexp     *regexp.Regexp
+	DeletePartialUploads bool `yaml:"DeletePartialUploads,omitempty"`
+	ResumeTimeout        int  `yaml:"ResumeTimeout,omitempty"`
+	ListBatchSize        int  `yaml:"ListBatchSize,omitempty"`
+	NlstClassify         bool `yaml:"NlstClassify,omitempty"`
+	AsciiUpload          bool `yaml:"AsciiUpload,omitempty"`
+	AsciiDownload        bool `yaml:"AsciiDownload,omitempty"`
+	MaxSessionGoroutines int  `yaml:"MaxSessionGoroutines,omitempty"`
+
+	ListTimeZone string `yaml:"ListTimeZone,omitempty"`
+	listLocation *time.Location
+	FactTimeZone string `yaml:"FactTimeZone,omitempty"`
+	factLocation *time.Location
+
+	LazyDriver    bool `yaml:"LazyDriver,omitempty"`
+	DriverTimeout int  `yaml:"DriverTimeout,omitempty"`
+
+	TransferStallTimeout int `yaml:"TransferStallTimeout,omitempty"`
+	IdleTimeout          int `yaml:"IdleTimeout,omitempty"`
+
+	LoginMessage     string `yaml:"LoginMessage,omitempty"`
+	LoginMessageFile string `yaml:"LoginMessageFile,omitempty"`
+	BannerFile       string `yaml:"BannerFile,omitempty"`
+
+	DirMessageFile string            `yaml:"DirMessageFile,omitempty"`
+	DirMessages    map[string]string `yaml:"DirMessages,omitempty"`
+
+	WriteOnlyDirs []string `yaml:"WriteOnlyDirs,omitempty"`
+
+	Bandwidth struct {
+		TotalKBps int            `yaml:"TotalKBps,omitempty"`
+		Weights   map[string]int `yaml:"Weights,omitempty"`
+	} `yaml:"Bandwidth,omitempty"`
+
+	Throttle struct {
+		UploadKBps   int `yaml:"UploadKBps,omitempty"`
+		DownloadKBps int `yaml:"DownloadKBps,omitempty"`
+	} `yaml:"Throttle,omitempty"`
+
+	ModeZ struct {
+		Enable bool `yaml:"Enable,omitempty"`
+		Level  int  `yaml:"Level,omitempty"`
+	} `yaml:"ModeZ,omitempty"`
+
+	Access struct {
+		Allow []string `yaml:"Allow,omitempty"`
+		Deny  []string `yaml:"Deny,omitempty"`
+	} `yaml:"Access,omitempty"`
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	LoginBan struct {
+		MaxFailures int `yaml:"MaxFailures,omitempty"`
+		FindTime    int `yaml:"FindTime,omitempty"`
+		BanTime     int `yaml:"BanTime,omitempty"`
+		FailDelay   int `yaml:"FailDelay,omitempty"`
+	} `yaml:"LoginBan,omitempty"`
 
 	Pasv struct {
-		Enable        bool   `yaml:"Enable,omitempty"`
-		IP            string `yaml:"IP,omitempty"`
-		PortStart     int    `yaml:"PortStart,omitempty"`
-		PortEnd       int    `yaml:"PortEnd,omitempty"`
-		ListenTimeout int    `yaml:"ListenTimeout,omitempty"`
+		Enable        bool          `yaml:"Enable,omitempty"`
+		IP            string        `yaml:"IP,omitempty"`
+		Host          string        `yaml:"Host,omitempty"`
+		Networks      []PasvNetwork `yaml:"Networks,omitempty"`
+		PortStart     int           `yaml:"PortStart,omitempty"`
+		PortEnd       int           `yaml:"PortEnd,omitempty"`
+		ListenTimeout int           `yaml:"ListenTimeout,omitempty"`
 	} `yaml:"Pasv,omitempty"`
+	pasvNets []pasvNet
 
 	Port struct {
 		Enable         bool `yaml:"Enable,omitempty"`
@@ -45,37 +165,342 @@ type FtpdConfig struct {
 	} `yaml:"Port,omitempty"`
 
 	FileDriver struct {
-		BaseDir string `yaml:"BaseDir,omitempty"`
+		BaseDir        string `yaml:"BaseDir,omitempty"`
+		MaxFilesPerDir int    `yaml:"MaxFilesPerDir,omitempty"`
+		SnapshotList   bool   `yaml:"SnapshotList,omitempty"`
+		FollowSymlinks bool   `yaml:"FollowSymlinks,omitempty"`
+		DirMode        string `yaml:"DirMode,omitempty"`
 	} `yaml:"FileDriver,omitempty"`
 
 	MinioDriver struct {
-		Endpoint        string `yaml:"Endpoint,omitempty"`
-		AccessKeyID     string `yaml:"AccessKeyID,omitempty"`
-		SecretAccessKey string `yaml:"SecretAccessKey,omitempty"`
-		UseSSL          bool   `yaml:"UseSSL,omitempty"`
-		Bucket          string `yaml:"Bucket,omitempty"`
+		Endpoint        string            `yaml:"Endpoint,omitempty"`
+		AccessKeyID     string            `yaml:"AccessKeyID,omitempty"`
+		SecretAccessKey string            `yaml:"SecretAccessKey,omitempty"`
+		UseSSL          bool              `yaml:"UseSSL,omitempty"`
+		Bucket          string            `yaml:"Bucket,omitempty"`
+		Prefix          string            `yaml:"Prefix,omitempty"`
+		Users           map[string]string `yaml:"Users,omitempty"`
+		PresignExpire   int               `yaml:"PresignExpire,omitempty"`
+		PartSize        int               `yaml:"PartSize,omitempty"`
+		SmallUploadSize int               `yaml:"SmallUploadSize,omitempty"`
+		CacheDir        string            `yaml:"CacheDir,omitempty"`
+		CacheSize       int               `yaml:"CacheSize,omitempty"`
+		CacheTTL        int               `yaml:"CacheTTL,omitempty"`
 	} `yaml:"MinioDriver,omitempty"`
 
+	S3Driver struct {
+		Endpoint        string   `yaml:"Endpoint,omitempty"`
+		Region          string   `yaml:"Region,omitempty"`
+		Bucket          string   `yaml:"Bucket,omitempty"`
+		AccessKeyID     string   `yaml:"AccessKeyID,omitempty"`
+		SecretAccessKey string   `yaml:"SecretAccessKey,omitempty"`
+		RoleARNs        []string `yaml:"RoleARNs,omitempty"`
+		ExternalID      string   `yaml:"ExternalID,omitempty"`
+		STSEndpoint     string   `yaml:"STSEndpoint,omitempty"`
+		UseSSL          bool     `yaml:"UseSSL,omitempty"`
+		PathStyle       bool     `yaml:"PathStyle,omitempty"`
+		SSE             string   `yaml:"SSE,omitempty"`
+		SSEKMSKeyID     string   `yaml:"SSEKMSKeyID,omitempty"`
+		PresignExpire   int      `yaml:"PresignExpire,omitempty"`
+		PartSize        int      `yaml:"PartSize,omitempty"`
+	} `yaml:"S3Driver,omitempty"`
+
+	GCSDriver struct {
+		Bucket          string `yaml:"Bucket,omitempty"`
+		CredentialsFile string `yaml:"CredentialsFile,omitempty"`
+	} `yaml:"GCSDriver,omitempty"`
+
+	SFTPDriver struct {
+		Addr           string            `yaml:"Addr,omitempty"`
+		User           string            `yaml:"User,omitempty"`
+		Password       string            `yaml:"Password,omitempty"`
+		KeyFile        string            `yaml:"KeyFile,omitempty"`
+		KnownHostsFile string            `yaml:"KnownHostsFile,omitempty"`
+		RootPath       string            `yaml:"RootPath,omitempty"`
+		Users          map[string]string `yaml:"Users,omitempty"`
+	} `yaml:"SFTPDriver,omitempty"`
+
+	Encryption struct {
+		Enable     bool   `yaml:"Enable,omitempty"`
+		Key        string `yaml:"Key,omitempty"`
+		KeyFile    string `yaml:"KeyFile,omitempty"`
+		KeyCommand string `yaml:"KeyCommand,omitempty"`
+	} `yaml:"Encryption,omitempty"`
+	encryptionKey []byte
+
 	AuthTLS struct {
-		Enable   bool   `yaml:"Enable,omitempty"`
-		CertFile string `yaml:"CertFile,omitempty"`
-		KeyFile  string `yaml:"KeyFile,omitempty"`
+		Enable           bool     `yaml:"Enable,omitempty"`
+		CertFile         string   `yaml:"CertFile,omitempty"`
+		KeyFile          string   `yaml:"KeyFile,omitempty"`
+		MinVersion       string   `yaml:"MinVersion,omitempty"`
+		CipherSuites     []string `yaml:"CipherSuites,omitempty"`
+		CurvePreferences []string `yaml:"CurvePreferences,omitempty"`
+		ReloadInterval   int      `yaml:"ReloadInterval,omitempty"`
+		ClientAuth       string   `yaml:"ClientAuth,omitempty"`
+		ClientCAFile     string   `yaml:"ClientCAFile,omitempty"`
+		ClientCertUser   string   `yaml:"ClientCertUser,omitempty"`
+		RequireReuse     bool     `yaml:"RequireReuse,omitempty"`
+		Force            bool     `yaml:"Force,omitempty"`
 	} `yaml:"AuthTLS,omitempty"`
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	tlsCurves       []tls.CurveID
+	tlsClientAuth   tls.ClientAuthType
+	tlsClientCAs    *x509.CertPool
+
+	ACME struct {
+		Enable        bool     `yaml:"Enable,omitempty"`
+		Hosts         []string `yaml:"Hosts,omitempty"`
+		Email         string   `yaml:"Email,omitempty"`
+		CacheDir      string   `yaml:"CacheDir,omitempty"`
+		Challenge     string   `yaml:"Challenge,omitempty"`
+		ChallengeBind string   `yaml:"ChallengeBind,omitempty"`
+		DirectoryURL  string   `yaml:"DirectoryURL,omitempty"`
+	} `yaml:"ACME,omitempty"`
+
+	ReplyCodes map[string]int `yaml:"ReplyCodes,omitempty"`
+
+	TOTPSkew int `yaml:"TOTPSkew,omitempty"`
+
+	RequireStrongPasswords bool `yaml:"RequireStrongPasswords,omitempty"`
+	MinPasswordLength      int  `yaml:"MinPasswordLength,omitempty"`
+
+	AuthFile string `yaml:"AuthFile,omitempty"`
+
+	AuthWebhook struct {
+		URL     string `yaml:"URL,omitempty"`
+		Token   string `yaml:"Token,omitempty"`
+		Timeout int    `yaml:"Timeout,omitempty"`
+	} `yaml:"AuthWebhook,omitempty"`
+
+	SQL struct {
+		Enable  bool   `yaml:"Enable,omitempty"`
+		Driver  string `yaml:"Driver,omitempty"`
+		DSN     string `yaml:"DSN,omitempty"`
+		Query   string `yaml:"Query,omitempty"`
+		Timeout int    `yaml:"Timeout,omitempty"`
+	} `yaml:"SQL,omitempty"`
+
+	LDAP struct {
+		Enable         bool     `yaml:"Enable,omitempty"`
+		URL            string   `yaml:"URL,omitempty"`
+		StartTLS       bool     `yaml:"StartTLS,omitempty"`
+		CAFile         string   `yaml:"CAFile,omitempty"`
+		BindDN         string   `yaml:"BindDN,omitempty"`
+		BindPassword   string   `yaml:"BindPassword,omitempty"`
+		BaseDN         string   `yaml:"BaseDN,omitempty"`
+		UserFilter     string   `yaml:"UserFilter,omitempty"`
+		GroupAttribute string   `yaml:"GroupAttribute,omitempty"`
+		Groups         []string `yaml:"Groups,omitempty"`
+		Timeout        int      `yaml:"Timeout,omitempty"`
+	} `yaml:"LDAP,omitempty"`
+
+	Users map[string]FtpdUser `yaml:"Users,omitempty"`
+
+	VirtualHosts map[string]VirtualHost `yaml:"VirtualHosts,omitempty"`
+
+	Mounts []Mount `yaml:"Mounts,omitempty"`
+}
+
+// Mount - a path served by a driver of its own, the driver settings not
+// set are the ones of the config
+type Mount struct {
+	Path     string `yaml:"Path,omitempty"`
+	Driver   string `yaml:"Driver,omitempty"`
+	BaseDir  string `yaml:"BaseDir,omitempty"`
+	Bucket   string `yaml:"Bucket,omitempty"`
+	ReadOnly bool   `yaml:"ReadOnly,omitempty"`
+	UserHome bool   `yaml:"UserHome,omitempty"`
+}
+
+// VirtualHost - a virtual ftp site chosen by HOST, the settings not empty
+// replace the ones of the config
+type VirtualHost struct {
+	Users        map[string]FtpdUser `yaml:"Users,omitempty"`
+	AuthFile     string              `yaml:"AuthFile,omitempty"`
+	BaseDir      string              `yaml:"BaseDir,omitempty"`
+	Bucket       string              `yaml:"Bucket,omitempty"`
+	Banner       string              `yaml:"Banner,omitempty"`
+	LoginMessage string              `yaml:"LoginMessage,omitempty"`
+	CertFile     string              `yaml:"CertFile,omitempty"`
+	KeyFile      string              `yaml:"KeyFile,omitempty"`
+}
 
-	Users map[string]string `yaml:"Users,omitempty"`
+// PasvNetwork - the address advertised in PASV reply to clients in Network,
+// an IPv4 address or a hostname resolved at reply time
+type PasvNetwork struct {
+	Network string `yaml:"Network,omitempty"`
+	Address string `yaml:"Address,omitempty"`
+}
+
+// pasvNet - a parsed PasvNetwork
+type pasvNet struct {
+	nets    []*net.IPNet
+	address string
+}
+
+// FtpdUser - ftpd user configure, a plain string in config is the password
+type FtpdUser struct {
+	Password        string   `yaml:"Password,omitempty"`
+	TOTPSecret      string   `yaml:"TOTPSecret,omitempty"`
+	Home            string   `yaml:"Home,omitempty"`
+	Group           string   `yaml:"Group,omitempty"`
+	AllowedNetworks []string `yaml:"AllowedNetworks,omitempty"`
+	PasvPortStart   int      `yaml:"PasvPortStart,omitempty"`
+	PasvPortEnd     int      `yaml:"PasvPortEnd,omitempty"`
+	UploadKBps      int      `yaml:"UploadKBps,omitempty"`
+	DownloadKBps    int      `yaml:"DownloadKBps,omitempty"`
+	ReadOnly        bool     `yaml:"ReadOnly,omitempty"`
+	QuotaBytes      int64    `yaml:"QuotaBytes,omitempty"`
+	QuotaFiles      int      `yaml:"QuotaFiles,omitempty"`
+	CanUpload       *bool    `yaml:"CanUpload,omitempty"`
+	CanDownload     *bool    `yaml:"CanDownload,omitempty"`
+	CanDelete       *bool    `yaml:"CanDelete,omitempty"`
+	CanRename       *bool    `yaml:"CanRename,omitempty"`
+	CanMkdir        *bool    `yaml:"CanMkdir,omitempty"`
+	CanList         *bool    `yaml:"CanList,omitempty"`
+	Admin           bool     `yaml:"Admin,omitempty"`
+	CertLogin       bool     `yaml:"CertLogin,omitempty"`
+
+	UploadNamePattern string `yaml:"UploadNamePattern,omitempty"`
+	uploadNameRegexp  *regexp.Regexp
+}
+
+// UnmarshalYAML accept both a password string and a user mapping
+func (user *FtpdUser) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		user.Password = value.Value
+		return nil
+	}
+	type plain FtpdUser
+	return value.Decode((*plain)(user))
 }
 
+// errNoDataConn - no data connection opened by PASV or PORT
+var errNoDataConn = errors.New("no data connection")
+
+// errIdleTimeout - no command from client in IdleTimeout
+var errIdleTimeout = errors.New("idle timeout")
+
+// errTooManyGoroutines - the session already runs MaxSessionGoroutines
+var errTooManyGoroutines = errors.New("too many session goroutines")
+
+// ErrTooManyFiles - the directory already holds the maximum number of files
+var ErrTooManyFiles = errors.New("too many files in directory")
+
 // DriverFactory - new a driver
 type DriverFactory interface {
 	NewDriver(string) (Driver, error)
 }
 
+// UserDriverFactory - driver factory told the login user of a driver
+// besides its home, such as to map users to storage of their own.
+type UserDriverFactory interface {
+	NewUserDriver(user, home string) (Driver, error)
+}
+
+// newUserDriver return the driver of user with home, by NewUserDriver if
+// factory is a UserDriverFactory.
+func newUserDriver(factory DriverFactory, user, home string) (Driver, error) {
+	if uf, ok := factory.(UserDriverFactory); ok {
+		return uf.NewUserDriver(user, home)
+	}
+	return factory.NewDriver(home)
+}
+
 // FileInfo - ftp file information
 type FileInfo interface {
 	os.FileInfo
 }
 
-// Driver - file driver interface
+// LinkFileInfo - file information of a symlink knowing its target
+type LinkFileInfo interface {
+	FileInfo
+	LinkTarget() string
+}
+
+// linkFileInfo - file information of a symlink in file driver
+type linkFileInfo struct {
+	os.FileInfo
+	target string
+}
+
+// LinkTarget return the target of symlink
+func (fi *linkFileInfo) LinkTarget() string {
+	return fi.target
+}
+
+// followFileInfo - file information of a symlink target under the link name
+type followFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name return the symlink name
+func (fi *followFileInfo) Name() string {
+	return fi.name
+}
+
+// VirtualFileInfo - synthetic file information for entries not backed by storage
+type VirtualFileInfo struct {
+	name    string
+	isDir   bool
+	size    func() int64
+	modTime func() time.Time
+}
+
+// NewVirtualFileInfo return a synthetic file information, size and modTime
+// are called every time the information is used, nil means zero value.
+func NewVirtualFileInfo(name string, isDir bool, size func() int64, modTime func() time.Time) FileInfo {
+	return &VirtualFileInfo{
+		name:    name,
+		isDir:   isDir,
+		size:    size,
+		modTime: modTime,
+	}
+}
+
+// Name return virtual file name
+func (v *VirtualFileInfo) Name() string {
+	return v.name
+}
+
+// Size return virtual file size
+func (v *VirtualFileInfo) Size() int64 {
+	if v.size == nil {
+		return 0
+	}
+	return v.size()
+}
+
+// Mode return virtual file mode
+func (v *VirtualFileInfo) Mode() os.FileMode {
+	if v.isDir {
+		return os.ModePerm | os.ModeDir
+	}
+	return os.ModePerm
+}
+
+// ModTime return virtual file modify time
+func (v *VirtualFileInfo) ModTime() time.Time {
+	if v.modTime == nil {
+		return time.Time{}
+	}
+	return v.modTime()
+}
+
+// IsDir return virtual path is dir
+func (v *VirtualFileInfo) IsDir() bool {
+	return v.isDir
+}
+
+// Sys return virtual file system information, not implemented.
+func (v *VirtualFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Driver - file driver interface, a driver implementing io.Closer is
+// closed when its session ends.
 type Driver interface {
 	Stat(string) (FileInfo, error)
 
@@ -96,1634 +521,10936 @@ type Driver interface {
 	PutFile(string, int64, io.Reader) (int64, error)
 }
 
-// MinioDriverFactory - minio driver factory
-type MinioDriverFactory struct {
-	endpoint        string
-	accessKeyID     string
-	secretAccessKey string
-	useSSL          bool
-	bucket          string
+// DriverContext - driver able to cancel its operations, the server binds
+// it to the session so an aborted session cancels the in-flight operation.
+type DriverContext interface {
+	Driver
+	WithContext(context.Context) Driver
 }
 
-// NewMinioDriverFactory return a minio driver factory
-func NewMinioDriverFactory(endpoint, accessKeyID, secretAccessKey, bucket string, useSSL bool) DriverFactory {
-	return &MinioDriverFactory{
-		endpoint:        endpoint,
-		accessKeyID:     accessKeyID,
-		secretAccessKey: secretAccessKey,
-		useSSL:          useSSL,
-		bucket:          bucket,
-	}
+// URLDriver - driver able to hand off a file download by url
+type URLDriver interface {
+	GetURL(string) (string, error)
 }
 
-// MinioFileInfo - minio file information
-type MinioFileInfo struct {
-	name   string
-	object minio.ObjectInfo
-	isDir  bool
+// HashDriver - driver able to supply a precomputed checksum of a file by
+// algorithm name of HASH, such as "MD5", in lower case hex, return
+// ErrHashUnsupported to have the server read the file instead.
+type HashDriver interface {
+	Hash(string, string) (string, error)
 }
 
-// Name return minio file name
-func (m *MinioFileInfo) Name() string {
-	return m.name
+// ErrHashUnsupported - the driver has no precomputed checksum of the file
+var ErrHashUnsupported = errors.New("hash not supported")
+
+// ChmodDriver - driver able to change file mode
+type ChmodDriver interface {
+	Chmod(string, os.FileMode) error
 }
 
-// Size return minio file size
-func (m *MinioFileInfo) Size() int64 {
-	if m.isDir {
-		return 4096
-	}
-	return m.object.Size
+// DriverCapabilities - optional operations supported by a driver
+type DriverCapabilities struct {
+	Chtimes bool
+	Chmod   bool
+	URL     bool
 }
 
-// Mode return minio file mode
-func (m *MinioFileInfo) Mode() os.FileMode {
-	if m.isDir {
-		return os.ModePerm | os.ModeDir
-	}
-	return os.ModePerm
+// CapabilityReporter - driver or driver factory reporting its capabilities
+type CapabilityReporter interface {
+	Capabilities() DriverCapabilities
 }
 
-// ModTime return minio file modify time
-func (m *MinioFileInfo) ModTime() time.Time {
-	if m.isDir {
-		return time.Now()
+// Capabilities return the capabilities of v, a driver or driver factory
+// not reporting them is assumed to support Chtimes and the optional
+// interfaces it implements.
+func Capabilities(v interface{}) DriverCapabilities {
+	if reporter, ok := v.(CapabilityReporter); ok {
+		return reporter.Capabilities()
 	}
-	return m.object.LastModified
+	_, chmod := v.(ChmodDriver)
+	_, url := v.(URLDriver)
+	return DriverCapabilities{Chtimes: true, Chmod: chmod, URL: url}
 }
 
-// IsDir return minio path is dir
-func (m *MinioFileInfo) IsDir() bool {
-	return m.isDir
+// ErrReadOnly - a write operation on a read-only driver
+var ErrReadOnly = errors.New("read-only")
+
+// ReadOnlyDriver - driver wrapper failing every write with ErrReadOnly
+// before it reaches the inner driver.
+type ReadOnlyDriver struct {
+	inner Driver
 }
 
-// Sys return minio file system information, not implemented.
-func (m *MinioFileInfo) Sys() interface{} {
-	return nil
+// NewReadOnlyDriver return a read-only wrapper of inner
+func NewReadOnlyDriver(inner Driver) Driver {
+	return &ReadOnlyDriver{inner}
 }
 
-// MinioDriver - minio driver
-type MinioDriver struct {
-	client *minio.Client
-	bucket string
-	user   string
+// Capabilities return the capabilities of inner driver without writes
+func (driver *ReadOnlyDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{URL: Capabilities(driver.inner).URL}
 }
 
-// NewDriver return a minio driver
-func (factory *MinioDriverFactory) NewDriver(user string) (Driver, error) {
-	client, err := minio.New(factory.endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(factory.accessKeyID, factory.secretAccessKey, ""),
-		Secure: factory.useSSL,
-	})
-	if err != nil {
-		return nil, err
+// WithContext return a read-only wrapper of inner bound to ctx
+func (driver *ReadOnlyDriver) WithContext(ctx context.Context) Driver {
+	if dc, ok := driver.inner.(DriverContext); ok {
+		return &ReadOnlyDriver{dc.WithContext(ctx)}
 	}
+	return driver
+}
 
-	ctx := context.Background()
+// Close close inner driver
+func (driver *ReadOnlyDriver) Close() error {
+	closeDriver(driver.inner)
+	return nil
+}
 
-	err = client.MakeBucket(ctx, factory.bucket, minio.MakeBucketOptions{ObjectLocking: false})
-	if err != nil {
-		exists, errBucketExists := client.BucketExists(ctx, factory.bucket)
-		if !exists || errBucketExists != nil {
-			return nil, err
-		}
-	}
+// Stat return file information of inner driver
+func (driver *ReadOnlyDriver) Stat(path string) (FileInfo, error) {
+	return driver.inner.Stat(path)
+}
 
-	return &MinioDriver{client, factory.bucket, user}, nil
+// ListDir return file list of inner driver
+func (driver *ReadOnlyDriver) ListDir(path string, callback func(FileInfo) error) error {
+	return driver.inner.ListDir(path, callback)
 }
 
-// miniopath return file path joined with user
-func (driver *MinioDriver) miniopath(path string) string {
-	return filepath.Join(driver.user, path)
+// GetFile return file size, file reader of inner driver
+func (driver *ReadOnlyDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return driver.inner.GetFile(path, offset)
 }
 
-// miniodir return dir path joined with user
-func (driver *MinioDriver) miniodir(path string) string {
-	dir := filepath.Join(driver.user, path)
-	if !strings.HasSuffix(dir, "/") {
-		dir += "/"
-	}
-	if dir != "/" && strings.HasPrefix(dir, "/") {
-		dir = strings.TrimPrefix(dir, "/")
+// GetURL return the url of inner driver
+func (driver *ReadOnlyDriver) GetURL(path string) (string, error) {
+	if inner, ok := driver.inner.(URLDriver); ok {
+		return inner.GetURL(path)
 	}
-	return dir
+	return "", errors.New("not implemented")
 }
 
-// Stat return file information
-func (driver *MinioDriver) Stat(path string) (FileInfo, error) {
-	if path == "/" {
-		return &MinioFileInfo{
-			name:  "/",
-			isDir: true,
-		}, nil
+// Hash forward to inner driver if it supplies checksums
+func (driver *ReadOnlyDriver) Hash(path, algo string) (string, error) {
+	if inner, ok := driver.inner.(HashDriver); ok {
+		return inner.Hash(path, algo)
 	}
+	return "", ErrHashUnsupported
+}
 
-	rpath := driver.miniopath(path)
-	object, err := driver.client.StatObject(context.Background(), driver.bucket, rpath, minio.StatObjectOptions{})
-	if err != nil {
-		return &MinioFileInfo{
-			name:  rpath,
-			isDir: true,
-		}, nil
-	}
-	return &MinioFileInfo{
-		name:   strings.TrimSuffix(strings.TrimPrefix(object.Key, rpath), "/"),
-		object: object,
-		isDir:  strings.HasSuffix(object.Key, "/"),
-	}, nil
+// Chtimes fail with ErrReadOnly
+func (driver *ReadOnlyDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return ErrReadOnly
 }
 
-// Chtimes change file modify time
-func (driver *MinioDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
-	return errors.New("not implemented")
+// DeleteDir fail with ErrReadOnly
+func (driver *ReadOnlyDriver) DeleteDir(path string) error {
+	return ErrReadOnly
 }
 
-// DeleteDir delete dir in minio
-func (driver *MinioDriver) DeleteDir(path string) error {
-	rpath := driver.miniodir(path)
+// DeleteFile fail with ErrReadOnly
+func (driver *ReadOnlyDriver) DeleteFile(path string) error {
+	return ErrReadOnly
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Rename fail with ErrReadOnly
+func (driver *ReadOnlyDriver) Rename(from string, to string) error {
+	return ErrReadOnly
+}
 
-	objectCh := driver.client.ListObjects(ctx, driver.bucket, minio.ListObjectsOptions{
-		Prefix:    rpath,
-		Recursive: false,
-	})
-	for rErr := range driver.client.RemoveObjects(ctx, driver.bucket, objectCh, minio.RemoveObjectsOptions{
-		GovernanceBypass: true,
-	}) {
-		return rErr.Err
-	}
-	return driver.client.RemoveObject(ctx, driver.bucket, rpath, minio.RemoveObjectOptions{})
+// MakeDir fail with ErrReadOnly
+func (driver *ReadOnlyDriver) MakeDir(path string) error {
+	return ErrReadOnly
 }
 
-// DeleteFile delete file in minio
-func (driver *MinioDriver) DeleteFile(path string) error {
-	rpath := driver.miniopath(path)
-	return driver.client.RemoveObject(context.Background(), driver.bucket, rpath, minio.RemoveObjectOptions{})
+// PutFile fail with ErrReadOnly
+func (driver *ReadOnlyDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	return 0, ErrReadOnly
 }
 
-// Rename rename file or dir in minio
-func (driver *MinioDriver) Rename(from string, to string) error {
-	fpath := driver.miniopath(from)
-	tpath := driver.miniopath(to)
-	ctx := context.Background()
+// ErrCrossMount - a rename between different mounts
+var ErrCrossMount = errors.New("rename across mounts")
 
-	rename := func(from, to string) error {
-		_, err := driver.client.CopyObject(ctx, minio.CopyDestOptions{
-			Bucket: driver.bucket,
-			Object: to,
-		}, minio.CopySrcOptions{
-			Bucket: driver.bucket,
-			Object: from,
-		})
-		if err == nil {
-			err = driver.client.RemoveObject(ctx, driver.bucket, fpath, minio.RemoveObjectOptions{})
-		}
-		return err
-	}
+// MountPoint - a path of MountDriverFactory served by a factory of its own,
+// the mounted drivers are created without home unless UserHome.
+type MountPoint struct {
+	Path     string
+	Factory  DriverFactory
+	ReadOnly bool
+	UserHome bool
+}
 
-	err := rename(fpath, tpath)
-	if err != nil {
-		fpath += "/"
-		tpath += "/"
-		err = rename(fpath, tpath)
-	}
+// MountDriverFactory - factory of drivers routing the paths under the
+// mount points to the mounted drivers and the rest to the root driver
+type MountDriverFactory struct {
+	root   DriverFactory
+	mounts []MountPoint
+}
 
-	return err
+// NewMountDriverFactory return a factory of root with mounts, a path is
+// served by the mount of the longest matching path.
+func NewMountDriverFactory(root DriverFactory, mounts []MountPoint) DriverFactory {
+	sorted := make([]MountPoint, len(mounts))
+	for i, m := range mounts {
+		m.Path = jailpath(m.Path)
+		sorted[i] = m
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Path) > len(sorted[j].Path)
+	})
+	return &MountDriverFactory{root: root, mounts: sorted}
 }
 
-// MakeDir make dir in minio
-func (driver *MinioDriver) MakeDir(path string) error {
-	rpath := driver.miniodir(path)
-	_, err := driver.client.PutObject(context.Background(), driver.bucket, rpath, nil, 0, minio.PutObjectOptions{})
-	return err
+// Capabilities return the capabilities any of the drivers supports
+func (factory *MountDriverFactory) Capabilities() DriverCapabilities {
+	caps := Capabilities(factory.root)
+	for _, m := range factory.mounts {
+		mc := Capabilities(m.Factory)
+		caps.Chtimes = caps.Chtimes || mc.Chtimes
+		caps.Chmod = caps.Chmod || mc.Chmod
+		caps.URL = caps.URL || mc.URL
+	}
+	return caps
 }
 
-// GetFile return file size, file reader in minio
-func (driver *MinioDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
-	rpath := driver.miniopath(path)
+// NewDriver return a driver of the root and mounted drivers
+func (factory *MountDriverFactory) NewDriver(home string) (Driver, error) {
+	return factory.NewUserDriver("", home)
+}
 
-	object, err := driver.client.GetObject(context.Background(), driver.bucket, rpath, minio.GetObjectOptions{})
+// NewUserDriver return a driver of the root and mounted drivers of user
+func (factory *MountDriverFactory) NewUserDriver(user, home string) (Driver, error) {
+	root, err := newUserDriver(factory.root, user, home)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	defer func() {
-		if err != nil && object != nil {
-			object.Close()
+	driver := &MountDriver{root: root}
+	for _, m := range factory.mounts {
+		mountHome := ""
+		if m.UserHome {
+			mountHome = home
 		}
-	}()
-	info, err := object.Stat()
-	if err != nil {
-		return 0, nil, err
-	}
-	if offset > 0 {
-		_, err = object.Seek(offset, io.SeekStart)
+		inner, err := newUserDriver(m.Factory, user, mountHome)
 		if err != nil {
-			return 0, nil, err
+			driver.Close()
+			return nil, fmt.Errorf("mount %s: %v", m.Path, err)
 		}
+		if m.ReadOnly {
+			inner = NewReadOnlyDriver(inner)
+		}
+		driver.mounts = append(driver.mounts, mountedDriver{m.Path, inner})
 	}
+	return driver, nil
+}
 
-	return info.Size - offset, object, nil
+// mountedDriver - a driver mounted at path
+type mountedDriver struct {
+	path   string
+	driver Driver
 }
 
-// PutFile put a file to minio, support append with offset.
-func (driver *MinioDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
-	rpath := driver.miniopath(path)
+// MountDriver - driver routing paths to the mounted drivers by the longest
+// mount path, the mount points are listed in their parent directories.
+type MountDriver struct {
+	root   Driver
+	mounts []mountedDriver
+}
 
-	if offset == 0 {
-		info, err := driver.client.PutObject(context.Background(), driver.bucket, rpath, reader, -1, minio.PutObjectOptions{})
-		if err != nil {
-			return 0, err
+// route return the driver serving path and the path in it, mount is the
+// mount path, empty for the root driver.
+func (driver *MountDriver) route(path string) (Driver, string, string) {
+	path = jailpath(path)
+	for _, m := range driver.mounts {
+		if path == m.path || strings.HasPrefix(path, m.path+"/") {
+			return m.driver, jailpath(strings.TrimPrefix(path, m.path)), m.path
 		}
-		return info.Size, nil
 	}
+	return driver.root, path, ""
+}
 
-	ctx := context.Background()
+// mountEntries return the names of the mount points under dir and whether
+// each is a mount point itself or a directory leading to one.
+func (driver *MountDriver) mountEntries(dir string) map[string]bool {
+	dir = jailpath(dir)
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = "/"
+	}
+	entries := make(map[string]bool)
+	for _, m := range driver.mounts {
+		if !strings.HasPrefix(m.path, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(m.path, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			if _, ok := entries[rest[:i]]; !ok {
+				entries[rest[:i]] = false
+			}
+		} else {
+			entries[rest] = true
+		}
+	}
+	return entries
+}
 
-	tmppath := rpath + ".tmp"
+// Capabilities return the capabilities any of the drivers supports
+func (driver *MountDriver) Capabilities() DriverCapabilities {
+	caps := Capabilities(driver.root)
+	for _, m := range driver.mounts {
+		mc := Capabilities(m.driver)
+		caps.Chtimes = caps.Chtimes || mc.Chtimes
+		caps.Chmod = caps.Chmod || mc.Chmod
+		caps.URL = caps.URL || mc.URL
+	}
+	return caps
+}
 
-	defer func() {
-		driver.client.RemoveObject(ctx, driver.bucket, tmppath, minio.RemoveObjectOptions{})
-	}()
+// WithContext return the driver with the drivers bound to ctx
+func (driver *MountDriver) WithContext(ctx context.Context) Driver {
+	bind := func(d Driver) Driver {
+		if dc, ok := d.(DriverContext); ok {
+			return dc.WithContext(ctx)
+		}
+		return d
+	}
+	bound := &MountDriver{root: bind(driver.root)}
+	for _, m := range driver.mounts {
+		bound.mounts = append(bound.mounts, mountedDriver{m.path, bind(m.driver)})
+	}
+	return bound
+}
 
-	_, err := driver.client.PutObject(ctx, driver.bucket, tmppath, reader, -1, minio.PutObjectOptions{})
-	if err != nil {
-		return 0, err
+// Close close the root and mounted drivers
+func (driver *MountDriver) Close() error {
+	if driver.root != nil {
+		closeDriver(driver.root)
 	}
-	info, err := driver.client.ComposeObject(ctx,
-		minio.CopyDestOptions{Bucket: driver.bucket, Object: rpath},
-		minio.CopySrcOptions{Bucket: driver.bucket, Object: rpath},
-		minio.CopySrcOptions{Bucket: driver.bucket, Object: tmppath})
-	if err != nil {
-		return 0, err
+	for _, m := range driver.mounts {
+		closeDriver(m.driver)
 	}
-	return info.Size, nil
+	return nil
 }
 
-// ListDir return file list from dir in minio
-func (driver *MinioDriver) ListDir(path string, callback func(FileInfo) error) error {
-	rpath := driver.miniodir(path)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Stat return file information of path, a mount point is named as its
+// mount path and a directory leading to one exists even if the root
+// driver has no such directory.
+func (driver *MountDriver) Stat(path string) (FileInfo, error) {
+	inner, rpath, mount := driver.route(path)
+	fi, err := inner.Stat(rpath)
+	if len(mount) > 0 && rpath == "/" {
+		if err != nil {
+			return NewVirtualFileInfo(filepath.Base(mount), true, nil, nil), nil
+		}
+		return &followFileInfo{fi, filepath.Base(mount)}, nil
+	}
+	if err != nil && len(mount) == 0 && len(driver.mountEntries(path)) > 0 {
+		return NewVirtualFileInfo(filepath.Base(jailpath(path)), true, nil, nil), nil
+	}
+	return fi, err
+}
 
-	objectCh := driver.client.ListObjects(ctx, driver.bucket, minio.ListObjectsOptions{
-		Prefix:    rpath,
-		Recursive: false,
+// ListDir list path of the driver serving it, with the mount points under
+// path in place of the files of the same name.
+func (driver *MountDriver) ListDir(path string, callback func(FileInfo) error) error {
+	inner, rpath, _ := driver.route(path)
+	entries := driver.mountEntries(path)
+	if len(entries) == 0 {
+		return inner.ListDir(rpath, callback)
+	}
+	err := inner.ListDir(rpath, func(fi FileInfo) error {
+		if _, ok := entries[fi.Name()]; ok {
+			return nil
+		}
+		return callback(fi)
 	})
-	for object := range objectCh {
-		if object.Err != nil {
-			return object.Err
+	if err != nil {
+		if _, serr := inner.Stat(rpath); serr == nil {
+			return err
 		}
-		if object.Key == rpath {
+		// a directory only leading to mount points.
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fi, err := driver.Stat(filepath.ToSlash(filepath.Join(jailpath(path), name)))
+		if err != nil {
 			continue
 		}
-		info := &MinioFileInfo{
-			name:   strings.TrimSuffix(strings.TrimPrefix(object.Key, rpath), "/"),
-			object: object,
-			isDir:  strings.HasSuffix(object.Key, "/"),
-		}
-		err := callback(info)
-		if err != nil {
+		if err := callback(fi); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// FileDriverFactory - file based driver factory
-type FileDriverFactory struct {
-	root string
+// GetFile return file size, file reader of the driver serving path
+func (driver *MountDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	inner, rpath, _ := driver.route(path)
+	return inner.GetFile(rpath, offset)
 }
 
-// NewFileDriverFactory return a file based driver factory
-func NewFileDriverFactory(root string) DriverFactory {
-	_, err := os.Lstat(root)
-	if os.IsNotExist(err) {
-		os.MkdirAll(root, os.ModePerm)
-	} else if err != nil {
-		log.Printf("NewFileDriverFactory fail, err: %v\n", err)
-		os.Exit(-1)
+// PutFile write file of the driver serving path
+func (driver *MountDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	inner, rpath, _ := driver.route(path)
+	return inner.PutFile(rpath, offset, reader)
+}
+
+// Chtimes change file times of the driver serving path
+func (driver *MountDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	inner, rpath, _ := driver.route(path)
+	return inner.Chtimes(rpath, atime, mtime)
+}
+
+// MakeDir create directory of the driver serving path
+func (driver *MountDriver) MakeDir(path string) error {
+	inner, rpath, _ := driver.route(path)
+	return inner.MakeDir(rpath)
+}
+
+// DeleteDir delete directory of the driver serving path, a mount point can
+// not be deleted.
+func (driver *MountDriver) DeleteDir(path string) error {
+	inner, rpath, mount := driver.route(path)
+	if (len(mount) > 0 && rpath == "/") || (len(mount) == 0 && len(driver.mountEntries(path)) > 0) {
+		return os.ErrPermission
 	}
-	return &FileDriverFactory{
-		root: root,
+	return inner.DeleteDir(rpath)
+}
+
+// DeleteFile delete file of the driver serving path
+func (driver *MountDriver) DeleteFile(path string) error {
+	inner, rpath, _ := driver.route(path)
+	return inner.DeleteFile(rpath)
+}
+
+// Rename rename a file within the driver serving both paths, fail with
+// ErrCrossMount across mounts.
+func (driver *MountDriver) Rename(from string, to string) error {
+	inner, rfrom, mount := driver.route(from)
+	_, rto, toMount := driver.route(to)
+	if mount != toMount {
+		return ErrCrossMount
 	}
+	if (len(mount) > 0 && (rfrom == "/" || rto == "/")) || len(driver.mountEntries(from)) > 0 {
+		return os.ErrPermission
+	}
+	return inner.Rename(rfrom, rto)
 }
 
-// FileDriver - file based driver
-type FileDriver struct {
-	root string
+// GetURL return the url of the driver serving path
+func (driver *MountDriver) GetURL(path string) (string, error) {
+	inner, rpath, _ := driver.route(path)
+	if d, ok := inner.(URLDriver); ok {
+		return d.GetURL(rpath)
+	}
+	return "", errors.New("not implemented")
 }
 
-// NewDriver return a file based driver
-func (factory *FileDriverFactory) NewDriver(user string) (Driver, error) {
-	var err error
-	root, err := filepath.Abs(filepath.Join(factory.root, user))
-	if err != nil {
-		return nil, err
+// Hash return the checksum of the driver serving path if it supplies one
+func (driver *MountDriver) Hash(path, algo string) (string, error) {
+	inner, rpath, _ := driver.route(path)
+	if d, ok := inner.(HashDriver); ok {
+		return d.Hash(rpath, algo)
 	}
-	_, err = os.Lstat(root)
-	if os.IsNotExist(err) {
-		os.MkdirAll(root, os.ModePerm)
-	} else if err != nil {
-		return nil, err
+	return "", ErrHashUnsupported
+}
+
+// Chmod change file mode of the driver serving path
+func (driver *MountDriver) Chmod(path string, mode os.FileMode) error {
+	inner, rpath, _ := driver.route(path)
+	if d, ok := inner.(ChmodDriver); ok {
+		return d.Chmod(rpath, mode)
 	}
-	return &FileDriver{root}, nil
+	return errors.New("not implemented")
 }
 
-// abspath return abs path joined with driver root path
-func (driver *FileDriver) abspath(path string) string {
-	return filepath.Join(driver.root, path)
+// encryptChunkSize - plaintext size of the chunks of an encrypted file,
+// each sealed with its own tag.
+const encryptChunkSize = 64 << 10
+
+const (
+	encryptNonceSize  = 8
+	encryptHeaderSize = 4 + encryptNonceSize
+	encryptTagSize    = 16
+)
+
+// encryptMagic - start of an encrypted file, followed by its random nonce
+var encryptMagic = []byte("KFE1")
+
+// ErrDecrypt - an encrypted file is corrupted, truncated or of another key
+var ErrDecrypt = errors.New("decrypt failed")
+
+// ErrResumeUnsupported - an upload from an offset of an encrypted file
+var ErrResumeUnsupported = errors.New("resume not supported")
+
+// decryptedSize return the plaintext size of an encrypted file of size
+func decryptedSize(size int64) int64 {
+	n := size - encryptHeaderSize
+	if n < encryptTagSize {
+		return 0
+	}
+	const sealed = encryptChunkSize + encryptTagSize
+	plain := n / sealed * encryptChunkSize
+	if rem := n % sealed; rem >= encryptTagSize {
+		plain += rem - encryptTagSize
+	}
+	return plain
 }
 
-// Stat return file information
-func (driver *FileDriver) Stat(path string) (FileInfo, error) {
-	return os.Lstat(driver.abspath(path))
+// chunkNonce return the nonce of chunk i of a file of nonce
+func chunkNonce(nonce []byte, i uint32) []byte {
+	n := make([]byte, 12)
+	copy(n, nonce)
+	binary.BigEndian.PutUint32(n[encryptNonceSize:], i)
+	return n
 }
 
-// Chtimes change file modify time
-func (driver *FileDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
-	return os.Chtimes(driver.abspath(path), atime, mtime)
+// chunkData return the additional data of a chunk, the last chunk is
+// marked so a truncated file fails to decrypt.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
 }
 
-// DeleteDir delete a dir
-func (driver *FileDriver) DeleteDir(path string) error {
-	rpath := driver.abspath(path)
-	fi, err := os.Lstat(rpath)
-	if err != nil {
-		return err
+// encryptReader - reader of the encrypted file of a plaintext reader
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	plain   []byte
+	carry   int
+	sealed  []byte
+	out     []byte
+	done    bool
+}
+
+// newEncryptReader return the reader of the encrypted src, starting with
+// the header of a new random nonce.
+func newEncryptReader(src io.Reader, aead cipher.AEAD) (*encryptReader, error) {
+	header := make([]byte, encryptHeaderSize)
+	copy(header, encryptMagic)
+	if _, err := crand.Read(header[len(encryptMagic):]); err != nil {
+		return nil, err
 	}
-	if fi.IsDir() {
-		return os.RemoveAll(rpath)
+	return &encryptReader{
+		src:    src,
+		aead:   aead,
+		nonce:  header[len(encryptMagic):],
+		plain:  make([]byte, encryptChunkSize+1),
+		sealed: make([]byte, 0, encryptChunkSize+encryptTagSize),
+		out:    header,
+	}, nil
+}
+
+// Read return encrypted data
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
 	}
-	return errors.New("not a directory")
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
 }
 
-// DeleteFile delete a file
-func (driver *FileDriver) DeleteFile(path string) error {
-	rpath := driver.abspath(path)
-	fi, err := os.Lstat(rpath)
-	if err != nil {
+// seal encrypt the next chunk of src, a byte is read ahead to know the
+// last chunk.
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.plain[r.carry:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return err
 	}
-	if !fi.IsDir() {
-		return os.Remove(rpath)
+	n += r.carry
+	last := n <= encryptChunkSize
+	size := n
+	if !last {
+		size = encryptChunkSize
 	}
-	return errors.New("not a file")
+	if r.counter == math.MaxUint32 {
+		return errors.New("file too large to encrypt")
+	}
+	r.out = r.aead.Seal(r.sealed[:0], chunkNonce(r.nonce, r.counter), r.plain[:size], chunkData(last))
+	r.counter++
+	if last {
+		r.done = true
+	} else {
+		r.plain[0] = r.plain[encryptChunkSize]
+		r.carry = 1
+	}
+	return nil
 }
 
-// Rename rename a file or dir
-func (driver *FileDriver) Rename(from string, to string) error {
-	frpath := driver.abspath(from)
-	trpath := driver.abspath(to)
-	return os.Rename(frpath, trpath)
+// decryptReader - reader of the plaintext of an encrypted file from its
+// chunk counter, skip bytes of the first chunk are dropped.
+type decryptReader struct {
+	src     io.ReadCloser
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	skip    int
+	sealed  []byte
+	plain   []byte
+	out     []byte
+	done    bool
 }
 
-// MakeDir make a dir
-func (driver *FileDriver) MakeDir(path string) error {
-	return os.MkdirAll(driver.abspath(path), os.ModePerm)
+// Read return decrypted data
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
 }
 
-// GetFile return file size, file reader
-func (driver *FileDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
-	f, err := os.Open(driver.abspath(path))
-	if err != nil {
-		return 0, nil, err
+// open decrypt the next chunk of src, a full chunk may be the last one so
+// it is opened again as such, into plain since a failed Open clears its
+// output.
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
 	}
-	defer func() {
-		if err != nil && f != nil {
-			f.Close()
-		}
-	}()
-	fi, err := f.Stat()
-	if err != nil {
-		return 0, nil, err
+	sealed := r.sealed[:n]
+	nonce := chunkNonce(r.nonce, r.counter)
+	var plain []byte
+	if n == len(r.sealed) {
+		plain, err = r.aead.Open(r.plain[:0], nonce, sealed, chunkData(false))
 	}
-	if offset > 0 {
-		_, err = f.Seek(offset, io.SeekStart)
+	if n < len(r.sealed) || err != nil {
+		plain, err = r.aead.Open(r.plain[:0], nonce, sealed, chunkData(true))
 		if err != nil {
-			return 0, nil, err
+			return ErrDecrypt
+		}
+		r.done = true
+	}
+	r.counter++
+	if r.skip > 0 {
+		if r.skip > len(plain) {
+			return ErrDecrypt
 		}
+		plain = plain[r.skip:]
+		r.skip = 0
 	}
+	r.out = plain
+	return nil
+}
 
-	return fi.Size() - offset, f, nil
+// Close close the encrypted file
+func (r *decryptReader) Close() error {
+	return r.src.Close()
 }
 
-// PutFile put a file, support append with offset.
-func (driver *FileDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
-	rpath := driver.abspath(path)
+// encryptedFileInfo - file information of an encrypted file with the
+// plaintext size
+type encryptedFileInfo struct {
+	FileInfo
+}
 
-	fi, err := os.Lstat(rpath)
-	if err == nil && fi.IsDir() {
-		return 0, errors.New("directory already exist")
+// Size return the plaintext size
+func (fi *encryptedFileInfo) Size() int64 {
+	return decryptedSize(fi.FileInfo.Size())
+}
+
+// EncryptDriverFactory - factory of drivers encrypting the files of inner
+type EncryptDriverFactory struct {
+	inner DriverFactory
+	aead  cipher.AEAD
+}
+
+// NewEncryptDriverFactory return a factory of encrypting wrappers of the
+// drivers of inner with a 32 bytes AES-256 key.
+func NewEncryptDriverFactory(inner DriverFactory, key []byte) (DriverFactory, error) {
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
 	}
+	return &EncryptDriverFactory{inner: inner, aead: aead}, nil
+}
 
-	ff := os.O_WRONLY
-	if offset > 0 {
-		ff |= os.O_APPEND
-	} else {
-		ff |= os.O_CREATE | os.O_TRUNC
+// newEncryptAEAD return the AES-256-GCM of key
+func newEncryptAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid encryption key: %d bytes, must be 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	f, err := os.OpenFile(rpath, ff, 0666)
+// Capabilities return the capabilities of inner without url
+func (factory *EncryptDriverFactory) Capabilities() DriverCapabilities {
+	caps := Capabilities(factory.inner)
+	caps.URL = false
+	return caps
+}
+
+// NewDriver return an encrypting driver of inner
+func (factory *EncryptDriverFactory) NewDriver(home string) (Driver, error) {
+	return factory.NewUserDriver("", home)
+}
+
+// NewUserDriver return an encrypting driver of inner for user
+func (factory *EncryptDriverFactory) NewUserDriver(user, home string) (Driver, error) {
+	inner, err := newUserDriver(factory.inner, user, home)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer f.Close()
-	if offset > 0 {
-		_, err = f.Seek(offset, io.SeekStart)
-		if err != nil {
-			return 0, err
-		}
+	return &EncryptDriver{inner: inner, aead: factory.aead}, nil
+}
+
+// EncryptDriver - driver wrapper storing files encrypted with AES-256-GCM
+// in chunks, the sizes are of the plaintext. The checksums and urls of
+// inner are of the encrypted files so they are not used.
+type EncryptDriver struct {
+	inner Driver
+	aead  cipher.AEAD
+}
+
+// Capabilities return the capabilities of inner without url
+func (driver *EncryptDriver) Capabilities() DriverCapabilities {
+	caps := Capabilities(driver.inner)
+	caps.URL = false
+	return caps
+}
+
+// WithContext return an encrypting wrapper of inner bound to ctx
+func (driver *EncryptDriver) WithContext(ctx context.Context) Driver {
+	if dc, ok := driver.inner.(DriverContext); ok {
+		return &EncryptDriver{dc.WithContext(ctx), driver.aead}
 	}
+	return driver
+}
 
-	return io.Copy(f, reader)
+// Close close inner driver
+func (driver *EncryptDriver) Close() error {
+	closeDriver(driver.inner)
+	return nil
 }
 
-// ListDir return file list in dir
-func (driver *FileDriver) ListDir(path string, callback func(FileInfo) error) error {
-	rpath := driver.abspath(path)
-	return filepath.Walk(rpath, func(path string, info os.FileInfo, err error) error {
+// plainInfo return fi with the plaintext size of a regular file
+func plainInfo(fi FileInfo) FileInfo {
+	if fi.Mode().IsRegular() {
+		return &encryptedFileInfo{fi}
+	}
+	return fi
+}
+
+// Stat return file information of inner driver with plaintext size
+func (driver *EncryptDriver) Stat(path string) (FileInfo, error) {
+	fi, err := driver.inner.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo(fi), nil
+}
+
+// ListDir return file list of inner driver with plaintext sizes
+func (driver *EncryptDriver) ListDir(path string, callback func(FileInfo) error) error {
+	return driver.inner.ListDir(path, func(fi FileInfo) error {
+		return callback(plainInfo(fi))
+	})
+}
+
+// GetFile return plaintext size from offset, decrypting reader of file,
+// the chunks before offset are not read.
+func (driver *EncryptDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	size, reader, err := driver.inner.GetFile(path, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header[:len(encryptMagic)], encryptMagic) {
+		reader.Close()
+		return 0, nil, ErrDecrypt
+	}
+	plain := decryptedSize(size)
+	if offset >= plain && offset > 0 {
+		reader.Close()
+		return plain - offset, ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	chunk := offset / encryptChunkSize
+	if chunk > 0 {
+		reader.Close()
+		_, reader, err = driver.inner.GetFile(path, encryptHeaderSize+chunk*(encryptChunkSize+encryptTagSize))
 		if err != nil {
-			return err
-		}
-		name, _ := filepath.Rel(rpath, path)
-		if name == info.Name() {
-			err = callback(info)
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
+			return 0, nil, err
 		}
-		return nil
-	})
+	}
+	return plain - offset, &decryptReader{
+		src:     reader,
+		aead:    driver.aead,
+		nonce:   header[len(encryptMagic):],
+		counter: uint32(chunk),
+		skip:    int(offset - chunk*encryptChunkSize),
+		sealed:  make([]byte, encryptChunkSize+encryptTagSize),
+		plain:   make([]byte, 0, encryptChunkSize),
+	}, nil
 }
 
-// FtpdHandler - ftpd handler
-type FtpdHandler struct {
-	UserBeforeLogin func(string, string) bool
-	UserAfterLogin  func(string)
+// PutFile encrypt reader to file of inner driver, return the plaintext
+// size written. An upload from offset fails with ErrResumeUnsupported, the
+// sealed chunks of a file can not be appended to in place.
+func (driver *EncryptDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	if offset > 0 {
+		return 0, ErrResumeUnsupported
+	}
+	var written int64
+	er, err := newEncryptReader(&countReader{reader, &written}, driver.aead)
+	if err != nil {
+		return 0, err
+	}
+	_, err = driver.inner.PutFile(path, 0, er)
+	return written, err
+}
 
-	ClientBeforePasv func(string) bool
-	ClientBeforePort func(string) bool
+// Chtimes change file times of inner driver
+func (driver *EncryptDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return driver.inner.Chtimes(path, atime, mtime)
+}
 
-	FileBeforePut func(string, string) bool
-	FileAfterPut  func(string, string)
+// MakeDir create directory of inner driver
+func (driver *EncryptDriver) MakeDir(path string) error {
+	return driver.inner.MakeDir(path)
+}
 
-	FileBeforeGet func(string, string) bool
-	FileAfterGet  func(string, string)
+// DeleteDir delete directory of inner driver
+func (driver *EncryptDriver) DeleteDir(path string) error {
+	return driver.inner.DeleteDir(path)
+}
 
-	FileBeforeDelete func(string, string) bool
-	FileAfterDelete  func(string, string)
+// DeleteFile delete file of inner driver
+func (driver *EncryptDriver) DeleteFile(path string) error {
+	return driver.inner.DeleteFile(path)
+}
 
-	FileBeforeRename func(string, string, string) bool
-	FileAfterRename  func(string, string, string)
+// Rename rename file of inner driver
+func (driver *EncryptDriver) Rename(from string, to string) error {
+	return driver.inner.Rename(from, to)
 }
 
-// ftpHandler - ftpd global handler
-var ftpHandler FtpdHandler
+// Chmod change file mode of inner driver
+func (driver *EncryptDriver) Chmod(path string, mode os.FileMode) error {
+	if d, ok := driver.inner.(ChmodDriver); ok {
+		return d.Chmod(path, mode)
+	}
+	return errors.New("not implemented")
+}
 
-// FtpConn - ftp session
-type FtpConn struct {
-	id        int
-	arg       string
-	user      string
-	path      string
-	mode      string
-	clnt      string
-	rename    string
-	authd     bool
-	tls       bool
-	offset    int64
-	config    *FtpdConfig
-	tlsConfig *tls.Config
-	factory   DriverFactory
-	driver    Driver
-	ctrlConn  net.Conn
-	dataConn  net.Conn
-	reader    *bufio.Reader
-	writer    *bufio.Writer
-	lock      sync.Mutex
-	pasvPort  int
-	notify    chan int
+// DiskCache - files of drivers kept on local disk up to a total size, the
+// least recently used are evicted first. Within ttl a cached file is used
+// without checking the driver, after it the file is used if its size and
+// modify time did not change.
+type DiskCache struct {
+	dir     string
+	lock    sync.Mutex
+	maxSize int64
+	ttl     time.Duration
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
 }
 
-// FtpCmd - ftp command handler
-type FtpCmd struct {
-	Fn   func(*FtpConn) error
-	Auth bool
+// cacheEntry - a cached file
+type cacheEntry struct {
+	key     string
+	file    string
+	size    int64
+	modTime time.Time
+	checked time.Time
 }
 
-var cmdMap = map[string]FtpCmd{
-	// Authentication
-	"USER": {(*FtpConn).handleUSER, false},
-	"PASS": {(*FtpConn).handlePASS, false},
+// NewDiskCache return a disk cache in dir, the files cached by a previous
+// run are removed as they are not known.
+func NewDiskCache(dir string, maxSize int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	for _, pattern := range []string{"*.cache", "*.part"} {
+		files, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+	return &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
 
-	// TLS handling
-	"AUTH": {(*FtpConn).handleAUTH, false},
-	"PROT": {(*FtpConn).handlePROT, false},
-	"PBSZ": {(*FtpConn).handlePBSZ, false},
+// diskCaches - the disk caches by dir, shared by the driver factories of
+// virtual hosts and mounts.
+var diskCaches = struct {
+	sync.Mutex
+	m map[string]*DiskCache
+}{m: make(map[string]*DiskCache)}
+
+// openDiskCache return the disk cache of dir with the limits given, the
+// one opened before if any.
+func openDiskCache(dir string, maxSize int64, ttl time.Duration) (*DiskCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	diskCaches.Lock()
+	defer diskCaches.Unlock()
+	if cache, ok := diskCaches.m[dir]; ok {
+		cache.lock.Lock()
+		cache.maxSize = maxSize
+		cache.ttl = ttl
+		cache.evict()
+		cache.lock.Unlock()
+		return cache, nil
+	}
+	cache, err := NewDiskCache(dir, maxSize, ttl)
+	if err != nil {
+		return nil, err
+	}
+	diskCaches.m[dir] = cache
+	return cache, nil
+}
 
-	// Misc
-	"CLNT": {(*FtpConn).handleCLNT, false},
-	"FEAT": {(*FtpConn).handleFEAT, false},
-	"SYST": {(*FtpConn).handleSYST, false},
-	"NOOP": {(*FtpConn).handleNOOP, false},
-	"OPTS": {(*FtpConn).handleOPTS, false},
-	"QUIT": {(*FtpConn).handleQUIT, false},
+// get return the cached file of key, stat is called to check it after ttl.
+func (cache *DiskCache) get(key string, stat func() (FileInfo, error)) (string, bool) {
+	cache.lock.Lock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		cache.lock.Unlock()
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if cache.ttl > 0 && time.Since(entry.checked) < cache.ttl {
+		cache.lru.MoveToFront(elem)
+		cache.lock.Unlock()
+		return entry.file, true
+	}
+	cache.lock.Unlock()
 
-	// File access
-	"SIZE": {(*FtpConn).handleSIZE, true},
-	"STAT": {(*FtpConn).handleSTAT, true},
-	"MDTM": {(*FtpConn).handleMDTM, true},
-	"MFMT": {(*FtpConn).handleMFMT, true},
-	"RETR": {(*FtpConn).handleRETR, true},
-	"STOR": {(*FtpConn).handleSTOR, true},
-	"APPE": {(*FtpConn).handleAPPE, true},
-	"DELE": {(*FtpConn).handleDELE, true},
-	"RNFR": {(*FtpConn).handleRNFR, true},
-	"RNTO": {(*FtpConn).handleRNTO, true},
-	"ALLO": {(*FtpConn).handleALLO, true},
-	"REST": {(*FtpConn).handleREST, true},
-	"SITE": {(*FtpConn).handleSITE, true},
+	fi, err := stat()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.entries[key] != elem {
+		return "", false
+	}
+	if err != nil || fi.Size() != entry.size || !fi.ModTime().Equal(entry.modTime) {
+		cache.removeElement(elem)
+		return "", false
+	}
+	entry.checked = time.Now()
+	cache.lru.MoveToFront(elem)
+	return entry.file, true
+}
 
-	// Directory handling
-	"CWD":  {(*FtpConn).handleCWD, true},
-	"PWD":  {(*FtpConn).handlePWD, true},
-	"CDUP": {(*FtpConn).handleCDUP, true},
-	"NLST": {(*FtpConn).handleNLST, true},
-	"LIST": {(*FtpConn).handleLIST, true},
-	"MLSD": {(*FtpConn).handleMLSD, true},
-	"MLST": {(*FtpConn).handleMLST, true},
-	"MKD":  {(*FtpConn).handleMKD, true},
-	"XMKD": {(*FtpConn).handleMKD, true},
-	"RMD":  {(*FtpConn).handleRMD, true},
-	"XRMD": {(*FtpConn).handleRMD, true},
+// put cache the temporary file tmp as the file of key
+func (cache *DiskCache) put(key, tmp string, size int64, modTime time.Time) {
+	sum := sha256.Sum256([]byte(key))
+	file := filepath.Join(cache.dir, hex.EncodeToString(sum[:])+".cache")
 
-	// Connection handling
-	"TYPE": {(*FtpConn).handleTYPE, true},
-	"PASV": {(*FtpConn).handlePASV, true},
-	"EPSV": {(*FtpConn).handlePASV, true},
-	"PORT": {(*FtpConn).handlePORT, true},
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.removeElement(elem)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	entry := &cacheEntry{key: key, file: file, size: size, modTime: modTime, checked: time.Now()}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	cache.size += size
+	cache.evict()
 }
 
-func (fc *FtpConn) handleUSER() error {
-	fc.authd = false
-	fc.user = fc.arg
-	fc.Send(331, "Please specify the password.")
-	return nil
+// evict remove the least recently used files over maxSize
+func (cache *DiskCache) evict() {
+	for cache.size > cache.maxSize && cache.lru.Len() > 0 {
+		cache.removeElement(cache.lru.Back())
+	}
 }
 
-func (fc *FtpConn) handlePASS() error {
-	loginOk := false
-	if ftpHandler.UserBeforeLogin != nil {
-		loginOk = ftpHandler.UserBeforeLogin(fc.user, fc.arg)
-	} else {
-		pwd, ok := fc.config.Users[fc.user]
-		if ok && pwd == fc.arg {
-			loginOk = true
-		}
-	}
-	if loginOk {
-		home := ""
-		if fc.config.HomeDir {
-			home = fc.user
-		}
-		driver, err := fc.factory.NewDriver(home)
-		if err != nil {
-			fc.Close()
-			return err
-		}
-		fc.driver = driver
-		fc.authd = true
-		fc.Send(230, "Login successful.")
-		if ftpHandler.UserAfterLogin != nil {
-			ftpHandler.UserAfterLogin(fc.user)
-		}
-		return nil
-	}
-	fc.Send(530, "Login incorrect.")
-	return nil
+// removeElement remove a cached file, a reader of it reads on.
+func (cache *DiskCache) removeElement(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.size -= entry.size
+	os.Remove(entry.file)
 }
 
-func (fc *FtpConn) handleAUTH() error {
-	if !fc.config.AuthTLS.Enable {
-		fc.Send(550, "Auth not enable.")
-		return nil
+// remove remove the cached file of key
+func (cache *DiskCache) remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.removeElement(elem)
 	}
-	if !fc.tls && (fc.arg == "TLS" || fc.arg == "SSL") {
-		conn := tls.Server(fc.ctrlConn, fc.tlsConfig)
-		err := conn.Handshake()
-		if err != nil {
-			fc.Send(421, fmt.Sprintf("Negotiation failed: %s", err.Error()))
-			return err
+}
+
+// removeTree remove the cached file of key and the ones under it as a
+// directory
+func (cache *DiskCache) removeTree(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for k, elem := range cache.entries {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			cache.removeElement(elem)
 		}
-		fc.ctrlConn = conn
-		fc.reader = bufio.NewReader(conn)
-		fc.writer = bufio.NewWriter(conn)
-		fc.tls = true
-		fc.Send(234, "Proceed with negotiation.")
-		return nil
 	}
-	fc.Send(504, "Unknown AUTH type.")
-	return nil
 }
 
-func (fc *FtpConn) handlePROT() error {
-	if fc.tls {
-		if fc.arg == "P" {
-			fc.Send(200, "OK")
+// fits return whether a file of size may be cached
+func (cache *DiskCache) fits(size int64) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return size <= cache.maxSize
+}
+
+// cacheFillReader - reader of a file copying it to a temporary file, which
+// is cached if the whole file is read.
+type cacheFillReader struct {
+	io.ReadCloser
+	cache   *DiskCache
+	key     string
+	tmp     *os.File
+	n       int64
+	size    int64
+	modTime time.Time
+}
+
+// Read return data of the file
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.tmp != nil {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			r.discard()
+		}
+		r.n += int64(n)
+	}
+	if err == io.EOF && r.tmp != nil {
+		if r.n != r.size {
+			r.discard()
+		} else if cerr := r.tmp.Close(); cerr != nil {
+			os.Remove(r.tmp.Name())
+			r.tmp = nil
 		} else {
-			fc.Send(536, "Only P level is supported.")
+			r.cache.put(r.key, r.tmp.Name(), r.size, r.modTime)
+			r.tmp = nil
 		}
-		return nil
 	}
-	fc.Send(550, "Permission denied.")
-	return nil
+	return n, err
 }
 
-func (fc *FtpConn) handlePBSZ() error {
-	if fc.tls && fc.arg == "0" {
-		fc.Send(200, "OK")
-		return nil
+// discard remove the temporary file
+func (r *cacheFillReader) discard() {
+	r.tmp.Close()
+	os.Remove(r.tmp.Name())
+	r.tmp = nil
+}
+
+// Close close the file, a file not read to the end is not cached.
+func (r *cacheFillReader) Close() error {
+	if r.tmp != nil {
+		r.discard()
 	}
-	fc.Send(550, "Permission denied.")
-	return nil
+	return r.ReadCloser.Close()
 }
 
-func (fc *FtpConn) handleCLNT() error {
-	fc.clnt = fc.arg
-	fc.Send(200, "Noted.")
-	return nil
+// CacheDriverFactory - factory of drivers caching the files of inner
+type CacheDriverFactory struct {
+	inner DriverFactory
+	cache *DiskCache
+	scope string
 }
 
-func (fc *FtpConn) handleFEAT() error {
-	feats := []string{"CLNT", "EPSV", "MDTM", "MFMT", "MLSD", "MLST", "PASV", "PBSZ", "PROT", "REST STREAM", "SIZE", "TVFS", "UTF8"}
-	if fc.config.AuthTLS.Enable {
-		feats = append([]string{"AUTH TLS"}, feats...)
+// NewCacheDriverFactory return a factory of caching wrappers of the drivers
+// of inner, scope tells the storage of inner apart in a shared cache, such
+// as the endpoint.
+func NewCacheDriverFactory(inner DriverFactory, cache *DiskCache, scope string) DriverFactory {
+	return &CacheDriverFactory{inner: inner, cache: cache, scope: scope}
+}
+
+// Capabilities return the capabilities of inner
+func (factory *CacheDriverFactory) Capabilities() DriverCapabilities {
+	return Capabilities(factory.inner)
+}
+
+// NewDriver return a caching driver of inner
+func (factory *CacheDriverFactory) NewDriver(home string) (Driver, error) {
+	return factory.NewUserDriver("", home)
+}
+
+// NewUserDriver return a caching driver of inner for user, the files are
+// keyed by the storage root of inner if it tells one, its home otherwise.
+func (factory *CacheDriverFactory) NewUserDriver(user, home string) (Driver, error) {
+	inner, err := newUserDriver(factory.inner, user, home)
+	if err != nil {
+		return nil, err
 	}
-	for i, feat := range feats {
-		feats[i] = " " + feat
+	root := jailpath(home)
+	if cr, ok := inner.(interface{ cacheRoot() string }); ok {
+		root = cr.cacheRoot()
 	}
-	fc.SendMulti(211, "Features:", strings.Join(feats, "\r\n"), "End")
-	return nil
+	return &CacheDriver{inner: inner, cache: factory.cache, scope: factory.scope, root: root}, nil
 }
 
-func (fc *FtpConn) handleSYST() error {
-	fc.Send(215, "UNIX Type: L8")
-	return nil
+// CacheDriver - driver wrapper serving the files read from a disk cache,
+// the files written, renamed or deleted by it are removed from the cache.
+type CacheDriver struct {
+	inner Driver
+	cache *DiskCache
+	scope string
+	root  string
 }
 
-func (fc *FtpConn) handleNOOP() error {
-	fc.Send(200, "NOOP ok.")
-	return nil
+// key return the cache key of path, the same for the users of a root.
+func (driver *CacheDriver) key(path string) string {
+	return driver.scope + "\x00" + filepath.ToSlash(filepath.Join(driver.root, jailpath(path)))
 }
 
-func (fc *FtpConn) handleOPTS() error {
-	if strings.ToUpper(fc.arg) == "UTF8 ON" {
-		fc.Send(200, "Always in UTF8 mode.")
-		return nil
+// Capabilities return the capabilities of inner driver
+func (driver *CacheDriver) Capabilities() DriverCapabilities {
+	return Capabilities(driver.inner)
+}
+
+// WithContext return a caching wrapper of inner bound to ctx
+func (driver *CacheDriver) WithContext(ctx context.Context) Driver {
+	if dc, ok := driver.inner.(DriverContext); ok {
+		return &CacheDriver{dc.WithContext(ctx), driver.cache, driver.scope, driver.root}
 	}
-	fc.Send(501, "Option not understood.")
-	return nil
+	return driver
 }
 
-func (fc *FtpConn) handleQUIT() error {
-	fc.Send(221, "Goodbye.")
-	fc.Close()
+// Close close inner driver
+func (driver *CacheDriver) Close() error {
+	closeDriver(driver.inner)
 	return nil
 }
 
-func (fc *FtpConn) handleSIZE() error {
-	path := fc.buildPath(fc.arg)
-	fi, err := fc.driver.Stat(path)
-	if err != nil {
-		fc.Send(550, "Could not get file size.")
-		return err
-	}
-	fc.Send(213, fmt.Sprintf("%d", fi.Size()))
-	return nil
+// Stat return file information of inner driver
+func (driver *CacheDriver) Stat(path string) (FileInfo, error) {
+	return driver.inner.Stat(path)
 }
 
-func (fc *FtpConn) handleSTAT() error {
-	if fc.arg == "" {
-		status := []string{
-			fmt.Sprintf("Connected to %s", fc.ctrlConn.LocalAddr().(*net.TCPAddr).IP.String()),
-			fmt.Sprintf("Logged in as %s", fc.user),
-			fmt.Sprintf("TYPE: %s", fc.mode),
-			"KFtpd",
-		}
-		for i, stat := range status {
-			status[i] = "     " + stat
+// ListDir return file list of inner driver
+func (driver *CacheDriver) ListDir(path string, callback func(FileInfo) error) error {
+	return driver.inner.ListDir(path, callback)
+}
+
+// GetFile return file size, file reader of the cached file, a file read
+// whole from inner driver is cached.
+func (driver *CacheDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	key := driver.key(path)
+	file, ok := driver.cache.get(key, func() (FileInfo, error) {
+		return driver.inner.Stat(path)
+	})
+	if ok {
+		if f, err := os.Open(file); err == nil {
+			if fi, err := f.Stat(); err == nil {
+				if _, err := f.Seek(offset, io.SeekStart); err == nil {
+					return fi.Size() - offset, f, nil
+				}
+			}
+			f.Close()
 		}
-		fc.SendMulti(211, "FTP server status:", strings.Join(status, "\r\n"), "End of status")
-		return nil
+	}
+	if offset > 0 {
+		return driver.inner.GetFile(path, offset)
 	}
 
-	var status []string
-	path := fc.buildPath(fc.arg)
-	fi, err := fc.driver.Stat(path)
-	if err == nil {
-		if fi.IsDir() {
-			fc.driver.ListDir(path, func(fi FileInfo) error {
-				status = append(status, fc.fileStat(fi))
-				return nil
-			})
-		} else {
-			status = append(status, fc.fileStat(fi))
-		}
+	fi, err := driver.inner.Stat(path)
+	if err != nil || fi.IsDir() || !driver.cache.fits(fi.Size()) {
+		return driver.inner.GetFile(path, 0)
+	}
+	size, reader, err := driver.inner.GetFile(path, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	tmp, err := ioutil.TempFile(driver.cache.dir, "*.part")
+	if err != nil {
+		return size, reader, nil
 	}
+	return size, &cacheFillReader{ReadCloser: reader, cache: driver.cache, key: key, tmp: tmp, size: size, modTime: fi.ModTime()}, nil
+}
 
-	fc.SendMulti(213, "Status follows:", strings.Join(status, "\r\n"), "End of status")
-	return nil
+// PutFile put file of inner driver
+func (driver *CacheDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	n, err := driver.inner.PutFile(path, offset, reader)
+	driver.cache.remove(driver.key(path))
+	return n, err
 }
 
-func (fc *FtpConn) handleMDTM() error {
-	path := fc.buildPath(fc.arg)
-	fi, err := fc.driver.Stat(path)
-	if err != nil {
-		fc.Send(550, "Could not get file modification time.")
-		return err
-	}
-	fc.Send(213, fi.ModTime().UTC().Format("20060102150405"))
-	return nil
+// Chtimes change file times of inner driver
+func (driver *CacheDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	err := driver.inner.Chtimes(path, atime, mtime)
+	driver.cache.remove(driver.key(path))
+	return err
 }
 
-func (fc *FtpConn) handleMFMT() error {
-	arg := strings.SplitN(fc.arg, " ", 2)
-	if len(arg) != 2 {
-		fc.Send(500, "Illegal MFMT command.")
-		return nil
+// MakeDir create directory of inner driver
+func (driver *CacheDriver) MakeDir(path string) error {
+	return driver.inner.MakeDir(path)
+}
+
+// DeleteDir delete directory of inner driver
+func (driver *CacheDriver) DeleteDir(path string) error {
+	err := driver.inner.DeleteDir(path)
+	driver.cache.removeTree(driver.key(path))
+	return err
+}
+
+// DeleteFile delete file of inner driver
+func (driver *CacheDriver) DeleteFile(path string) error {
+	err := driver.inner.DeleteFile(path)
+	driver.cache.remove(driver.key(path))
+	return err
+}
+
+// Rename rename file of inner driver
+func (driver *CacheDriver) Rename(from string, to string) error {
+	err := driver.inner.Rename(from, to)
+	driver.cache.removeTree(driver.key(from))
+	driver.cache.removeTree(driver.key(to))
+	return err
+}
+
+// GetURL return the url of inner driver
+func (driver *CacheDriver) GetURL(path string) (string, error) {
+	if inner, ok := driver.inner.(URLDriver); ok {
+		return inner.GetURL(path)
 	}
+	return "", errors.New("not implemented")
+}
 
-	mtime, err := time.Parse("20060102150405", arg[0])
-	if err != nil {
-		fc.Send(500, "Illegal MFMT command.")
-		return err
+// Hash forward to inner driver if it supplies checksums
+func (driver *CacheDriver) Hash(path, algo string) (string, error) {
+	if inner, ok := driver.inner.(HashDriver); ok {
+		return inner.Hash(path, algo)
 	}
+	return "", ErrHashUnsupported
+}
 
-	path := fc.buildPath(arg[1])
-	err = fc.driver.Chtimes(path, mtime, mtime)
-	if err != nil {
-		fc.Send(550, "Could not change file modification time.")
-		return err
+// Chmod change file mode of inner driver
+func (driver *CacheDriver) Chmod(path string, mode os.FileMode) error {
+	if d, ok := driver.inner.(ChmodDriver); ok {
+		return d.Chmod(path, mode)
 	}
-	fc.Send(213, fmt.Sprintf("Modify=%s; %s", arg[0], arg[1]))
-	return nil
+	return errors.New("not implemented")
 }
 
-func (fc *FtpConn) handleRETR() error {
-	path := fc.buildPath(fc.arg)
+// Authenticator - verify the password of a user
+type Authenticator interface {
+	Authenticate(string, string) (bool, error)
+}
 
-	defer func() {
+// ConfigAuthenticator - authenticator of users in config, a user with
+// TOTPSecret must send the password followed by the current TOTP code.
+type ConfigAuthenticator struct {
+	config *FtpdConfig
+}
+
+// NewConfigAuthenticator return an authenticator of users in config
+func NewConfigAuthenticator(config *FtpdConfig) Authenticator {
+	return &ConfigAuthenticator{config}
+}
+
+// Authenticate verify the password and TOTP code of user
+func (auth *ConfigAuthenticator) Authenticate(user, pass string) (bool, error) {
+	u, ok := auth.config.Users[user]
+	if !ok {
+		return false, nil
+	}
+	return checkUserPassword(u, pass, auth.config.TOTPSkew)
+}
+
+// checkUserPassword verify pass against the password and TOTP secret of u
+func checkUserPassword(u FtpdUser, pass string, skew int) (bool, error) {
+	if len(u.TOTPSecret) > 0 {
+		if len(pass) < totpDigits {
+			return false, nil
+		}
+		code := pass[len(pass)-totpDigits:]
+		pass = pass[:len(pass)-totpDigits]
+		ok, err := verifyTOTP(u.TOTPSecret, code, skew, time.Now())
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return CheckPassword(u.Password, pass)
+}
+
+// CheckPassword check pass against the stored password, a bcrypt hash
+// with prefix "$2a$", "$2b$" or "$2y$", an argon2id hash with prefix
+// "$argon2id$", or else the plaintext.
+func CheckPassword(stored, pass string) (bool, error) {
+	if isBcryptHash(stored) {
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if isArgon2idHash(stored) {
+		hash, err := parseArgon2id(stored)
+		if err != nil {
+			return false, err
+		}
+		key := argon2.IDKey([]byte(pass), hash.salt, hash.iterations, hash.memory, hash.threads, uint32(len(hash.key)))
+		return subtle.ConstantTimeCompare(key, hash.key) == 1, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1, nil
+}
+
+// isBcryptHash return whether stored is a bcrypt hash
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// isArgon2idHash return whether stored is an argon2id hash
+func isArgon2idHash(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$")
+}
+
+// argon2idHash - params, salt and key of an argon2id hash
+type argon2idHash struct {
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// parseArgon2id parse the PHC string "$argon2id$v=19$m=65536,t=3,p=4$salt$key"
+func parseArgon2id(stored string) (*argon2idHash, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+	hash := new(argon2idHash)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.iterations, &hash.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id params: %s", parts[3])
+	}
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return hash, nil
+}
+
+// checkPasswordHash return the error of a malformed password hash
+func checkPasswordHash(stored string) error {
+	if isBcryptHash(stored) {
+		_, err := bcrypt.Cost([]byte(stored))
+		return err
+	}
+	if isArgon2idHash(stored) {
+		_, err := parseArgon2id(stored)
+		return err
+	}
+	return nil
+}
+
+// HtpasswdAuthenticator - authenticator of users in an Apache htpasswd
+// file of bcrypt, MD5-crypt or SHA1 entries, reloaded when the file changes.
+type HtpasswdAuthenticator struct {
+	file    string
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+	users   map[string]string
+}
+
+// NewHtpasswdAuthenticator return an authenticator of users in htpasswd file
+func NewHtpasswdAuthenticator(file string) (Authenticator, error) {
+	auth := &HtpasswdAuthenticator{file: file}
+	if _, err := auth.load(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// load return the users of file, parsed again if the file changed since
+// last load, the users last loaded are kept if the file is broken. A file
+// rewritten within the mtime granularity keeps its mtime and maybe its
+// size, so the content hash is compared too.
+func (auth *HtpasswdAuthenticator) load() (map[string]string, error) {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	fi, err := os.Stat(auth.file)
+	if err != nil {
+		return auth.users, err
+	}
+	data, err := ioutil.ReadFile(auth.file)
+	if err != nil {
+		return auth.users, err
+	}
+	sum := sha256.Sum256(data)
+	if auth.users != nil && fi.ModTime().Equal(auth.modTime) && fi.Size() == auth.size && sum == auth.sum {
+		return auth.users, nil
+	}
+
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 || len(s[0]) == 0 {
+			return auth.users, fmt.Errorf("%s:%d: invalid htpasswd entry", auth.file, i+1)
+		}
+		users[s[0]] = s[1]
+	}
+	auth.users = users
+	auth.modTime = fi.ModTime()
+	auth.size = fi.Size()
+	auth.sum = sum
+	return users, nil
+}
+
+// Authenticate verify the password of user against its htpasswd entry
+func (auth *HtpasswdAuthenticator) Authenticate(user, pass string) (bool, error) {
+	users, err := auth.load()
+	if err != nil {
+		defaultLogger.Log(LogWarn, "reload htpasswd fail", "file", auth.file, "err", err)
+	}
+	hash, ok := users[user]
+	if !ok {
+		return false, nil
+	}
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		return subtle.ConstantTimeCompare([]byte(md5Crypt(pass, hash, "$apr1$")), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "$1$"):
+		return subtle.ConstantTimeCompare([]byte(md5Crypt(pass, hash, "$1$")), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[5:])) == 1, nil
+	case isBcryptHash(hash):
+		return CheckPassword(hash, pass)
+	}
+	// crypt(3) DES, unknown $x$ schemes and plain text are never compared
+	// as plain text.
+	return false, fmt.Errorf("htpasswd user %s: %w", user, errHtpasswdHash)
+}
+
+// errHtpasswdHash - htpasswd entry not bcrypt, MD5-crypt or SHA1
+var errHtpasswdHash = errors.New("unsupported htpasswd hash")
+
+// md5Crypt return the MD5-crypt hash of pass with the salt of hash
+func md5Crypt(pass, hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	alt.Write([]byte(pass + salt + pass))
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write([]byte(pass + magic + salt))
+	for i := len(pass); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(altSum)
+		} else {
+			d.Write(altSum[:i])
+		}
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write([]byte(pass[:1]))
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write([]byte(pass))
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write([]byte(pass))
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write([]byte(pass))
+		}
+		sum = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := []byte(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	to64(uint32(sum[0])<<16|uint32(sum[6])<<8|uint32(sum[12]), 4)
+	to64(uint32(sum[1])<<16|uint32(sum[7])<<8|uint32(sum[13]), 4)
+	to64(uint32(sum[2])<<16|uint32(sum[8])<<8|uint32(sum[14]), 4)
+	to64(uint32(sum[3])<<16|uint32(sum[9])<<8|uint32(sum[15]), 4)
+	to64(uint32(sum[4])<<16|uint32(sum[10])<<8|uint32(sum[5]), 4)
+	to64(uint32(sum[11]), 2)
+	return string(out)
+}
+
+// LDAPOptions - settings of LDAPAuthenticator
+type LDAPOptions struct {
+	// URL - "ldap://host:389" or "ldaps://host:636"
+	URL string
+	// StartTLS - upgrade a ldap:// connection to TLS
+	StartTLS bool
+	// CAFile - CA certificates to trust, system ones if empty
+	CAFile string
+	// BindDN, BindPassword - service account searching users, anonymous if empty
+	BindDN       string
+	BindPassword string
+	// BaseDN - where users are searched
+	BaseDN string
+	// UserFilter - search filter holding %s for the escaped user name
+	UserFilter string
+	// GroupAttribute, Groups - a user must be a member of one of Groups if any
+	GroupAttribute string
+	Groups         []string
+	// Timeout - seconds of dial and each operation
+	Timeout int
+}
+
+// LDAPAuthenticator - authenticator of users in LDAP or Active Directory,
+// the user entry is searched with the service account then bound with the
+// password of user, a user must be a member of one of groups if any.
+type LDAPAuthenticator struct {
+	opts      LDAPOptions
+	url       *url.URL
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// NewLDAPAuthenticator return an authenticator of users in LDAP server of opts
+func NewLDAPAuthenticator(opts LDAPOptions) (Authenticator, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("ldap: unsupported url scheme: %s", u.Scheme)
+	}
+	if _, err := ldap.CompileFilter(strings.ReplaceAll(opts.UserFilter, "%s", "x")); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname()}
+	if len(opts.CAFile) > 0 {
+		data, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ldap: no certificate in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &LDAPAuthenticator{
+		opts:      opts,
+		url:       u,
+		tlsConfig: tlsConfig,
+		timeout:   time.Duration(opts.Timeout) * time.Second,
+	}, nil
+}
+
+// Authenticate search the entry of user and bind as it with pass
+func (auth *LDAPAuthenticator) Authenticate(user, pass string) (bool, error) {
+	// a simple bind with empty password is an anonymous bind which
+	// always succeeds.
+	if len(user) == 0 || len(pass) == 0 {
+		return false, nil
+	}
+
+	conn, err := auth.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if len(auth.opts.BindDN) > 0 {
+		if err := conn.Bind(auth.opts.BindDN, auth.opts.BindPassword); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return false, errors.New("ldap: invalid credentials of BindDN")
+			}
+			return false, err
+		}
+	}
+
+	var attrs []string
+	if len(auth.opts.Groups) > 0 {
+		attrs = append(attrs, auth.opts.GroupAttribute)
+	}
+	filter := strings.ReplaceAll(auth.opts.UserFilter, "%s", ldap.EscapeFilter(user))
+	result, err := conn.Search(ldap.NewSearchRequest(auth.opts.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(auth.timeout/time.Second), false, filter, attrs, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return false, err
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return false, nil
+	}
+	entry := result.Entries[0]
+
+	if len(auth.opts.Groups) > 0 && !auth.inGroups(entry.GetEqualFoldAttributeValues(auth.opts.GroupAttribute)) {
+		return false, nil
+	}
+
+	if err := conn.Bind(entry.DN, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// inGroups return whether one of values is one of groups
+func (auth *LDAPAuthenticator) inGroups(values []string) bool {
+	for _, value := range values {
+		for _, group := range auth.opts.Groups {
+			if strings.EqualFold(value, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dial connect to the ldap server, secured by TLS if ldaps or StartTLS
+func (auth *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(auth.url.String(),
+		ldap.DialWithDialer(&net.Dialer{Timeout: auth.timeout}),
+		ldap.DialWithTLSConfig(auth.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if auth.timeout > 0 {
+		conn.SetTimeout(auth.timeout)
+	}
+	if auth.url.Scheme == "ldap" && auth.opts.StartTLS {
+		if err := conn.StartTLS(auth.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// UserStore - authenticator holding the settings of its users, which are
+// loaded at login instead of the ones in Users
+type UserStore interface {
+	Authenticator
+	LoadUser(string) (*FtpdUser, error)
+}
+
+// SQLUserStore - user store of a database table, a user is queried at
+// each login so changes of the table apply without restart.
+type SQLUserStore struct {
+	db      *sql.DB
+	query   string
+	skew    int
+	timeout time.Duration
+}
+
+// sqlUserColumns - setters of FtpdUser by column name of the user query
+var sqlUserColumns = map[string]func(*FtpdUser, string) error{
+	"password":         func(u *FtpdUser, v string) error { u.Password = v; return nil },
+	"totp_secret":      func(u *FtpdUser, v string) error { u.TOTPSecret = v; return nil },
+	"home":             func(u *FtpdUser, v string) error { u.Home = v; return nil },
+	"user_group":       func(u *FtpdUser, v string) error { u.Group = v; return nil },
+	"allowed_networks": func(u *FtpdUser, v string) error { u.AllowedNetworks = strings.Split(v, ","); return nil },
+	"quota_bytes":      func(u *FtpdUser, v string) (err error) { u.QuotaBytes, err = strconv.ParseInt(v, 10, 64); return },
+	"quota_files":      func(u *FtpdUser, v string) (err error) { u.QuotaFiles, err = strconv.Atoi(v); return },
+	"upload_kbps":      func(u *FtpdUser, v string) (err error) { u.UploadKBps, err = strconv.Atoi(v); return },
+	"download_kbps":    func(u *FtpdUser, v string) (err error) { u.DownloadKBps, err = strconv.Atoi(v); return },
+	"read_only":        func(u *FtpdUser, v string) (err error) { u.ReadOnly, err = strconv.ParseBool(v); return },
+	"can_upload":       func(u *FtpdUser, v string) (err error) { u.CanUpload, err = sqlBool(v); return },
+	"can_download":     func(u *FtpdUser, v string) (err error) { u.CanDownload, err = sqlBool(v); return },
+	"can_delete":       func(u *FtpdUser, v string) (err error) { u.CanDelete, err = sqlBool(v); return },
+	"can_rename":       func(u *FtpdUser, v string) (err error) { u.CanRename, err = sqlBool(v); return },
+	"can_mkdir":        func(u *FtpdUser, v string) (err error) { u.CanMkdir, err = sqlBool(v); return },
+	"can_list":         func(u *FtpdUser, v string) (err error) { u.CanList, err = sqlBool(v); return },
+	"admin":            func(u *FtpdUser, v string) (err error) { u.Admin, err = strconv.ParseBool(v); return },
+	"cert_login":       func(u *FtpdUser, v string) (err error) { u.CertLogin, err = strconv.ParseBool(v); return },
+}
+
+// sqlBool parse a boolean column of a permission flag
+func sqlBool(v string) (*bool, error) {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// NewSQLUserStore return a user store of database dsn by driverName, which
+// must be registered by the program importing its database/sql driver.
+// query selects the user by the name as its only parameter, columns are
+// named as the keys of sqlUserColumns, password is required, a NULL column
+// keeps the default.
+func NewSQLUserStore(driverName, dsn, query string, skew, timeout int) (UserStore, error) {
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driverName
+	}
+	if !registered {
+		return nil, fmt.Errorf("sql: driver %s not registered, build with its driver such as -tags %s", driverName, driverName)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLUserStore{db: db, query: query, skew: skew, timeout: time.Duration(timeout) * time.Second}, nil
+}
+
+// LoadUser query the settings of user, nil if not found
+func (store *SQLUserStore) LoadUser(name string) (*FtpdUser, error) {
+	ctx := context.Background()
+	if store.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, store.timeout)
+		defer cancel()
+	}
+	rows, err := store.db.QueryContext(ctx, store.query, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	hasPassword := false
+	for _, column := range columns {
+		if _, ok := sqlUserColumns[strings.ToLower(column)]; !ok {
+			return nil, fmt.Errorf("sql: unknown user column: %s", column)
+		}
+		hasPassword = hasPassword || strings.EqualFold(column, "password")
+	}
+	if !hasPassword {
+		return nil, errors.New("sql: user query returns no password column")
+	}
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	user := new(FtpdUser)
+	for i, column := range columns {
+		if !values[i].Valid {
+			continue
+		}
+		if err := sqlUserColumns[strings.ToLower(column)](user, values[i].String); err != nil {
+			return nil, fmt.Errorf("sql: bad value of column %s: %v", column, err)
+		}
+	}
+	return user, nil
+}
+
+// Authenticate verify the password and TOTP code of user in database
+func (store *SQLUserStore) Authenticate(name, pass string) (bool, error) {
+	user, err := store.Login(name, pass, "")
+	return user != nil, err
+}
+
+// Login verify the password and TOTP code of user, return the settings of
+// user queried once for both.
+func (store *SQLUserStore) Login(name, pass, ip string) (*FtpdUser, error) {
+	user, err := store.LoadUser(name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	ok, err := checkUserPassword(*user, pass, store.skew)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Close close the database
+func (store *SQLUserStore) Close() error {
+	return store.db.Close()
+}
+
+// LoginAuthenticator - authenticator knowing the client ip, return the
+// settings of user on login, nil if denied
+type LoginAuthenticator interface {
+	Authenticator
+	Login(user, pass, ip string) (*FtpdUser, error)
+}
+
+// WebhookAuthenticator - authenticator posting the credentials to an http
+// endpoint, which replies allow or deny with the settings of user.
+type WebhookAuthenticator struct {
+	url     string
+	token   string
+	timeout time.Duration
+}
+
+// webhookRequest - body posted to the webhook
+type webhookRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	IP       string `json:"ip"`
+}
+
+// webhookReply - body replied by the webhook, the settings are the ones
+// of FtpdUser. An allowed user with an empty home gets the home of a user
+// without Home in Users, from HomeTemplate or HomeDir.
+type webhookReply struct {
+	Allow           bool     `json:"allow"`
+	Home            string   `json:"home"`
+	Group           string   `json:"group"`
+	AllowedNetworks []string `json:"allowed_networks"`
+	QuotaBytes      int64    `json:"quota_bytes"`
+	QuotaFiles      int      `json:"quota_files"`
+	UploadKBps      int      `json:"upload_kbps"`
+	DownloadKBps    int      `json:"download_kbps"`
+	ReadOnly        bool     `json:"read_only"`
+	CanUpload       *bool    `json:"can_upload"`
+	CanDownload     *bool    `json:"can_download"`
+	CanDelete       *bool    `json:"can_delete"`
+	CanRename       *bool    `json:"can_rename"`
+	CanMkdir        *bool    `json:"can_mkdir"`
+	CanList         *bool    `json:"can_list"`
+	Admin           bool     `json:"admin"`
+}
+
+// NewWebhookAuthenticator return an authenticator posting to url, token
+// is sent as bearer token if any.
+func NewWebhookAuthenticator(url, token string, timeout int) Authenticator {
+	return &WebhookAuthenticator{url: url, token: token, timeout: time.Duration(timeout) * time.Second}
+}
+
+// Authenticate verify the password of user by the webhook
+func (auth *WebhookAuthenticator) Authenticate(user, pass string) (bool, error) {
+	u, err := auth.Login(user, pass, "")
+	return u != nil, err
+}
+
+// Login post the credentials and client ip, return the settings of user
+// if allowed
+func (auth *WebhookAuthenticator) Login(user, pass, ip string) (*FtpdUser, error) {
+	body, err := json.Marshal(webhookRequest{user, pass, ip})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if auth.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, auth.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", auth.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(auth.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+auth.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("webhook: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var reply webhookReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if !reply.Allow {
+		return nil, nil
+	}
+	return &FtpdUser{
+		Home:            reply.Home,
+		Group:           reply.Group,
+		AllowedNetworks: reply.AllowedNetworks,
+		QuotaBytes:      reply.QuotaBytes,
+		QuotaFiles:      reply.QuotaFiles,
+		UploadKBps:      reply.UploadKBps,
+		DownloadKBps:    reply.DownloadKBps,
+		ReadOnly:        reply.ReadOnly,
+		CanUpload:       reply.CanUpload,
+		CanDownload:     reply.CanDownload,
+		CanDelete:       reply.CanDelete,
+		CanRename:       reply.CanRename,
+		CanMkdir:        reply.CanMkdir,
+		CanList:         reply.CanList,
+		Admin:           reply.Admin,
+	}, nil
+}
+
+// totpDigits - digits of TOTP code
+const totpDigits = 6
+
+// totpPeriod - seconds of a TOTP time step
+const totpPeriod = 30
+
+// totpCode return the RFC 6238 TOTP code of key at time step counter
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// verifyTOTP check code against the base32 secret, allow skew time steps
+// before and after now for the clock difference of client.
+func verifyTOTP(secret, code string, skew int, now time.Time) (bool, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return false, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	counter := now.Unix() / totpPeriod
+	for i := -skew; i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter+int64(i))), []byte(code)) == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MinioDriverFactory - minio driver factory
+type MinioDriverFactory struct {
+	endpoint        string
+	accessKeyID     string
+	secretAccessKey string
+	useSSL          bool
+	bucket          string
+	presignExpire   int
+	partSize        int
+	smallUploadSize int
+	prefix          string
+	users           map[string]string
+}
+
+// Capabilities return the capabilities of minio drivers
+func (factory *MinioDriverFactory) Capabilities() DriverCapabilities {
+	return DriverCapabilities{URL: factory.presignExpire > 0}
+}
+
+// MinioDriverOptions - options of minio drivers
+type MinioDriverOptions struct {
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+	Bucket          string
+	// PresignExpire is the seconds of presigned url valid, 0 means disabled.
+	PresignExpire int
+	// PartSize is the MiB of upload part buffered in memory, 0 means the
+	// minio default which is sized for the largest object and can be
+	// hundreds of MiB.
+	PartSize int
+	// SmallUploadSize is the KiB of uploads buffered and put in one request.
+	SmallUploadSize int
+	// Prefix is the key prefix the objects of a user are under, joined with
+	// the user home.
+	Prefix string
+	// Users map a ftp user to the bucket or bucket/prefix it is rooted at.
+	Users map[string]string
+}
+
+// NewMinioDriverFactory return a minio driver factory
+func NewMinioDriverFactory(endpoint, accessKeyID, secretAccessKey, bucket string, useSSL bool) DriverFactory {
+	return NewMinioDriverFactoryWithOptions(MinioDriverOptions{
+		Endpoint:        endpoint,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		UseSSL:          useSSL,
+		Bucket:          bucket,
+	})
+}
+
+// NewMinioDriverFactoryWithOptions return a minio driver factory of opts
+func NewMinioDriverFactoryWithOptions(opts MinioDriverOptions) DriverFactory {
+	return &MinioDriverFactory{
+		endpoint:        opts.Endpoint,
+		accessKeyID:     opts.AccessKeyID,
+		secretAccessKey: opts.SecretAccessKey,
+		useSSL:          opts.UseSSL,
+		bucket:          opts.Bucket,
+		presignExpire:   opts.PresignExpire,
+		partSize:        opts.PartSize,
+		smallUploadSize: opts.SmallUploadSize,
+		prefix:          opts.Prefix,
+		users:           opts.Users,
+	}
+}
+
+// MinioFileInfo - minio file information
+type MinioFileInfo struct {
+	name   string
+	object minio.ObjectInfo
+	isDir  bool
+}
+
+// Name return minio file name
+func (m *MinioFileInfo) Name() string {
+	return m.name
+}
+
+// Size return minio file size
+func (m *MinioFileInfo) Size() int64 {
+	if m.isDir {
+		return 4096
+	}
+	return m.object.Size
+}
+
+// Mode return minio file mode
+func (m *MinioFileInfo) Mode() os.FileMode {
+	if m.isDir {
+		return os.ModePerm | os.ModeDir
+	}
+	return os.ModePerm
+}
+
+// ModTime return minio file modify time
+func (m *MinioFileInfo) ModTime() time.Time {
+	if m.isDir {
+		return time.Now()
+	}
+	return m.object.LastModified
+}
+
+// IsDir return minio path is dir
+func (m *MinioFileInfo) IsDir() bool {
+	return m.isDir
+}
+
+// Sys return minio file system information, not implemented.
+func (m *MinioFileInfo) Sys() interface{} {
+	return nil
+}
+
+// MinioDriver - minio driver
+type MinioDriver struct {
+	client          *minio.Client
+	bucket          string
+	prefix          string
+	presignExpire   int
+	partSize        int
+	smallUploadSize int
+	sse             encrypt.ServerSide
+	ctx             context.Context
+}
+
+// minioClient - a minio client shared by the drivers of an endpoint and
+// credentials, with the checks of buckets in flight or succeeded.
+type minioClient struct {
+	client  *minio.Client
+	lock    sync.Mutex
+	buckets map[string]*bucketCall
+}
+
+// bucketCall - a check of a bucket, err is set once done is closed
+type bucketCall struct {
+	done chan struct{}
+	err  error
+}
+
+// minioBucketTimeout - timeout of creating a bucket at login
+const minioBucketTimeout = 30 * time.Second
+
+// minioClients - the minio clients by endpoint and credentials, shared by
+// the driver factories of virtual hosts and mounts so their connections
+// are pooled together.
+var minioClients = struct {
+	sync.Mutex
+	m map[string]*minioClient
+}{m: make(map[string]*minioClient)}
+
+// openMinioClient return the shared minio client of endpoint and credentials
+func openMinioClient(endpoint, accessKeyID, secretAccessKey string, useSSL bool) (*minioClient, error) {
+	key := strings.Join([]string{endpoint, accessKeyID, secretAccessKey, strconv.FormatBool(useSSL)}, "\x00")
+	minioClients.Lock()
+	defer minioClients.Unlock()
+	if mc, ok := minioClients.m[key]; ok {
+		return mc, nil
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mc := &minioClient{client: client, buckets: make(map[string]*bucketCall)}
+	minioClients.m[key] = mc
+	return mc, nil
+}
+
+// makeBucket create bucket unless it is known to exist, the logins of a
+// bucket wait for one check at most minioBucketTimeout and share its
+// result, a failed one is tried again by the next login.
+func (mc *minioClient) makeBucket(ctx context.Context, bucket string) error {
+	mc.lock.Lock()
+	call, ok := mc.buckets[bucket]
+	if !ok {
+		call = &bucketCall{done: make(chan struct{})}
+		mc.buckets[bucket] = call
+	}
+	mc.lock.Unlock()
+
+	if !ok {
+		call.err = mc.createBucket(bucket)
+		if call.err != nil {
+			mc.lock.Lock()
+			delete(mc.buckets, bucket)
+			mc.lock.Unlock()
+		}
+		close(call.done)
+	}
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// createBucket create bucket if it does not exist
+func (mc *minioClient) createBucket(bucket string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), minioBucketTimeout)
+	defer cancel()
+	err := mc.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{ObjectLocking: false})
+	if err != nil {
+		exists, errBucketExists := mc.client.BucketExists(ctx, bucket)
+		if !exists || errBucketExists != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewDriver return a minio driver of the shared client, the bucket is
+// created by the first login.
+func (factory *MinioDriverFactory) NewDriver(home string) (Driver, error) {
+	return factory.NewUserDriver("", home)
+}
+
+// NewUserDriver return a minio driver of user, rooted at the bucket or
+// bucket/prefix the login name of user is mapped to in users, the objects
+// of others are under prefix joined with home.
+func (factory *MinioDriverFactory) NewUserDriver(user, home string) (Driver, error) {
+	mc, err := openMinioClient(factory.endpoint, factory.accessKeyID, factory.secretAccessKey, factory.useSSL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, prefix := factory.bucket, filepath.ToSlash(filepath.Join(factory.prefix, home))
+	if mapped, ok := factory.users[user]; ok && len(user) > 0 {
+		bucket, prefix = mapped, ""
+		if i := strings.Index(mapped, "/"); i >= 0 {
+			bucket, prefix = mapped[:i], mapped[i+1:]
+		}
+	}
+	if err := mc.makeBucket(context.Background(), bucket); err != nil {
+		return nil, err
+	}
+	return &MinioDriver{mc.client, bucket, prefix, factory.presignExpire, factory.partSize, factory.smallUploadSize, nil, context.Background()}, nil
+}
+
+// S3DriverFactory - aws s3 driver factory, the drivers share one client of
+// aws-sdk-go-v2 with the credentials, region and encryption of aws.
+type S3DriverFactory struct {
+	client        *s3.Client
+	presign       *s3.PresignClient
+	uploader      *manager.Uploader
+	bucket        string
+	sse           string
+	kmsKeyID      string
+	presignExpire int
+	lock          sync.Mutex
+	bucketExists  bool
+}
+
+// S3DriverOptions - options of aws s3 drivers
+type S3DriverOptions struct {
+	// Endpoint is the host of an s3 compatible service, empty or
+	// s3.amazonaws.com for the regional endpoint of aws.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// AccessKeyID and SecretAccessKey are the static credentials, without
+	// them the credentials are the default ones of aws: AWS_* environment,
+	// the shared config and credentials files, then the IAM role of the
+	// instance or task.
+	AccessKeyID     string
+	SecretAccessKey string
+	// RoleARNs are the roles assumed in turn with STS AssumeRole, each by
+	// the credentials of the previous one, ExternalID is sent to assume the
+	// last one. STSEndpoint is the STS url, the regional one if empty.
+	RoleARNs    []string
+	ExternalID  string
+	STSEndpoint string
+	UseSSL      bool
+	// PathStyle address the bucket in path instead of host name.
+	PathStyle bool
+	// SSE is "" for none, AES256 for SSE-S3 or aws:kms for SSE-KMS with
+	// SSEKMSKeyID, the default key if empty.
+	SSE           string
+	SSEKMSKeyID   string
+	PresignExpire int
+	// PartSize is the MiB of an upload part buffered in memory, the
+	// minimum of s3 if 0.
+	PartSize int
+}
+
+// s3BucketTimeout - timeout of checking the bucket at the first login
+const s3BucketTimeout = 30 * time.Second
+
+// NewS3DriverFactory return an aws s3 driver factory of opts
+func NewS3DriverFactory(opts S3DriverOptions) (DriverFactory, error) {
+	loadOpts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(opts.Region)}
+	if len(opts.AccessKeyID) > 0 {
+		loadOpts = append(loadOpts, awsconfig.WithCredentialsProvider(
+			awscreds.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, "")))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, arn := range opts.RoleARNs {
+		// the sts client signs with the credentials of cfg so far, those of
+		// the previous role.
+		client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if len(opts.STSEndpoint) > 0 {
+				o.EndpointResolver = sts.EndpointResolverFromURL(opts.STSEndpoint)
+			}
+		})
+		last := i == len(opts.RoleARNs)-1
+		provider := stscreds.NewAssumeRoleProvider(client, arn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "kftpd"
+			if last && len(opts.ExternalID) > 0 {
+				o.ExternalID = aws.String(opts.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = opts.PathStyle
+		o.EndpointOptions.DisableHTTPS = !opts.UseSSL
+		if len(opts.Endpoint) > 0 && opts.Endpoint != "s3.amazonaws.com" {
+			scheme := "https://"
+			if !opts.UseSSL {
+				scheme = "http://"
+			}
+			o.EndpointResolver = s3.EndpointResolverFromURL(scheme + opts.Endpoint)
+		}
+	})
+	return &S3DriverFactory{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			// one part in memory for each upload.
+			u.PartSize = int64(opts.PartSize) << 20
+			u.Concurrency = 1
+		}),
+		bucket:        opts.Bucket,
+		sse:           opts.SSE,
+		kmsKeyID:      opts.SSEKMSKeyID,
+		presignExpire: opts.PresignExpire,
+	}, nil
+}
+
+// Capabilities return the capabilities of s3 drivers
+func (factory *S3DriverFactory) Capabilities() DriverCapabilities {
+	return DriverCapabilities{URL: factory.presignExpire > 0}
+}
+
+// checkBucket check the bucket exists, once succeeded it is not checked
+// again, buckets are not created on aws.
+func (factory *S3DriverFactory) checkBucket() error {
+	factory.lock.Lock()
+	defer factory.lock.Unlock()
+	if factory.bucketExists {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3BucketTimeout)
+	defer cancel()
+	if _, err := factory.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(factory.bucket)}); err != nil {
+		return fmt.Errorf("bucket %s: %v", factory.bucket, err)
+	}
+	factory.bucketExists = true
+	return nil
+}
+
+// NewDriver return a s3 driver of user on the shared client
+func (factory *S3DriverFactory) NewDriver(user string) (Driver, error) {
+	if err := factory.checkBucket(); err != nil {
+		return nil, err
+	}
+	return &S3Driver{factory, user, context.Background()}, nil
+}
+
+// S3FileInfo - s3 file information
+type S3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// Name return s3 file name
+func (s *S3FileInfo) Name() string {
+	return s.name
+}
+
+// Size return s3 file size
+func (s *S3FileInfo) Size() int64 {
+	if s.isDir {
+		return 4096
+	}
+	return s.size
+}
+
+// Mode return s3 file mode
+func (s *S3FileInfo) Mode() os.FileMode {
+	if s.isDir {
+		return os.ModePerm | os.ModeDir
+	}
+	return os.ModePerm
+}
+
+// ModTime return s3 file modify time
+func (s *S3FileInfo) ModTime() time.Time {
+	if s.isDir {
+		return time.Now()
+	}
+	return s.modTime
+}
+
+// IsDir return s3 path is dir
+func (s *S3FileInfo) IsDir() bool {
+	return s.isDir
+}
+
+// Sys return s3 file system information, not implemented.
+func (s *S3FileInfo) Sys() interface{} {
+	return nil
+}
+
+// S3Driver - aws s3 driver, objects of user are under the user prefix and
+// directories are "dir/" objects like minio driver.
+type S3Driver struct {
+	factory *S3DriverFactory
+	user    string
+	ctx     context.Context
+}
+
+// s3path return object key of path joined with user
+func (driver *S3Driver) s3path(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join("/", driver.user, jailpath(path))), "/")
+}
+
+// s3dir return object prefix of dir path joined with user, always end with
+// a slash, empty for the bucket root.
+func (driver *S3Driver) s3dir(path string) string {
+	dir := driver.s3path(path)
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// s3NotFound return whether err is a 404 of s3
+func s3NotFound(err error) bool {
+	var re *awshttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound
+}
+
+// sseHeaders set the server side encryption of an upload to sse and kmsKeyID
+func (driver *S3Driver) sseHeaders(sse *types.ServerSideEncryption, kmsKeyID **string) {
+	if len(driver.factory.sse) == 0 {
+		return
+	}
+	*sse = types.ServerSideEncryption(driver.factory.sse)
+	if driver.factory.sse == "aws:kms" && len(driver.factory.kmsKeyID) > 0 {
+		*kmsKeyID = aws.String(driver.factory.kmsKeyID)
+	}
+}
+
+// head return the metadata of object key
+func (driver *S3Driver) head(key string) (*s3.HeadObjectOutput, error) {
+	return driver.factory.client.HeadObject(driver.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(key),
+	})
+}
+
+// list call fn with the objects and common prefixes under prefix, page by
+// page, up to maxKeys in total if not 0.
+func (driver *S3Driver) list(prefix, delimiter string, maxKeys int32, fn func(objects []types.Object, prefixes []types.CommonPrefix) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(driver.factory.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if len(delimiter) > 0 {
+		input.Delimiter = aws.String(delimiter)
+	}
+	paginator := s3.NewListObjectsV2Paginator(driver.factory.client, input, func(o *s3.ListObjectsV2PaginatorOptions) {
+		o.Limit = maxKeys
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(driver.ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Contents, page.CommonPrefixes); err != nil {
+			return err
+		}
+		if maxKeys > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// WithContext return a copy of driver whose requests are canceled with ctx
+func (driver *S3Driver) WithContext(ctx context.Context) Driver {
+	d := *driver
+	d.ctx = ctx
+	return &d
+}
+
+// Capabilities return the capabilities of s3 driver
+func (driver *S3Driver) Capabilities() DriverCapabilities {
+	return driver.factory.Capabilities()
+}
+
+// Stat return file information
+func (driver *S3Driver) Stat(path string) (FileInfo, error) {
+	if path == "/" {
+		return &S3FileInfo{name: "/", isDir: true}, nil
+	}
+
+	rpath := driver.s3path(path)
+	object, err := driver.head(rpath)
+	if s3NotFound(err) {
+		// no object of the path, it is a dir if any object under it.
+		exists := false
+		err = driver.list(driver.s3dir(path), "", 1, func(objects []types.Object, prefixes []types.CommonPrefix) error {
+			exists = len(objects) > 0
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return &S3FileInfo{name: filepath.Base(rpath), isDir: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &S3FileInfo{name: filepath.Base(rpath), size: object.ContentLength, modTime: aws.ToTime(object.LastModified)}, nil
+}
+
+// Chtimes change file modify time
+func (driver *S3Driver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return errors.New("not implemented")
+}
+
+// DeleteDir delete dir in s3
+func (driver *S3Driver) DeleteDir(path string) error {
+	rpath := driver.s3dir(path)
+	if rpath == "" {
+		return errors.New("can not delete root directory")
+	}
+
+	err := driver.list(rpath, "/", 0, func(objects []types.Object, prefixes []types.CommonPrefix) error {
+		if len(objects) == 0 {
+			return nil
+		}
+		ids := make([]types.ObjectIdentifier, len(objects))
+		for i, object := range objects {
+			ids[i] = types.ObjectIdentifier{Key: object.Key}
+		}
+		output, err := driver.factory.client.DeleteObjects(driver.ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(driver.factory.bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: true},
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("delete %s: %s", aws.ToString(output.Errors[0].Key), aws.ToString(output.Errors[0].Message))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return driver.deleteObject(rpath)
+}
+
+// DeleteFile delete file in s3
+func (driver *S3Driver) DeleteFile(path string) error {
+	return driver.deleteObject(driver.s3path(path))
+}
+
+// deleteObject delete object key
+func (driver *S3Driver) deleteObject(key string) error {
+	_, err := driver.factory.client.DeleteObject(driver.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Rename rename file or dir in s3
+func (driver *S3Driver) Rename(from string, to string) error {
+	fpath := driver.s3path(from)
+	tpath := driver.s3path(to)
+
+	rename := func(from, to string) error {
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(driver.factory.bucket),
+			Key:        aws.String(to),
+			CopySource: aws.String(url.PathEscape(driver.factory.bucket) + "/" + (&url.URL{Path: from}).EscapedPath()),
+		}
+		driver.sseHeaders(&input.ServerSideEncryption, &input.SSEKMSKeyId)
+		if _, err := driver.factory.client.CopyObject(driver.ctx, input); err != nil {
+			return err
+		}
+		return driver.deleteObject(from)
+	}
+
+	err := rename(fpath, tpath)
+	if err != nil {
+		err = rename(fpath+"/", tpath+"/")
+	}
+	return err
+}
+
+// MakeDir make dir in s3
+func (driver *S3Driver) MakeDir(path string) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(driver.s3dir(path)),
+		Body:   bytes.NewReader(nil),
+	}
+	driver.sseHeaders(&input.ServerSideEncryption, &input.SSEKMSKeyId)
+	_, err := driver.factory.client.PutObject(driver.ctx, input)
+	return err
+}
+
+// GetFile return file size, file reader in s3
+func (driver *S3Driver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	rpath := driver.s3path(path)
+
+	object, err := driver.head(rpath)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset >= object.ContentLength {
+		// s3 refuses a range starting at the end.
+		return 0, ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(rpath),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	output, err := driver.factory.client.GetObject(driver.ctx, input)
+	if err != nil {
+		return 0, nil, err
+	}
+	return object.ContentLength - offset, output.Body, nil
+}
+
+// PutFile put a file to s3, support append with offset by uploading the
+// object again with its first offset bytes read back from s3, return the
+// bytes of reader.
+func (driver *S3Driver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	rpath := driver.s3path(path)
+
+	var n int64
+	body := io.Reader(&countReader{reader, &n})
+	if offset > 0 {
+		output, err := driver.factory.client.GetObject(driver.ctx, &s3.GetObjectInput{
+			Bucket: aws.String(driver.factory.bucket),
+			Key:    aws.String(rpath),
+			Range:  aws.String(fmt.Sprintf("bytes=0-%d", offset-1)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		defer output.Body.Close()
+		body = io.MultiReader(io.LimitReader(output.Body, offset), body)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(rpath),
+		Body:   body,
+	}
+	driver.sseHeaders(&input.ServerSideEncryption, &input.SSEKMSKeyId)
+	if _, err := driver.factory.uploader.Upload(driver.ctx, input); err != nil {
+		return 0, err
+	}
+	return atomic.LoadInt64(&n), nil
+}
+
+// GetURL return a presigned url to download file from s3 directly
+func (driver *S3Driver) GetURL(path string) (string, error) {
+	if driver.factory.presignExpire <= 0 {
+		return "", errors.New("presigned url disabled")
+	}
+	rpath := driver.s3path(path)
+	if _, err := driver.head(rpath); err != nil {
+		return "", err
+	}
+	request, err := driver.factory.presign.PresignGetObject(driver.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(driver.factory.bucket),
+		Key:    aws.String(rpath),
+	}, s3.WithPresignExpires(time.Duration(driver.factory.presignExpire)*time.Second))
+	if err != nil {
+		return "", err
+	}
+	return request.URL, nil
+}
+
+// Hash return the MD5 of object from its ETag, which is not the MD5 of
+// multipart uploads or objects encrypted with SSE-KMS.
+func (driver *S3Driver) Hash(path, algo string) (string, error) {
+	if algo != "MD5" || driver.factory.sse == "aws:kms" {
+		return "", ErrHashUnsupported
+	}
+	object, err := driver.head(driver.s3path(path))
+	if err != nil {
+		return "", err
+	}
+	etag := strings.Trim(aws.ToString(object.ETag), "\"")
+	if len(etag) != 32 {
+		return "", ErrHashUnsupported
+	}
+	return strings.ToLower(etag), nil
+}
+
+// ListDir return file list from dir in s3
+func (driver *S3Driver) ListDir(path string, callback func(FileInfo) error) error {
+	rpath := driver.s3dir(path)
+
+	return driver.list(rpath, "/", 0, func(objects []types.Object, prefixes []types.CommonPrefix) error {
+		for _, prefix := range prefixes {
+			info := &S3FileInfo{
+				name:  strings.TrimSuffix(strings.TrimPrefix(aws.ToString(prefix.Prefix), rpath), "/"),
+				isDir: true,
+			}
+			if err := callback(info); err != nil {
+				return err
+			}
+		}
+		for _, object := range objects {
+			key := aws.ToString(object.Key)
+			if key == rpath {
+				continue
+			}
+			info := &S3FileInfo{
+				name:    strings.TrimPrefix(key, rpath),
+				size:    object.Size,
+				modTime: aws.ToTime(object.LastModified),
+			}
+			if err := callback(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cacheRoot return the bucket and key prefix of the objects of driver
+func (driver *MinioDriver) cacheRoot() string {
+	return driver.bucket + "/" + driver.prefix
+}
+
+// miniopath return object key of file path joined with prefix,
+// keys never start with a slash whether HomeDir is enabled or not.
+func (driver *MinioDriver) miniopath(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join("/", driver.prefix, jailpath(path))), "/")
+}
+
+// miniodir return object prefix of dir path joined with prefix, always end with
+// a slash no matter whether the ftp path has one, empty for the bucket root.
+func (driver *MinioDriver) miniodir(path string) string {
+	dir := driver.miniopath(path)
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// Stat return file information
+func (driver *MinioDriver) Stat(path string) (FileInfo, error) {
+	if path == "/" {
+		return &MinioFileInfo{
+			name:  "/",
+			isDir: true,
+		}, nil
+	}
+
+	rpath := driver.miniopath(path)
+	object, err := driver.client.StatObject(driver.ctx, driver.bucket, rpath, minio.StatObjectOptions{})
+	if err != nil {
+		// no object of the path, it is a dir if any object under it.
+		exists, lerr := driver.hasPrefix(driver.miniodir(path))
+		if lerr != nil {
+			return nil, lerr
+		}
+		if !exists {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return &MinioFileInfo{
+			name:  filepath.Base(rpath),
+			isDir: true,
+		}, nil
+	}
+	return &MinioFileInfo{
+		name:   filepath.Base(rpath),
+		object: object,
+		isDir:  strings.HasSuffix(object.Key, "/"),
+	}, nil
+}
+
+// hasPrefix return whether any object key starts with prefix
+func (driver *MinioDriver) hasPrefix(prefix string) (bool, error) {
+	ctx, cancel := context.WithCancel(driver.ctx)
+	defer cancel()
+
+	objectCh := driver.client.ListObjects(ctx, driver.bucket, minio.ListObjectsOptions{
+		Prefix:  prefix,
+		MaxKeys: 1,
+	})
+	for object := range objectCh {
+		if object.Err != nil {
+			return false, object.Err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// WithContext return a copy of driver whose requests are canceled with ctx
+func (driver *MinioDriver) WithContext(ctx context.Context) Driver {
+	d := *driver
+	d.ctx = ctx
+	return &d
+}
+
+// Capabilities return the capabilities of minio driver
+func (driver *MinioDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{URL: driver.presignExpire > 0}
+}
+
+// Chtimes change file modify time
+func (driver *MinioDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return errors.New("not implemented")
+}
+
+// DeleteDir delete dir in minio
+func (driver *MinioDriver) DeleteDir(path string) error {
+	rpath := driver.miniodir(path)
+	if rpath == "" {
+		return errors.New("can not delete root directory")
+	}
+
+	ctx, cancel := context.WithCancel(driver.ctx)
+	defer cancel()
+
+	objectCh := driver.client.ListObjects(ctx, driver.bucket, minio.ListObjectsOptions{
+		Prefix:    rpath,
+		Recursive: false,
+	})
+	for rErr := range driver.client.RemoveObjects(ctx, driver.bucket, objectCh, minio.RemoveObjectsOptions{
+		GovernanceBypass: true,
+	}) {
+		return rErr.Err
+	}
+	return driver.client.RemoveObject(ctx, driver.bucket, rpath, minio.RemoveObjectOptions{})
+}
+
+// DeleteFile delete file in minio
+func (driver *MinioDriver) DeleteFile(path string) error {
+	rpath := driver.miniopath(path)
+	return driver.client.RemoveObject(driver.ctx, driver.bucket, rpath, minio.RemoveObjectOptions{})
+}
+
+// Rename rename file or dir in minio
+func (driver *MinioDriver) Rename(from string, to string) error {
+	fpath := driver.miniopath(from)
+	tpath := driver.miniopath(to)
+	ctx := driver.ctx
+
+	rename := func(from, to string) error {
+		_, err := driver.client.CopyObject(ctx, minio.CopyDestOptions{
+			Bucket:     driver.bucket,
+			Object:     to,
+			Encryption: driver.sse,
+		}, minio.CopySrcOptions{
+			Bucket: driver.bucket,
+			Object: from,
+		})
+		if err == nil {
+			err = driver.client.RemoveObject(ctx, driver.bucket, fpath, minio.RemoveObjectOptions{})
+		}
+		return err
+	}
+
+	err := rename(fpath, tpath)
+	if err != nil {
+		fpath += "/"
+		tpath += "/"
+		err = rename(fpath, tpath)
+	}
+
+	return err
+}
+
+// MakeDir make dir in minio
+func (driver *MinioDriver) MakeDir(path string) error {
+	rpath := driver.miniodir(path)
+	_, err := driver.client.PutObject(driver.ctx, driver.bucket, rpath, nil, 0, minio.PutObjectOptions{ServerSideEncryption: driver.sse})
+	return err
+}
+
+// GetFile return file size, file reader in minio
+func (driver *MinioDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	rpath := driver.miniopath(path)
+
+	object, err := driver.client.GetObject(driver.ctx, driver.bucket, rpath, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err != nil && object != nil {
+			object.Close()
+		}
+	}()
+	info, err := object.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > 0 {
+		_, err = object.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return info.Size - offset, object, nil
+}
+
+// PutFile put a file to minio, support append with offset.
+func (driver *MinioDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	rpath := driver.miniopath(path)
+
+	if offset == 0 {
+		info, err := driver.putObject(driver.ctx, rpath, reader)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size, nil
+	}
+
+	ctx := driver.ctx
+
+	tmppath := rpath + ".tmp"
+
+	defer func() {
+		// the session context is canceled by a disconnect, the temporary
+		// object is removed anyway.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		driver.client.RemoveObject(ctx, driver.bucket, tmppath, minio.RemoveObjectOptions{})
+	}()
+
+	_, err := driver.putObject(ctx, tmppath, reader)
+	if err != nil {
+		return 0, err
+	}
+	info, err := driver.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: driver.bucket, Object: rpath, Encryption: driver.sse},
+		minio.CopySrcOptions{Bucket: driver.bucket, Object: rpath},
+		minio.CopySrcOptions{Bucket: driver.bucket, Object: tmppath})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// putOptions return options of uploading an object of unknown size,
+// minio buffers a whole part in memory before sending it.
+func (driver *MinioDriver) putOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{PartSize: uint64(driver.partSize) << 20, ServerSideEncryption: driver.sse}
+}
+
+// putObject upload reader to object rpath, an upload within smallUploadSize
+// is buffered to put with known size in a single request, otherwise it is
+// streamed in parts.
+func (driver *MinioDriver) putObject(ctx context.Context, rpath string, reader io.Reader) (minio.UploadInfo, error) {
+	if driver.smallUploadSize <= 0 {
+		return driver.client.PutObject(ctx, driver.bucket, rpath, reader, -1, driver.putOptions())
+	}
+
+	limit := int64(driver.smallUploadSize) << 10
+	buf, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if int64(len(buf)) <= limit {
+		return driver.client.PutObject(ctx, driver.bucket, rpath, bytes.NewReader(buf), int64(len(buf)), driver.putOptions())
+	}
+	return driver.client.PutObject(ctx, driver.bucket, rpath, io.MultiReader(bytes.NewReader(buf), reader), -1, driver.putOptions())
+}
+
+// GetURL return a presigned url to download file from minio directly
+func (driver *MinioDriver) GetURL(path string) (string, error) {
+	if driver.presignExpire <= 0 {
+		return "", errors.New("presigned url disabled")
+	}
+	rpath := driver.miniopath(path)
+	ctx := driver.ctx
+
+	_, err := driver.client.StatObject(ctx, driver.bucket, rpath, minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	u, err := driver.client.PresignedGetObject(ctx, driver.bucket, rpath, time.Duration(driver.presignExpire)*time.Second, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Hash return the MD5 of object from its ETag, which is not the MD5 of
+// multipart uploads or objects encrypted with SSE-C or SSE-KMS.
+func (driver *MinioDriver) Hash(path, algo string) (string, error) {
+	if algo != "MD5" || (driver.sse != nil && driver.sse.Type() != encrypt.S3) {
+		return "", ErrHashUnsupported
+	}
+	object, err := driver.client.StatObject(driver.ctx, driver.bucket, driver.miniopath(path), minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	etag := strings.Trim(object.ETag, "\"")
+	if len(etag) != 32 {
+		return "", ErrHashUnsupported
+	}
+	return strings.ToLower(etag), nil
+}
+
+// ListDir return file list from dir in minio
+func (driver *MinioDriver) ListDir(path string, callback func(FileInfo) error) error {
+	rpath := driver.miniodir(path)
+
+	ctx, cancel := context.WithCancel(driver.ctx)
+	defer cancel()
+
+	objectCh := driver.client.ListObjects(ctx, driver.bucket, minio.ListObjectsOptions{
+		Prefix:    rpath,
+		Recursive: false,
+	})
+	for object := range objectCh {
+		if object.Err != nil {
+			return object.Err
+		}
+		if object.Key == rpath {
+			continue
+		}
+		info := &MinioFileInfo{
+			name:   strings.TrimSuffix(strings.TrimPrefix(object.Key, rpath), "/"),
+			object: object,
+			isDir:  strings.HasSuffix(object.Key, "/"),
+		}
+		err := callback(info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GCSDriverFactory - google cloud storage driver factory
+type GCSDriverFactory struct {
+	bucket          string
+	credentialsFile string
+	endpoint        string
+	lock            sync.Mutex
+	tokens          *gcsTokenSource
+}
+
+// NewGCSDriverFactory return a google cloud storage driver factory,
+// credentialsFile is a service account JSON key, empty means the one of
+// GOOGLE_APPLICATION_CREDENTIALS, then the account of metadata server such
+// as workload identity on GKE.
+func NewGCSDriverFactory(bucket, credentialsFile string) DriverFactory {
+	return &GCSDriverFactory{
+		bucket:          bucket,
+		credentialsFile: credentialsFile,
+		endpoint:        gcsAPI,
+	}
+}
+
+// Capabilities return the capabilities of gcs drivers
+func (factory *GCSDriverFactory) Capabilities() DriverCapabilities {
+	return DriverCapabilities{}
+}
+
+// NewDriver return a gcs driver, the credentials are loaded at the first one
+func (factory *GCSDriverFactory) NewDriver(user string) (Driver, error) {
+	factory.lock.Lock()
+	defer factory.lock.Unlock()
+	if factory.tokens == nil {
+		tokens, err := newGCSTokenSource(factory.credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		factory.tokens = tokens
+	}
+	return &GCSDriver{factory.bucket, user, factory.endpoint, factory.tokens, context.Background()}, nil
+}
+
+// gcsScope - oauth2 scope of reading and writing objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsMetadataTokenURL - token of the default account from metadata server
+const gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcsTokenSource - oauth2 access tokens of a service account, cached until
+// a minute before expiry.
+type gcsTokenSource struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	lock     sync.Mutex
+	token    string
+	expiry   time.Time
+}
+
+// newGCSTokenSource return a token source of the service account key file,
+// or of metadata server without one.
+func newGCSTokenSource(credentialsFile string) (*gcsTokenSource, error) {
+	if len(credentialsFile) == 0 {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if len(credentialsFile) == 0 {
+		return &gcsTokenSource{}, nil
+	}
+
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("not supported credentials type: %s", account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid private key of service account")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key of service account is not rsa")
+	}
+	if len(account.TokenURI) == 0 {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &gcsTokenSource{email: account.ClientEmail, key: key, tokenURI: account.TokenURI}, nil
+}
+
+// Token return a valid access token
+func (ts *gcsTokenSource) Token(ctx context.Context) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.token) > 0 && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.key == nil {
+		req, err = http.NewRequest("GET", gcsMetadataTokenURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		assertion, err := ts.assertion()
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err = http.NewRequest("POST", ts.tokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("gcs token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion return a signed JWT asking a token of the service account
+func (ts *gcsTokenSource) assertion() (string, error) {
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": gcsScope,
+		"aud":   ts.tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(crand.Reader, ts.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// gcsObject - object resource of gcs JSON API
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+// GCSFileInfo - gcs file information
+type GCSFileInfo struct {
+	name   string
+	object gcsObject
+	isDir  bool
+}
+
+// Name return gcs file name
+func (g *GCSFileInfo) Name() string {
+	return g.name
+}
+
+// Size return gcs file size
+func (g *GCSFileInfo) Size() int64 {
+	if g.isDir {
+		return 4096
+	}
+	return g.object.Size
+}
+
+// Mode return gcs file mode
+func (g *GCSFileInfo) Mode() os.FileMode {
+	if g.isDir {
+		return os.ModePerm | os.ModeDir
+	}
+	return os.ModePerm
+}
+
+// ModTime return gcs file modify time
+func (g *GCSFileInfo) ModTime() time.Time {
+	if g.isDir {
+		return time.Now()
+	}
+	return g.object.Updated
+}
+
+// IsDir return gcs path is dir
+func (g *GCSFileInfo) IsDir() bool {
+	return g.isDir
+}
+
+// Sys return gcs file system information, not implemented.
+func (g *GCSFileInfo) Sys() interface{} {
+	return nil
+}
+
+// GCSDriver - google cloud storage driver, objects of user are under the
+// user prefix and directories are "dir/" objects like minio driver.
+type GCSDriver struct {
+	bucket   string
+	user     string
+	endpoint string
+	tokens   *gcsTokenSource
+	ctx      context.Context
+}
+
+// errGCSNotFound - the object or bucket does not exist
+var errGCSNotFound = errors.New("gcs: not found")
+
+// gcsAPI - base url of gcs JSON API
+const gcsAPI = "https://storage.googleapis.com"
+
+// gcspath return object name of path joined with user
+func (driver *GCSDriver) gcspath(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join("/", driver.user, jailpath(path))), "/")
+}
+
+// gcsdir return object prefix of dir path joined with user, always end with
+// a slash, empty for the bucket root.
+func (driver *GCSDriver) gcsdir(path string) string {
+	dir := driver.gcspath(path)
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// objectURL return the url of object name with the rest of path
+func (driver *GCSDriver) objectURL(name, rest string) string {
+	return driver.endpoint + "/storage/v1/b/" + url.PathEscape(driver.bucket) + "/o/" + url.PathEscape(name) + rest
+}
+
+// do send a request of gcs API, decode the JSON reply into out if not nil,
+// the body of reply is left open for the caller otherwise.
+func (driver *GCSDriver) do(method, rawurl string, body io.Reader, header http.Header, out interface{}) (*http.Response, error) {
+	token, err := driver.tokens.Token(driver.ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(driver.ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errGCSNotFound
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// list call fn with the objects and sub prefixes directly under prefix,
+// page by page.
+func (driver *GCSDriver) list(prefix string, maxResults int, fn func(objects []gcsObject, prefixes []string) error) error {
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "delimiter": {"/"}}
+		if maxResults > 0 {
+			query.Set("maxResults", strconv.Itoa(maxResults))
+		}
+		if len(pageToken) > 0 {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			Prefixes      []string    `json:"prefixes"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		rawurl := driver.endpoint + "/storage/v1/b/" + url.PathEscape(driver.bucket) + "/o?" + query.Encode()
+		if _, err := driver.do("GET", rawurl, nil, nil, &page); err != nil {
+			return err
+		}
+		if err := fn(page.Items, page.Prefixes); err != nil {
+			return err
+		}
+		if len(page.NextPageToken) == 0 || maxResults > 0 {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// upload put reader to object name in a single streamed request
+func (driver *GCSDriver) upload(name string, reader io.Reader) (gcsObject, error) {
+	var object gcsObject
+	query := url.Values{"uploadType": {"media"}, "name": {name}}
+	rawurl := driver.endpoint + "/upload/storage/v1/b/" + url.PathEscape(driver.bucket) + "/o?" + query.Encode()
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	_, err := driver.do("POST", rawurl, reader, header, &object)
+	return object, err
+}
+
+// WithContext return a copy of driver whose requests are canceled with ctx
+func (driver *GCSDriver) WithContext(ctx context.Context) Driver {
+	d := *driver
+	d.ctx = ctx
+	return &d
+}
+
+// Capabilities return the capabilities of gcs driver
+func (driver *GCSDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{}
+}
+
+// Stat return file information
+func (driver *GCSDriver) Stat(path string) (FileInfo, error) {
+	if path == "/" {
+		return &GCSFileInfo{name: "/", isDir: true}, nil
+	}
+
+	rpath := driver.gcspath(path)
+	var object gcsObject
+	_, err := driver.do("GET", driver.objectURL(rpath, ""), nil, nil, &object)
+	if err == errGCSNotFound {
+		// no object of the path, it is a dir if any object under it.
+		exists := false
+		err = driver.list(driver.gcsdir(path), 1, func(objects []gcsObject, prefixes []string) error {
+			exists = len(objects) > 0 || len(prefixes) > 0
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return &GCSFileInfo{name: filepath.Base(rpath), isDir: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &GCSFileInfo{name: filepath.Base(rpath), object: object}, nil
+}
+
+// Chtimes change file modify time
+func (driver *GCSDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return errors.New("not implemented")
+}
+
+// DeleteDir delete dir in gcs
+func (driver *GCSDriver) DeleteDir(path string) error {
+	rpath := driver.gcsdir(path)
+	if rpath == "" {
+		return errors.New("can not delete root directory")
+	}
+
+	err := driver.list(rpath, 0, func(objects []gcsObject, prefixes []string) error {
+		for _, object := range objects {
+			if object.Name == rpath {
+				continue
+			}
+			if _, err := driver.do("DELETE", driver.objectURL(object.Name, ""), nil, nil, nil); err != nil && err != errGCSNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = driver.do("DELETE", driver.objectURL(rpath, ""), nil, nil, nil)
+	if err == errGCSNotFound {
+		err = nil
+	}
+	return err
+}
+
+// DeleteFile delete file in gcs
+func (driver *GCSDriver) DeleteFile(path string) error {
+	_, err := driver.do("DELETE", driver.objectURL(driver.gcspath(path), ""), nil, nil, nil)
+	return err
+}
+
+// Rename rename file or dir in gcs
+func (driver *GCSDriver) Rename(from string, to string) error {
+	fpath := driver.gcspath(from)
+	tpath := driver.gcspath(to)
+
+	rename := func(from, to string) error {
+		// large objects are rewritten in several calls.
+		rewriteToken := ""
+		for {
+			rest := "/rewriteTo/b/" + url.PathEscape(driver.bucket) + "/o/" + url.PathEscape(to)
+			if len(rewriteToken) > 0 {
+				rest += "?rewriteToken=" + url.QueryEscape(rewriteToken)
+			}
+			var result struct {
+				Done         bool   `json:"done"`
+				RewriteToken string `json:"rewriteToken"`
+			}
+			if _, err := driver.do("POST", driver.objectURL(from, rest), nil, nil, &result); err != nil {
+				return err
+			}
+			if result.Done {
+				break
+			}
+			rewriteToken = result.RewriteToken
+		}
+		_, err := driver.do("DELETE", driver.objectURL(from, ""), nil, nil, nil)
+		return err
+	}
+
+	err := rename(fpath, tpath)
+	if err != nil {
+		err = rename(fpath+"/", tpath+"/")
+	}
+	return err
+}
+
+// MakeDir make dir in gcs
+func (driver *GCSDriver) MakeDir(path string) error {
+	_, err := driver.upload(driver.gcsdir(path), bytes.NewReader(nil))
+	return err
+}
+
+// GetFile return file size, file reader in gcs
+func (driver *GCSDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	rpath := driver.gcspath(path)
+
+	var object gcsObject
+	if _, err := driver.do("GET", driver.objectURL(rpath, ""), nil, nil, &object); err != nil {
+		return 0, nil, err
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := driver.do("GET", driver.objectURL(rpath, "?alt=media"), nil, header, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return object.Size - offset, resp.Body, nil
+}
+
+// PutFile put a file to gcs, support append with offset.
+func (driver *GCSDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	rpath := driver.gcspath(path)
+
+	if offset == 0 {
+		object, err := driver.upload(rpath, reader)
+		if err != nil {
+			return 0, err
+		}
+		return object.Size, nil
+	}
+
+	tmppath := rpath + ".tmp"
+
+	defer func() {
+		driver.do("DELETE", driver.objectURL(tmppath, ""), nil, nil, nil)
+	}()
+
+	if _, err := driver.upload(tmppath, reader); err != nil {
+		return 0, err
+	}
+	compose, _ := json.Marshal(map[string]interface{}{
+		"sourceObjects": []map[string]string{{"name": rpath}, {"name": tmppath}},
+	})
+	var object gcsObject
+	header := http.Header{"Content-Type": {"application/json"}}
+	if _, err := driver.do("POST", driver.objectURL(rpath, "/compose"), bytes.NewReader(compose), header, &object); err != nil {
+		return 0, err
+	}
+	return object.Size, nil
+}
+
+// ListDir return file list from dir in gcs
+func (driver *GCSDriver) ListDir(path string, callback func(FileInfo) error) error {
+	rpath := driver.gcsdir(path)
+
+	return driver.list(rpath, 0, func(objects []gcsObject, prefixes []string) error {
+		for _, prefix := range prefixes {
+			info := &GCSFileInfo{
+				name:  strings.TrimSuffix(strings.TrimPrefix(prefix, rpath), "/"),
+				isDir: true,
+			}
+			if err := callback(info); err != nil {
+				return err
+			}
+		}
+		for _, object := range objects {
+			if object.Name == rpath {
+				continue
+			}
+			info := &GCSFileInfo{
+				name:   strings.TrimPrefix(object.Name, rpath),
+				object: object,
+			}
+			if err := callback(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SFTPDriverFactory - driver factory of an upstream sftp server, making
+// kftpd a gateway for clients speaking ftp only.
+type SFTPDriverFactory struct {
+	addr           string
+	user           string
+	password       string
+	keyFile        string
+	knownHostsFile string
+	root           string
+	users          map[string]string
+}
+
+// NewSFTPDriverFactory return a sftp driver factory logging in addr as
+// user with the private key in keyFile or password, the host key must be
+// in knownHostsFile. A ftp user mapped in users logs in as the upstream
+// user of the map and is rooted at root, the others log in as user and
+// are rooted at their home under root, root is relative to the upstream
+// login directory unless absolute.
+func NewSFTPDriverFactory(addr, user, password, keyFile, knownHostsFile, root string, users map[string]string) DriverFactory {
+	return &SFTPDriverFactory{
+		addr:           addr,
+		user:           user,
+		password:       password,
+		keyFile:        keyFile,
+		knownHostsFile: knownHostsFile,
+		root:           root,
+		users:          users,
+	}
+}
+
+// Capabilities return the capabilities of sftp drivers
+func (factory *SFTPDriverFactory) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Chtimes: true, Chmod: true}
+}
+
+// clientConfig return the ssh config of upstream user
+func (factory *SFTPDriverFactory) clientConfig(user string) (*ssh.ClientConfig, error) {
+	if len(factory.knownHostsFile) == 0 {
+		return nil, errors.New("sftp driver needs a known hosts file to verify the upstream server")
+	}
+	hostKeyCallback, err := knownhosts.New(factory.knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	var auth []ssh.AuthMethod
+	if len(factory.keyFile) > 0 {
+		data, err := ioutil.ReadFile(factory.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(factory.password) > 0 {
+		auth = append(auth, ssh.Password(factory.password))
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// NewDriver connect to the upstream server as the user mapped from user
+func (factory *SFTPDriverFactory) NewDriver(user string) (Driver, error) {
+	upstream, root := factory.user, filepath.ToSlash(filepath.Join(factory.root, homeName(user)))
+	if mapped, ok := factory.users[user]; ok && len(user) > 0 {
+		upstream, root = mapped, factory.root
+	}
+	config, err := factory.clientConfig(upstream)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", factory.addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	driver := &SFTPDriver{client: client, conn: conn}
+	if driver.root, err = driver.makeRoot(root); err != nil {
+		driver.Close()
+		return nil, err
+	}
+	return driver, nil
+}
+
+// SFTPDriver - driver of an upstream sftp server
+type SFTPDriver struct {
+	client *sftp.Client
+	conn   *ssh.Client
+	root   string
+}
+
+// makeRoot return the absolute path of root, created if not exist
+func (driver *SFTPDriver) makeRoot(root string) (string, error) {
+	if !strings.HasPrefix(root, "/") {
+		home, err := driver.client.Getwd()
+		if err != nil {
+			return "", err
+		}
+		root = filepath.ToSlash(filepath.Join(home, root))
+	}
+	if err := driver.client.MkdirAll(root); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// sftppath return upstream path joined with driver root path
+func (driver *SFTPDriver) sftppath(path string) string {
+	return filepath.ToSlash(filepath.Join(driver.root, jailpath(path)))
+}
+
+// Close close the sftp session and ssh connection
+func (driver *SFTPDriver) Close() error {
+	driver.client.Close()
+	return driver.conn.Close()
+}
+
+// Capabilities return the capabilities of sftp driver
+func (driver *SFTPDriver) Capabilities() DriverCapabilities {
+	return DriverCapabilities{Chtimes: true, Chmod: true}
+}
+
+// Stat return file information
+func (driver *SFTPDriver) Stat(path string) (FileInfo, error) {
+	info, err := driver.client.Stat(driver.sftppath(path))
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if path == "/" {
+		return &sftpFileInfo{info, "/"}, nil
+	}
+	return info, nil
+}
+
+// Chtimes change file access and modify time
+func (driver *SFTPDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return driver.client.Chtimes(driver.sftppath(path), atime, mtime)
+}
+
+// Chmod change file permission bits
+func (driver *SFTPDriver) Chmod(path string, mode os.FileMode) error {
+	return driver.client.Chmod(driver.sftppath(path), mode.Perm())
+}
+
+// DeleteDir delete dir
+func (driver *SFTPDriver) DeleteDir(path string) error {
+	return driver.client.RemoveDirectory(driver.sftppath(path))
+}
+
+// DeleteFile delete file
+func (driver *SFTPDriver) DeleteFile(path string) error {
+	return driver.client.Remove(driver.sftppath(path))
+}
+
+// Rename rename file or dir
+func (driver *SFTPDriver) Rename(from string, to string) error {
+	return driver.client.Rename(driver.sftppath(from), driver.sftppath(to))
+}
+
+// MakeDir make dir
+func (driver *SFTPDriver) MakeDir(path string) error {
+	return driver.client.Mkdir(driver.sftppath(path))
+}
+
+// ListDir return file list in dir
+func (driver *SFTPDriver) ListDir(path string, callback func(FileInfo) error) error {
+	infos, err := driver.client.ReadDir(driver.sftppath(path))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := callback(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFile return file size, file reader from offset
+func (driver *SFTPDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	f, err := driver.client.Open(driver.sftppath(path))
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return info.Size() - offset, f, nil
+}
+
+// PutFile put a file from reader, write at offset if offset > 0
+func (driver *SFTPDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	rpath := driver.sftppath(path)
+	if info, err := driver.client.Stat(rpath); err == nil && info.IsDir() {
+		return 0, errors.New("directory already exist")
+	}
+
+	flags := os.O_WRONLY
+	if offset <= 0 {
+		offset = 0
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	f, err := driver.client.OpenFile(rpath, flags)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, err
+	}
+	n, err := f.ReadFrom(reader)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// sftpFileInfo - sftp file information of another name, "/" of the root
+type sftpFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name return sftp file name
+func (s *sftpFileInfo) Name() string {
+	return s.name
+}
+
+// FileDriverFactory - file based driver factory
+type FileDriverFactory struct {
+	root           string
+	maxFilesPerDir int
+	snapshotList   bool
+	followSymlinks bool
+	dirMode        os.FileMode
+	inheritDirMode bool
+}
+
+// FileDriverOptions - options of file drivers
+type FileDriverOptions struct {
+	// MaxFilesPerDir limit the entries of a directory, 0 means no limit.
+	MaxFilesPerDir int
+	// SnapshotList read all entries of a directory before listing them.
+	SnapshotList bool
+	// FollowSymlinks show symlinks as their targets instead of links.
+	FollowSymlinks bool
+	// DirMode is the mode of new directories, 0 means os.ModePerm with umask.
+	DirMode os.FileMode
+	// InheritDirMode make new directories take the mode of their parent.
+	InheritDirMode bool
+}
+
+// NewFileDriverFactory return a file based driver factory
+func NewFileDriverFactory(root string) DriverFactory {
+	return NewFileDriverFactoryWithOptions(root, FileDriverOptions{})
+}
+
+// NewFileDriverFactoryWithOptions return a file based driver factory of the
+// files under root with opts
+func NewFileDriverFactoryWithOptions(root string, opts FileDriverOptions) DriverFactory {
+	_, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		os.MkdirAll(root, os.ModePerm)
+	} else if err != nil {
+		defaultLogger.Log(LogError, "new file driver factory fail", "root", root, "err", err)
+		os.Exit(-1)
+	}
+	return &FileDriverFactory{
+		root:           root,
+		maxFilesPerDir: opts.MaxFilesPerDir,
+		snapshotList:   opts.SnapshotList,
+		followSymlinks: opts.FollowSymlinks,
+		dirMode:        opts.DirMode,
+		inheritDirMode: opts.InheritDirMode,
+	}
+}
+
+// FileDriver - file based driver
+type FileDriver struct {
+	root           string
+	maxFilesPerDir int
+	snapshotList   bool
+	followSymlinks bool
+	dirMode        os.FileMode
+	inheritDirMode bool
+}
+
+// NewDriver return a file based driver
+func (factory *FileDriverFactory) NewDriver(user string) (Driver, error) {
+	var err error
+	root, err := filepath.Abs(filepath.Join(factory.root, user))
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(root)
+	if os.IsNotExist(err) {
+		os.MkdirAll(root, os.ModePerm)
+	} else if err != nil {
+		return nil, err
+	}
+	return &FileDriver{root, factory.maxFilesPerDir, factory.snapshotList, factory.followSymlinks, factory.dirMode, factory.inheritDirMode}, nil
+}
+
+// abspath return abs path joined with driver root path
+func (driver *FileDriver) abspath(path string) string {
+	return filepath.Join(driver.root, jailpath(path))
+}
+
+// jailpath return path cleaned as if rooted at "/", so ".." never climbs
+// above the root of driver into the data of other users.
+func jailpath(path string) string {
+	return filepath.Clean("/" + filepath.ToSlash(path))
+}
+
+// checkDirFull return ErrTooManyFiles if creating rpath would exceed
+// the entries limit of its parent directory.
+func (driver *FileDriver) checkDirFull(rpath string) error {
+	if driver.maxFilesPerDir <= 0 {
+		return nil
+	}
+	if _, err := os.Lstat(rpath); err == nil {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(rpath))
+	if err != nil {
+		return nil
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(driver.maxFilesPerDir)
+	if len(names) >= driver.maxFilesPerDir {
+		return ErrTooManyFiles
+	}
+	return nil
+}
+
+// Stat return file information
+func (driver *FileDriver) Stat(path string) (FileInfo, error) {
+	rpath := driver.abspath(path)
+	info, err := os.Lstat(rpath)
+	if err != nil {
+		return nil, err
+	}
+	return driver.linkInfo(rpath, info), nil
+}
+
+// linkInfo return the information of a symlink as its target when
+// following symlinks, or with its target otherwise, a broken symlink
+// is always shown as link.
+func (driver *FileDriver) linkInfo(rpath string, info os.FileInfo) FileInfo {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return info
+	}
+	if driver.followSymlinks {
+		if target, err := os.Stat(rpath); err == nil {
+			return &followFileInfo{target, info.Name()}
+		}
+	}
+	target, err := os.Readlink(rpath)
+	if err != nil {
+		return info
+	}
+	return &linkFileInfo{info, target}
+}
+
+// Chtimes change file modify time
+func (driver *FileDriver) Chtimes(path string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(driver.abspath(path), atime, mtime)
+}
+
+// Chmod change file mode
+func (driver *FileDriver) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(driver.abspath(path), mode)
+}
+
+// DeleteDir delete a dir
+func (driver *FileDriver) DeleteDir(path string) error {
+	rpath := driver.abspath(path)
+	fi, err := os.Lstat(rpath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.RemoveAll(rpath)
+	}
+	return errors.New("not a directory")
+}
+
+// DeleteFile delete a file
+func (driver *FileDriver) DeleteFile(path string) error {
+	rpath := driver.abspath(path)
+	fi, err := os.Lstat(rpath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.Remove(rpath)
+	}
+	return errors.New("not a file")
+}
+
+// Rename rename a file or dir
+func (driver *FileDriver) Rename(from string, to string) error {
+	frpath := driver.abspath(from)
+	trpath := driver.abspath(to)
+	// a rename in the same dir does not add an entry.
+	if filepath.Dir(frpath) != filepath.Dir(trpath) {
+		if err := driver.checkDirFull(trpath); err != nil {
+			return err
+		}
+	}
+	return os.Rename(frpath, trpath)
+}
+
+// MakeDir make a dir
+func (driver *FileDriver) MakeDir(path string) error {
+	rpath := driver.abspath(path)
+	if err := driver.checkDirFull(rpath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rpath, os.ModePerm); err != nil {
+		return err
+	}
+
+	mode := driver.dirMode
+	if driver.inheritDirMode {
+		parent, err := os.Stat(filepath.Dir(rpath))
+		if err != nil {
+			return err
+		}
+		mode = parent.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if mode == 0 {
+		return nil
+	}
+	// chmod as the mode of mkdir is masked by umask.
+	return os.Chmod(rpath, mode)
+}
+
+// parseDirMode parse an octal mode like 2775 or "inherit", an empty
+// mode means the default one.
+func parseDirMode(s string) (os.FileMode, bool, error) {
+	if len(s) == 0 {
+		return 0, false, nil
+	}
+	if s == "inherit" {
+		return 0, true, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 07777 {
+		return 0, false, fmt.Errorf("invalid dir mode %s", s)
+	}
+	mode := os.FileMode(v & 0777)
+	if v&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if v&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if v&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, false, nil
+}
+
+// GetFile return file size, file reader
+func (driver *FileDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	f, err := os.Open(driver.abspath(path))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err != nil && f != nil {
+			f.Close()
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return fi.Size() - offset, f, nil
+}
+
+// PutFile put a file, support append with offset.
+func (driver *FileDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	rpath := driver.abspath(path)
+
+	fi, err := os.Lstat(rpath)
+	if err == nil && fi.IsDir() {
+		return 0, errors.New("directory already exist")
+	}
+
+	ff := os.O_WRONLY
+	if offset > 0 {
+		ff |= os.O_APPEND
+	} else {
+		if err := driver.checkDirFull(rpath); err != nil {
+			return 0, err
+		}
+		ff |= os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(rpath, ff, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return io.Copy(f, reader)
+}
+
+// ListDir return file list in dir
+func (driver *FileDriver) ListDir(path string, callback func(FileInfo) error) error {
+	rpath := driver.abspath(path)
+	if driver.snapshotList {
+		return driver.listSnapshot(rpath, callback)
+	}
+	return filepath.Walk(rpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == rpath && !info.IsDir() {
+			// a file is listed as itself.
+			return callback(driver.linkInfo(path, info))
+		}
+		name, _ := filepath.Rel(rpath, path)
+		if name == info.Name() {
+			err = callback(driver.linkInfo(path, info))
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+}
+
+// listSnapshot read all entry names of rpath at once then list them,
+// entries removed in the meantime are skipped instead of failing the
+// listing, a file is listed as itself.
+func (driver *FileDriver) listSnapshot(rpath string, callback func(FileInfo) error) error {
+	info, err := os.Stat(rpath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return callback(info)
+	}
+
+	dir, err := os.Open(rpath)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(rpath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = callback(driver.linkInfo(filepath.Join(rpath, name), info)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bandwidthLimiter - share a total bandwidth among transfers by weight
+type bandwidthLimiter struct {
+	rate   float64
+	lock   sync.Mutex
+	weight int
+}
+
+// bandwidthFlow - a transfer drawing from the shared bandwidth
+type bandwidthFlow struct {
+	limiter *bandwidthLimiter
+	weight  int
+	tokens  float64
+	last    time.Time
+}
+
+// newBandwidthLimiter return a limiter of kbps total bandwidth
+func newBandwidthLimiter(kbps int) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(kbps) * 1024}
+}
+
+// setRate change the total bandwidth to kbps
+func (limiter *bandwidthLimiter) setRate(kbps int) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.rate = float64(kbps) * 1024
+}
+
+// open start a flow with weight
+func (limiter *bandwidthLimiter) open(weight int) *bandwidthFlow {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.weight += weight
+	return &bandwidthFlow{limiter: limiter, weight: weight, last: time.Now()}
+}
+
+// share return the bytes per second of a flow with weight
+func (limiter *bandwidthLimiter) share(weight int) float64 {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.rate * float64(weight) / float64(limiter.weight)
+}
+
+// close stop the flow and give its share back to others
+func (flow *bandwidthFlow) close() {
+	flow.limiter.lock.Lock()
+	defer flow.limiter.lock.Unlock()
+	flow.limiter.weight -= flow.weight
+}
+
+// wait block until n bytes are allowed by the flow share, at most one
+// second of unused share is saved for bursts.
+func (flow *bandwidthFlow) wait(n int) {
+	share := flow.limiter.share(flow.weight)
+	now := time.Now()
+	flow.tokens += now.Sub(flow.last).Seconds() * share
+	if flow.tokens > share {
+		flow.tokens = share
+	}
+	flow.last = now
+	flow.tokens -= float64(n)
+	if flow.tokens < 0 {
+		time.Sleep(time.Duration(-flow.tokens / share * float64(time.Second)))
+	}
+}
+
+// bandwidthReader - reader limited by a bandwidth flow
+type bandwidthReader struct {
+	reader io.Reader
+	flow   *bandwidthFlow
+}
+
+func (r *bandwidthReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.flow.wait(n)
+	}
+	return n, err
+}
+
+// countReader - reader adding the bytes read to a counter, atomically as
+// the counter may be read by another goroutine.
+type countReader struct {
+	reader io.Reader
+	n      *int64
+}
+
+// Read read from reader and count the bytes
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// bandwidthWriter - writer limited by a bandwidth flow
+type bandwidthWriter struct {
+	writer io.Writer
+	flow   *bandwidthFlow
+}
+
+func (w *bandwidthWriter) Write(p []byte) (int, error) {
+	w.flow.wait(len(p))
+	return w.writer.Write(p)
+}
+
+// throttleLimiters - the Throttle bandwidth of users, one limiter of each
+// direction for a user shared by its sessions, so opening more sessions
+// does not get a user more bandwidth.
+type throttleLimiters struct {
+	lock     sync.Mutex
+	limiters map[throttleKey]*bandwidthLimiter
+}
+
+// throttleKey - a user and the direction of its transfers
+type throttleKey struct {
+	user   string
+	upload bool
+}
+
+func newThrottleLimiters() *throttleLimiters {
+	return &throttleLimiters{limiters: make(map[throttleKey]*bandwidthLimiter)}
+}
+
+// open start a flow of a transfer of user limited to kbps in total with
+// the other transfers of user in the same direction.
+func (tl *throttleLimiters) open(user string, upload bool, kbps int) *bandwidthFlow {
+	tl.lock.Lock()
+	key := throttleKey{user, upload}
+	limiter, ok := tl.limiters[key]
+	if !ok {
+		limiter = newBandwidthLimiter(kbps)
+		tl.limiters[key] = limiter
+	}
+	tl.lock.Unlock()
+	// the limit may have changed by reload or by another login.
+	limiter.setRate(kbps)
+	return limiter.open(1)
+}
+
+// ErrQuotaExceeded - an upload over the quota of user
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaUsage - bytes and files used by a user
+type quotaUsage struct {
+	bytes int64
+	files int
+}
+
+// portPool - passive ports in use, shared by sessions, ports of a range
+// are handed out in turn so a released port is reused as late as possible
+type portPool struct {
+	lock sync.Mutex
+	used map[int]bool
+	next map[int]int
+}
+
+func newPortPool() *portPool {
+	return &portPool{used: make(map[int]bool), next: make(map[int]int)}
+}
+
+// listen listen the next free port of range on ip, the port is in use
+// until released, ports bound by other programs are skipped.
+func (pp *portPool) listen(ip net.IP, start, end int) (*net.TCPListener, error) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	port, ok := pp.next[start]
+	if !ok || port > end {
+		port = start
+	}
+	for i := start; i <= end; i++ {
+		if !pp.used[port] {
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+			if err == nil {
+				pp.used[port] = true
+				pp.next[start] = port + 1
+				return listener, nil
+			}
+		}
+		if port++; port > end {
+			port = start
+		}
+	}
+	return nil, errors.New("no available listening port")
+}
+
+// release make port available again
+func (pp *portPool) release(port int) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	delete(pp.used, port)
+}
+
+// quotaManager - track the usage of users with quota, shared by sessions
+type quotaManager struct {
+	lock  sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+// newQuotaManager return an empty quota manager
+func newQuotaManager() *quotaManager {
+	return &quotaManager{usage: make(map[string]*quotaUsage)}
+}
+
+// set replace the usage of user
+func (qm *quotaManager) set(user string, bytes int64, files int) {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+	qm.usage[user] = &quotaUsage{bytes, files}
+}
+
+// add change the usage of user by bytes and files, if the usage is known
+func (qm *quotaManager) add(user string, bytes int64, files int) {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+	if usage, ok := qm.usage[user]; ok {
+		usage.bytes += bytes
+		usage.files += files
+	}
+}
+
+// get return the usage of user, false if unknown
+func (qm *quotaManager) get(user string) (int64, int, bool) {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+	if usage, ok := qm.usage[user]; ok {
+		return usage.bytes, usage.files, true
+	}
+	return 0, 0, false
+}
+
+// reserve charge user for an upload creating a file if create, or
+// replacing replaced bytes, so concurrent uploads never overshoot the
+// limits. It return nil if the usage is unknown, false if over quota.
+func (qm *quotaManager) reserve(user string, create bool, replaced, maxBytes int64, maxFiles int) (*quotaReservation, bool) {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+	usage, ok := qm.usage[user]
+	if !ok {
+		return nil, true
+	}
+	if create && maxFiles > 0 && usage.files >= maxFiles {
+		return nil, false
+	}
+	if maxBytes > 0 && usage.bytes-replaced > maxBytes {
+		return nil, false
+	}
+	res := &quotaReservation{qm: qm, user: user, maxBytes: maxBytes, bytes: -replaced}
+	if create {
+		res.files = 1
+	}
+	usage.bytes += res.bytes
+	usage.files += res.files
+	return res, true
+}
+
+// quotaReservation - the usage charged for an upload in progress
+type quotaReservation struct {
+	qm       *quotaManager
+	user     string
+	maxBytes int64
+	bytes    int64
+	files    int
+}
+
+// take charge at most want bytes within the byte quota, return the bytes
+// charged.
+func (res *quotaReservation) take(want int64) int64 {
+	res.qm.lock.Lock()
+	defer res.qm.lock.Unlock()
+	usage, ok := res.qm.usage[res.user]
+	if !ok {
+		return want
+	}
+	if res.maxBytes > 0 && usage.bytes+want > res.maxBytes {
+		want = res.maxBytes - usage.bytes
+		if want < 0 {
+			want = 0
+		}
+	}
+	usage.bytes += want
+	res.bytes += want
+	return want
+}
+
+// settle replace the usage charged by the actual change of the upload
+func (res *quotaReservation) settle(bytes int64, files int) {
+	res.qm.add(res.user, bytes-res.bytes, files-res.files)
+	res.bytes, res.files = bytes, files
+}
+
+// uploadTracker - uploads in progress and interrupted ones kept to be
+// resumed, shared by sessions and keyed by home and path of file
+type uploadTracker struct {
+	lock    sync.Mutex
+	uploads map[string]*trackedUpload
+}
+
+// trackedUpload - an upload and the timer deleting it if interrupted
+type trackedUpload struct {
+	Upload
+	timer *time.Timer
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: make(map[string]*trackedUpload)}
+}
+
+// start record an upload in progress, return the size of the interrupted
+// upload of the file it resumes if any.
+func (ut *uploadTracker) start(key, user, path string) (int64, bool) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	var size int64
+	old, ok := ut.uploads[key]
+	resumed := ok && old.Partial
+	if resumed {
+		old.timer.Stop()
+		size = old.Size
+	}
+	ut.uploads[key] = &trackedUpload{Upload: Upload{User: user, Path: path, Started: time.Now()}}
+	return size, resumed
+}
+
+// interrupt keep an interrupted upload of size for timeout, cleanup is
+// called if it is not resumed by then.
+func (ut *uploadTracker) interrupt(key string, size int64, timeout time.Duration, cleanup func()) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	upload, ok := ut.uploads[key]
+	if !ok {
+		return
+	}
+	upload.Partial = true
+	upload.Size = size
+	upload.timer = time.AfterFunc(timeout, func() {
+		ut.lock.Lock()
+		expired := ut.uploads[key] == upload
+		if expired {
+			delete(ut.uploads, key)
+		}
+		ut.lock.Unlock()
+		if expired {
+			cleanup()
+		}
+	})
+}
+
+// partial return whether key is an interrupted upload of user
+func (ut *uploadTracker) partial(key, user string) bool {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	upload, ok := ut.uploads[key]
+	return ok && upload.Partial && upload.User == user
+}
+
+// finish untrack an upload in progress, an interrupted one is kept
+func (ut *uploadTracker) finish(key string) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	if upload, ok := ut.uploads[key]; ok && !upload.Partial {
+		delete(ut.uploads, key)
+	}
+}
+
+// list return the uploads in progress and interrupted, sorted by start
+func (ut *uploadTracker) list() []Upload {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	uploads := make([]Upload, 0, len(ut.uploads))
+	for _, upload := range ut.uploads {
+		uploads = append(uploads, upload.Upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Started.Before(uploads[j].Started) })
+	return uploads
+}
+
+// loginBans - failed logins and bans of ips
+type loginBans struct {
+	lock     sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]time.Time
+}
+
+// newLoginBans return empty login bans
+func newLoginBans() *loginBans {
+	return &loginBans{failures: make(map[string][]time.Time), bans: make(map[string]time.Time)}
+}
+
+// fail record a failed login of ip, ban it for banTime if it fails
+// maxFailures times in findTime, return whether it is banned.
+func (lb *loginBans) fail(ip string, maxFailures int, findTime, banTime time.Duration) bool {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	now := time.Now()
+	for k, times := range lb.failures {
+		for len(times) > 0 && now.Sub(times[0]) > findTime {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(lb.failures, k)
+		} else {
+			lb.failures[k] = times
+		}
+	}
+	times := append(lb.failures[ip], now)
+	if len(times) < maxFailures {
+		lb.failures[ip] = times
+		return false
+	}
+	delete(lb.failures, ip)
+	lb.bans[ip] = now.Add(banTime)
+	return true
+}
+
+// succeed forget the failed logins of ip
+func (lb *loginBans) succeed(ip string) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	delete(lb.failures, ip)
+}
+
+// banned return whether ip is banned now
+func (lb *loginBans) banned(ip string) bool {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	until, ok := lb.bans[ip]
+	if ok && time.Now().After(until) {
+		delete(lb.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// list return the bans not expired, sorted by ip
+func (lb *loginBans) list() []Ban {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(lb.bans))
+	for ip, until := range lb.bans {
+		if now.After(until) {
+			delete(lb.bans, ip)
+			continue
+		}
+		bans = append(bans, Ban{ip, until})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// unban lift the ban of ip, return false if not banned
+func (lb *loginBans) unban(ip string) bool {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	delete(lb.failures, ip)
+	_, ok := lb.bans[ip]
+	delete(lb.bans, ip)
+	return ok
+}
+
+// quotaReader - reader charging the bytes read to a reservation before
+// reading them, failing with ErrQuotaExceeded past the byte quota
+type quotaReader struct {
+	reader   io.Reader
+	res      *quotaReservation
+	exceeded bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.res == nil {
+		return r.reader.Read(p)
+	}
+	allowed := r.res.take(int64(len(p)))
+	if allowed == 0 {
+		// probe for one more byte, an upload of exactly the quota is fine.
+		var b [1]byte
+		n, err := r.reader.Read(b[:])
+		if n > 0 {
+			r.exceeded = true
+			return 0, ErrQuotaExceeded
+		}
+		return 0, err
+	}
+	n, err := r.reader.Read(p[:allowed])
+	if int64(n) < allowed {
+		r.res.take(int64(n) - allowed)
+	}
+	return n, err
+}
+
+// FtpdHandler - ftpd handler
+type FtpdHandler struct {
+	UserBeforeLogin func(string, string) bool
+	UserAfterLogin  func(string)
+
+	ClientBeforePasv func(string) bool
+	ClientBeforePort func(string) bool
+
+	FileBeforePut func(string, string) bool
+	FileAfterPut  func(string, string)
+
+	FileBeforeGet func(string, string) bool
+	FileAfterGet  func(string, string)
+
+	FileBeforeDelete func(string, string) bool
+	FileAfterDelete  func(string, string)
+
+	FileBeforeRename func(string, string, string) bool
+	FileAfterRename  func(string, string, string)
+
+	TransferComplete func(string, string, int64) error
+}
+
+// Version - kftpd version, set by -ldflags "-X github.com/zhoukk/kftpd.Version=..."
+var Version = "dev"
+
+// BuildTime - kftpd build time, set by -ldflags "-X github.com/zhoukk/kftpd.BuildTime=..."
+var BuildTime = ""
+
+// ftpHandler - ftpd global handler, used by servers without their own
+var ftpHandler FtpdHandler
+
+// FtpConn - ftp session
+type FtpConn struct {
+	// bytesIn and bytesOut are first to be 64-bit aligned for atomic.
+	bytesIn  int64
+	bytesOut int64
+
+	id        int
+	cmd       string
+	arg       string
+	user      string
+	path      string
+	mode      string
+	typeA     bool
+	clnt      string
+	remote    string
+	connected time.Time
+	rename    string
+	authd     bool
+	tls       bool
+	pbsz      bool
+	protP     bool
+	certUser  string
+	host      string
+	hostBase  *FtpdConfig
+	hostAuth  Authenticator
+	offset    int64
+	config    *FtpdConfig
+	tlsConfig *tls.Config
+	factory   DriverFactory
+	driver    Driver
+	ctrlConn  net.Conn
+	dataConn  net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	lock      sync.Mutex
+	pasvPort  int
+	notify    chan int
+	flow      *bandwidthFlow
+	throttle  *bandwidthFlow
+
+	conn         net.Conn
+	server       *Server
+	stateLock    sync.Mutex
+	busy         bool
+	pasvListener *net.TCPListener
+	goroutines   int
+	sendLock     sync.Mutex
+	logLock      sync.Mutex
+	loginUser    string
+	handler      *FtpdHandler
+	ctx          context.Context
+	cancel       context.CancelFunc
+	epsvAll      bool
+	lines        chan ctrlLine
+	resume       chan struct{}
+	activeConn   net.Conn
+	aborted      bool
+	abortHash    context.CancelFunc
+	logger       Logger
+	quota        *quotaManager
+	throttles    *throttleLimiters
+	ports        *portPool
+	uploads      *uploadTracker
+	account      *FtpdUser
+	modeZ        bool
+	zlevel       int
+	hashAlgo     string
+	mlstOpts     map[string]bool
+}
+
+// ctrlLine - a command line read from control connection, pause means the
+// reader waits for resume before reading on, as AUTH replaces the reader.
+type ctrlLine struct {
+	line  string
+	pause bool
+	err   error
+}
+
+// FtpCmd - ftp command handler
+type FtpCmd struct {
+	Fn   func(*FtpConn) error
+	Auth bool
+}
+
+var siteCmdMap map[string]func(*FtpConn, string) error
+
+func init() {
+	// initialized here as SITE HELP refers to the map itself
+	siteCmdMap = map[string]func(*FtpConn, string) error{
+		"CHMOD":   (*FtpConn).handleSiteCHMOD,
+		"GETURL":  (*FtpConn).handleSiteGETURL,
+		"HELP":    (*FtpConn).handleSiteHELP,
+		"KICK":    (*FtpConn).handleSiteKICK,
+		"QUOTA":   (*FtpConn).handleSiteQUOTA,
+		"VERSION": (*FtpConn).handleSiteVERSION,
+		"WHO":     (*FtpConn).handleSiteWHO,
+	}
+}
+
+var optsMap = map[string]func(*FtpConn, string) error{
+	"CSID": (*FtpConn).handleOptsCSID,
+	"MODE": (*FtpConn).handleOptsMODE,
+	"HASH": (*FtpConn).handleOptsHASH,
+	"MLST": (*FtpConn).handleOptsMLST,
+	"UTF8": (*FtpConn).handleOptsUTF8,
+}
+
+// writeCmds - commands refused for read-only users
+var writeCmds = map[string]bool{
+	"STOR": true,
+	"APPE": true,
+	"DELE": true,
+	"RNFR": true,
+	"RNTO": true,
+	"MKD":  true,
+	"XMKD": true,
+	"RMD":  true,
+	"XRMD": true,
+	"MFMT": true,
+}
+
+// permCmds - commands allowed by a permission flag of user, an unset
+// flag allows the command
+var permCmds = map[string]func(FtpdUser) *bool{
+	"STOR":    func(user FtpdUser) *bool { return user.CanUpload },
+	"APPE":    func(user FtpdUser) *bool { return user.CanUpload },
+	"RETR":    func(user FtpdUser) *bool { return user.CanDownload },
+	"DELE":    func(user FtpdUser) *bool { return user.CanDelete },
+	"RMD":     func(user FtpdUser) *bool { return user.CanDelete },
+	"XRMD":    func(user FtpdUser) *bool { return user.CanDelete },
+	"RNFR":    func(user FtpdUser) *bool { return user.CanRename },
+	"RNTO":    func(user FtpdUser) *bool { return user.CanRename },
+	"XCRC":    func(user FtpdUser) *bool { return user.CanDownload },
+	"XMD5":    func(user FtpdUser) *bool { return user.CanDownload },
+	"XSHA1":   func(user FtpdUser) *bool { return user.CanDownload },
+	"XSHA256": func(user FtpdUser) *bool { return user.CanDownload },
+	"HASH":    func(user FtpdUser) *bool { return user.CanDownload },
+	"MKD":     func(user FtpdUser) *bool { return user.CanMkdir },
+	"XMKD":    func(user FtpdUser) *bool { return user.CanMkdir },
+	"LIST":    func(user FtpdUser) *bool { return user.CanList },
+	"NLST":    func(user FtpdUser) *bool { return user.CanList },
+	"MLSD":    func(user FtpdUser) *bool { return user.CanList },
+	"MLST":    func(user FtpdUser) *bool { return user.CanList },
+}
+
+var cmdMap = map[string]FtpCmd{
+	// Authentication
+	"USER": {(*FtpConn).handleUSER, false},
+	"PASS": {(*FtpConn).handlePASS, false},
+
+	// TLS handling
+	"AUTH": {(*FtpConn).handleAUTH, false},
+	"PROT": {(*FtpConn).handlePROT, false},
+	"PBSZ": {(*FtpConn).handlePBSZ, false},
+
+	// Virtual host
+	"HOST": {(*FtpConn).handleHOST, false},
+
+	// Misc
+	"CLNT": {(*FtpConn).handleCLNT, false},
+	"FEAT": {(*FtpConn).handleFEAT, false},
+	"SYST": {(*FtpConn).handleSYST, false},
+	"NOOP": {(*FtpConn).handleNOOP, false},
+	"OPTS": {(*FtpConn).handleOPTS, false},
+	"QUIT": {(*FtpConn).handleQUIT, false},
+	"ABOR": {(*FtpConn).handleABOR, true},
+
+	// File access
+	"SIZE":    {(*FtpConn).handleSIZE, true},
+	"STAT":    {(*FtpConn).handleSTAT, true},
+	"MDTM":    {(*FtpConn).handleMDTM, true},
+	"MFMT":    {(*FtpConn).handleMFMT, true},
+	"RETR":    {(*FtpConn).handleRETR, true},
+	"STOR":    {(*FtpConn).handleSTOR, true},
+	"APPE":    {(*FtpConn).handleAPPE, true},
+	"DELE":    {(*FtpConn).handleDELE, true},
+	"RNFR":    {(*FtpConn).handleRNFR, true},
+	"RNTO":    {(*FtpConn).handleRNTO, true},
+	"ALLO":    {(*FtpConn).handleALLO, true},
+	"REST":    {(*FtpConn).handleREST, true},
+	"SITE":    {(*FtpConn).handleSITE, true},
+	"HASH":    {(*FtpConn).handleHASH, true},
+	"XCRC":    {(*FtpConn).handleXCRC, true},
+	"XMD5":    {(*FtpConn).handleXMD5, true},
+	"XSHA1":   {(*FtpConn).handleXSHA1, true},
+	"XSHA256": {(*FtpConn).handleXSHA256, true},
+
+	// Directory handling
+	"CWD":  {(*FtpConn).handleCWD, true},
+	"PWD":  {(*FtpConn).handlePWD, true},
+	"CDUP": {(*FtpConn).handleCDUP, true},
+	"NLST": {(*FtpConn).handleNLST, true},
+	"LIST": {(*FtpConn).handleLIST, true},
+	"MLSD": {(*FtpConn).handleMLSD, true},
+	"MLST": {(*FtpConn).handleMLST, true},
+	"MKD":  {(*FtpConn).handleMKD, true},
+	"XMKD": {(*FtpConn).handleMKD, true},
+	"RMD":  {(*FtpConn).handleRMD, true},
+	"XRMD": {(*FtpConn).handleRMD, true},
+
+	// Connection handling
+	"TYPE": {(*FtpConn).handleTYPE, true},
+	"MODE": {(*FtpConn).handleMODE, true},
+	"PASV": {(*FtpConn).handlePASV, true},
+	"EPSV": {(*FtpConn).handleEPSV, true},
+	"EPRT": {(*FtpConn).handleEPRT, true},
+	"PORT": {(*FtpConn).handlePORT, true},
+}
+
+func (fc *FtpConn) handleUSER() error {
+	if fc.tlsRequired() {
+		return nil
+	}
+	// a new USER starts over the login, drop anything of the previous one.
+	fc.authd = false
+	fc.setLoginUser("")
+	fc.account = nil
+	if fc.driver != nil {
+		closeDriver(fc.driver)
+	}
+	fc.driver = nil
+	fc.path = "/"
+	fc.offset = 0
+	fc.CloseFileTransfer()
+	fc.logLock.Lock()
+	fc.user = fc.arg
+	fc.logLock.Unlock()
+	if len(fc.certUser) > 0 && fc.user == fc.certUser && fc.handler.UserBeforeLogin == nil {
+		if ok, err := fc.certLogin(); err != nil {
+			fc.log(LogWarn, "authenticate fail", "err", err)
+		} else if ok {
+			return fc.loginSucceeded(232, "User logged in, authorized by certificate.")
+		}
+	}
+	fc.Send(331, "Please specify the password.")
+	return nil
+}
+
+// certLogin return whether the user named by the verified client
+// certificate may log in without PASS by CertLogin of its settings
+func (fc *FtpConn) certLogin() (bool, error) {
+	auth := fc.loginAuthenticator()
+	if store, ok := auth.(UserStore); ok {
+		account, err := store.LoadUser(fc.user)
+		if err != nil || account == nil || !account.CertLogin {
+			return false, err
+		}
+		fc.account = account
+	} else if _, ok := auth.(*ConfigAuthenticator); !ok {
+		// the others verify a password only.
+		return false, nil
+	} else if user, ok := fc.config.Users[fc.user]; !ok || !user.CertLogin {
+		return false, nil
+	}
+	if !fc.networkAllowed() {
+		fc.log(LogWarn, "login from network not allowed", "ip", fc.remoteIP())
+		fc.account = nil
+		return false, nil
+	}
+	return true, nil
+}
+
+func (fc *FtpConn) handlePASS() error {
+	if fc.tlsRequired() {
+		return nil
+	}
+	loginOk := false
+	if fc.handler.UserBeforeLogin != nil {
+		loginOk = fc.handler.UserBeforeLogin(fc.user, fc.arg)
+	} else {
+		ok, err := fc.login(fc.loginAuthenticator())
+		if err != nil {
+			fc.log(LogWarn, "authenticate fail", "err", err)
+		}
+		loginOk = ok && err == nil
+	}
+	if loginOk && !fc.networkAllowed() {
+		fc.log(LogWarn, "login from network not allowed", "ip", fc.remoteIP())
+		fc.account = nil
+		loginOk = false
+	}
+	if !loginOk && fc.loginFailed() {
+		fc.Send(421, "Too many failed logins, try again later.")
+		fc.Close()
+		return ErrSessionClosed
+	}
+	if loginOk {
+		return fc.loginSucceeded(230, "Login successful.")
+	}
+	fc.Send(530, "Login incorrect.")
+	return nil
+}
+
+// loginAuthenticator return the authenticator of login, the one of the
+// virtual host if it has its own users or AuthFile, then the one of
+// server, then Users.
+func (fc *FtpConn) loginAuthenticator() Authenticator {
+	if authenticator != nil {
+		return authenticator
+	}
+	if fc.hostAuth != nil {
+		return fc.hostAuth
+	}
+	if fc.server != nil {
+		if auth := fc.server.authenticator(); auth != nil {
+			return auth
+		}
+	}
+	return &ConfigAuthenticator{fc.config}
+}
+
+func (fc *FtpConn) handleHOST() error {
+	if fc.authd || len(fc.user) > 0 {
+		fc.Send(503, "HOST must be sent before USER.")
+		return nil
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(fc.arg, "["), "]")
+	base := fc.hostBase
+	if base == nil {
+		base = fc.config
+	}
+	if len(base.VirtualHosts) == 0 {
+		// a single site serves any host name.
+		fc.host = name
+		fc.Send(220, "Host accepted.")
+		return nil
+	}
+	config := base.virtualHost(name)
+	if config == nil {
+		fc.Send(504, "Unknown host.")
+		return nil
+	}
+
+	factory := fc.factory
+	if base.Driver != "custom" {
+		var err error
+		if factory, err = newConfigDriverFactory(config); err != nil {
+			fc.Send(451, "Requested action aborted: local error in processing.")
+			return err
+		}
+	}
+	var auth Authenticator
+	if len(config.AuthFile) > 0 {
+		var err error
+		if auth, err = NewHtpasswdAuthenticator(config.AuthFile); err != nil {
+			fc.Send(451, "Requested action aborted: local error in processing.")
+			return err
+		}
+	} else if len(base.VirtualHosts[strings.ToLower(name)].Users) > 0 {
+		auth = &ConfigAuthenticator{config}
+	}
+
+	fc.hostBase = base
+	fc.host = strings.ToLower(name)
+	fc.config = config
+	fc.factory = factory
+	fc.hostAuth = auth
+	if fc.tlsConfig != nil && fc.server != nil {
+		// the certificate of the host for clients sending no SNI.
+		tlsConfig := fc.tlsConfig.Clone()
+		host := fc.host
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if len(hello.ServerName) == 0 {
+				named := *hello
+				named.ServerName = host
+				hello = &named
+			}
+			return fc.server.getCertificate(hello)
+		}
+		fc.tlsConfig = tlsConfig
+	}
+	fc.log(LogInfo, "virtual host", "host", fc.host)
+	if len(config.Banner) > 0 && config.Banner != base.Banner {
+		fc.Send(220, config.Banner)
+	} else {
+		fc.Send(220, "Host accepted.")
+	}
+	return nil
+}
+
+// hostKey return key prefixed by the virtual host if any, for the state
+// shared by the server such as quota and uploads.
+func (fc *FtpConn) hostKey(key string) string {
+	if len(fc.host) == 0 || fc.hostBase == nil {
+		return key
+	}
+	return fc.host + ":" + key
+}
+
+// tlsRequired reply 550 if AuthTLS Force but the control connection is
+// plaintext, so credentials are never sent in the clear.
+func (fc *FtpConn) tlsRequired() bool {
+	if !fc.config.AuthTLS.Force || fc.tls {
+		return false
+	}
+	fc.Send(550, "Use AUTH TLS first.")
+	return true
+}
+
+// loginSucceeded open the driver of the user logged in and reply code with
+// the login message if any.
+func (fc *FtpConn) loginSucceeded(code int, reply string) error {
+	if fc.server != nil {
+		fc.server.bans.succeed(fc.remoteIP())
+	}
+	if !fc.config.LazyDriver {
+		if err := fc.openDriver(); err != nil {
+			fc.Send(421, "Service not available, closing control connection.")
+			fc.Close()
+			return err
+		}
+	}
+	fc.authd = true
+	fc.setLoginUser(fc.user)
+	fc.sendMessage(code, fc.loginMessage(), reply)
+	if fc.handler.UserAfterLogin != nil {
+		fc.handler.UserAfterLogin(fc.user)
+	}
+	return nil
+}
+
+// loginFailed record a failed login of client, delay the reply by
+// FailDelay unless the session is closed meanwhile, return whether the
+// client ip is banned.
+func (fc *FtpConn) loginFailed() bool {
+	ban := fc.config.LoginBan
+	if ban.FailDelay > 0 {
+		timer := time.NewTimer(time.Duration(ban.FailDelay) * time.Second)
+		select {
+		case <-timer.C:
+		case <-fc.ctx.Done():
+			timer.Stop()
+		}
+	}
+	if fc.server == nil || ban.MaxFailures <= 0 {
+		return false
+	}
+	ip := fc.remoteIP()
+	if !fc.server.bans.fail(ip, ban.MaxFailures, time.Duration(ban.FindTime)*time.Second, time.Duration(ban.BanTime)*time.Second) {
+		return false
+	}
+	fc.log(LogWarn, "ban ip for failed logins", "ip", ip, "seconds", ban.BanTime)
+	return true
+}
+
+// networkAllowed return whether the client ip is in AllowedNetworks of
+// user if any
+func (fc *FtpConn) networkAllowed() bool {
+	user, ok := fc.userConfig()
+	if !ok || len(user.AllowedNetworks) == 0 {
+		return true
+	}
+	nets, err := parseNetworks(user.AllowedNetworks)
+	if err != nil {
+		fc.log(LogWarn, "bad AllowedNetworks", "err", err)
+		return false
+	}
+	return networksContain(nets, fc.remoteIP())
+}
+
+// remoteIP return the ip of client
+func (fc *FtpConn) remoteIP() string {
+	ip, _, _ := net.SplitHostPort(fc.conn.RemoteAddr().String())
+	return ip
+}
+
+// login authenticate user by auth, keep the settings of user from a user
+// store or login authenticator
+func (fc *FtpConn) login(auth Authenticator) (bool, error) {
+	if login, ok := auth.(LoginAuthenticator); ok {
+		account, err := login.Login(fc.user, fc.arg, fc.remoteIP())
+		if err != nil || account == nil {
+			return false, err
+		}
+		fc.account = account
+		return true, nil
+	}
+	ok, err := auth.Authenticate(fc.user, fc.arg)
+	if !ok || err != nil {
+		return false, err
+	}
+	if store, ok := auth.(UserStore); ok {
+		account, err := store.LoadUser(fc.user)
+		if err != nil || account == nil {
+			return false, err
+		}
+		fc.account = account
+	}
+	return true, nil
+}
+
+// errDriverTimeout - driver factory not return in DriverTimeout
+var errDriverTimeout = errors.New("new driver timeout")
+
+// openDriver create the driver of login user, wait at most DriverTimeout
+// seconds for the driver factory.
+func (fc *FtpConn) openDriver() error {
+	home := fc.driverHome()
+	if fc.config.DriverTimeout <= 0 {
+		driver, err := newUserDriver(fc.factory, fc.user, home)
+		if err != nil {
+			return err
+		}
+		fc.setDriver(driver)
+		return nil
+	}
+
+	type result struct {
+		driver Driver
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		driver, err := newUserDriver(fc.factory, fc.user, home)
+		ch <- result{driver, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return r.err
+		}
+		fc.setDriver(r.driver)
+		return nil
+	case <-time.After(time.Duration(fc.config.DriverTimeout) * time.Second):
+		// the driver created too late is not used.
+		go func() {
+			if r := <-ch; r.err == nil {
+				closeDriver(r.driver)
+			}
+		}()
+		return errDriverTimeout
+	}
+}
+
+// driverHome return the home of login user the driver is created with, the
+// Home of user, HomeTemplate or the user name of HomeDir in that order.
+func (fc *FtpConn) driverHome() string {
+	home := ""
+	user, ok := fc.userConfig()
+	if ok && len(user.Home) > 0 {
+		home = user.Home
+	} else if len(fc.config.HomeTemplate) > 0 {
+		home = fc.config.HomeTemplate
+	} else if fc.config.HomeDir {
+		home = "%u"
+	}
+	return strings.TrimPrefix(jailpath(expandHome(home, fc.user, user.Group)), "/")
+}
+
+// expandHome expand %u to the user name and %g to the group of a home
+// template, the names can not climb out of the driver root.
+func expandHome(home, user, group string) string {
+	return strings.NewReplacer("%u", homeName(user), "%g", homeName(group), "%%", "%").Replace(home)
+}
+
+// homeName return v as a single path element, with separators replaced
+// and dot names refused, so a user name can not escape its parent dir.
+func homeName(v string) string {
+	v = strings.NewReplacer("/", "_", "\\", "_").Replace(v)
+	if v == ".." || v == "." {
+		return "_"
+	}
+	return v
+}
+
+// closeDriver close a driver holding connections, such as sftp driver
+func closeDriver(driver Driver) {
+	if closer, ok := driver.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// setDriver set the session driver, bound to the session context if
+// the driver is able to cancel its operations.
+func (fc *FtpConn) setDriver(driver Driver) {
+	if fc.readOnly() {
+		driver = NewReadOnlyDriver(driver)
+	}
+	if dc, ok := driver.(DriverContext); ok {
+		driver = dc.WithContext(fc.ctx)
+	}
+	fc.driver = driver
+	fc.loadQuota()
+}
+
+func (fc *FtpConn) handleAUTH() error {
+	if !fc.config.AuthTLS.Enable {
+		fc.Send(550, "Auth not enable.")
+		return nil
+	}
+	if fc.tls {
+		// a secured session never goes back to plaintext.
+		fc.Send(503, "Already using TLS.")
+		return nil
+	}
+	if fc.arg == "TLS" || fc.arg == "SSL" {
+		fc.Send(234, "Proceed with negotiation.")
+		// commands sent before the handshake may be injected by a man in
+		// the middle, they must not run as if sent over TLS.
+		if n := fc.reader.Buffered(); n > 0 {
+			fc.log(LogWarn, "discard bytes before tls handshake", "bytes", n)
+			fc.reader.Discard(n)
+		}
+		conn := tls.Server(fc.ctrlConn, fc.tlsConfig)
+		err := conn.Handshake()
+		if err != nil {
+			fc.Close()
+			return err
+		}
+		// a reply sent by kick from another goroutine must not see the
+		// writer half swapped.
+		fc.sendLock.Lock()
+		fc.ctrlConn = conn
+		fc.reader = bufio.NewReader(conn)
+		fc.writer = bufio.NewWriter(conn)
+		fc.sendLock.Unlock()
+		fc.tls = true
+		if chains := conn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			fc.certUser = fc.config.clientCertUser(chains[0][0])
+			fc.log(LogInfo, "client certificate verified", "cert_user", fc.certUser)
+		}
+		return nil
+	}
+	fc.Send(504, "Unknown AUTH type.")
+	return nil
+}
+
+func (fc *FtpConn) handlePROT() error {
+	if fc.tls {
+		// RFC 4217 9: PBSZ must come first.
+		if !fc.pbsz {
+			fc.Send(503, "PBSZ required before PROT.")
+			return nil
+		}
+		switch fc.arg {
+		case "P":
+			fc.protP = true
+			fc.Send(200, "Protection level set to Private.")
+		case "C":
+			if fc.config.AuthTLS.Force {
+				fc.Send(534, "Clear protection level not allowed.")
+				return nil
+			}
+			fc.protP = false
+			fc.Send(200, "Protection level set to Clear.")
+		default:
+			fc.Send(536, "Only C and P levels are supported.")
+		}
+		return nil
+	}
+	fc.Send(550, "Permission denied.")
+	return nil
+}
+
+func (fc *FtpConn) handlePBSZ() error {
+	if fc.tls && fc.arg == "0" {
+		fc.pbsz = true
+		fc.Send(200, "OK")
+		return nil
+	}
+	fc.Send(550, "Permission denied.")
+	return nil
+}
+
+func (fc *FtpConn) handleCLNT() error {
+	fc.clnt = fc.arg
+	fc.Send(200, "Noted.")
+	return nil
+}
+
+func (fc *FtpConn) handleFEAT() error {
+	feats := []string{"CLNT", "EPRT", "EPSV", "HOST", "MDTM", "MFMT", "MLSD", fc.mlstFeat(), "PASV", "PBSZ", "PROT", "REST STREAM", "SIZE", "TVFS", "UTF8"}
+	if fc.config.Stealth {
+		feats = []string{"EPRT", "EPSV", "PASV", "PBSZ", "PROT", "REST STREAM", "SIZE", "UTF8"}
+	}
+	disabled := make(map[string]bool)
+	if !fc.capabilities().Chtimes {
+		disabled["MFMT"] = true
+	}
+	if !fc.config.Pasv.Enable {
+		disabled["EPSV"] = true
+		disabled["PASV"] = true
+	}
+	if !fc.config.Port.Enable {
+		disabled["EPRT"] = true
+	}
+	var enabled []string
+	if fc.config.AuthTLS.Enable {
+		enabled = append(enabled, " AUTH TLS")
+	}
+	if fc.config.ModeZ.Enable {
+		enabled = append(enabled, " MODE Z")
+	}
+	if !fc.config.Stealth {
+		algos := make([]string, len(hashAlgoNames))
+		for i, algo := range hashAlgoNames {
+			algos[i] = algo
+			if algo == fc.hashAlgorithm() {
+				algos[i] += "*"
+			}
+		}
+		enabled = append(enabled, " HASH "+strings.Join(algos, ";"), " XCRC", " XMD5", " XSHA1", " XSHA256")
+	}
+	for _, feat := range feats {
+		if !disabled[feat] {
+			enabled = append(enabled, " "+feat)
+		}
+	}
+	fc.SendMulti(211, "Features:", strings.Join(enabled, "\r\n"), "End")
+	return nil
+}
+
+func (fc *FtpConn) handleSYST() error {
+	// the same reply as most unix servers by default, keep it in stealth mode.
+	fc.Send(215, fc.config.Syst)
+	return nil
+}
+
+func (fc *FtpConn) handleNOOP() error {
+	fc.Send(200, "NOOP ok.")
+	return nil
+}
+
+func (fc *FtpConn) handleOPTS() error {
+	words := strings.SplitN(fc.arg, " ", 2)
+	arg := ""
+	if len(words) == 2 {
+		arg = words[1]
+	}
+	if fn, ok := optsMap[strings.ToUpper(words[0])]; ok {
+		return fn(fc, arg)
+	}
+
+	// unknown options are harmless, keep the session and note them.
+	fc.log(LogInfo, "unknown OPTS", "option", fc.arg)
+	fc.Send(501, "Option not understood.")
+	return nil
+}
+
+func (fc *FtpConn) handleOptsUTF8(arg string) error {
+	if strings.ToUpper(arg) == "ON" {
+		fc.Send(200, "Always in UTF8 mode.")
+		return nil
+	}
+	fc.Send(501, "Option not understood.")
+	return nil
+}
+
+func (fc *FtpConn) handleOptsMODE(arg string) error {
+	words := strings.Fields(strings.ToUpper(arg))
+	if !fc.config.ModeZ.Enable || len(words) != 3 || words[0] != "Z" || words[1] != "LEVEL" {
+		fc.Send(501, "Option not understood.")
+		return nil
+	}
+	level, err := strconv.Atoi(words[2])
+	if err != nil || level < 1 || level > 9 {
+		fc.Send(501, "Invalid MODE Z level.")
+		return nil
+	}
+	fc.zlevel = level
+	fc.Send(200, fmt.Sprintf("MODE Z level set to %d.", level))
+	return nil
+}
+
+func (fc *FtpConn) handleOptsMLST(arg string) error {
+	opts := make(map[string]bool)
+	var facts string
+	for _, fact := range strings.Split(arg, ";") {
+		fact = strings.ToLower(strings.TrimSpace(fact))
+		for _, f := range mlstFacts {
+			if strings.ToLower(f) == fact && !opts[fact] {
+				opts[fact] = true
+				facts += fact + ";"
+			}
+		}
+	}
+	fc.mlstOpts = opts
+	if len(facts) == 0 {
+		fc.Send(200, "MLST OPTS")
+		return nil
+	}
+	fc.Send(200, "MLST OPTS "+facts)
+	return nil
+}
+
+func (fc *FtpConn) handleOptsCSID(arg string) error {
+	if len(arg) > 0 {
+		fc.clnt = arg
+	}
+	if fc.config.Stealth {
+		fc.Send(200, "Noted.")
+		return nil
+	}
+	fc.Send(200, fmt.Sprintf("Name=KFtpd; Version=%s;", Version))
+	return nil
+}
+
+func (fc *FtpConn) handleQUIT() error {
+	fc.Send(221, "Goodbye.")
+	fc.Close()
+	return nil
+}
+
+func (fc *FtpConn) handleABOR() error {
+	fc.stateLock.Lock()
+	aborted := fc.aborted
+	fc.aborted = false
+	fc.stateLock.Unlock()
+	fc.resetFileTransfer()
+	if aborted {
+		fc.Send(226, "Abort successful.")
+	} else {
+		fc.Send(225, "No transfer to abort.")
+	}
+	return nil
+}
+
+func (fc *FtpConn) handleSIZE() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+	fi, err := fc.driver.Stat(path)
+	if err != nil {
+		fc.Send(550, "Could not get file size.")
+		return err
+	}
+	if fi.IsDir() {
+		fc.Send(550, "Not a regular file.")
+		return nil
+	}
+	fc.Send(213, fmt.Sprintf("%d", fi.Size()))
+	return nil
+}
+
+func (fc *FtpConn) handleSTAT() error {
+	if fc.arg == "" {
+		status := []string{
+			fmt.Sprintf("Connected to %s", fc.localAddr()),
+			fmt.Sprintf("Logged in as %s", fc.user),
+			fmt.Sprintf("TYPE: %s", fc.mode),
+		}
+		if !fc.config.Stealth {
+			status = append(status, versionString())
+		}
+		for i, stat := range status {
+			status[i] = "     " + stat
+		}
+		fc.SendMulti(211, "FTP server status:", strings.Join(status, "\r\n"), "End of status")
+		return nil
+	}
+
+	if !fc.permitted("LIST") {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	var status []string
+	path := fc.buildPath(fc.arg)
+	fi, err := fc.driver.Stat(path)
+	if err == nil && !fc.writeOnlyDir(path) {
+		if fi.IsDir() {
+			fc.driver.ListDir(path, func(fi FileInfo) error {
+				status = append(status, fc.fileStat(fi))
+				return nil
+			})
+		} else {
+			status = append(status, fc.fileStat(fi))
+		}
+	}
+
+	fc.SendMulti(213, "Status follows:", strings.Join(status, "\r\n"), "End of status")
+	return nil
+}
+
+func (fc *FtpConn) handleMDTM() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+	fi, err := fc.driver.Stat(path)
+	if err != nil {
+		fc.Send(550, "Could not get file modification time.")
+		return err
+	}
+	fc.Send(213, fi.ModTime().In(fc.config.factLocation).Format("20060102150405"))
+	return nil
+}
+
+func (fc *FtpConn) handleMFMT() error {
+	if !fc.capabilities().Chtimes {
+		fc.Send(502, "Command not implemented for this backend.")
+		return nil
+	}
+
+	arg := strings.SplitN(fc.arg, " ", 2)
+	if len(arg) != 2 {
+		fc.Send(500, "Illegal MFMT command.")
+		return nil
+	}
+
+	mtime, err := time.ParseInLocation("20060102150405", arg[0], fc.config.factLocation)
+	if err != nil {
+		fc.Send(500, "Illegal MFMT command.")
+		return err
+	}
+
+	path := fc.buildPath(arg[1])
+	err = fc.driver.Chtimes(path, mtime, mtime)
+	if err != nil {
+		fc.Send(550, "Could not change file modification time.")
+		return err
+	}
+	fc.Send(213, fmt.Sprintf("Modify=%s; %s", arg[0], arg[1]))
+	return nil
+}
+
+func (fc *FtpConn) handleRETR() error {
+	path := fc.buildPath(fc.arg)
+
+	defer func() {
+		fc.offset = 0
+		fc.CloseFileTransfer()
+	}()
+
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		<-fc.notify
+		return nil
+	}
+
+	if fc.handler.FileBeforeGet != nil {
+		if !fc.handler.FileBeforeGet(fc.user, path) {
+			fc.Send(550, "Not Allowed.")
+			<-fc.notify
+			return nil
+		}
+	}
+
+	size, reader, err := fc.driver.GetFile(path, fc.offset)
+	if err != nil {
+		fc.Send(550, "Failed to open file.")
+		<-fc.notify
+		return err
+	}
+	defer reader.Close()
+
+	<-fc.notify
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return nil
+	}
+	fc.Send(150, fmt.Sprintf("Opening %s mode data connection for %s (%d bytes).", fc.mode, fc.arg, size))
+	err = fc.PutFileTransfer(reader)
+	if err == errNoDataConn {
+		fc.Send(425, "Can't open data connection.")
+		return err
+	}
+	if err != nil {
+		fc.Send(426, "Failure writing network stream.")
+		return err
+	}
+	if fc.handler.TransferComplete != nil {
+		if err := fc.handler.TransferComplete(fc.user, path, size); err != nil {
+			fc.Send(451, "Transfer rejected.")
+			return err
+		}
+	}
+	fc.Send(226, "Transfer complete.")
+	if fc.handler.FileAfterGet != nil {
+		fc.handler.FileAfterGet(fc.user, path)
+	}
+	return nil
+}
+
+func (fc *FtpConn) handleSTOR() error {
+	path := fc.buildPath(fc.arg)
+
+	defer func() {
+		fc.offset = 0
+		fc.CloseFileTransfer()
+	}()
+
+	if !fc.uploadNameAllowed(path) {
+		fc.Send(553, "File name not allowed.")
+		<-fc.notify
+		return nil
+	}
+
+	if fc.writeOnlyExists(path) {
+		fc.Send(550, "Permission denied.")
+		<-fc.notify
+		return nil
+	}
+
+	if fc.handler.FileBeforePut != nil {
+		if !fc.handler.FileBeforePut(fc.user, path) {
+			fc.Send(550, "Not Allowed.")
+			<-fc.notify
+			return nil
+		}
+	}
+
+	<-fc.notify
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return nil
+	}
+	old, res, ok := fc.quotaCheck(path)
+	if !ok {
+		fc.Send(552, "Quota exceeded.")
+		return nil
+	}
+	defer fc.quotaUpdate(path, old, res)
+	reader := fc.GetFileTransfer()
+	if reader == nil {
+		fc.Send(550, "Failed to open transfer.")
+		return nil
+	}
+	key := fc.uploadKey(path)
+	_, resumed := fc.uploads.start(key, fc.user, path)
+	defer fc.uploads.finish(key)
+	fc.Send(150, "Ok to send data.")
+	qr := &quotaReader{reader: reader, res: res}
+	size, err := fc.driver.PutFile(path, fc.offset, qr)
+	if errors.Is(err, ErrTooManyFiles) {
+		fc.Send(552, "Too many files in directory.")
+		return err
+	}
+	if errors.Is(err, ErrReadOnly) {
+		fc.Send(550, "Permission denied.")
+		return err
+	}
+	if errors.Is(err, ErrResumeUnsupported) {
+		fc.Send(550, "Resume not supported.")
+		return err
+	}
+	if qr.exceeded {
+		fc.Send(552, "Quota exceeded.")
+		if fc.offset == 0 {
+			if derr := fc.driver.DeleteFile(path); derr != nil {
+				fc.log(LogError, "delete over quota upload fail", "path", path, "err", derr)
+			}
+		}
+		return ErrQuotaExceeded
+	}
+	if err != nil {
+		fc.Send(426, "Failure reading network stream.")
+		fc.partialUpload(path, fc.offset == 0 || resumed)
+		return err
+	}
+	if err := fc.uploadComplete(path, fc.offset, size); err != nil {
+		fc.Send(550, "Transfer rejected.")
+		return err
+	}
+	fc.Send(226, "Transfer complete.")
+	if fc.handler.FileAfterPut != nil {
+		fc.handler.FileAfterPut(fc.user, path)
+	}
+	return nil
+}
+
+func (fc *FtpConn) handleAPPE() error {
+	path := fc.buildPath(fc.arg)
+
+	defer func() {
 		fc.offset = 0
 		fc.CloseFileTransfer()
 	}()
 
-	if ftpHandler.FileBeforeGet != nil {
-		if !ftpHandler.FileBeforeGet(fc.user, path) {
-			fc.Send(550, "Not Allowed.")
-			<-fc.notify
-			return nil
+	if !fc.uploadNameAllowed(path) {
+		fc.Send(553, "File name not allowed.")
+		<-fc.notify
+		return nil
+	}
+
+	if fc.writeOnlyExists(path) {
+		fc.Send(550, "Permission denied.")
+		<-fc.notify
+		return nil
+	}
+
+	<-fc.notify
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return nil
+	}
+	old, res, ok := fc.quotaCheck(path)
+	if !ok {
+		fc.Send(552, "Quota exceeded.")
+		return nil
+	}
+	defer fc.quotaUpdate(path, old, res)
+	reader := fc.GetFileTransfer()
+	if reader == nil {
+		fc.Send(550, "Failed to open transfer.")
+		return nil
+	}
+	key := fc.uploadKey(path)
+	partial, resumed := fc.uploads.start(key, fc.user, path)
+	defer fc.uploads.finish(key)
+	if resumed && fc.offset == 0 {
+		// APPE of an interrupted upload resumes it at the end.
+		fc.offset = partial
+	}
+	fc.Send(150, "Ok to send data.")
+	qr := &quotaReader{reader: reader, res: res}
+	size, err := fc.driver.PutFile(path, fc.offset, qr)
+	if errors.Is(err, ErrTooManyFiles) {
+		fc.Send(552, "Too many files in directory.")
+		return err
+	}
+	if errors.Is(err, ErrReadOnly) {
+		fc.Send(550, "Permission denied.")
+		return err
+	}
+	if errors.Is(err, ErrResumeUnsupported) {
+		fc.Send(550, "Resume not supported.")
+		return err
+	}
+	if qr.exceeded {
+		fc.Send(552, "Quota exceeded.")
+		if fc.offset == 0 {
+			if derr := fc.driver.DeleteFile(path); derr != nil {
+				fc.log(LogError, "delete over quota upload fail", "path", path, "err", derr)
+			}
+		}
+		return ErrQuotaExceeded
+	}
+	if err != nil {
+		fc.Send(426, "Failure reading network stream.")
+		fc.partialUpload(path, resumed)
+		return err
+	}
+	if err := fc.uploadComplete(path, fc.offset, size); err != nil {
+		fc.Send(550, "Transfer rejected.")
+		return err
+	}
+	fc.Send(226, "Transfer complete.")
+	return nil
+}
+
+func (fc *FtpConn) handleDELE() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	if fc.handler.FileBeforeDelete != nil {
+		if !fc.handler.FileBeforeDelete(fc.user, path) {
+			fc.Send(550, "Not Allowed.")
+			return nil
+		}
+	}
+
+	info, err := fc.driver.Stat(path)
+	if err == nil {
+		defer fc.quotaUpdate(path, info, nil)
+	}
+
+	err = fc.driver.DeleteFile(path)
+	if err != nil {
+		fc.Send(550, "Delete operation failed.")
+		return err
+	}
+	fc.Send(250, "Delete operation successful.")
+	if fc.handler.FileAfterDelete != nil {
+		fc.handler.FileAfterDelete(fc.user, path)
+	}
+	return nil
+}
+
+func (fc *FtpConn) handleRNFR() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	_, err := fc.driver.Stat(path)
+	if err != nil {
+		fc.Send(550, "RNFR command failed.")
+		return err
+	}
+	fc.rename = path
+	fc.Send(350, "Ready for RNTO.")
+	return nil
+}
+
+func (fc *FtpConn) handleRNTO() error {
+	if fc.rename == "" {
+		fc.Send(503, "RNFR required first.")
+		return nil
+	}
+	path := fc.buildPath(fc.arg)
+
+	defer func() {
+		fc.rename = ""
+	}()
+
+	if fc.writeOnlyExists(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	// a file may not get a name refused for uploads by a rename.
+	if info, err := fc.driver.Stat(fc.rename); err == nil && !info.IsDir() && !fc.uploadNameAllowed(path) {
+		fc.Send(553, "File name not allowed.")
+		return nil
+	}
+
+	if fc.handler.FileBeforeRename != nil {
+		if !fc.handler.FileBeforeRename(fc.user, fc.rename, path) {
+			fc.Send(550, "Not Allowed.")
+			return nil
+		}
+	}
+
+	// a file renamed over is gone from the usage, the one renamed stays.
+	replaced, err := fc.driver.Stat(path)
+	if err != nil || replaced.IsDir() {
+		replaced = nil
+	}
+
+	err = fc.driver.Rename(fc.rename, path)
+	if errors.Is(err, ErrTooManyFiles) {
+		fc.Send(552, "Too many files in directory.")
+		return err
+	}
+	if err != nil {
+		fc.Send(550, "Rename failed.")
+		return err
+	}
+	fc.quotaRename(fc.rename, path, replaced)
+	fc.Send(250, "Rename successful.")
+	if fc.handler.FileAfterRename != nil {
+		fc.handler.FileAfterRename(fc.user, fc.rename, path)
+	}
+	return nil
+}
+
+func (fc *FtpConn) handleALLO() error {
+	fc.Send(202, "Obsolete.")
+	return nil
+}
+
+func (fc *FtpConn) handleREST() error {
+	fc.offset, _ = strconv.ParseInt(fc.arg, 10, 0)
+	fc.Send(350, fmt.Sprintf("Restart position accepted (%d).", fc.offset))
+	return nil
+}
+
+func (fc *FtpConn) handleSITE() error {
+	words := strings.SplitN(fc.arg, " ", 2)
+	arg := ""
+	if len(words) == 2 {
+		arg = words[1]
+	}
+	if fn, ok := siteCmdMap[strings.ToUpper(words[0])]; ok {
+		return fn(fc, arg)
+	}
+
+	if fc.config.Stealth {
+		fc.Send(202, "Command not implemented.")
+		return nil
+	}
+	fc.Send(202, "@zhoukk")
+	return nil
+}
+
+func (fc *FtpConn) handleSiteGETURL(arg string) error {
+	path := fc.buildPath(arg)
+
+	driver, ok := fc.driver.(URLDriver)
+	if !ok || !fc.capabilities().URL {
+		fc.Send(502, "Command not implemented for this backend.")
+		return nil
+	}
+
+	if !fc.permitted("RETR") || fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	if fc.handler.FileBeforeGet != nil {
+		if !fc.handler.FileBeforeGet(fc.user, path) {
+			fc.Send(550, "Not Allowed.")
+			return nil
+		}
+	}
+
+	url, err := driver.GetURL(path)
+	if err != nil {
+		fc.Send(550, "Could not get file url.")
+		return err
+	}
+	fc.Send(200, url)
+	return nil
+}
+
+func (fc *FtpConn) handleSiteCHMOD(arg string) error {
+	// the read-only wrapper hides Chmod of the driver, tell the user why.
+	if fc.readOnly() {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	driver, ok := fc.driver.(ChmodDriver)
+	if !ok || !fc.capabilities().Chmod {
+		fc.Send(502, "Command not implemented for this backend.")
+		return nil
+	}
+
+	words := strings.SplitN(arg, " ", 2)
+	if len(words) != 2 {
+		fc.Send(501, "Illegal SITE CHMOD command.")
+		return nil
+	}
+	mode, err := strconv.ParseUint(words[0], 8, 32)
+	if err != nil || mode > 0777 {
+		fc.Send(501, "Illegal SITE CHMOD command.")
+		return nil
+	}
+
+	path := fc.buildPath(words[1])
+	err = driver.Chmod(path, os.FileMode(mode))
+	if err != nil {
+		fc.Send(550, "Could not change file mode.")
+		return err
+	}
+	fc.Send(200, "SITE CHMOD command successful.")
+	return nil
+}
+
+func (fc *FtpConn) handleSiteHELP(arg string) error {
+	caps := fc.capabilities()
+	cmds := []string{"HELP", "QUOTA"}
+	if caps.Chmod {
+		cmds = append(cmds, "CHMOD")
+	}
+	if caps.URL {
+		cmds = append(cmds, "GETURL")
+	}
+	if !fc.config.Stealth {
+		cmds = append(cmds, "VERSION")
+	}
+	if fc.admin() {
+		cmds = append(cmds, "KICK", "WHO")
+	}
+	sort.Strings(cmds)
+	fc.SendMulti(214, "The following SITE commands are recognized:", " "+strings.Join(cmds, " "), "Help OK.")
+	return nil
+}
+
+func (fc *FtpConn) handleSiteQUOTA(arg string) error {
+	maxBytes, maxFiles := fc.quotaLimits()
+	bytes, files, ok := fc.quota.get(fc.hostKey(fc.user))
+	if !ok {
+		fc.Send(200, "No quota.")
+		return nil
+	}
+	limit := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	fc.Send(200, fmt.Sprintf("Quota: %d/%s bytes, %d/%s files.", bytes, limit(maxBytes), files, limit(int64(maxFiles))))
+	return nil
+}
+
+// adminAllowed check whether the login user is an admin and the session
+// is served by a server, reply the client if not.
+func (fc *FtpConn) adminAllowed() bool {
+	if !fc.admin() {
+		fc.Send(550, "Permission denied.")
+		return false
+	}
+	if fc.server == nil {
+		fc.Send(502, "Command not implemented.")
+		return false
+	}
+	return true
+}
+
+func (fc *FtpConn) handleSiteWHO(arg string) error {
+	if !fc.adminAllowed() {
+		return nil
+	}
+	sessions := fc.server.Sessions()
+	lines := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		user := session.User
+		if len(user) == 0 {
+			user = "-"
+		}
+		lines = append(lines, fmt.Sprintf(" %d %s %s %s", session.ID, user, session.Remote, session.Connected.Format(time.RFC3339)))
+	}
+	fc.SendMulti(200, "Connected sessions:", strings.Join(lines, "\r\n"), "End")
+	return nil
+}
+
+func (fc *FtpConn) handleSiteKICK(arg string) error {
+	if !fc.adminAllowed() {
+		return nil
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil {
+		fc.Send(501, "Usage: SITE KICK <id>.")
+		return nil
+	}
+	if id == fc.id {
+		fc.Send(550, "Can not kick own session.")
+		return nil
+	}
+	if !fc.server.Kick(id) {
+		fc.Send(550, "No such session.")
+		return nil
+	}
+	fc.log(LogInfo, "kick session", "id", id)
+	fc.Send(200, fmt.Sprintf("Session %d kicked.", id))
+	return nil
+}
+
+func (fc *FtpConn) handleSiteVERSION(arg string) error {
+	if fc.config.Stealth {
+		fc.Send(202, "Command not implemented.")
+		return nil
+	}
+	fc.Send(200, versionString())
+	return nil
+}
+
+// versionString return kftpd version with build time if any
+func versionString() string {
+	if len(BuildTime) > 0 {
+		return fmt.Sprintf("KFtpd %s (built %s)", Version, BuildTime)
+	}
+	return "KFtpd " + Version
+}
+
+// capabilities return the capabilities of the session driver,
+// of the driver factory before login.
+func (fc *FtpConn) capabilities() DriverCapabilities {
+	if fc.driver != nil {
+		return Capabilities(fc.driver)
+	}
+	return Capabilities(fc.factory)
+}
+
+func (fc *FtpConn) handleCWD() error {
+	return fc.changeDir(fc.buildPath(fc.arg))
+}
+
+// changeDir change the working directory to path, the reply tells a
+// missing path from a path which is not a directory.
+func (fc *FtpConn) changeDir(path string) error {
+	fi, err := fc.driver.Stat(path)
+	if os.IsNotExist(err) {
+		fc.Send(550, "No such directory.")
+		return err
+	}
+	if err != nil {
+		fc.Send(550, "Failed to change directory.")
+		return err
+	}
+	if !fi.IsDir() {
+		fc.Send(550, "Not a directory.")
+		return nil
+	}
+
+	fc.path = path
+	fc.sendMessage(250, fc.dirMessage(path), "Directory successfully changed.")
+	return nil
+}
+
+func (fc *FtpConn) handlePWD() error {
+	fc.Send(257, fmt.Sprintf(`"%s"`, fc.path))
+	return nil
+}
+
+func (fc *FtpConn) handleCDUP() error {
+	return fc.changeDir(fc.buildPath(".."))
+}
+
+func (fc *FtpConn) handleNLST() error {
+	opts, arg := fc.listArgs()
+	dir, pattern := fc.listGlob(arg)
+	prefix := ""
+	if len(pattern) > 0 {
+		// names keep the directory given so mget finds them.
+		if i := strings.LastIndex(arg, "/"); i >= 0 {
+			prefix = arg[:i+1]
+		}
+	}
+	classify := fc.config.NlstClassify || strings.Contains(opts, "F")
+	return fc.sendList(dir, pattern, func(fi FileInfo) string {
+		if classify && fi.IsDir() {
+			return prefix + fi.Name() + "/"
+		}
+		return prefix + fi.Name()
+	})
+}
+
+func (fc *FtpConn) handleLIST() error {
+	_, arg := fc.listArgs()
+	dir, pattern := fc.listGlob(arg)
+	return fc.sendList(dir, pattern, fc.fileStat)
+}
+
+func (fc *FtpConn) handleMLSD() error {
+	path := fc.buildPath(fc.arg)
+	return fc.sendList(path, "", func(fi FileInfo) string {
+		return fc.fileMls(filepath.Join(path, fi.Name()), fi)
+	})
+}
+
+// listGlob return the directory to list of a listing argument and the
+// glob pattern of its last element, such as "*.csv" of "data/*.csv". The
+// pattern is empty if the last element has no wildcard or names an
+// existing file. Only the last element may hold wildcards, the matching
+// does not recurse.
+func (fc *FtpConn) listGlob(arg string) (string, string) {
+	path := fc.buildPath(arg)
+	name := filepath.Base(path)
+	if !strings.ContainsAny(name, "*?[") || path == "/" {
+		return path, ""
+	}
+	if _, err := filepath.Match(name, ""); err != nil {
+		return path, ""
+	}
+	if _, err := fc.driver.Stat(path); err == nil {
+		return path, ""
+	}
+	return filepath.ToSlash(filepath.Dir(path)), name
+}
+
+// sendList send the listing of path to file transfer, each file is
+// written as ListDir yields it so the listing is never held in memory.
+// Only the files matching pattern are sent if any.
+func (fc *FtpConn) sendList(path, pattern string, line func(FileInfo) string) error {
+	if _, err := fc.driver.Stat(path); err != nil {
+		fc.Send(550, "No such file or directory.")
+		fc.resetFileTransfer()
+		return err
+	}
+
+	fc.Send(150, "Here comes the directory listing.")
+	defer fc.CloseFileTransfer()
+
+	<-fc.notify
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return nil
+	}
+	w, err := fc.newListWriter()
+	if err != nil {
+		fc.Send(451, "Requested action aborted: local error in processing.")
+		return err
+	}
+	var werr error
+	if !fc.writeOnlyDir(path) {
+		err = fc.driver.ListDir(path, func(fi FileInfo) error {
+			if len(pattern) > 0 {
+				if ok, _ := filepath.Match(pattern, fi.Name()); !ok {
+					return nil
+				}
+			}
+			werr = w.WriteLine(line(fi))
+			return werr
+		})
+	}
+	if werr == nil {
+		werr = w.Close()
+	}
+	if werr == errNoDataConn {
+		fc.Send(425, "Can't open data connection.")
+		return werr
+	}
+	if werr != nil {
+		fc.Send(426, "Failure writing network stream.")
+		return werr
+	}
+	if err != nil {
+		fc.Send(226, "Transfer done (but failed to open directory).")
+		return err
+	}
+	fc.Send(226, "Directory send OK.")
+	return nil
+}
+
+func (fc *FtpConn) handleMLST() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	fi, err := fc.driver.Stat(path)
+	if err != nil {
+		fc.Send(550, "Could not get file details.")
+		return err
+	}
+	fc.SendMulti(250, "File details:", " "+fc.fileMls(path, fi), "End")
+	return nil
+}
+
+func (fc *FtpConn) handleMKD() error {
+	path := fc.buildPath(fc.arg)
+
+	err := fc.driver.MakeDir(path)
+	if errors.Is(err, ErrTooManyFiles) {
+		fc.Send(552, "Too many files in directory.")
+		return err
+	}
+	if errors.Is(err, ErrReadOnly) {
+		fc.Send(550, "Permission denied.")
+		return err
+	}
+	if err != nil {
+		fc.Send(550, "Create directory operation failed.")
+		return err
+	}
+	fc.Send(257, fmt.Sprintf(`"%s" created`, fc.quote(path)))
+	return nil
+}
+
+func (fc *FtpConn) handleRMD() error {
+	path := fc.buildPath(fc.arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+
+	// the files of dir are deleted with it.
+	var bytes int64
+	var files int
+	user := fc.hostKey(fc.user)
+	if _, _, ok := fc.quota.get(user); ok && !fc.inMount(path) {
+		bytes, files, _ = fc.walkUsage(path)
+	}
+
+	err := fc.driver.DeleteDir(path)
+	if err != nil {
+		fc.Send(550, "Remove directory operation failed.")
+		return err
+	}
+	fc.quota.add(user, -bytes, -files)
+	fc.Send(250, "Remove directory operation successful.")
+	return nil
+}
+
+func (fc *FtpConn) handleTYPE() error {
+	switch fc.arg {
+	case "A", "a":
+		fc.mode = "ASCII"
+		fc.typeA = true
+		fc.Send(200, "Switching to ASCII mode.")
+	case "I", "i":
+		fc.mode = "BINARY"
+		fc.typeA = false
+		fc.Send(200, "Switching to Binary mode.")
+	default:
+		fc.mode = ""
+		fc.typeA = false
+		fc.Send(500, "Unrecognised TYPE command.")
+	}
+	return nil
+}
+
+// hashAlgos - algorithms of HASH, named as in the HASH draft
+var hashAlgos = map[string]func() hash.Hash{
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// hashAlgoNames - algorithms of HASH in FEAT order
+var hashAlgoNames = []string{"CRC32", "MD5", "SHA-1", "SHA-256", "SHA-512"}
+
+// fileHash return the checksum of file by algo, the one the driver
+// supplies if any or else the one of the file content.
+func (fc *FtpConn) fileHash(ctx context.Context, path, algo string) (string, error) {
+	driver := fc.driver
+	if dc, ok := driver.(DriverContext); ok {
+		driver = dc.WithContext(ctx)
+	}
+	if hd, ok := driver.(HashDriver); ok {
+		sum, err := hd.Hash(path, algo)
+		if err != ErrHashUnsupported {
+			return sum, err
+		}
+	}
+	_, reader, err := driver.GetFile(path, 0)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := hashAlgos[algo]()
+	if _, err := io.Copy(h, &ctxReader{ctx, reader}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ctxReader - reader failing once ctx is done, so a driver unable to
+// cancel its reads stops at the next one.
+type ctxReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// spawnHash compute the checksum of path by algo in a helper goroutine
+// like a transfer, so ABOR cancels it. It return context.Canceled once
+// aborted, the checksum still running is dropped.
+func (fc *FtpConn) spawnHash(path, algo string) (string, error) {
+	ctx, cancel := context.WithCancel(fc.ctx)
+	defer cancel()
+	fc.stateLock.Lock()
+	fc.abortHash = cancel
+	fc.stateLock.Unlock()
+	defer func() {
+		fc.stateLock.Lock()
+		fc.abortHash = nil
+		fc.stateLock.Unlock()
+	}()
+
+	type result struct {
+		sum string
+		err error
+	}
+	ch := make(chan result, 1)
+	if !fc.spawn(func() {
+		sum, err := fc.fileHash(ctx, path, algo)
+		ch <- result{sum, err}
+	}) {
+		return "", errTooManyGoroutines
+	}
+	select {
+	case r := <-ch:
+		return r.sum, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// hashFile reply the checksum of the file of argument by algo
+func (fc *FtpConn) hashFile(arg, algo string, code int) error {
+	path := fc.buildPath(arg)
+	if fc.writeOnlyFile(path) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+	fi, err := fc.driver.Stat(path)
+	if err != nil || fi.IsDir() {
+		fc.Send(550, "Could not get file checksum.")
+		return err
+	}
+	if fc.handler.FileBeforeGet != nil {
+		if !fc.handler.FileBeforeGet(fc.user, path) {
+			fc.Send(550, "Not Allowed.")
+			return nil
+		}
+	}
+	sum, err := fc.spawnHash(path, algo)
+	if err == errTooManyGoroutines {
+		fc.Send(450, "Too many pending operations.")
+		return nil
+	}
+	if err == context.Canceled {
+		fc.Send(426, "Checksum aborted.")
+		return nil
+	}
+	if err != nil {
+		fc.Send(550, "Could not get file checksum.")
+		return err
+	}
+	if code == 213 {
+		fc.Send(213, fmt.Sprintf("%s 0-%d %s %s", algo, fi.Size(), sum, arg))
+	} else {
+		fc.Send(code, sum)
+	}
+	return nil
+}
+
+// hashAlgorithm return the HASH algorithm of session, SHA-256 by default
+func (fc *FtpConn) hashAlgorithm() string {
+	if len(fc.hashAlgo) > 0 {
+		return fc.hashAlgo
+	}
+	return "SHA-256"
+}
+
+func (fc *FtpConn) handleHASH() error {
+	return fc.hashFile(fc.arg, fc.hashAlgorithm(), 213)
+}
+
+func (fc *FtpConn) handleXCRC() error {
+	return fc.hashFile(fc.arg, "CRC32", 250)
+}
+
+func (fc *FtpConn) handleXMD5() error {
+	return fc.hashFile(fc.arg, "MD5", 250)
+}
+
+func (fc *FtpConn) handleXSHA1() error {
+	return fc.hashFile(fc.arg, "SHA-1", 250)
+}
+
+func (fc *FtpConn) handleXSHA256() error {
+	return fc.hashFile(fc.arg, "SHA-256", 250)
+}
+
+func (fc *FtpConn) handleOptsHASH(arg string) error {
+	if len(arg) == 0 {
+		fc.Send(200, fc.hashAlgorithm())
+		return nil
+	}
+	algo := strings.ToUpper(arg)
+	if _, ok := hashAlgos[algo]; !ok {
+		fc.Send(504, "Unknown algorithm.")
+		return nil
+	}
+	fc.hashAlgo = algo
+	fc.Send(200, algo)
+	return nil
+}
+
+func (fc *FtpConn) handleMODE() error {
+	switch strings.ToUpper(fc.arg) {
+	case "S":
+		fc.modeZ = false
+		fc.Send(200, "Mode set to S.")
+	case "Z":
+		if !fc.config.ModeZ.Enable {
+			fc.Send(504, "Unsupported transfer mode.")
+			return nil
+		}
+		fc.modeZ = true
+		fc.Send(200, "Mode set to Z.")
+	default:
+		fc.Send(504, "Unsupported transfer mode.")
+	}
+	return nil
+}
+
+func (fc *FtpConn) handlePASV() error {
+	if fc.epsvAll {
+		fc.Send(501, "PASV not allowed after EPSV ALL.")
+		return nil
+	}
+
+	if !fc.passiveAllowed() {
+		return nil
+	}
+
+	ip := fc.pasvIP()
+	if ip == nil {
+		fc.Send(425, "Can't open passive connection.")
+		return errors.New("no ipv4 address for passive connection")
+	}
+
+	port, err := fc.passiveOpen()
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		return nil
+	}
+	p1 := port / 256
+	p2 := port - (p1 * 256)
+	fc.Send(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], p1, p2))
+	return nil
+}
+
+// handleEPSV - extended passive mode of RFC 2428, the client connects to
+// the address of control connection so it works over IPv6 too.
+func (fc *FtpConn) handleEPSV() error {
+	switch strings.ToUpper(fc.arg) {
+	case "ALL":
+		// the client promises to use EPSV only, refuse PORT and PASV after.
+		fc.epsvAll = true
+		fc.Send(200, "EPSV ALL ok.")
+		return nil
+	case "", "1", "2":
+	default:
+		fc.Send(522, "Network protocol not supported, use (1,2)")
+		return nil
+	}
+
+	if !fc.passiveAllowed() {
+		return nil
+	}
+
+	port, err := fc.passiveOpen()
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		return nil
+	}
+	fc.Send(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	return nil
+}
+
+// passiveAllowed check whether passive mode is allowed now, reply the
+// client if not.
+func (fc *FtpConn) passiveAllowed() bool {
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return false
+	}
+
+	if !fc.config.Pasv.Enable {
+		// not 421, which makes clients drop the session instead of
+		// falling back to active mode.
+		fc.Send(502, "Passive mode is disabled, use PORT.")
+		return false
+	}
+
+	if fc.handler.ClientBeforePasv != nil {
+		if !fc.handler.ClientBeforePasv(fc.user) {
+			fc.Send(550, "Not Allowed.")
+			return false
+		}
+	}
+	return true
+}
+
+// passiveOpen listen a passive port and wait client in background,
+// return the port, or 0 if the client is replied with an error.
+func (fc *FtpConn) passiveOpen() (int, error) {
+	fc.resetFileTransfer()
+
+	listener, err := fc.pasvListen()
+	if err != nil {
+		fc.log(LogError, "pasv listen fail", "err", err)
+		fc.Send(425, "Can't open passive connection.")
+		return 0, err
+	}
+	fc.stateLock.Lock()
+	fc.pasvListener = listener
+	fc.stateLock.Unlock()
+
+	ok := fc.spawn(func() {
+		conn, err := fc.pasvAccept(listener)
+		listener.Close()
+
+		// a listener replaced by a newer PASV must not notify, the one
+		// closed on shutdown still does to wake up the waiting command.
+		fc.stateLock.Lock()
+		current := fc.pasvListener == listener
+		if current {
+			fc.pasvListener = nil
+		}
+		fc.stateLock.Unlock()
+		if !current {
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			fc.log(LogWarn, "pasv accept fail", "err", err)
+		} else {
+			fc.OpenFileTransfer(conn)
+		}
+		fc.notify <- 1
+	})
+	if !ok {
+		fc.resetFileTransfer()
+		fc.Send(425, "Too many pending data connections.")
+		return 0, nil
+	}
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (fc *FtpConn) handlePORT() error {
+	if fc.epsvAll {
+		fc.Send(501, "PORT not allowed after EPSV ALL.")
+		return nil
+	}
+
+	if !fc.activeAllowed() {
+		return nil
+	}
+
+	// h1,h2,h3,h4,p1,p2 of RFC 959, each a decimal of 0-255.
+	quads := strings.Split(fc.arg, ",")
+	if len(quads) != 6 {
+		fc.Send(501, "Illegal PORT command.")
+		return nil
+	}
+	var b [6]byte
+	for i, quad := range quads {
+		v, err := strconv.Atoi(quad)
+		if err != nil || v < 0 || v > 255 {
+			fc.Send(501, "Illegal PORT command.")
+			return nil
+		}
+		b[i] = byte(v)
+	}
+	ip := net.IPv4(b[0], b[1], b[2], b[3])
+	port := int(b[4])*256 + int(b[5])
+	if port == 0 {
+		fc.Send(501, "Illegal PORT command.")
+		return nil
+	}
+
+	if !fc.activeTargetAllowed(ip, port) {
+		fc.Send(500, "Illegal PORT command.")
+		return nil
+	}
+	if err := fc.activeOpen(ip.String(), port); err != nil {
+		fc.Send(500, "Illegal PORT command.")
+		return err
+	}
+	fc.Send(200, "PORT command successful.")
+	return nil
+}
+
+// handleEPRT - extended active mode of RFC 2428 like "|2|::1|6446|",
+// the first character is the delimiter.
+func (fc *FtpConn) handleEPRT() error {
+	if fc.epsvAll {
+		fc.Send(501, "EPRT not allowed after EPSV ALL.")
+		return nil
+	}
+
+	if !fc.activeAllowed() {
+		return nil
+	}
+
+	if len(fc.arg) < 1 {
+		fc.Send(501, "Illegal EPRT command.")
+		return nil
+	}
+	fields := strings.Split(fc.arg, fc.arg[:1])
+	if len(fields) != 5 {
+		fc.Send(501, "Illegal EPRT command.")
+		return nil
+	}
+	if fields[1] != "1" && fields[1] != "2" {
+		fc.Send(522, "Network protocol not supported, use (1,2)")
+		return nil
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[3])
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		fc.Send(501, "Illegal EPRT command.")
+		return nil
+	}
+	if (fields[1] == "1") != (ip.To4() != nil) {
+		fc.Send(501, "Illegal EPRT command.")
+		return nil
+	}
+	if !fc.activeTargetAllowed(ip, port) {
+		fc.Send(501, "Illegal EPRT command.")
+		return nil
+	}
+
+	if err := fc.activeOpen(ip.String(), port); err != nil {
+		fc.Send(425, "Can't open data connection.")
+		return err
+	}
+	fc.Send(200, "EPRT command successful.")
+	return nil
+}
+
+// activeAllowed check whether active mode is allowed now, reply the
+// client if not.
+func (fc *FtpConn) activeAllowed() bool {
+	if fc.serverClosing() {
+		fc.Send(421, "Server shutting down.")
+		return false
+	}
+
+	if !fc.config.Port.Enable {
+		fc.Send(502, "Active mode is disabled, use PASV.")
+		return false
+	}
+
+	if fc.handler.ClientBeforePort != nil {
+		if !fc.handler.ClientBeforePort(fc.user) {
+			fc.Send(550, "Not Allowed.")
+			return false
+		}
+	}
+	return true
+}
+
+// activeTargetAllowed return whether PORT or EPRT may connect to ip and
+// port, with BounceProtection only a port of 1024 and above of the client
+// ip is, so the server can not be used to attack other hosts or services.
+func (fc *FtpConn) activeTargetAllowed(ip net.IP, port int) bool {
+	if !fc.config.BounceProtection {
+		return true
+	}
+	if ip == nil || port < 1024 || !fc.clientIP(ip) {
+		fc.log(LogWarn, "refuse active data connection target", "ip", ip, "port", port)
+		return false
+	}
+	return true
+}
+
+// pasvAccept accept the data connection of passive listener, with
+// BounceProtection connections from other ips than the client one are
+// closed so no one else can steal the transfer.
+func (fc *FtpConn) pasvAccept(listener *net.TCPListener) (net.Conn, error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil || !fc.config.BounceProtection {
+			return conn, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if ok && fc.clientIP(addr.IP) {
+			return conn, nil
+		}
+		fc.log(LogWarn, "refuse passive data connection", "peer", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// clientIP return whether ip is the one of control connection, always true
+// if control connection is not tcp.
+func (fc *FtpConn) clientIP(ip net.IP) bool {
+	addr, ok := fc.conn.RemoteAddr().(*net.TCPAddr)
+	return !ok || addr.IP.Equal(ip)
+}
+
+// activeOpen connect to the data port of client
+func (fc *FtpConn) activeOpen(ip string, port int) error {
+	fc.resetFileTransfer()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), time.Duration(fc.config.Port.ConnectTimeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	fc.OpenFileTransfer(conn)
+	fc.notify <- 1
+	return nil
+}
+
+// NewFtpConn return a new ftp session, conn can be one end of net.Pipe
+// to drive the session with Exec without a network.
+func NewFtpConn(cid int, conn net.Conn, config *FtpdConfig, tlsConfig *tls.Config, factory DriverFactory) *FtpConn {
+	fc := new(FtpConn)
+
+	fc.id = cid
+	fc.remote = conn.RemoteAddr().String()
+	fc.connected = time.Now()
+	fc.conn = conn
+	fc.ctrlConn = conn
+	setOOBInline(conn)
+	fc.config = config
+	fc.tlsConfig = tlsConfig
+	fc.reader = bufio.NewReader(conn)
+	fc.writer = bufio.NewWriter(conn)
+	fc.factory = factory
+	fc.path = "/"
+	fc.arg = ""
+	fc.mode = "ASCII"
+	fc.authd = false
+	fc.notify = make(chan int, 1)
+	fc.handler = &ftpHandler
+	fc.logger = newConfigLogger(config)
+	fc.quota = newQuotaManager()
+	fc.throttles = newThrottleLimiters()
+	fc.ports = newPortPool()
+	fc.uploads = newUploadTracker()
+	fc.ctx, fc.cancel = context.WithCancel(context.Background())
+
+	return fc
+}
+
+// buildPath return ftp clean path, always absolute and slash separated,
+// trailing slashes are dropped so "dir/" and "dir" resolve to the same path.
+func (fc *FtpConn) buildPath(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = fc.path + "/" + path
+	}
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// listArgs split ls style options like "-la" from the path argument of
+// listing commands, return the option letters and the path.
+func (fc *FtpConn) listArgs() (string, string) {
+	opts := ""
+	arg := fc.arg
+	for strings.HasPrefix(arg, "-") {
+		words := strings.SplitN(arg, " ", 2)
+		opts += strings.TrimPrefix(words[0], "-")
+		if len(words) == 2 {
+			arg = strings.TrimLeft(words[1], " ")
+		} else {
+			arg = ""
+		}
+	}
+	return opts, arg
+}
+
+// fileStat return ftp format file information
+func (fc *FtpConn) fileStat(fi FileInfo) string {
+	mode := fi.Mode().String()
+	name := fi.Name()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		mode = "l" + mode[1:]
+	}
+	if link, ok := fi.(LinkFileInfo); ok {
+		name += " -> " + link.LinkTarget()
+	}
+	return fmt.Sprintf("%s 1 %s %s %12d %s %s", mode, fc.user, fc.user, fi.Size(), fc.listTime(fi.ModTime()), name)
+}
+
+// listTime return LIST format time in ListTimeZone, with the year instead
+// of the time for those more than six months away like ls.
+func (fc *FtpConn) listTime(t time.Time) string {
+	t = t.In(fc.config.listLocation)
+	if d := time.Since(t); d > 182*24*time.Hour || d < -182*24*time.Hour {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+// mlstFacts - facts of MLSD and MLST in FEAT order, all selected by default
+var mlstFacts = []string{"Type", "Size", "Modify", "Perm", "Unique", "UNIX.mode", "UNIX.owner"}
+
+// mlstFact return whether the fact is selected by OPTS MLST
+func (fc *FtpConn) mlstFact(fact string) bool {
+	if fc.mlstOpts == nil {
+		return true
+	}
+	return fc.mlstOpts[strings.ToLower(fact)]
+}
+
+// mlstFeat return the MLST feature of FEAT, selected facts marked with *
+func (fc *FtpConn) mlstFeat() string {
+	var facts string
+	for _, fact := range mlstFacts {
+		facts += strings.ToLower(fact)
+		if fc.mlstFact(fact) {
+			facts += "*"
+		}
+		facts += ";"
+	}
+	return "MLST " + facts
+}
+
+// allowed return whether the login user may run command
+func (fc *FtpConn) allowed(command string) bool {
+	return !(writeCmds[command] && fc.readOnly()) && fc.permitted(command)
+}
+
+// filePerm return the Perm fact of file, RFC 3659 7.5.5.
+func (fc *FtpConn) filePerm(fi FileInfo) string {
+	var perm string
+	if fi.IsDir() {
+		perm = "e"
+		if fc.allowed("STOR") {
+			perm += "c"
+		}
+		if fc.allowed("RMD") {
+			perm += "d"
+		}
+		if fc.allowed("RNFR") {
+			perm += "f"
+		}
+		if fc.allowed("LIST") {
+			perm += "l"
+		}
+		if fc.allowed("MKD") {
+			perm += "m"
+		}
+		if fc.allowed("DELE") {
+			perm += "p"
+		}
+		return perm
+	}
+	if fc.allowed("APPE") {
+		perm += "a"
+	}
+	if fc.allowed("DELE") {
+		perm += "d"
+	}
+	if fc.allowed("RNFR") {
+		perm += "f"
+	}
+	if fc.allowed("RETR") {
+		perm += "r"
+	}
+	if fc.allowed("STOR") {
+		perm += "w"
+	}
+	return perm
+}
+
+// fileUnique return the Unique fact of file, device and inode for local
+// files or else a hash of the path.
+func fileUnique(path string, fi FileInfo) string {
+	if dev, ino, _, ok := statInfo(fi); ok {
+		return fmt.Sprintf("%xU%x", dev, ino)
+	}
+	h := fnv.New64a()
+	io.WriteString(h, path)
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// fileMls return ftp mls* command required format file information
+func (fc *FtpConn) fileMls(path string, fi FileInfo) string {
+	var t string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		t = "OS.unix=symlink"
+	} else if fi.IsDir() {
+		t = "dir"
+	} else {
+		t = "file"
+	}
+	var facts string
+	for _, fact := range mlstFacts {
+		if !fc.mlstFact(fact) {
+			continue
+		}
+		var value string
+		switch fact {
+		case "Type":
+			value = t
+		case "Size":
+			// the Size fact is only meaningful for files, RFC 3659 7.5.7.
+			if t == "file" {
+				value = strconv.FormatInt(fi.Size(), 10)
+			}
+		case "Modify":
+			value = fi.ModTime().In(fc.config.factLocation).Format("20060102150405")
+		case "Perm":
+			value = fc.filePerm(fi)
+		case "Unique":
+			value = fileUnique(path, fi)
+		case "UNIX.mode":
+			value = fmt.Sprintf("%04o", fi.Mode().Perm())
+		case "UNIX.owner":
+			if _, _, uid, ok := statInfo(fi); ok {
+				value = strconv.FormatUint(uint64(uid), 10)
+			}
+		}
+		if len(value) > 0 {
+			facts += fact + "=" + value + ";"
+		}
+	}
+	return facts + " " + fi.Name()
+}
+
+// loginMessage return the message shown after login, LoginMessageFile is
+// read every login so it can be changed without restart.
+func (fc *FtpConn) loginMessage() string {
+	msg := fc.config.LoginMessage
+	if len(fc.config.LoginMessageFile) > 0 {
+		data, err := ioutil.ReadFile(fc.config.LoginMessageFile)
+		if err != nil {
+			fc.log(LogError, "read login message fail", "err", err)
+		} else {
+			msg = string(data)
+		}
+	}
+	return msg
+}
+
+// bannerMessage return the message of BannerFile shown before the greeting,
+// read every connection like LoginMessageFile.
+func (fc *FtpConn) bannerMessage() string {
+	if len(fc.config.BannerFile) == 0 {
+		return ""
+	}
+	data, err := ioutil.ReadFile(fc.config.BannerFile)
+	if err != nil {
+		fc.log(LogError, "read banner fail", "err", err)
+		return ""
+	}
+	return string(data)
+}
+
+// maxDirMessage - max bytes of a DirMessageFile shown
+const maxDirMessage = 4096
+
+// dirMessage return the message shown by CWD into dir, the one of
+// DirMessages or the DirMessageFile in dir.
+func (fc *FtpConn) dirMessage(dir string) string {
+	if msg, ok := fc.config.DirMessages[dir]; ok {
+		return msg
+	}
+	if len(fc.config.DirMessageFile) == 0 {
+		return ""
+	}
+	_, reader, err := fc.driver.GetFile(filepath.ToSlash(filepath.Join(dir, fc.config.DirMessageFile)), 0)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxDirMessage))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// writeOnlyDir return whether dir is or lies in one of WriteOnlyDirs,
+// its listing is empty.
+func (fc *FtpConn) writeOnlyDir(dir string) bool {
+	for _, wo := range fc.config.WriteOnlyDirs {
+		if dir == wo || wo == "/" || strings.HasPrefix(dir, wo+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOnlyFile return whether path lies in one of WriteOnlyDirs, it may
+// be uploaded but not read, renamed or deleted.
+func (fc *FtpConn) writeOnlyFile(path string) bool {
+	return path != "/" && fc.writeOnlyDir(filepath.ToSlash(filepath.Dir(path)))
+}
+
+// writeOnlyExists return whether path is a file of WriteOnlyDirs already
+// there, it may not be overwritten or appended to except to resume the
+// interrupted upload of the user.
+func (fc *FtpConn) writeOnlyExists(path string) bool {
+	if !fc.writeOnlyFile(path) {
+		return false
+	}
+	if _, err := fc.driver.Stat(path); err != nil {
+		return false
+	}
+	return !fc.uploads.partial(fc.uploadKey(path), fc.user)
+}
+
+// sendMessage reply code with msg before the reply line if any, %u, %h,
+// %r, %d, %t, %q, %f and %% of msg are expanded.
+func (fc *FtpConn) sendMessage(code int, msg, reply string) {
+	msg = strings.TrimRight(strings.ReplaceAll(msg, "\r\n", "\n"), "\n")
+	if len(msg) == 0 {
+		fc.Send(code, reply)
+		return
+	}
+	lines := strings.Split(fc.expandMessage(msg), "\n")
+	for i := 1; i < len(lines); i++ {
+		lines[i] = " " + lines[i]
+	}
+	fc.SendMulti(code, lines[0], strings.Join(lines[1:], "\r\n"), reply)
+}
+
+// expandMessage expand the variables of a message: %u the user, %h the
+// virtual host, %r the client ip, %d the current directory, %t the time,
+// %q and %f the bytes and files left of quota, %% a percent sign.
+func (fc *FtpConn) expandMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] != '%' || i+1 == len(msg) {
+			b.WriteByte(msg[i])
+			continue
+		}
+		i++
+		switch msg[i] {
+		case 'u':
+			b.WriteString(fc.user)
+		case 'h':
+			b.WriteString(fc.host)
+		case 'r':
+			b.WriteString(fc.remoteIP())
+		case 'd':
+			b.WriteString(fc.path)
+		case 't':
+			b.WriteString(time.Now().Format("2006-01-02 15:04:05 MST"))
+		case 'q', 'f':
+			bytes, files := fc.quotaLeft()
+			if msg[i] == 'q' {
+				b.WriteString(bytes)
+			} else {
+				b.WriteString(files)
+			}
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(msg[i])
+		}
+	}
+	return b.String()
+}
+
+// quotaLeft return the bytes and files left of the quota of login user,
+// "unlimited" if no limit.
+func (fc *FtpConn) quotaLeft() (string, string) {
+	maxBytes, maxFiles := fc.quotaLimits()
+	bytes, files, _ := fc.quota.get(fc.hostKey(fc.user))
+	left := func(max, used int64) string {
+		if max <= 0 {
+			return "unlimited"
+		}
+		if used > max {
+			used = max
+		}
+		return strconv.FormatInt(max-used, 10)
+	}
+	return left(maxBytes, bytes), left(int64(maxFiles), int64(files))
+}
+
+// uploadKey return the key of path in upload tracker
+func (fc *FtpConn) uploadKey(path string) string {
+	return fc.hostKey(fc.driverHome() + path)
+}
+
+// partialUpload handle the partial file of an interrupted upload of path,
+// it is deleted with DeletePartialUploads or kept ResumeTimeout for the
+// client to resume with REST and STOR or APPE before deleted. Only a file
+// the upload created is deleted, not one it appends to.
+func (fc *FtpConn) partialUpload(path string, created bool) {
+	if !created {
+		return
+	}
+	if fc.config.DeletePartialUploads && fc.offset == 0 {
+		if err := fc.driver.DeleteFile(path); err != nil {
+			fc.log(LogError, "delete partial upload fail", "path", path, "err", err)
+		}
+		return
+	}
+	if fc.config.ResumeTimeout <= 0 {
+		return
+	}
+	fi, err := fc.driver.Stat(path)
+	if err != nil {
+		return
+	}
+	fc.log(LogInfo, "keep partial upload", "path", path, "size", fi.Size())
+	timeout := time.Duration(fc.config.ResumeTimeout) * time.Second
+	fc.uploads.interrupt(fc.uploadKey(path), fi.Size(), timeout, fc.partialCleanup(path, fi.Size()))
+}
+
+// partialCleanup return the function deleting the partial file of path
+// not resumed in time, with a driver of its own as the session may be
+// gone, a file changed since is kept.
+func (fc *FtpConn) partialCleanup(path string, size int64) func() {
+	factory, home, login, user := fc.factory, fc.driverHome(), fc.user, fc.hostKey(fc.user)
+	return func() {
+		driver, err := newUserDriver(factory, login, home)
+		if err != nil {
+			fc.log(LogError, "open driver fail", "err", err)
+			return
+		}
+		defer closeDriver(driver)
+		fi, err := driver.Stat(path)
+		if err != nil || fi.Size() != size {
+			return
+		}
+		if err := driver.DeleteFile(path); err != nil {
+			fc.log(LogError, "delete partial upload fail", "path", path, "err", err)
+			return
+		}
+		fc.quota.add(user, -size, -1)
+		fc.log(LogInfo, "delete partial upload not resumed", "path", path)
+	}
+}
+
+// uploadComplete call TransferComplete handler for an upload, the uploaded
+// file is deleted if the handler rejects it and the upload created it at
+// offset 0, a resumed or appended upload leaves the existing file in place.
+func (fc *FtpConn) uploadComplete(path string, offset, size int64) error {
+	if fc.handler.TransferComplete == nil {
+		return nil
+	}
+	err := fc.handler.TransferComplete(fc.user, path, size)
+	if err != nil {
+		if offset > 0 {
+			fc.log(LogInfo, "keep rejected resumed upload", "path", path, "offset", offset)
+		} else if derr := fc.driver.DeleteFile(path); derr != nil {
+			fc.log(LogError, "delete rejected upload fail", "path", path, "err", derr)
+		}
+	}
+	return err
+}
+
+// uploadNameAllowed return whether the upload file name matches the
+// UploadNamePattern of user, or else the global one
+func (fc *FtpConn) uploadNameAllowed(path string) bool {
+	re := fc.config.uploadNameRegexp
+	if user, ok := fc.userConfig(); ok && user.uploadNameRegexp != nil {
+		re = user.uploadNameRegexp
+	}
+	if re == nil {
+		return true
+	}
+	return re.MatchString(filepath.Base(path))
+}
+
+// quote return quoted string
+func (fc *FtpConn) quote(s string) string {
+	if !strings.Contains(s, "\"") {
+		return s
+	}
+	return strings.ReplaceAll(s, "\"", `""`)
+}
+
+// pasvIP return the ipv4 address advertised in PASV reply, the one of the
+// first Networks the client is in, the configured IP or Host, or the local
+// address of control connection which the client reached us on, so
+// multi-homed hosts advertise the right address for every client.
+func (fc *FtpConn) pasvIP() net.IP {
+	for _, pn := range fc.config.pasvNets {
+		if networksContain(pn.nets, fc.remoteIP()) {
+			return fc.resolvePasv(pn.address)
+		}
+	}
+	if len(fc.config.Pasv.IP) > 0 {
+		return net.ParseIP(fc.config.Pasv.IP).To4()
+	}
+	if len(fc.config.Pasv.Host) > 0 {
+		return fc.resolvePasv(fc.config.Pasv.Host)
+	}
+	return fc.localIP().To4()
+}
+
+// resolvePasv return the ipv4 address of a PASV address, hostnames are
+// resolved every reply to follow dynamic dns, the local address of control
+// connection is used if it fails.
+func (fc *FtpConn) resolvePasv(address string) net.IP {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.To4()
+	}
+	ctx, cancel := context.WithTimeout(fc.ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		fc.log(LogWarn, "resolve pasv host fail", "host", address, "err", err)
+		return fc.localIP().To4()
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+	fc.log(LogWarn, "no ipv4 address of pasv host", "host", address)
+	return fc.localIP().To4()
+}
+
+// localIP return the local ip of control connection, nil if it is not tcp
+func (fc *FtpConn) localIP() net.IP {
+	if addr, ok := fc.ctrlConn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// localAddr return the local address of control connection for display
+func (fc *FtpConn) localAddr() string {
+	if ip := fc.localIP(); ip != nil {
+		return ip.String()
+	}
+	return fc.ctrlConn.LocalAddr().String()
+}
+
+// pasvListen listen a passive port from the port pool on the local address
+// of control connection, or on all addresses if control connection is not
+// tcp. The port is released when the data connection is closed.
+func (fc *FtpConn) pasvListen() (*net.TCPListener, error) {
+	portStart, portEnd := fc.pasvPortRange()
+	listener, err := fc.ports.listen(fc.localIP(), portStart, portEnd)
+	if err != nil {
+		return nil, err
+	}
+	fc.lock.Lock()
+	fc.pasvPort = listener.Addr().(*net.TCPAddr).Port
+	fc.lock.Unlock()
+	listener.SetDeadline(time.Now().Add(time.Duration(fc.config.Pasv.ListenTimeout) * time.Second))
+	return listener, nil
+}
+
+// pasvPortRange return the passive port range of login user,
+// the global range if the user has none.
+func (fc *FtpConn) pasvPortRange() (int, int) {
+	if user, ok := fc.userConfig(); ok && fc.authd && user.PasvPortStart > 0 {
+		return user.PasvPortStart, user.PasvPortEnd
+	}
+	return fc.config.Pasv.PortStart, fc.config.Pasv.PortEnd
+}
+
+// throttleKBps return the upload and download KB/s limits of login user,
+// the Throttle ones if the user has none, 0 means no limit.
+func (fc *FtpConn) throttleKBps() (int, int) {
+	up, down := fc.config.Throttle.UploadKBps, fc.config.Throttle.DownloadKBps
+	if user, ok := fc.userConfig(); ok && fc.authd {
+		if user.UploadKBps != 0 {
+			up = user.UploadKBps
+		}
+		if user.DownloadKBps != 0 {
+			down = user.DownloadKBps
+		}
+	}
+	if up < 0 {
+		up = 0
+	}
+	if down < 0 {
+		down = 0
+	}
+	return up, down
+}
+
+// log write a log entry with the fields of session
+func (fc *FtpConn) log(level LogLevel, msg string, keyvals ...interface{}) {
+	// data transfer goroutines log while the next command is read, user and
+	// cmd are written under logLock for them.
+	fc.logLock.Lock()
+	user, cmd := fc.user, fc.cmd
+	fc.logLock.Unlock()
+	fields := []interface{}{"session", fc.id, "remote", fc.conn.RemoteAddr().String()}
+	if len(user) > 0 {
+		fields = append(fields, "user", user)
+	}
+	if len(cmd) > 0 {
+		fields = append(fields, "command", cmd)
+	}
+	fc.logger.Log(level, msg, append(fields, keyvals...)...)
+}
+
+// readOnly return whether the login user is read-only
+func (fc *FtpConn) readOnly() bool {
+	user, ok := fc.userConfig()
+	return ok && user.ReadOnly
+}
+
+// admin return whether the login user is an admin
+func (fc *FtpConn) admin() bool {
+	user, ok := fc.userConfig()
+	return ok && fc.authd && user.Admin
+}
+
+// permitted return whether the permission flags of login user allow command
+func (fc *FtpConn) permitted(command string) bool {
+	perm, ok := permCmds[command]
+	if !ok {
+		return true
+	}
+	user, ok := fc.userConfig()
+	if !ok {
+		return true
+	}
+	flag := perm(user)
+	return flag == nil || *flag
+}
+
+// userConfig return the settings of user, the ones loaded from the user
+// store at login or else the ones in Users
+func (fc *FtpConn) userConfig() (FtpdUser, bool) {
+	if fc.account != nil {
+		return *fc.account, true
+	}
+	user, ok := fc.config.Users[fc.user]
+	return user, ok
+}
+
+// quotaLimits return the byte and file quota of login user, 0 means no limit
+func (fc *FtpConn) quotaLimits() (int64, int) {
+	user, ok := fc.userConfig()
+	if !ok {
+		return 0, 0
+	}
+	return user.QuotaBytes, user.QuotaFiles
+}
+
+// loadQuota compute the usage of login user with quota by walking the
+// files of driver, once for a user as the sessions keep it up to date.
+func (fc *FtpConn) loadQuota() {
+	maxBytes, maxFiles := fc.quotaLimits()
+	if maxBytes == 0 && maxFiles == 0 {
+		return
+	}
+	if _, _, ok := fc.quota.get(fc.hostKey(fc.user)); ok {
+		return
+	}
+	bytes, files, err := fc.walkUsage("/")
+	if err != nil {
+		fc.log(LogError, "load quota fail", "err", err)
+		return
+	}
+	fc.quota.set(fc.hostKey(fc.user), bytes, files)
+}
+
+// walkUsage return the bytes and files under dir, the Mounts are not
+// walked as their files are not in quota.
+func (fc *FtpConn) walkUsage(dir string) (int64, int, error) {
+	var bytes int64
+	var files int
+	var walk func(string) error
+	walk = func(dir string) error {
+		return fc.driver.ListDir(dir, func(info FileInfo) error {
+			path := filepath.ToSlash(filepath.Join(dir, info.Name()))
+			if fc.inMount(path) {
+				return nil
+			}
+			if info.IsDir() {
+				return walk(path)
+			}
+			bytes += info.Size()
+			files++
+			return nil
+		})
+	}
+	err := walk(dir)
+	return bytes, files, err
+}
+
+// inMount return whether path is or lies in one of Mounts
+func (fc *FtpConn) inMount(path string) bool {
+	for _, m := range fc.config.Mounts {
+		mp := jailpath(m.Path)
+		if path == mp || strings.HasPrefix(path, mp+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaCheck return the file info of path before upload and the quota
+// reserved for the upload, nil without quota, false if the user is over
+// quota.
+func (fc *FtpConn) quotaCheck(path string) (FileInfo, *quotaReservation, bool) {
+	old, err := fc.driver.Stat(path)
+	if err != nil {
+		old = nil
+	}
+	if fc.inMount(path) {
+		return old, nil, true
+	}
+	var replaced int64
+	if old != nil && fc.offset == 0 {
+		// the old file is replaced.
+		replaced = old.Size()
+	}
+	maxBytes, maxFiles := fc.quotaLimits()
+	res, ok := fc.quota.reserve(fc.hostKey(fc.user), old == nil, replaced, maxBytes, maxFiles)
+	return old, res, ok
+}
+
+// quotaUpdate apply the change of path since old to the usage of user,
+// in place of the usage reserved by res if any.
+func (fc *FtpConn) quotaUpdate(path string, old FileInfo, res *quotaReservation) {
+	if fc.inMount(path) {
+		return
+	}
+	if _, _, ok := fc.quota.get(fc.hostKey(fc.user)); !ok {
+		return
+	}
+	var bytes int64
+	files := 0
+	if old != nil {
+		bytes -= old.Size()
+		files--
+	}
+	if info, err := fc.driver.Stat(path); err == nil {
+		bytes += info.Size()
+		files++
+	}
+	if res != nil {
+		res.settle(bytes, files)
+		return
+	}
+	fc.quota.add(fc.hostKey(fc.user), bytes, files)
+}
+
+// quotaRename apply a rename of from over replaced to the usage of user,
+// a file moved in or out of Mounts is added or dropped.
+func (fc *FtpConn) quotaRename(from, to string, replaced FileInfo) {
+	user := fc.hostKey(fc.user)
+	if _, _, ok := fc.quota.get(user); !ok {
+		return
+	}
+	if replaced != nil && !fc.inMount(to) {
+		fc.quota.add(user, -replaced.Size(), -1)
+	}
+	if fc.inMount(from) == fc.inMount(to) {
+		return
+	}
+	bytes, files := int64(0), 0
+	if info, err := fc.driver.Stat(to); err == nil {
+		if info.IsDir() {
+			bytes, files, _ = fc.walkUsage(to)
+		} else {
+			bytes, files = info.Size(), 1
+		}
+	}
+	if fc.inMount(to) {
+		bytes, files = -bytes, -files
+	}
+	fc.quota.add(user, bytes, files)
+}
+
+// Close close ftp connections
+func (fc *FtpConn) Close() {
+	fc.cancel()
+	if fc.driver != nil {
+		closeDriver(fc.driver)
+	}
+	if fc.ctrlConn != nil {
+		fc.ctrlConn.Close()
+		fc.ctrlConn = nil
+	}
+}
+
+// closePasvListener close the passive listener still waiting for client
+func (fc *FtpConn) closePasvListener() {
+	fc.stateLock.Lock()
+	defer fc.stateLock.Unlock()
+	if fc.pasvListener != nil {
+		fc.pasvListener.Close()
+	}
+}
+
+// resetFileTransfer drop the previous PASV or PORT data connection which is
+// never used, before a new one is set up.
+func (fc *FtpConn) resetFileTransfer() {
+	fc.stateLock.Lock()
+	listener := fc.pasvListener
+	fc.pasvListener = nil
+	fc.stateLock.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	select {
+	case <-fc.notify:
+	default:
+	}
+	fc.CloseFileTransfer()
+}
+
+// spawn run fn in a helper goroutine of the session, return false without
+// running it if the session already has MaxSessionGoroutines running.
+func (fc *FtpConn) spawn(fn func()) bool {
+	fc.stateLock.Lock()
+	if fc.config.MaxSessionGoroutines > 0 && fc.goroutines >= fc.config.MaxSessionGoroutines {
+		fc.stateLock.Unlock()
+		fc.log(LogWarn, "too many session goroutines", "goroutines", fc.goroutines)
+		return false
+	}
+	fc.goroutines++
+	fc.stateLock.Unlock()
+
+	go func() {
+		defer func() {
+			fc.stateLock.Lock()
+			fc.goroutines--
+			fc.stateLock.Unlock()
+		}()
+		fn()
+	}()
+	return true
+}
+
+// Goroutines return the number of helper goroutines running in the session
+func (fc *FtpConn) Goroutines() int {
+	fc.stateLock.Lock()
+	defer fc.stateLock.Unlock()
+	return fc.goroutines
+}
+
+// setLoginUser record the logged in user for the server to look up sessions
+func (fc *FtpConn) setLoginUser(user string) {
+	fc.stateLock.Lock()
+	fc.loginUser = user
+	fc.stateLock.Unlock()
+}
+
+// kick close the session with 421 whatever it is doing
+func (fc *FtpConn) kick() {
+	fc.Send(421, "Session closed by administrator.")
+	fc.abort()
+}
+
+// abort close the session from outside, canceling the driver operation
+// in flight and the passive listener.
+func (fc *FtpConn) abort() {
+	fc.cancel()
+	fc.closePasvListener()
+	fc.conn.Close()
+}
+
+// serverClosing return whether the server is shutting down, no new
+// transfer is started then.
+func (fc *FtpConn) serverClosing() bool {
+	return fc.server != nil && fc.server.isClosing()
+}
+
+// setBusy mark whether the session is handling a command,
+// return false if the server is shutting down.
+func (fc *FtpConn) setBusy(busy bool) bool {
+	fc.stateLock.Lock()
+	fc.busy = busy
+	fc.stateLock.Unlock()
+	return fc.server == nil || !fc.server.isClosing()
+}
+
+// shutdown close the session if it is idle or its passive listener otherwise,
+// a busy session quits after the current command.
+func (fc *FtpConn) shutdown() {
+	fc.stateLock.Lock()
+	defer fc.stateLock.Unlock()
+	if fc.pasvListener != nil {
+		fc.pasvListener.Close()
+	}
+	if !fc.busy {
+		fc.conn.Close()
+	}
+}
+
+// OpenFileTransfer open a ftp file transfer
+func (fc *FtpConn) OpenFileTransfer(conn net.Conn) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.dataConn != nil {
+		fc.dataConn.Close()
+	}
+	fc.log(LogDebug, "open data connection", "port", fc.pasvPort)
+	fc.stateLock.Lock()
+	fc.activeConn = conn
+	fc.stateLock.Unlock()
+	if fc.protP {
+		conn = &tlsDataConn{Conn: tls.Server(conn, fc.tlsConfig), requireReuse: fc.config.AuthTLS.RequireReuse}
+	}
+	if fc.config.TransferStallTimeout > 0 {
+		conn = &stallConn{conn, time.Duration(fc.config.TransferStallTimeout) * time.Second}
+	}
+	fc.dataConn = conn
+}
+
+// errTLSNotReused - the data connection not resume the tls session of
+// control connection
+var errTLSNotReused = errors.New("tls session of data connection not reused")
+
+// tlsDataConn - data connection protected by PROT P, the handshake runs at
+// the first read or write as the client starts it after the 150 reply. The
+// tls config is the one of the session, so only a data connection resuming
+// the session of control connection resumes at all.
+type tlsDataConn struct {
+	*tls.Conn
+	requireReuse bool
+	once         sync.Once
+	err          error
+}
+
+// handshake run the tls handshake, fail if the session not resumed but
+// required.
+func (c *tlsDataConn) handshake() error {
+	c.once.Do(func() {
+		if c.err = c.Conn.Handshake(); c.err != nil {
+			return
+		}
+		if c.requireReuse && !c.Conn.ConnectionState().DidResume {
+			c.err = errTLSNotReused
+		}
+	})
+	return c.err
+}
+
+// Read read after the handshake
+func (c *tlsDataConn) Read(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// Write write after the handshake
+func (c *tlsDataConn) Write(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// stallConn - data connection failing a read or write which makes no
+// progress in timeout, however long the whole transfer takes.
+type stallConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read read with the deadline renewed
+func (c *stallConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// Write write with the deadline renewed
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// openBandwidthFlow join the transfer to the shared bandwidth of server
+func (fc *FtpConn) openBandwidthFlow() *bandwidthFlow {
+	if fc.server == nil {
+		return nil
+	}
+	limiter := fc.server.bandwidthLimiter()
+	if limiter == nil {
+		return nil
+	}
+	weight, ok := fc.config.Bandwidth.Weights[fc.user]
+	if !ok || weight <= 0 {
+		weight = 1
+	}
+	return limiter.open(weight)
+}
+
+// CloseFileTransfer close a ftp file transfer
+func (fc *FtpConn) CloseFileTransfer() {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.flow != nil {
+		fc.flow.close()
+		fc.flow = nil
+	}
+	if fc.throttle != nil {
+		fc.throttle.close()
+		fc.throttle = nil
+	}
+	bytesIn, bytesOut := atomic.SwapInt64(&fc.bytesIn, 0), atomic.SwapInt64(&fc.bytesOut, 0)
+	if bytesIn > 0 || bytesOut > 0 {
+		if err := usageStore.Add(fc.user, bytesIn, bytesOut); err != nil {
+			fc.log(LogError, "add usage fail", "err", err)
+		}
+	}
+	fc.stateLock.Lock()
+	fc.activeConn = nil
+	fc.stateLock.Unlock()
+	if fc.dataConn != nil {
+		fc.dataConn.Close()
+		fc.dataConn = nil
+		fc.log(LogDebug, "close data connection", "port", fc.pasvPort)
+	}
+	if fc.pasvPort != 0 {
+		fc.ports.release(fc.pasvPort)
+		fc.pasvPort = 0
+	}
+}
+
+// GetFileTransfer return a client file reader transfer, each layer only
+// reads the data connection when the driver reads it and keeps no more
+// than a fixed buffer, so a slow driver holds back the client by TCP flow
+// control instead of buffering the upload.
+func (fc *FtpConn) GetFileTransfer() io.Reader {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.dataConn == nil {
+		return nil
+	}
+	if fc.flow == nil {
+		fc.flow = fc.openBandwidthFlow()
+	}
+	var reader io.Reader = fc.dataConn
+	if fc.flow != nil {
+		reader = &bandwidthReader{reader, fc.flow}
+	}
+	if fc.throttle == nil {
+		if up, _ := fc.throttleKBps(); up > 0 {
+			fc.throttle = fc.throttles.open(fc.hostKey(fc.user), true, up)
+		}
+	}
+	if fc.throttle != nil {
+		reader = &bandwidthReader{reader, fc.throttle}
+	}
+	reader = &countReader{reader, &fc.bytesIn}
+	if fc.modeZ {
+		reader = &zlibReader{reader: reader}
+	}
+	// only after TYPE A, a client never sending TYPE expects no conversion
+	// of the ASCII type a session starts in.
+	if fc.typeA && fc.config.AsciiUpload {
+		reader = &lfReader{reader: bufio.NewReader(reader)}
+	}
+	return reader
+}
+
+// PutFileTransfer transfer a ftp file to client
+func (fc *FtpConn) PutFileTransfer(reader io.Reader) error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.dataConn == nil {
+		return errNoDataConn
+	}
+	var writer io.Writer = fc.dataConn
+	if fc.flow == nil {
+		fc.flow = fc.openBandwidthFlow()
+	}
+	if fc.flow != nil {
+		writer = &bandwidthWriter{writer, fc.flow}
+	}
+	if fc.throttle == nil {
+		if _, down := fc.throttleKBps(); down > 0 {
+			fc.throttle = fc.throttles.open(fc.hostKey(fc.user), false, down)
+		}
+	}
+	if fc.throttle != nil {
+		writer = &bandwidthWriter{writer, fc.throttle}
+	}
+	if fc.typeA && fc.config.AsciiDownload {
+		reader = &crlfReader{reader: bufio.NewReader(reader)}
+	}
+	if fc.modeZ {
+		zw, err := zlib.NewWriterLevel(writer, fc.zlibLevel())
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(zw, reader)
+		atomic.AddInt64(&fc.bytesOut, n)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	n, err := io.Copy(writer, reader)
+	atomic.AddInt64(&fc.bytesOut, n)
+	return err
+}
+
+// zlibLevel return the MODE Z compression level of session
+func (fc *FtpConn) zlibLevel() int {
+	if fc.zlevel > 0 {
+		return fc.zlevel
+	}
+	return fc.config.ModeZ.Level
+}
+
+// transferWriter - writer of file transfer
+type transferWriter struct {
+	fc *FtpConn
+}
+
+func (w transferWriter) Write(p []byte) (int, error) {
+	if err := w.fc.WriteFileTransfer(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// zlibReader - reader of a MODE Z upload, the stream header is read by
+// the first Read so no byte is waited for before the 150 reply.
+type zlibReader struct {
+	reader io.Reader
+	zr     io.ReadCloser
+}
+
+func (r *zlibReader) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		br := bufio.NewReader(r.reader)
+		if _, err := br.Peek(1); err != nil {
+			// an empty file may be sent as no stream at all.
+			return 0, err
+		}
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(p)
+}
+
+// lfReader - reader of an ASCII mode upload converting CRLF to LF, the
+// bytes are converted as they stream so a file is never buffered whole.
+type lfReader struct {
+	reader *bufio.Reader
+	err    error
+}
+
+func (r *lfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && r.err == nil {
+		// return what is converted rather than wait for more bytes.
+		if n > 0 && r.reader.Buffered() == 0 {
+			break
+		}
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			r.err = err
+			break
+		}
+		if b == '\r' {
+			if next, err := r.reader.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+		p[n] = b
+		n++
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+// crlfReader - reader of an ASCII mode download converting LF to CRLF,
+// a CRLF already in the file is kept as is.
+type crlfReader struct {
+	reader *bufio.Reader
+	prev   byte
+	lf     bool
+	err    error
+}
+
+func (r *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	if r.lf && len(p) > 0 {
+		// the LF of a CRLF not fitting the previous read.
+		p[0] = '\n'
+		n = 1
+		r.lf = false
+	}
+	for n < len(p) && r.err == nil {
+		if n > 0 && r.reader.Buffered() == 0 {
+			break
+		}
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			r.err = err
+			break
+		}
+		if b == '\n' && r.prev != '\r' {
+			p[n] = '\r'
+			n++
+			if n == len(p) {
+				r.prev = b
+				r.lf = true
+				break
+			}
+		}
+		r.prev = b
+		p[n] = b
+		n++
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+// listWriter - writer of a listing to file transfer, lines are buffered
+// and flushed every ListBatchSize lines or when the buffer is full.
+type listWriter struct {
+	buf   *bufio.Writer
+	zw    *zlib.Writer
+	batch int
+	lines int
+}
+
+// newListWriter return a listing writer of file transfer
+func (fc *FtpConn) newListWriter() (*listWriter, error) {
+	w := &listWriter{batch: fc.config.ListBatchSize}
+	var out io.Writer = transferWriter{fc}
+	if fc.modeZ {
+		// one stream for the whole listing, flushed by batch.
+		zw, err := zlib.NewWriterLevel(out, fc.zlibLevel())
+		if err != nil {
+			return nil, err
+		}
+		w.zw = zw
+		out = zw
+	}
+	w.buf = bufio.NewWriter(out)
+	return w, nil
+}
+
+// WriteLine write a listing line
+func (w *listWriter) WriteLine(line string) error {
+	if _, err := w.buf.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	w.lines++
+	if w.batch > 0 && w.lines%w.batch == 0 {
+		if err := w.buf.Flush(); err != nil {
+			return err
+		}
+		if w.zw != nil {
+			return w.zw.Flush()
+		}
+	}
+	return nil
+}
+
+// Close write the buffered lines and end the MODE Z stream
+func (w *listWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+// WriteListTransfer write listing lines to file transfer,
+// ListBatchSize lines a write to balance latency and throughput.
+func (fc *FtpConn) WriteListTransfer(lines []string) error {
+	w, err := fc.newListWriter()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// WriteFileTransfer write all data to file transfer
+func (fc *FtpConn) WriteFileTransfer(msg []byte) error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.dataConn == nil {
+		return errNoDataConn
+	}
+	fc.log(LogDebug, "send data", "bytes", len(msg))
+	for len(msg) > 0 {
+		n, err := fc.dataConn.Write(msg)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// replyCode return the reply code overridden by ReplyCodes for current command
+func (fc *FtpConn) replyCode(code int) int {
+	if c, ok := fc.config.ReplyCodes[fmt.Sprintf("%s_%d", fc.cmd, code)]; ok {
+		return c
+	}
+	return code
+}
+
+// Send send code and message to client
+func (fc *FtpConn) Send(code int, msg string) {
+	fc.sendLock.Lock()
+	defer fc.sendLock.Unlock()
+	code = fc.replyCode(code)
+	fc.log(LogDebug, "send", "code", code, "reply", msg)
+	fc.writer.WriteString(fmt.Sprintf("%d %s\r\n", code, msg))
+	fc.writer.Flush()
+}
+
+// SendMulti send code and multiple line message to client
+func (fc *FtpConn) SendMulti(code int, header, body, footer string) {
+	fc.sendLock.Lock()
+	defer fc.sendLock.Unlock()
+	code = fc.replyCode(code)
+	fc.log(LogDebug, "send", "code", code, "reply", header+"\n"+body+"\n"+footer)
+	if len(body) > 0 {
+		fc.writer.WriteString(fmt.Sprintf("%d-%s\r\n%s\r\n%d %s\r\n", code, header, body, code, footer))
+	} else {
+		fc.writer.WriteString(fmt.Sprintf("%d-%s\r\n%d %s\r\n", code, header, code, footer))
+	}
+	fc.writer.Flush()
+}
+
+// Serve parse and handle ftp client data
+func (fc *FtpConn) Serve() {
+	banner := fc.config.Banner
+	if len(banner) == 0 {
+		banner = "KFtpd"
+		if fc.config.Stealth {
+			banner = "FTP server ready."
+		}
+	}
+	fc.sendMessage(220, fc.bannerMessage(), fc.expandMessage(banner))
+	fc.lines = make(chan ctrlLine)
+	fc.resume = make(chan struct{})
+	go fc.readLines()
+	for {
+		// the idle timer runs only between commands, not in transfers.
+		var idle *time.Timer
+		var timeout <-chan time.Time
+		if fc.config.IdleTimeout > 0 {
+			idle = time.NewTimer(time.Duration(fc.config.IdleTimeout) * time.Second)
+			timeout = idle.C
+		}
+		var cl ctrlLine
+		select {
+		case cl = <-fc.lines:
+		case <-timeout:
+			fc.log(LogInfo, "idle timeout")
+			fc.Send(421, "Timeout.")
+			cl.err = errIdleTimeout
+		case <-fc.ctx.Done():
+			cl.err = fc.ctx.Err()
+		}
+		if idle != nil {
+			idle.Stop()
+		}
+		if cl.err != nil {
+			break
+		}
+		err := fc.Exec(cl.line)
+		if cl.pause {
+			select {
+			case fc.resume <- struct{}{}:
+			case <-fc.ctx.Done():
+			}
+		}
+		if err == ErrSessionClosed {
+			break
+		}
+	}
+	fc.closePasvListener()
+	fc.CloseFileTransfer()
+	fc.Close()
+}
+
+// readLines read command lines from client while the previous command is
+// running, so an ABOR can interrupt the transfer in progress.
+func (fc *FtpConn) readLines() {
+	for {
+		line, _, err := fc.reader.ReadLine()
+		cl := ctrlLine{line: string(line), err: err}
+		if err == nil {
+			if len(line) == 0 {
+				continue
+			}
+			command := strings.ToUpper(strings.SplitN(trimTelnet(cl.line), " ", 2)[0])
+			if command == "ABOR" {
+				fc.abortTransfer()
+			}
+			cl.pause = command == "AUTH"
+		}
+		select {
+		case fc.lines <- cl:
+		case <-fc.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		if cl.pause {
+			select {
+			case <-fc.resume:
+			case <-fc.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// trimTelnet drop the telnet IP and Synch sequences clients send before ABOR
+func trimTelnet(line string) string {
+	for len(line) >= 2 && line[0] == 0xff {
+		line = line[2:]
+	}
+	return line
+}
+
+// abortTransfer close the data connection and passive listener of the
+// command running, which fails with 426 and leaves ABOR to reply 226.
+func (fc *FtpConn) abortTransfer() {
+	fc.stateLock.Lock()
+	defer fc.stateLock.Unlock()
+	if !fc.busy {
+		return
+	}
+	fc.aborted = true
+	if fc.pasvListener != nil {
+		fc.pasvListener.Close()
+	}
+	if fc.activeConn != nil {
+		fc.activeConn.Close()
+	}
+	if fc.abortHash != nil {
+		fc.abortHash()
+	}
+}
+
+// ErrSessionClosed - returned by Exec when the session must be closed
+var ErrSessionClosed = errors.New("kftpd: session closed")
+
+// Exec handle a command line as if received from client, the reply is
+// written to the control connection. It returns the error of command
+// handler, or ErrSessionClosed if the session must be closed.
+func (fc *FtpConn) Exec(line string) error {
+	words := strings.SplitN(trimTelnet(line), " ", 2)
+	command := strings.ToUpper(words[0])
+	fc.logLock.Lock()
+	fc.cmd = command
+	fc.logLock.Unlock()
+	if len(words) == 2 {
+		fc.arg = words[1]
+	} else {
+		fc.arg = ""
+	}
+	if command == "PASS" {
+		fc.log(LogDebug, "recv", "line", "PASS ****")
+	} else {
+		fc.log(LogDebug, "recv", "line", line)
+	}
+	// a pending rename is only valid for the command right after RNFR.
+	if command != "RNTO" {
+		fc.rename = ""
+	}
+	if command == "HELP" {
+		if fc.config.Stealth {
+			fc.Send(214, "Help OK.")
+			return nil
+		}
+		var cmds []string
+		for cmd := range cmdMap {
+			cmds = append(cmds, " "+cmd)
+		}
+		sort.Strings(cmds)
+		fc.SendMulti(214, "The following commands are recognized.", strings.Join(cmds, "\r\n"), "Help OK.")
+		return nil
+	}
+	cmd, ok := cmdMap[command]
+	if !ok {
+		fc.Send(500, "Unknown command.")
+		return nil
+	}
+	if cmd.Auth && !fc.authd {
+		fc.Send(530, "Please login with USER and PASS.")
+		return nil
+	}
+	if (writeCmds[command] && fc.readOnly()) || !fc.permitted(command) {
+		fc.Send(550, "Permission denied.")
+		return nil
+	}
+	// a lazy driver is created by the first command needs login.
+	if cmd.Auth && fc.driver == nil {
+		if err := fc.openDriver(); err != nil {
+			fc.log(LogError, "open driver fail", "err", err)
+			fc.Send(421, "Service not available, closing control connection.")
+			return ErrSessionClosed
+		}
+	}
+	if !fc.setBusy(true) {
+		fc.Send(421, "Server shutting down.")
+		return ErrSessionClosed
+	}
+	err := cmd.Fn(fc)
+	if err != nil && err != ErrSessionClosed {
+		fc.log(LogWarn, "command fail", "err", err)
+	}
+	if !fc.setBusy(false) {
+		fc.Send(421, "Server shutting down.")
+		return ErrSessionClosed
+	}
+	return err
+}
+
+// Login mark the session logged in as user with driver, skipping USER and
+// PASS, for driving handlers with Exec directly such as in tests.
+func (fc *FtpConn) Login(user string, driver Driver) {
+	fc.logLock.Lock()
+	fc.user = user
+	fc.logLock.Unlock()
+	fc.setDriver(driver)
+	fc.authd = true
+	fc.setLoginUser(user)
+}
+
+// UserBeforeLogin register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func UserBeforeLogin(handler func(string, string) bool) {
+	ftpHandler.UserBeforeLogin = handler
+}
+
+// UserAfterLogin register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func UserAfterLogin(handler func(string)) {
+	ftpHandler.UserAfterLogin = handler
+}
+
+// ClientBeforePasv register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func ClientBeforePasv(handler func(string) bool) {
+	ftpHandler.ClientBeforePasv = handler
+}
+
+// ClientBeforePort register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func ClientBeforePort(handler func(string) bool) {
+	ftpHandler.ClientBeforePort = handler
+}
+
+// FileBeforePut register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileBeforePut(handler func(string, string) bool) {
+	ftpHandler.FileBeforePut = handler
+}
+
+// FileAfterPut register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileAfterPut(handler func(string, string)) {
+	ftpHandler.FileAfterPut = handler
+}
+
+// FileBeforeGet register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileBeforeGet(handler func(string, string) bool) {
+	ftpHandler.FileBeforeGet = handler
+}
+
+// FileAfterGet register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileAfterGet(handler func(string, string)) {
+	ftpHandler.FileAfterGet = handler
+}
+
+// FileBeforeDelete register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileBeforeDelete(handler func(string, string) bool) {
+	ftpHandler.FileBeforeDelete = handler
+}
+
+// FileAfterDelete register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileAfterDelete(handler func(string, string)) {
+	ftpHandler.FileAfterDelete = handler
+}
+
+// FileBeforeRename register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileBeforeRename(handler func(string, string, string) bool) {
+	ftpHandler.FileBeforeRename = handler
+}
+
+// FileAfterRename register to the global handler.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func FileAfterRename(handler func(string, string, string)) {
+	ftpHandler.FileAfterRename = handler
+}
+
+// OnTransferComplete register to the global handler, called after a file
+// transfer before the final reply, a non-nil error fails the transfer and
+// deletes an uploaded file.
+//
+// Deprecated: use Server.SetHandler to scope hooks to a server.
+func OnTransferComplete(handler func(string, string, int64) error) {
+	ftpHandler.TransferComplete = handler
+}
+
+// LogLevel - severity of a log entry
+type LogLevel int
+
+// log levels from the most verbose
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+// logLevels - LogLevel config names
+var logLevels = map[string]LogLevel{
+	"debug": LogDebug,
+	"info":  LogInfo,
+	"warn":  LogWarn,
+	"error": LogError,
+}
+
+// String return the name of level
+func (level LogLevel) String() string {
+	for name, l := range logLevels {
+		if l == level {
+			return name
+		}
+	}
+	return strconv.Itoa(int(level))
+}
+
+// Logger - leveled logger, keyvals are fields of the entry alternating
+// between keys and values, such as "session", 1, "user", "kftpd".
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// textLogger - logger writing lines like "INFO msg key=value"
+type textLogger struct {
+	level  LogLevel
+	logger *log.Logger
+}
+
+// NewTextLogger return a logger writing text lines to w, entries below
+// level are dropped.
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &textLogger{level: level, logger: log.New(w, "", log.LstdFlags)}
+}
+
+// Log write an entry as a text line
+func (l *textLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		value := fmt.Sprint(keyvals[i+1])
+		if strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], value)
+	}
+	l.logger.Println(b.String())
+}
+
+// jsonLogger - logger writing an object a line, for log collectors
+type jsonLogger struct {
+	level LogLevel
+	lock  sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLogger return a logger writing JSON lines to w with time, level,
+// msg and the fields, entries below level are dropped.
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &jsonLogger{level: level, w: w}
+}
+
+// Log write an entry as a JSON line
+func (l *jsonLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		value := keyvals[i+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		entry[fmt.Sprint(keyvals[i])] = value
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"level": level.String(), "msg": msg, "err": err.Error()})
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.w.Write(append(data, '\n'))
+}
+
+// newConfigLogger return the logger of LogFormat and LogLevel,
+// Debug lowers the level to debug.
+func newConfigLogger(cfg *FtpdConfig) Logger {
+	level := cfg.logLevel
+	if cfg.Debug {
+		level = LogDebug
+	}
+	if cfg.LogFormat == "json" {
+		return NewJSONLogger(os.Stderr, level)
+	}
+	return NewTextLogger(os.Stderr, level)
+}
+
+// defaultLogger - logger of messages outside a server
+var defaultLogger = NewTextLogger(os.Stderr, LogInfo)
+
+// UsageStore - store of the bytes transferred by users, Add is called
+// when a file transfer is closed.
+type UsageStore interface {
+	Add(user string, in, out int64) error
+	Usage(user string) (int64, int64)
+}
+
+// memoryUsageStore - usage store in memory
+type memoryUsageStore struct {
+	lock  sync.Mutex
+	usage map[string][2]int64
+}
+
+// NewMemoryUsageStore return a usage store in memory
+func NewMemoryUsageStore() UsageStore {
+	return &memoryUsageStore{usage: make(map[string][2]int64)}
+}
+
+// Add add the bytes uploaded and downloaded by user
+func (store *memoryUsageStore) Add(user string, in, out int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	usage := store.usage[user]
+	usage[0] += in
+	usage[1] += out
+	store.usage[user] = usage
+	return nil
+}
+
+// Usage return the bytes uploaded and downloaded by user
+func (store *memoryUsageStore) Usage(user string) (int64, int64) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	usage := store.usage[user]
+	return usage[0], usage[1]
+}
+
+var usageStore = NewMemoryUsageStore()
+
+// SetUsageStore set a custom usage store, such as one flushing to database
+func SetUsageStore(store UsageStore) {
+	usageStore = store
+}
+
+// Usage return the bytes uploaded and downloaded by user
+func Usage(user string) (int64, int64) {
+	return usageStore.Usage(user)
+}
+
+var authenticator Authenticator
+
+// SetAuthenticator set a custom authenticator instead of users in config
+func SetAuthenticator(customAuthenticator Authenticator) {
+	authenticator = customAuthenticator
+}
+
+var factory DriverFactory
+
+// SetDriverFactory set a custom ftp driver factory
+func SetDriverFactory(customDriverFactory DriverFactory) {
+	factory = customDriverFactory
+}
+
+// NewFtpdConfig return a ftd config
+func NewFtpdConfig() *FtpdConfig {
+	var cfg FtpdConfig
+
+	cfg.Bind = ":21"
+	cfg.Driver = "file"
+	cfg.HomeDir = true
+	cfg.HomeTemplate = ""
+	cfg.Debug = true
+	cfg.Stealth = false
+	cfg.BounceProtection = true
+	cfg.Banner = ""
+	cfg.Syst = "UNIX Type: L8"
+	cfg.LogLevel = "info"
+	cfg.logLevel = LogInfo
+	cfg.LogFormat = "text"
+	cfg.UploadNamePattern = ""
+	cfg.DeletePartialUploads = false
+	cfg.ResumeTimeout = 0
+	cfg.ListBatchSize = 0
+	cfg.NlstClassify = false
+	cfg.AsciiUpload = true
+	cfg.AsciiDownload = true
+	cfg.MaxSessionGoroutines = 0
+	cfg.ListTimeZone = "Local"
+	cfg.listLocation = time.Local
+	cfg.FactTimeZone = "UTC"
+	cfg.factLocation = time.UTC
+	cfg.LazyDriver = false
+	cfg.DriverTimeout = 0
+	cfg.TransferStallTimeout = 0
+	cfg.IdleTimeout = 0
+	cfg.LoginMessage = ""
+	cfg.LoginMessageFile = ""
+	cfg.BannerFile = ""
+	cfg.DirMessageFile = ""
+	cfg.DirMessages = nil
+	cfg.WriteOnlyDirs = nil
+
+	cfg.Bandwidth.TotalKBps = 0
+
+	cfg.Throttle.UploadKBps = 0
+	cfg.Throttle.DownloadKBps = 0
+
+	cfg.ModeZ.Enable = false
+	cfg.ModeZ.Level = 6
+
+	cfg.Access.Allow = nil
+	cfg.Access.Deny = nil
+
+	cfg.LoginBan.MaxFailures = 0
+	cfg.LoginBan.FindTime = 600
+	cfg.LoginBan.BanTime = 900
+	cfg.LoginBan.FailDelay = 0
+
+	cfg.Pasv.Enable = true
+	cfg.Pasv.IP = ""
+	cfg.Pasv.Host = ""
+	cfg.Pasv.Networks = nil
+	cfg.Pasv.PortStart = 21000
+	cfg.Pasv.PortEnd = 21100
+	cfg.Pasv.ListenTimeout = 10
+
+	cfg.Port.Enable = true
+	cfg.Port.ConnectTimeout = 10
+
+	cfg.FileDriver.BaseDir = "kftpd-data"
+	cfg.FileDriver.MaxFilesPerDir = 0
+	cfg.FileDriver.SnapshotList = true
+	cfg.FileDriver.FollowSymlinks = false
+	cfg.FileDriver.DirMode = ""
+
+	cfg.MinioDriver.Endpoint = "127.0.0.1:9000"
+	cfg.MinioDriver.AccessKeyID = "minioadmin"
+	cfg.MinioDriver.SecretAccessKey = "minioadmin"
+	cfg.MinioDriver.Bucket = "kftpd-data"
+	cfg.MinioDriver.Prefix = ""
+	cfg.MinioDriver.UseSSL = false
+	cfg.MinioDriver.PresignExpire = 0
+	cfg.MinioDriver.PartSize = 16
+	cfg.MinioDriver.SmallUploadSize = 0
+	cfg.MinioDriver.CacheDir = "cache"
+	cfg.MinioDriver.CacheSize = 0
+	cfg.MinioDriver.CacheTTL = 0
+
+	cfg.S3Driver.Endpoint = "s3.amazonaws.com"
+	cfg.S3Driver.Region = "us-east-1"
+	cfg.S3Driver.Bucket = "kftpd-data"
+	cfg.S3Driver.AccessKeyID = ""
+	cfg.S3Driver.SecretAccessKey = ""
+	cfg.S3Driver.RoleARNs = nil
+	cfg.S3Driver.ExternalID = ""
+	cfg.S3Driver.STSEndpoint = ""
+	cfg.S3Driver.UseSSL = true
+	cfg.S3Driver.PathStyle = false
+	cfg.S3Driver.SSE = ""
+	cfg.S3Driver.SSEKMSKeyID = ""
+	cfg.S3Driver.PresignExpire = 0
+	cfg.S3Driver.PartSize = 16
+
+	cfg.GCSDriver.Bucket = "kftpd-data"
+	cfg.GCSDriver.CredentialsFile = ""
+
+	cfg.SFTPDriver.Addr = "127.0.0.1:22"
+	cfg.SFTPDriver.User = "kftpd"
+	cfg.SFTPDriver.Password = ""
+	cfg.SFTPDriver.KeyFile = ""
+	cfg.SFTPDriver.KnownHostsFile = ""
+	cfg.SFTPDriver.RootPath = "kftpd-data"
+
+	cfg.Encryption.Enable = false
+	cfg.Encryption.Key = ""
+	cfg.Encryption.KeyFile = ""
+	cfg.Encryption.KeyCommand = ""
+
+	cfg.AuthTLS.Enable = false
+	cfg.AuthTLS.CertFile = ""
+	cfg.AuthTLS.KeyFile = ""
+	cfg.AuthTLS.MinVersion = ""
+	cfg.AuthTLS.CipherSuites = nil
+	cfg.AuthTLS.CurvePreferences = nil
+	cfg.AuthTLS.ReloadInterval = 0
+	cfg.AuthTLS.ClientAuth = "none"
+	cfg.AuthTLS.ClientCAFile = ""
+	cfg.AuthTLS.ClientCertUser = "CN"
+	cfg.AuthTLS.RequireReuse = false
+	cfg.AuthTLS.Force = false
+
+	cfg.ACME.Enable = false
+	cfg.ACME.Hosts = nil
+	cfg.ACME.Email = ""
+	cfg.ACME.CacheDir = "acme"
+	cfg.ACME.Challenge = "tls-alpn-01"
+	cfg.ACME.ChallengeBind = ":443"
+	cfg.ACME.DirectoryURL = ""
+
+	cfg.TOTPSkew = 1
+
+	cfg.RequireStrongPasswords = false
+	cfg.MinPasswordLength = 8
+
+	cfg.AuthFile = ""
+	cfg.VirtualHosts = nil
+	cfg.Mounts = nil
+
+	cfg.AuthWebhook.URL = ""
+	cfg.AuthWebhook.Token = ""
+	cfg.AuthWebhook.Timeout = 10
+
+	cfg.SQL.Enable = false
+	cfg.SQL.Driver = "postgres"
+	cfg.SQL.DSN = ""
+	cfg.SQL.Query = "SELECT password, home, quota_bytes, quota_files FROM ftp_users WHERE name = $1"
+	cfg.SQL.Timeout = 10
+
+	cfg.LDAP.Enable = false
+	cfg.LDAP.URL = "ldap://127.0.0.1:389"
+	cfg.LDAP.StartTLS = false
+	cfg.LDAP.CAFile = ""
+	cfg.LDAP.BindDN = ""
+	cfg.LDAP.BindPassword = ""
+	cfg.LDAP.BaseDN = ""
+	cfg.LDAP.UserFilter = "(&(objectClass=person)(uid=%s))"
+	cfg.LDAP.GroupAttribute = "memberOf"
+	cfg.LDAP.Groups = nil
+	cfg.LDAP.Timeout = 10
+
+	cfg.Users = map[string]FtpdUser{
+		"kftpd": {Password: "kftpd"},
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BIND"); ok {
+		cfg.Bind = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_DRIVER"); ok {
+		cfg.Driver = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_HOMEDIR"); ok {
+		cfg.HomeDir, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_HOMETEMPLATE"); ok {
+		cfg.HomeTemplate = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_DEBUG"); ok {
+		cfg.Debug, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_STEALTH"); ok {
+		cfg.Stealth, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BOUNCEPROTECTION"); ok {
+		cfg.BounceProtection, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BANNER"); ok {
+		cfg.Banner = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SYST"); ok {
+		cfg.Syst = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGLEVEL"); ok {
+		cfg.LogLevel = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGFORMAT"); ok {
+		cfg.LogFormat = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_UPLOADNAMEPATTERN"); ok {
+		cfg.UploadNamePattern = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_DELETEPARTIALUPLOADS"); ok {
+		cfg.DeletePartialUploads, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_RESUMETIMEOUT"); ok {
+		cfg.ResumeTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LISTBATCHSIZE"); ok {
+		cfg.ListBatchSize, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_NLSTCLASSIFY"); ok {
+		cfg.NlstClassify, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ASCIIUPLOAD"); ok {
+		cfg.AsciiUpload, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ASCIIDOWNLOAD"); ok {
+		cfg.AsciiDownload, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MAXSESSIONGOROUTINES"); ok {
+		cfg.MaxSessionGoroutines, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LISTTIMEZONE"); ok {
+		cfg.ListTimeZone = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FACTTIMEZONE"); ok {
+		cfg.FactTimeZone = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LAZYDRIVER"); ok {
+		cfg.LazyDriver, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_DRIVERTIMEOUT"); ok {
+		cfg.DriverTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_TRANSFERSTALLTIMEOUT"); ok {
+		cfg.TransferStallTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_IDLETIMEOUT"); ok {
+		cfg.IdleTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINMESSAGE"); ok {
+		cfg.LoginMessage = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINMESSAGEFILE"); ok {
+		cfg.LoginMessageFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BANNERFILE"); ok {
+		cfg.BannerFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_DIRMESSAGEFILE"); ok {
+		cfg.DirMessageFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_WRITEONLYDIRS"); ok {
+		cfg.WriteOnlyDirs = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BANDWIDTH_TOTALKBPS"); ok {
+		cfg.Bandwidth.TotalKBps, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_BANDWIDTH_WEIGHTS"); ok {
+		cfg.Bandwidth.Weights = make(map[string]int)
+		arr := strings.Split(env, ",")
+		for _, v := range arr {
+			s := strings.Split(v, ":")
+			if len(s) == 2 {
+				cfg.Bandwidth.Weights[s[0]], _ = strconv.Atoi(s[1])
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_THROTTLE_UPLOADKBPS"); ok {
+		cfg.Throttle.UploadKBps, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_THROTTLE_DOWNLOADKBPS"); ok {
+		cfg.Throttle.DownloadKBps, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MODEZ_ENABLE"); ok {
+		cfg.ModeZ.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MODEZ_LEVEL"); ok {
+		cfg.ModeZ.Level, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACCESS_ALLOW"); ok {
+		cfg.Access.Allow = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACCESS_DENY"); ok {
+		cfg.Access.Deny = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINBAN_MAXFAILURES"); ok {
+		cfg.LoginBan.MaxFailures, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINBAN_FINDTIME"); ok {
+		cfg.LoginBan.FindTime, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINBAN_BANTIME"); ok {
+		cfg.LoginBan.BanTime, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LOGINBAN_FAILDELAY"); ok {
+		cfg.LoginBan.FailDelay, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_ENABLE"); ok {
+		cfg.Pasv.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_IP"); ok {
+		cfg.Pasv.IP = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_HOST"); ok {
+		cfg.Pasv.Host = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_NETWORKS"); ok {
+		cfg.Pasv.Networks = nil
+		for _, rule := range strings.Split(env, ",") {
+			words := strings.SplitN(rule, "=", 2)
+			if len(words) == 2 {
+				cfg.Pasv.Networks = append(cfg.Pasv.Networks, PasvNetwork{Network: words[0], Address: words[1]})
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_PORTSTART"); ok {
+		cfg.Pasv.PortStart, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_PORTEND"); ok {
+		cfg.Pasv.PortEnd, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PASV_LISTEN_TIMEOUT"); ok {
+		cfg.Pasv.ListenTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PORT_ENABLE"); ok {
+		cfg.Port.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_PORT_CONNECT_TIMEOUT"); ok {
+		cfg.Port.ConnectTimeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_BASEDIR"); ok {
+		cfg.FileDriver.BaseDir = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_MAXFILESPERDIR"); ok {
+		cfg.FileDriver.MaxFilesPerDir, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_SNAPSHOTLIST"); ok {
+		cfg.FileDriver.SnapshotList, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_FOLLOWSYMLINKS"); ok {
+		cfg.FileDriver.FollowSymlinks, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_DIRMODE"); ok {
+		cfg.FileDriver.DirMode = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_ENDPOINT"); ok {
+		cfg.MinioDriver.Endpoint = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_ACCESSKEYID"); ok {
+		cfg.MinioDriver.AccessKeyID = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_SECRETACCESSKEY"); ok {
+		cfg.MinioDriver.SecretAccessKey = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_BUCKET"); ok {
+		cfg.MinioDriver.Bucket = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_PREFIX"); ok {
+		cfg.MinioDriver.Prefix = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_USERS"); ok {
+		cfg.MinioDriver.Users = make(map[string]string)
+		arr := strings.Split(env, ",")
+		for _, v := range arr {
+			s := strings.Split(v, ":")
+			if len(s) == 2 {
+				cfg.MinioDriver.Users[s[0]] = s[1]
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_USESSL"); ok {
+		cfg.MinioDriver.UseSSL, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_PRESIGNEXPIRE"); ok {
+		cfg.MinioDriver.PresignExpire, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_PARTSIZE"); ok {
+		cfg.MinioDriver.PartSize, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_SMALLUPLOADSIZE"); ok {
+		cfg.MinioDriver.SmallUploadSize, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_CACHEDIR"); ok {
+		cfg.MinioDriver.CacheDir = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_CACHESIZE"); ok {
+		cfg.MinioDriver.CacheSize, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_CACHETTL"); ok {
+		cfg.MinioDriver.CacheTTL, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_ENDPOINT"); ok {
+		cfg.S3Driver.Endpoint = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_REGION"); ok {
+		cfg.S3Driver.Region = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_BUCKET"); ok {
+		cfg.S3Driver.Bucket = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_ACCESSKEYID"); ok {
+		cfg.S3Driver.AccessKeyID = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_SECRETACCESSKEY"); ok {
+		cfg.S3Driver.SecretAccessKey = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_ROLEARNS"); ok {
+		cfg.S3Driver.RoleARNs = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_EXTERNALID"); ok {
+		cfg.S3Driver.ExternalID = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_STSENDPOINT"); ok {
+		cfg.S3Driver.STSEndpoint = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_USESSL"); ok {
+		cfg.S3Driver.UseSSL, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_PATHSTYLE"); ok {
+		cfg.S3Driver.PathStyle, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_SSE"); ok {
+		cfg.S3Driver.SSE = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_SSEKMSKEYID"); ok {
+		cfg.S3Driver.SSEKMSKeyID = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_PRESIGNEXPIRE"); ok {
+		cfg.S3Driver.PresignExpire, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_S3DRIVER_PARTSIZE"); ok {
+		cfg.S3Driver.PartSize, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_GCSDRIVER_BUCKET"); ok {
+		cfg.GCSDriver.Bucket = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_GCSDRIVER_CREDENTIALSFILE"); ok {
+		cfg.GCSDriver.CredentialsFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_ADDR"); ok {
+		cfg.SFTPDriver.Addr = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_USER"); ok {
+		cfg.SFTPDriver.User = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_PASSWORD"); ok {
+		cfg.SFTPDriver.Password = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_KEYFILE"); ok {
+		cfg.SFTPDriver.KeyFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_KNOWNHOSTSFILE"); ok {
+		cfg.SFTPDriver.KnownHostsFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_ROOTPATH"); ok {
+		cfg.SFTPDriver.RootPath = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SFTPDRIVER_USERS"); ok {
+		cfg.SFTPDriver.Users = make(map[string]string)
+		arr := strings.Split(env, ",")
+		for _, v := range arr {
+			s := strings.Split(v, ":")
+			if len(s) == 2 {
+				cfg.SFTPDriver.Users[s[0]] = s[1]
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ENCRYPTION_ENABLE"); ok {
+		cfg.Encryption.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ENCRYPTION_KEY"); ok {
+		cfg.Encryption.Key = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ENCRYPTION_KEYFILE"); ok {
+		cfg.Encryption.KeyFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ENCRYPTION_KEYCOMMAND"); ok {
+		cfg.Encryption.KeyCommand = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_ENABLE"); ok {
+		cfg.AuthTLS.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CERTFILE"); ok {
+		cfg.AuthTLS.CertFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_KEYFILE"); ok {
+		cfg.AuthTLS.KeyFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_MINVERSION"); ok {
+		cfg.AuthTLS.MinVersion = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CIPHERSUITES"); ok {
+		cfg.AuthTLS.CipherSuites = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CURVEPREFERENCES"); ok {
+		cfg.AuthTLS.CurvePreferences = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_RELOADINTERVAL"); ok {
+		cfg.AuthTLS.ReloadInterval, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CLIENTAUTH"); ok {
+		cfg.AuthTLS.ClientAuth = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CLIENTCAFILE"); ok {
+		cfg.AuthTLS.ClientCAFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CLIENTCERTUSER"); ok {
+		cfg.AuthTLS.ClientCertUser = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_REQUIREREUSE"); ok {
+		cfg.AuthTLS.RequireReuse, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_FORCE"); ok {
+		cfg.AuthTLS.Force, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_ENABLE"); ok {
+		cfg.ACME.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_HOSTS"); ok {
+		cfg.ACME.Hosts = strings.Split(env, ",")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_EMAIL"); ok {
+		cfg.ACME.Email = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_CACHEDIR"); ok {
+		cfg.ACME.CacheDir = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_CHALLENGE"); ok {
+		cfg.ACME.Challenge = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_CHALLENGEBIND"); ok {
+		cfg.ACME.ChallengeBind = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_ACME_DIRECTORYURL"); ok {
+		cfg.ACME.DirectoryURL = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_REPLYCODES"); ok {
+		cfg.ReplyCodes = make(map[string]int)
+		arr := strings.Split(env, ",")
+		for _, v := range arr {
+			s := strings.Split(v, ":")
+			if len(s) == 2 {
+				cfg.ReplyCodes[s[0]], _ = strconv.Atoi(s[1])
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_TOTPSKEW"); ok {
+		cfg.TOTPSkew, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_REQUIRESTRONGPASSWORDS"); ok {
+		cfg.RequireStrongPasswords, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_MINPASSWORDLENGTH"); ok {
+		cfg.MinPasswordLength, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHFILE"); ok {
+		cfg.AuthFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHWEBHOOK_URL"); ok {
+		cfg.AuthWebhook.URL = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHWEBHOOK_TOKEN"); ok {
+		cfg.AuthWebhook.Token = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_AUTHWEBHOOK_TIMEOUT"); ok {
+		cfg.AuthWebhook.Timeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SQL_ENABLE"); ok {
+		cfg.SQL.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SQL_DRIVER"); ok {
+		cfg.SQL.Driver = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SQL_DSN"); ok {
+		cfg.SQL.DSN = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SQL_QUERY"); ok {
+		cfg.SQL.Query = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_SQL_TIMEOUT"); ok {
+		cfg.SQL.Timeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_ENABLE"); ok {
+		cfg.LDAP.Enable, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_URL"); ok {
+		cfg.LDAP.URL = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_STARTTLS"); ok {
+		cfg.LDAP.StartTLS, _ = strconv.ParseBool(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_CAFILE"); ok {
+		cfg.LDAP.CAFile = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_BINDDN"); ok {
+		cfg.LDAP.BindDN = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_BINDPASSWORD"); ok {
+		cfg.LDAP.BindPassword = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_BASEDN"); ok {
+		cfg.LDAP.BaseDN = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_USERFILTER"); ok {
+		cfg.LDAP.UserFilter = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_GROUPATTRIBUTE"); ok {
+		cfg.LDAP.GroupAttribute = env
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_GROUPS"); ok {
+		// group DNs hold commas, they are separated by semicolons.
+		cfg.LDAP.Groups = strings.Split(env, ";")
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_LDAP_TIMEOUT"); ok {
+		cfg.LDAP.Timeout, _ = strconv.Atoi(env)
+	}
+
+	if env, ok := os.LookupEnv("KFTPD_USERS"); ok {
+		cfg.Users = make(map[string]FtpdUser)
+		// the params of argon2id hash hold commas, a part without colon
+		// belongs to the previous user.
+		var arr []string
+		for _, v := range strings.Split(env, ",") {
+			if !strings.Contains(v, ":") && len(arr) > 0 {
+				arr[len(arr)-1] += "," + v
+				continue
+			}
+			arr = append(arr, v)
+		}
+		for _, v := range arr {
+			s := strings.Split(v, ":")
+			if len(s) == 2 {
+				cfg.Users[s[0]] = FtpdUser{Password: s[1]}
+			}
+		}
+	}
+
+	return &cfg
+}
+
+// LoadFtpdConfig return a ftd config loaded from config file
+func LoadFtpdConfig(configFile string) (*FtpdConfig, error) {
+	cfg := NewFtpdConfig()
+
+	if len(configFile) > 0 {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate check the ftpd config and prepare the settings derived from it
+func (cfg *FtpdConfig) Validate() error {
+	cfg.uploadNameRegexp = nil
+	if len(cfg.UploadNamePattern) > 0 {
+		re, err := regexp.Compile(cfg.UploadNamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid UploadNamePattern: %v", err)
+		}
+		cfg.uploadNameRegexp = re
+	}
+
+	var err error
+	if cfg.listLocation, err = time.LoadLocation(cfg.ListTimeZone); err != nil {
+		return fmt.Errorf("invalid ListTimeZone: %v", err)
+	}
+	if cfg.factLocation, err = time.LoadLocation(cfg.FactTimeZone); err != nil {
+		return fmt.Errorf("invalid FactTimeZone: %v", err)
+	}
+
+	level, ok := logLevels[strings.ToLower(cfg.LogLevel)]
+	if !ok {
+		return fmt.Errorf("invalid LogLevel %s: must be debug, info, warn or error", cfg.LogLevel)
+	}
+	cfg.logLevel = level
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return fmt.Errorf("invalid LogFormat %s: must be text or json", cfg.LogFormat)
+	}
+
+	for event, code := range cfg.ReplyCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid ReplyCodes %s: %d", event, code)
+		}
+	}
+
+	if len(strings.TrimSpace(cfg.Syst)) == 0 {
+		cfg.Syst = "UNIX Type: L8"
+	}
+	if !systNames[strings.Fields(cfg.Syst)[0]] {
+		return fmt.Errorf("invalid Syst %s: must start with a system name such as UNIX or Windows_NT", cfg.Syst)
+	}
+	if strings.ContainsAny(cfg.Banner+cfg.Syst, "\r\n") {
+		return errors.New("invalid Banner or Syst: must be a single line")
+	}
+
+	if strings.ContainsAny(cfg.DirMessageFile, "/\\") {
+		return fmt.Errorf("invalid DirMessageFile %s: must be a file name", cfg.DirMessageFile)
+	}
+	if len(cfg.DirMessages) > 0 {
+		messages := make(map[string]string, len(cfg.DirMessages))
+		for dir, msg := range cfg.DirMessages {
+			messages[jailpath(dir)] = msg
+		}
+		cfg.DirMessages = messages
+	}
+	for i, dir := range cfg.WriteOnlyDirs {
+		if len(strings.TrimSpace(dir)) == 0 {
+			return errors.New("invalid WriteOnlyDirs: empty directory")
 		}
+		cfg.WriteOnlyDirs[i] = jailpath(strings.TrimSpace(dir))
 	}
 
-	size, reader, err := fc.driver.GetFile(path, fc.offset)
-	if err != nil {
-		fc.Send(550, "Failed to open file.")
-		<-fc.notify
-		return err
+	if !cfg.Pasv.Enable && !cfg.Port.Enable {
+		return errors.New("both Pasv and Port are disabled, no data connection possible")
 	}
-	defer reader.Close()
 
-	<-fc.notify
-	fc.Send(150, fmt.Sprintf("Opening %s mode data connection for %s (%d bytes).", fc.mode, fc.arg, size))
-	err = fc.PutFileTransfer(reader)
-	if err != nil {
-		fc.Send(426, "Failure writing network stream.")
-		return err
+	if _, _, err := parseDirMode(cfg.FileDriver.DirMode); err != nil {
+		return fmt.Errorf("invalid FileDriver.DirMode: %v", err)
 	}
-	fc.Send(226, "Transfer complete.")
-	if ftpHandler.FileAfterGet != nil {
-		ftpHandler.FileAfterGet(fc.user, path)
-	}
-	return nil
-}
 
-func (fc *FtpConn) handleSTOR() error {
-	path := fc.buildPath(fc.arg)
-
-	defer func() {
-		fc.offset = 0
-		fc.CloseFileTransfer()
-	}()
+	// minio rejects parts smaller than 5 MiB except the last one.
+	if cfg.MinioDriver.PartSize != 0 && cfg.MinioDriver.PartSize < 5 {
+		return fmt.Errorf("invalid MinioDriver.PartSize %d: at least 5 MiB", cfg.MinioDriver.PartSize)
+	}
 
-	if ftpHandler.FileBeforePut != nil {
-		if !ftpHandler.FileBeforePut(fc.user, path) {
-			fc.Send(550, "Not Allowed.")
-			<-fc.notify
-			return nil
+	for user, bucket := range cfg.MinioDriver.Users {
+		if len(strings.Trim(bucket, "/")) == 0 || strings.HasPrefix(bucket, "/") {
+			return fmt.Errorf("invalid MinioDriver Users %s: %s is not bucket or bucket/prefix", user, bucket)
 		}
 	}
 
-	<-fc.notify
-	reader := fc.GetFileTransfer()
-	if reader == nil {
-		fc.Send(550, "Failed to open transfer.")
-		return nil
+	if cfg.MinioDriver.CacheSize < 0 || cfg.MinioDriver.CacheTTL < 0 {
+		return errors.New("invalid MinioDriver CacheSize or CacheTTL: must not be negative")
 	}
-	fc.Send(150, "Ok to send data.")
-	_, err := fc.driver.PutFile(path, fc.offset, reader)
-	if err != nil {
-		fc.Send(426, "Failure reading network stream.")
-		return err
+	if cfg.MinioDriver.CacheSize > 0 && len(cfg.MinioDriver.CacheDir) == 0 {
+		return errors.New("invalid MinioDriver CacheDir: must not be empty")
 	}
-	fc.Send(226, "Transfer complete.")
-	if ftpHandler.FileAfterPut != nil {
-		ftpHandler.FileAfterPut(fc.user, path)
+
+	if cfg.S3Driver.PartSize != 0 && cfg.S3Driver.PartSize < 5 {
+		return fmt.Errorf("invalid S3Driver.PartSize %d: at least 5 MiB", cfg.S3Driver.PartSize)
+	}
+	if cfg.S3Driver.SSE != "" && cfg.S3Driver.SSE != "AES256" && cfg.S3Driver.SSE != "aws:kms" {
+		return fmt.Errorf("invalid S3Driver.SSE %s: must be empty, AES256 or aws:kms", cfg.S3Driver.SSE)
 	}
-	return nil
-}
 
-func (fc *FtpConn) handleAPPE() error {
-	path := fc.buildPath(fc.arg)
+	if err := cfg.loadEncryptionKey(); err != nil {
+		return err
+	}
 
-	defer func() {
-		fc.offset = 0
-		fc.CloseFileTransfer()
-	}()
+	if err := cfg.parseTLS(); err != nil {
+		return err
+	}
 
-	<-fc.notify
-	reader := fc.GetFileTransfer()
-	if reader == nil {
-		fc.Send(550, "Failed to open transfer.")
-		return nil
+	if cfg.AuthTLS.Force && !cfg.AuthTLS.Enable {
+		return errors.New("invalid AuthTLS Force: AuthTLS not enabled")
 	}
-	fc.Send(150, "Ok to send data.")
-	_, err := fc.driver.PutFile(path, fc.offset, reader)
-	if err != nil {
-		fc.Send(426, "Failure reading network stream.")
-		return err
+
+	if cfg.AuthTLS.ReloadInterval < 0 {
+		return fmt.Errorf("invalid AuthTLS ReloadInterval %d: must not be negative", cfg.AuthTLS.ReloadInterval)
 	}
-	fc.Send(226, "Transfer complete.")
-	return nil
-}
 
-func (fc *FtpConn) handleDELE() error {
-	path := fc.buildPath(fc.arg)
+	if cfg.ACME.Enable {
+		if !cfg.AuthTLS.Enable {
+			return errors.New("invalid ACME: AuthTLS not enabled")
+		}
+		var hosts []string
+		for _, host := range cfg.ACME.Hosts {
+			if host = strings.TrimSpace(host); len(host) > 0 {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return errors.New("invalid ACME Hosts: must not be empty")
+		}
+		cfg.ACME.Hosts = hosts
+		if len(cfg.ACME.CacheDir) == 0 {
+			return errors.New("invalid ACME CacheDir: must not be empty")
+		}
+		if cfg.ACME.Challenge != "tls-alpn-01" && cfg.ACME.Challenge != "http-01" {
+			return fmt.Errorf("invalid ACME Challenge %s: must be tls-alpn-01 or http-01", cfg.ACME.Challenge)
+		}
+		if _, _, err := net.SplitHostPort(cfg.ACME.ChallengeBind); err != nil {
+			return fmt.Errorf("invalid ACME ChallengeBind %s: %v", cfg.ACME.ChallengeBind, err)
+		}
+	}
 
-	if ftpHandler.FileBeforeDelete != nil {
-		if !ftpHandler.FileBeforeDelete(fc.user, path) {
-			fc.Send(550, "Not Allowed.")
-			return nil
+	if cfg.Pasv.Enable && (cfg.Pasv.PortStart <= 0 || cfg.Pasv.PortEnd > 65535 || cfg.Pasv.PortStart > cfg.Pasv.PortEnd) {
+		return fmt.Errorf("invalid Pasv port range: %d-%d", cfg.Pasv.PortStart, cfg.Pasv.PortEnd)
+	}
+	if len(cfg.Pasv.IP) > 0 && net.ParseIP(cfg.Pasv.IP).To4() == nil {
+		return fmt.Errorf("invalid Pasv.IP %s: PASV needs a dotted IPv4 address, leave it empty and let clients use EPSV otherwise", cfg.Pasv.IP)
+	}
+	if len(cfg.Pasv.IP) > 0 && len(cfg.Pasv.Host) > 0 {
+		return errors.New("invalid Pasv: IP and Host are exclusive")
+	}
+	if err := checkPasvAddress(cfg.Pasv.Host); err != nil {
+		return fmt.Errorf("invalid Pasv.Host: %v", err)
+	}
+	cfg.pasvNets = nil
+	for _, pn := range cfg.Pasv.Networks {
+		nets, err := parseNetworks(strings.Split(pn.Network, ","))
+		if err != nil || len(nets) == 0 {
+			return fmt.Errorf("invalid Pasv.Networks %s: bad network", pn.Network)
 		}
+		if len(pn.Address) == 0 {
+			return fmt.Errorf("invalid Pasv.Networks %s: empty address", pn.Network)
+		}
+		if err := checkPasvAddress(pn.Address); err != nil {
+			return fmt.Errorf("invalid Pasv.Networks %s: %v", pn.Network, err)
+		}
+		cfg.pasvNets = append(cfg.pasvNets, pasvNet{nets: nets, address: strings.TrimSpace(pn.Address)})
 	}
 
-	err := fc.driver.DeleteFile(path)
-	if err != nil {
-		fc.Send(550, "Delete operation failed.")
-		return err
+	if cfg.ModeZ.Enable && (cfg.ModeZ.Level < 1 || cfg.ModeZ.Level > 9) {
+		return fmt.Errorf("invalid ModeZ Level %d: must be 1-9", cfg.ModeZ.Level)
 	}
-	fc.Send(250, "Delete operation successful.")
-	if ftpHandler.FileAfterDelete != nil {
-		ftpHandler.FileAfterDelete(fc.user, path)
+
+	if cfg.allowNets, err = parseNetworks(cfg.Access.Allow); err != nil {
+		return fmt.Errorf("invalid Access Allow: %v", err)
+	}
+	if cfg.denyNets, err = parseNetworks(cfg.Access.Deny); err != nil {
+		return fmt.Errorf("invalid Access Deny: %v", err)
 	}
-	return nil
-}
 
-func (fc *FtpConn) handleRNFR() error {
-	path := fc.buildPath(fc.arg)
+	if cfg.LoginBan.MaxFailures > 0 && (cfg.LoginBan.FindTime <= 0 || cfg.LoginBan.BanTime <= 0) {
+		return fmt.Errorf("invalid LoginBan FindTime %d/BanTime %d: must be positive", cfg.LoginBan.FindTime, cfg.LoginBan.BanTime)
+	}
 
-	_, err := fc.driver.Stat(path)
-	if err != nil {
-		fc.Send(550, "RNFR command failed.")
+	if cfg.Throttle.UploadKBps < 0 || cfg.Throttle.DownloadKBps < 0 {
+		return fmt.Errorf("invalid Throttle %d/%d KB/s: must not be negative", cfg.Throttle.UploadKBps, cfg.Throttle.DownloadKBps)
+	}
+
+	sources := 0
+	if err := cfg.validateVirtualHosts(); err != nil {
 		return err
 	}
-	fc.rename = path
-	fc.Send(350, "Ready for RNTO.")
-	return nil
-}
 
-func (fc *FtpConn) handleRNTO() error {
-	if fc.rename == "" {
-		fc.Send(503, "RNFR required first.")
-		return nil
+	if err := cfg.validateMounts(); err != nil {
+		return err
 	}
-	path := fc.buildPath(fc.arg)
 
-	if ftpHandler.FileBeforeRename != nil {
-		if !ftpHandler.FileBeforeRename(fc.user, fc.rename, path) {
-			fc.Send(550, "Not Allowed.")
-			return nil
+	for _, enable := range []bool{len(cfg.AuthFile) > 0, len(cfg.AuthWebhook.URL) > 0, cfg.SQL.Enable, cfg.LDAP.Enable} {
+		if enable {
+			sources++
 		}
 	}
+	if sources > 1 {
+		return errors.New("AuthFile, AuthWebhook, SQL and LDAP are exclusive")
+	}
+	if cfg.LDAP.Enable && !strings.Contains(cfg.LDAP.UserFilter, "%s") {
+		return fmt.Errorf("invalid LDAP UserFilter %q: must hold %%s for the user name", cfg.LDAP.UserFilter)
+	}
 
-	err := fc.driver.Rename(fc.rename, path)
-	defer func() {
-		fc.rename = ""
-	}()
-	if err != nil {
-		fc.Send(550, "Rename failed.")
+	if err := compileUploadNames(cfg.Users); err != nil {
 		return err
 	}
-	fc.Send(250, "Rename successful.")
-	if ftpHandler.FileAfterRename != nil {
-		ftpHandler.FileAfterRename(fc.user, fc.rename, path)
+	for name, user := range cfg.Users {
+		if err := checkPasswordHash(user.Password); err != nil {
+			return fmt.Errorf("invalid password hash of user %s: %v", name, err)
+		}
+		if _, err := parseNetworks(user.AllowedNetworks); err != nil {
+			return fmt.Errorf("invalid AllowedNetworks of user %s: %v", name, err)
+		}
+		if user.QuotaBytes < 0 || user.QuotaFiles < 0 {
+			return fmt.Errorf("invalid quota of user %s: %d bytes/%d files: must not be negative", name, user.QuotaBytes, user.QuotaFiles)
+		}
+		if user.PasvPortStart == 0 && user.PasvPortEnd == 0 {
+			continue
+		}
+		if user.PasvPortStart <= 0 || user.PasvPortEnd > 65535 || user.PasvPortStart > user.PasvPortEnd {
+			return fmt.Errorf("invalid passive port range of user %s: %d-%d", name, user.PasvPortStart, user.PasvPortEnd)
+		}
 	}
-	return nil
-}
 
-func (fc *FtpConn) handleALLO() error {
-	fc.Send(202, "Obsolete.")
-	return nil
-}
+	if cfg.RequireStrongPasswords {
+		if err := cfg.checkPasswords(); err != nil {
+			return err
+		}
+	}
 
-func (fc *FtpConn) handleREST() error {
-	fc.offset, _ = strconv.ParseInt(fc.arg, 10, 0)
-	fc.Send(350, fmt.Sprintf("Restart position accepted (%d).", fc.offset))
 	return nil
 }
 
-func (fc *FtpConn) handleSITE() error {
-	fc.Send(202, "@zhoukk")
+// compileUploadNames compile the UploadNamePattern of users
+func compileUploadNames(users map[string]FtpdUser) error {
+	for name, user := range users {
+		user.uploadNameRegexp = nil
+		if len(user.UploadNamePattern) > 0 {
+			re, err := regexp.Compile(user.UploadNamePattern)
+			if err != nil {
+				return fmt.Errorf("invalid UploadNamePattern of user %s: %v", name, err)
+			}
+			user.uploadNameRegexp = re
+		}
+		users[name] = user
+	}
 	return nil
 }
 
-func (fc *FtpConn) handleCWD() error {
-	path := fc.buildPath(fc.arg)
-
-	fi, err := fc.driver.Stat(path)
-	if err != nil || !fi.IsDir() {
-		fc.Send(550, "Failed to change directory.")
-		return err
+// validateVirtualHosts check VirtualHosts, the names are kept lower case
+// as host names are case insensitive.
+func (cfg *FtpdConfig) validateVirtualHosts() error {
+	if len(cfg.VirtualHosts) == 0 {
+		return nil
 	}
-
-	fc.path = path
-	fc.Send(250, "Directory successfully changed.")
+	hosts := make(map[string]VirtualHost, len(cfg.VirtualHosts))
+	for name, vh := range cfg.VirtualHosts {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if len(key) == 0 {
+			return errors.New("invalid VirtualHosts: empty host name")
+		}
+		if _, ok := hosts[key]; ok {
+			return fmt.Errorf("invalid VirtualHosts %s: duplicate host name", name)
+		}
+		if len(vh.Users) > 0 && len(vh.AuthFile) > 0 {
+			return fmt.Errorf("invalid VirtualHosts %s: Users and AuthFile are exclusive", name)
+		}
+		if (len(vh.CertFile) > 0) != (len(vh.KeyFile) > 0) {
+			return fmt.Errorf("invalid VirtualHosts %s: CertFile and KeyFile must be set together", name)
+		}
+		if strings.ContainsAny(vh.Banner, "\r\n") {
+			return fmt.Errorf("invalid VirtualHosts %s Banner: must be a single line", name)
+		}
+		if err := compileUploadNames(vh.Users); err != nil {
+			return fmt.Errorf("invalid VirtualHosts %s: %v", name, err)
+		}
+		hosts[key] = vh
+	}
+	cfg.VirtualHosts = hosts
 	return nil
 }
 
-func (fc *FtpConn) handlePWD() error {
-	fc.Send(257, fmt.Sprintf(`"%s"`, fc.path))
+// validateMounts check Mounts, the paths are cleaned and the driver is the
+// one of config if not set.
+func (cfg *FtpdConfig) validateMounts() error {
+	paths := make(map[string]bool)
+	for i := range cfg.Mounts {
+		m := &cfg.Mounts[i]
+		m.Path = jailpath(m.Path)
+		if m.Path == "/" {
+			return errors.New("invalid Mounts Path /: mount the root with Driver instead")
+		}
+		if paths[m.Path] {
+			return fmt.Errorf("invalid Mounts Path %s: duplicate path", m.Path)
+		}
+		paths[m.Path] = true
+		if len(m.Driver) == 0 {
+			m.Driver = cfg.Driver
+		}
+		switch m.Driver {
+		case "file", "minio", "s3", "gcs", "sftp":
+		default:
+			return fmt.Errorf("invalid Mounts %s Driver %s: must be file, minio, s3, gcs or sftp", m.Path, m.Driver)
+		}
+	}
 	return nil
 }
 
-func (fc *FtpConn) handleCDUP() error {
-	path := fc.buildPath("..")
-
-	fi, err := fc.driver.Stat(path)
-	if err != nil || !fi.IsDir() {
-		fc.Send(550, "Failed to change directory.")
-		return err
+// mountConfig return the config of the driver of mount
+func (cfg *FtpdConfig) mountConfig(m Mount) *FtpdConfig {
+	mount := *cfg
+	mount.Mounts = nil
+	mount.Driver = m.Driver
+	if len(m.BaseDir) > 0 {
+		mount.FileDriver.BaseDir = m.BaseDir
 	}
+	if len(m.Bucket) > 0 {
+		mount.MinioDriver.Bucket = m.Bucket
+		mount.S3Driver.Bucket = m.Bucket
+		mount.GCSDriver.Bucket = m.Bucket
+	}
+	return &mount
+}
 
-	fc.path = path
-	fc.Send(250, "Directory successfully changed.")
-	return nil
+// virtualHost return the config of the virtual host name, nil if unknown
+func (cfg *FtpdConfig) virtualHost(name string) *FtpdConfig {
+	vh, ok := cfg.VirtualHosts[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	host := *cfg
+	if len(vh.Users) > 0 || len(vh.AuthFile) > 0 {
+		host.Users = vh.Users
+		host.AuthFile = vh.AuthFile
+	}
+	if len(vh.BaseDir) > 0 {
+		host.FileDriver.BaseDir = vh.BaseDir
+	}
+	if len(vh.Bucket) > 0 {
+		host.MinioDriver.Bucket = vh.Bucket
+		host.S3Driver.Bucket = vh.Bucket
+		host.GCSDriver.Bucket = vh.Bucket
+	}
+	if len(vh.Banner) > 0 {
+		host.Banner = vh.Banner
+	}
+	if len(vh.LoginMessage) > 0 {
+		host.LoginMessage = vh.LoginMessage
+		host.LoginMessageFile = ""
+	}
+	return &host
 }
 
-func (fc *FtpConn) handleNLST() error {
-	path := fc.buildPath(fc.arg)
+// tlsVersions - versions of AuthTLS MinVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-	fc.Send(150, "Here comes the directory listing.")
-	defer fc.CloseFileTransfer()
+// tlsCurves - curves of AuthTLS CurvePreferences
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
 
-	var files []string
-	err := fc.driver.ListDir(path, func(fi FileInfo) error {
-		files = append(files, fi.Name())
+// loadEncryptionKey read the key of Encryption from Key, KeyFile or the
+// output of KeyCommand, such as a KMS decrypt of the data key.
+func (cfg *FtpdConfig) loadEncryptionKey() error {
+	cfg.encryptionKey = nil
+	if !cfg.Encryption.Enable {
 		return nil
-	})
-	if err != nil {
-		fc.Send(226, "Transfer done (but failed to open directory).")
-		<-fc.notify
-		return err
 	}
-
-	<-fc.notify
-	fc.WriteFileTransfer([]byte(strings.Join(files, "\r\n")))
-	fc.Send(226, "Directory send OK.")
+	var key []byte
+	var err error
+	switch {
+	case len(cfg.Encryption.Key) > 0 && len(cfg.Encryption.KeyFile) == 0 && len(cfg.Encryption.KeyCommand) == 0:
+		key = []byte(cfg.Encryption.Key)
+	case len(cfg.Encryption.Key) == 0 && len(cfg.Encryption.KeyFile) > 0 && len(cfg.Encryption.KeyCommand) == 0:
+		if key, err = ioutil.ReadFile(cfg.Encryption.KeyFile); err != nil {
+			return fmt.Errorf("invalid Encryption KeyFile: %v", err)
+		}
+	case len(cfg.Encryption.Key) == 0 && len(cfg.Encryption.KeyFile) == 0 && len(cfg.Encryption.KeyCommand) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if key, err = exec.CommandContext(ctx, "/bin/sh", "-c", cfg.Encryption.KeyCommand).Output(); err != nil {
+			return fmt.Errorf("invalid Encryption KeyCommand: %v", err)
+		}
+	default:
+		return errors.New("invalid Encryption: exactly one of Key, KeyFile and KeyCommand must be set")
+	}
+	if cfg.encryptionKey, err = parseEncryptionKey(string(key)); err != nil {
+		return fmt.Errorf("invalid Encryption key: %v", err)
+	}
 	return nil
 }
 
-func (fc *FtpConn) handleLIST() error {
-	path := fc.buildPath(fc.arg)
+// parseEncryptionKey return the 32 bytes key of 64 hex digits or base64
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes of 64 hex digits or base64")
+	}
+	return key, nil
+}
 
-	fc.Send(150, "Here comes the directory listing.")
-	defer fc.CloseFileTransfer()
+// parseTLS check the AuthTLS version, cipher suite and curve names
+func (cfg *FtpdConfig) parseTLS() error {
+	cfg.tlsMinVersion = 0
+	if len(cfg.AuthTLS.MinVersion) > 0 {
+		version, ok := tlsVersions[cfg.AuthTLS.MinVersion]
+		if !ok {
+			return fmt.Errorf("invalid AuthTLS MinVersion %s: must be 1.0, 1.1, 1.2 or 1.3", cfg.AuthTLS.MinVersion)
+		}
+		cfg.tlsMinVersion = version
+	}
+
+	cfg.tlsCipherSuites = nil
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range cfg.AuthTLS.CipherSuites {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		id, ok := suites[name]
+		if !ok {
+			return fmt.Errorf("invalid AuthTLS CipherSuites %s: unknown cipher suite", name)
+		}
+		cfg.tlsCipherSuites = append(cfg.tlsCipherSuites, id)
+	}
+
+	cfg.tlsCurves = nil
+	for _, name := range cfg.AuthTLS.CurvePreferences {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("invalid AuthTLS CurvePreferences %s: must be X25519, P256, P384 or P521", name)
+		}
+		cfg.tlsCurves = append(cfg.tlsCurves, curve)
+	}
 
-	var files []string
-	err := fc.driver.ListDir(path, func(fi FileInfo) error {
-		files = append(files, fc.fileStat(fi))
+	cfg.tlsClientAuth = tls.NoClientCert
+	cfg.tlsClientCAs = nil
+	switch cfg.AuthTLS.ClientAuth {
+	case "", "none":
 		return nil
-	})
+	case "optional":
+		cfg.tlsClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.tlsClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid AuthTLS ClientAuth %s: must be none, optional or require", cfg.AuthTLS.ClientAuth)
+	}
+	if cfg.AuthTLS.ClientCertUser != "CN" && cfg.AuthTLS.ClientCertUser != "SAN" {
+		return fmt.Errorf("invalid AuthTLS ClientCertUser %s: must be CN or SAN", cfg.AuthTLS.ClientCertUser)
+	}
+	data, err := ioutil.ReadFile(cfg.AuthTLS.ClientCAFile)
 	if err != nil {
-		fc.Send(226, "Transfer done (but failed to open directory).")
-		<-fc.notify
-		return err
+		return fmt.Errorf("invalid AuthTLS ClientCAFile: %v", err)
+	}
+	cfg.tlsClientCAs = x509.NewCertPool()
+	if !cfg.tlsClientCAs.AppendCertsFromPEM(data) {
+		return fmt.Errorf("invalid AuthTLS ClientCAFile %s: no certificate found", cfg.AuthTLS.ClientCAFile)
 	}
-
-	<-fc.notify
-	fc.WriteFileTransfer([]byte(strings.Join(files, "\r\n")))
-	fc.Send(226, "Directory send OK.")
 	return nil
 }
 
-func (fc *FtpConn) handleMLSD() error {
-	path := fc.buildPath(fc.arg)
+// clientCertUser return the user name of a verified client certificate by
+// AuthTLS ClientCertUser, the common name or the first email or dns name
+// of the subject alternative names.
+func (cfg *FtpdConfig) clientCertUser(cert *x509.Certificate) string {
+	if cfg.AuthTLS.ClientCertUser != "SAN" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
 
-	fc.Send(150, "Here comes the directory listing.")
-	defer fc.CloseFileTransfer()
+// Check validate the config then check what it refers to as a dry run,
+// the bind address, certificate, login message file, authentication and
+// the driver being reachable with a writable base dir for file driver,
+// return all the problems found.
+func (cfg *FtpdConfig) Check() []error {
+	if err := cfg.Validate(); err != nil {
+		return []error{err}
+	}
 
-	var files []string
-	err := fc.driver.ListDir(path, func(fi FileInfo) error {
-		files = append(files, fc.fileMls(fi))
-		return nil
-	})
+	var errs []error
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Bind)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid Bind %s: %v", cfg.Bind, err))
+	} else if cfg.Pasv.Enable && addr.Port >= cfg.Pasv.PortStart && addr.Port <= cfg.Pasv.PortEnd {
+		errs = append(errs, fmt.Errorf("invalid Pasv port range %d-%d: contains the Bind port %d", cfg.Pasv.PortStart, cfg.Pasv.PortEnd, addr.Port))
+	}
+	if cfg.ACME.Enable {
+		if err := checkWritableDir(cfg.ACME.CacheDir); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ACME CacheDir %s: %v", cfg.ACME.CacheDir, err))
+		}
+	} else if cfg.AuthTLS.Enable {
+		if _, err := tls.LoadX509KeyPair(cfg.AuthTLS.CertFile, cfg.AuthTLS.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid AuthTLS certificate: %v", err))
+		}
+		if _, err := loadHostCertificates(cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(cfg.LoginMessageFile) > 0 {
+		if _, err := ioutil.ReadFile(cfg.LoginMessageFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid LoginMessageFile: %v", err))
+		}
+	}
+	if len(cfg.BannerFile) > 0 {
+		if _, err := ioutil.ReadFile(cfg.BannerFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid BannerFile: %v", err))
+		}
+	}
+	auth, err := newConfigAuth(cfg)
 	if err != nil {
-		fc.Send(226, "Transfer done (but failed to open directory).")
-		<-fc.notify
-		return err
+		errs = append(errs, fmt.Errorf("invalid authentication: %v", err))
+	} else if closer, ok := auth.(io.Closer); ok {
+		closer.Close()
 	}
-
-	<-fc.notify
-	fc.WriteFileTransfer([]byte(strings.Join(files, "\r\n")))
-	fc.Send(226, "Directory send OK.")
-	return nil
+	if err := cfg.checkDriver(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid %s driver: %v", cfg.Driver, err))
+	}
+	for _, m := range cfg.Mounts {
+		if err := cfg.mountConfig(m).checkDriver(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Mounts %s %s driver: %v", m.Path, m.Driver, err))
+		}
+	}
+	return errs
 }
 
-func (fc *FtpConn) handleMLST() error {
-	path := fc.buildPath(fc.arg)
+// errCheckDone - stop listing the root dir in checkDriver
+var errCheckDone = errors.New("check done")
 
-	fi, err := fc.driver.Stat(path)
+// checkDriver check the base dir of file driver is writable, the buckets
+// of minio driver can be queried, or the root dir of other drivers can be
+// listed with the credentials.
+func (cfg *FtpdConfig) checkDriver() error {
+	switch cfg.Driver {
+	case "file":
+		return checkWritableDir(cfg.FileDriver.BaseDir)
+	case "minio":
+		return cfg.checkMinioBuckets()
+	case "custom":
+		if factory == nil {
+			return errors.New("no driver factory set by SetDriverFactory")
+		}
+	}
+	driverFactory, err := newConfigDriverFactory(cfg)
 	if err != nil {
-
 		return err
 	}
-	fc.SendMulti(250, "File details:", fc.fileMls(fi), "End")
-	return nil
-}
-
-func (fc *FtpConn) handleMKD() error {
-	path := fc.buildPath(fc.arg)
-
-	err := fc.driver.MakeDir(path)
+	driver, err := driverFactory.NewDriver("")
 	if err != nil {
-		fc.Send(550, "Create directory operation failed.")
 		return err
 	}
-	fc.Send(257, fmt.Sprintf(`"%s" created`, fc.quote(path)))
-	return nil
+	defer closeDriver(driver)
+	if dc, ok := driver.(DriverContext); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		driver = dc.WithContext(ctx)
+	}
+	err = driver.ListDir("/", func(FileInfo) error { return errCheckDone })
+	if err == errCheckDone {
+		return nil
+	}
+	return err
 }
 
-func (fc *FtpConn) handleRMD() error {
-	path := fc.buildPath(fc.arg)
-
-	err := fc.driver.DeleteDir(path)
+// checkMinioBuckets check the buckets of minio driver with BucketExists, a
+// missing bucket is created by the first login so only the request has to
+// succeed, nothing is created by the check.
+func (cfg *FtpdConfig) checkMinioBuckets() error {
+	mc, err := openMinioClient(cfg.MinioDriver.Endpoint, cfg.MinioDriver.AccessKeyID, cfg.MinioDriver.SecretAccessKey, cfg.MinioDriver.UseSSL)
 	if err != nil {
-		fc.Send(550, "Remove directory operation failed.")
 		return err
 	}
-	fc.Send(250, "Remove directory operation successful.")
-	return nil
-}
-
-func (fc *FtpConn) handleTYPE() error {
-	switch fc.arg {
-	case "A", "a":
-		fc.mode = "ASCII"
-		fc.Send(200, "Switching to ASCII mode.")
-	case "I", "i":
-		fc.mode = "BINARY"
-		fc.Send(200, "Switching to Binary mode.")
-	default:
-		fc.mode = ""
-		fc.Send(500, "Unrecognised TYPE command.")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	buckets := []string{cfg.MinioDriver.Bucket}
+	for _, mapped := range cfg.MinioDriver.Users {
+		buckets = append(buckets, strings.SplitN(mapped, "/", 2)[0])
+	}
+	for _, bucket := range buckets {
+		if _, err := mc.client.BucketExists(ctx, bucket); err != nil {
+			return fmt.Errorf("bucket %s: %v", bucket, err)
+		}
 	}
 	return nil
 }
 
-func (fc *FtpConn) handlePASV() error {
-	if !fc.config.Pasv.Enable {
-		fc.Send(421, "PASV command is disabled.")
-		return nil
-	}
-
-	if ftpHandler.ClientBeforePasv != nil {
-		if !ftpHandler.ClientBeforePasv(fc.user) {
-			fc.Send(550, "Not Allowed.")
-			return nil
+// checkWritableDir check a file can be created in dir, or in the nearest
+// existing parent of dir if it is not created yet.
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
 		}
+		return checkWritableDir(parent)
 	}
-
-	listener, err := fc.pasvListen()
 	if err != nil {
-		log.Printf("[%d] pasv listen fail, err: %v\n", fc.id, err)
 		return err
 	}
-	go func() {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("[%d] pasv accept fail, err: %v\n", fc.id, err)
-		} else {
-			fc.OpenFileTransfer(conn)
-		}
-		fc.notify <- 1
-		listener.Close()
-	}()
-
-	ip := fc.config.Pasv.IP
-	if len(ip) == 0 {
-		ip = fc.ctrlConn.LocalAddr().(*net.TCPAddr).IP.String()
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
 	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	quads := strings.Split(ip, ".")
-	p1 := port / 256
-	p2 := port - (p1 * 256)
-	fc.Send(227, fmt.Sprintf("Entering Passive Mode (%s,%s,%s,%s,%d,%d).", quads[0], quads[1], quads[2], quads[3], p1, p2))
-	return nil
+	f, err := ioutil.TempFile(dir, ".kftpd-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
-func (fc *FtpConn) handlePORT() error {
-	if !fc.config.Port.Enable {
-		fc.Send(421, "PORT command is disabled.")
+// checkPasvAddress check a PASV address is an IPv4 address or a hostname
+func checkPasvAddress(address string) error {
+	address = strings.TrimSpace(address)
+	if len(address) == 0 {
 		return nil
 	}
-
-	if ftpHandler.ClientBeforePort != nil {
-		if !ftpHandler.ClientBeforePort(fc.user) {
-			fc.Send(550, "Not Allowed.")
-			return nil
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("%s is not an IPv4 address", address)
 		}
-	}
-
-	quads := strings.Split(fc.arg, ",")
-	if len(quads) < 6 {
-		fc.Send(500, "Illegal PORT command.")
 		return nil
 	}
-	p1, _ := strconv.Atoi(quads[4])
-	p2, _ := strconv.Atoi(quads[5])
-	port := (p1 * 256) + p2
-	ip := quads[0] + "." + quads[1] + "." + quads[2] + "." + quads[3]
-
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), time.Duration(fc.config.Port.ConnectTimeout)*time.Second)
-	if err != nil {
-		fc.Send(500, "Illegal PORT command.")
-		return err
+	if strings.ContainsAny(address, " /:") {
+		return fmt.Errorf("bad hostname %s", address)
 	}
-	fc.OpenFileTransfer(conn)
-	fc.notify <- 1
-	fc.Send(200, "PORT command successful.")
 	return nil
 }
 
-// NewFtpConn return a new ftp session
-func NewFtpConn(cid int, conn net.Conn, config *FtpdConfig, tlsConfig *tls.Config, factory DriverFactory) *FtpConn {
-	fc := new(FtpConn)
-
-	fc.id = cid
-	fc.ctrlConn = conn
-	fc.config = config
-	fc.tlsConfig = tlsConfig
-	fc.reader = bufio.NewReader(conn)
-	fc.writer = bufio.NewWriter(conn)
-	fc.factory = factory
-	fc.path = "/"
-	fc.arg = ""
-	fc.mode = "ASCII"
-	fc.authd = false
-	fc.notify = make(chan int, 1)
-
-	return fc
-}
-
-// buildPath return ftp clean path
-func (fc *FtpConn) buildPath(path string) string {
-	if strings.HasPrefix(path, "/") {
-		return filepath.Clean(path)
+// parseNetworks parse CIDRs, a bare ip is the network of itself
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip: %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
 	}
-	return filepath.Clean(filepath.Join(fc.path, path))
+	return nets, nil
 }
 
-// fileStat return ftp format file information
-func (fc *FtpConn) fileStat(fi FileInfo) string {
-	return fmt.Sprintf("%s 1 %s %s %12d %s %s", fi.Mode().String(), fc.user, fc.user, fi.Size(), fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+// networksContain return whether one of nets contains ip
+func networksContain(nets []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
-// fileMls return ftp mls* command required format file information
-func (fc *FtpConn) fileMls(fi FileInfo) string {
-	var t string
-	if fi.IsDir() {
-		t = "dir"
-	} else {
-		t = "file"
+// accessAllowed return whether ip may connect by the Access lists, Deny
+// wins over Allow, an empty Allow allows any ip.
+func (cfg *FtpdConfig) accessAllowed(ip string) bool {
+	if networksContain(cfg.denyNets, ip) {
+		return false
 	}
-	return fmt.Sprintf("Type=%s;Size=%d;Modify=%s; %s", t, fi.Size(), fi.ModTime().Format("20060102150405"), fi.Name())
+	return len(cfg.allowNets) == 0 || networksContain(cfg.allowNets, ip)
 }
 
-// quote return quoted string
-func (fc *FtpConn) quote(s string) string {
-	if !strings.Contains(s, "\"") {
-		return s
-	}
-	return strings.ReplaceAll(s, "\"", `""`)
+// systNames - system names allowed to start the SYST reply, RFC 1700
+var systNames = map[string]bool{
+	"UNIX":       true,
+	"Windows_NT": true,
+	"MACOS":      true,
+	"VMS":        true,
+	"OS/2":       true,
+	"MVS":        true,
+	"NETWARE":    true,
 }
 
-func (fc *FtpConn) pasvListen() (*net.TCPListener, error) {
-	nAttempts := fc.config.Pasv.PortEnd - fc.config.Pasv.PortStart + 1
+// checkPasswords reject users with empty or short passwords,
+// and warn about users sharing the same password.
+func (cfg *FtpdConfig) checkPasswords() error {
+	names := make([]string, 0, len(cfg.Users))
+	for name := range cfg.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	for i := 0; i < nAttempts; i++ {
-		port := fc.config.Pasv.PortStart + rand.Intn(nAttempts)
-		laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
-		if err != nil {
-			return nil, err
+	owners := make(map[string]string)
+	for _, name := range names {
+		pwd := cfg.Users[name].Password
+		if len(pwd) == 0 {
+			return fmt.Errorf("user %s has an empty password", name)
 		}
-		listener, err := net.ListenTCP("tcp", laddr)
-		if err == nil {
-			fc.pasvPort = port
-			listener.SetDeadline(time.Now().Add(time.Duration(fc.config.Pasv.ListenTimeout) * time.Second))
-			return listener, err
+		if isBcryptHash(pwd) || isArgon2idHash(pwd) {
+			// the strength of a hashed password is unknown.
+			continue
+		}
+		if len(pwd) < cfg.MinPasswordLength {
+			return fmt.Errorf("user %s password shorter than %d", name, cfg.MinPasswordLength)
+		}
+		if owner, ok := owners[pwd]; ok {
+			defaultLogger.Log(LogWarn, "user reuses the password of another user", "user", name, "owner", owner)
+			continue
 		}
+		owners[pwd] = name
 	}
-	return nil, errors.New("no available listening port")
+	return nil
 }
 
-// Close close ftp connections
-func (fc *FtpConn) Close() {
-	if fc.ctrlConn != nil {
-		fc.ctrlConn.Close()
-		fc.ctrlConn = nil
-	}
+// ErrServerClosed - returned by Server.Serve after Shutdown
+var ErrServerClosed = errors.New("kftpd: Server closed")
+
+// Server - ftp server
+type Server struct {
+	config    *FtpdConfig
+	bandwidth *bandwidthLimiter
+	listener  net.Listener
+	lock      sync.Mutex
+	sessions  map[*FtpConn]struct{}
+	closing   bool
+	quit      chan struct{}
+	done      chan struct{}
+	certLock  sync.RWMutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	hostCerts map[string]*tls.Certificate
+	acme      *autocert.Manager
+	acmeLn    net.Listener
+	handler   *FtpdHandler
+	logger    Logger
+	quota     *quotaManager
+	throttles *throttleLimiters
+	ports     *portPool
+	uploads   *uploadTracker
+	auth      Authenticator
+	bans      *loginBans
 }
 
-// OpenFileTransfer open a ftp file transfer
-func (fc *FtpConn) OpenFileTransfer(conn net.Conn) {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
-	if fc.dataConn != nil {
-		fc.dataConn.Close()
-	}
-	if fc.config.Debug {
-		log.Printf("[%d] Open: %d\n", fc.id, fc.pasvPort)
+// NewServer return a ftp server
+func NewServer(config *FtpdConfig) *Server {
+	return &Server{
+		config:    config,
+		sessions:  make(map[*FtpConn]struct{}),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		quota:     newQuotaManager(),
+		throttles: newThrottleLimiters(),
+		ports:     newPortPool(),
+		uploads:   newUploadTracker(),
+		bans:      newLoginBans(),
 	}
-	fc.dataConn = conn
 }
 
-// CloseFileTransfer close a ftp file transfer
-func (fc *FtpConn) CloseFileTransfer() {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
-	if fc.dataConn != nil {
-		fc.dataConn.Close()
-		fc.dataConn = nil
-		if fc.config.Debug {
-			log.Printf("[%d] Close: %d\n", fc.id, fc.pasvPort)
+// Serve start the ftp server, return ErrServerClosed after Shutdown
+func (server *Server) Serve() error {
+	config := server.config
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if config.ACME.Enable {
+		server.acme = server.newACMEManager(config)
+	} else if config.AuthTLS.Enable {
+		if err := server.loadCertificate(config.AuthTLS.CertFile, config.AuthTLS.KeyFile); err != nil {
+			return err
 		}
-		fc.pasvPort = 0
+		certs, err := loadHostCertificates(config)
+		if err != nil {
+			return err
+		}
+		server.certLock.Lock()
+		server.hostCerts = certs
+		server.certLock.Unlock()
 	}
-}
 
-// GetFileTransfer return a client file reader transfer
-func (fc *FtpConn) GetFileTransfer() io.Reader {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
-	return fc.dataConn
-}
+	driverFactory, err := newConfigDriverFactory(config)
+	if err != nil {
+		return err
+	}
 
-// PutFileTransfer transfer a ftp file to client
-func (fc *FtpConn) PutFileTransfer(reader io.Reader) error {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
-	_, err := io.Copy(fc.dataConn, reader)
-	return err
-}
+	if server.logger == nil {
+		server.logger = newConfigLogger(config)
+	}
 
-// WriteFileTransfer write data to file transfer
-func (fc *FtpConn) WriteFileTransfer(msg []byte) {
-	fc.lock.Lock()
-	defer fc.lock.Unlock()
-	if fc.dataConn != nil {
-		if fc.config.Debug {
-			log.Printf("[%d] Send: %s\n", fc.id, string(msg))
+	auth, err := newConfigAuth(config)
+	if err != nil {
+		return err
+	}
+	server.auth = auth
+
+	if config.Bandwidth.TotalKBps > 0 {
+		server.bandwidth = newBandwidthLimiter(config.Bandwidth.TotalKBps)
+	}
+
+	var acmeLn net.Listener
+	if server.acme != nil {
+		acmeLn, err = net.Listen("tcp", config.ACME.ChallengeBind)
+		if err != nil {
+			return err
 		}
-		fc.dataConn.Write(msg)
 	}
-}
 
-// Send send code and message to client
-func (fc *FtpConn) Send(code int, msg string) {
-	if fc.config.Debug {
-		log.Printf("[%d] Send: %d %s\n", fc.id, code, msg)
+	listener, err := net.Listen("tcp", config.Bind)
+	if err != nil {
+		if acmeLn != nil {
+			acmeLn.Close()
+		}
+		return err
 	}
-	fc.writer.WriteString(fmt.Sprintf("%d %s\r\n", code, msg))
-	fc.writer.Flush()
-}
 
-// SendMulti send code and multiple line message to client
-func (fc *FtpConn) SendMulti(code int, header, body, footer string) {
-	if fc.config.Debug {
-		log.Printf("[%d] Send %d %s\n%s\n%s\n", fc.id, code, header, body, footer)
+	server.lock.Lock()
+	if server.closing {
+		server.lock.Unlock()
+		listener.Close()
+		if acmeLn != nil {
+			acmeLn.Close()
+		}
+		return ErrServerClosed
+	}
+	server.listener = listener
+	server.acmeLn = acmeLn
+	server.lock.Unlock()
+
+	if acmeLn != nil {
+		server.serveACMEChallenge(acmeLn, config.ACME.Challenge)
+	} else if config.AuthTLS.Enable {
+		go server.watchCertificate()
 	}
-	fc.writer.WriteString(fmt.Sprintf("%d-%s\r\n%s\r\n%d %s\r\n", code, header, body, code, footer))
-	fc.writer.Flush()
-}
 
-// Serve parse and handle ftp client data
-func (fc *FtpConn) Serve() {
-	fc.Send(220, "KFtpd")
+	cid := 0
 	for {
-		line, _, err := fc.reader.ReadLine()
+		conn, err := listener.Accept()
 		if err != nil {
-			break
-		}
-		if len(line) == 0 {
+			if server.isClosing() {
+				return ErrServerClosed
+			}
 			continue
 		}
-		if fc.config.Debug {
-			log.Printf("[%d] Recv: %v\n", fc.id, string(line))
+		// a reloaded config applies to the sessions from now on.
+		config := server.currentConfig()
+		fc := NewFtpConn(cid, conn, config, server.tlsConfig(config), driverFactory)
+		fc.server = server
+		if ip := fc.remoteIP(); !config.accessAllowed(ip) {
+			fc.log(LogInfo, "refuse ip by access lists", "ip", ip)
+			fc.Send(421, "Access denied.")
+			conn.Close()
+			continue
+		} else if server.bans.banned(ip) {
+			fc.log(LogInfo, "refuse banned ip", "ip", ip)
+			fc.Send(421, "Too many failed logins, try again later.")
+			conn.Close()
+			continue
 		}
-		words := strings.SplitN(string(line), " ", 2)
-		command := strings.ToUpper(words[0])
-		if len(words) == 2 {
-			fc.arg = words[1]
-		} else {
-			fc.arg = ""
+		if server.handler != nil {
+			fc.handler = server.handler
 		}
-		if command == "HELP" {
-			var cmds []string
-			for cmd := range cmdMap {
-				cmds = append(cmds, " "+cmd)
-			}
-			sort.Strings(cmds)
-			fc.SendMulti(214, "The following commands are recognized.", strings.Join(cmds, "\r\n"), "Help OK.")
-			continue
+		fc.logger = server.logger
+		fc.quota = server.quota
+		fc.throttles = server.throttles
+		fc.ports = server.ports
+		fc.uploads = server.uploads
+		if !server.addSession(fc) {
+			conn.Close()
+			return ErrServerClosed
 		}
-		cmd, ok := cmdMap[command]
-		if !ok {
-			fc.Send(500, "Unknown command.")
-			continue
+		go func() {
+			fc.Serve()
+			server.removeSession(fc)
+		}()
+		cid = cid + 1
+	}
+}
+
+// newConfigDriverFactory return the driver factory of Driver with the
+// drivers of Mounts mounted if any.
+func newConfigDriverFactory(config *FtpdConfig) (DriverFactory, error) {
+	root, err := newDriverFactory(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Mounts) > 0 {
+		mounts := make([]MountPoint, len(config.Mounts))
+		for i, m := range config.Mounts {
+			factory, err := newDriverFactory(config.mountConfig(m))
+			if err != nil {
+				return nil, err
+			}
+			mounts[i] = MountPoint{Path: m.Path, Factory: factory, ReadOnly: m.ReadOnly, UserHome: m.UserHome}
 		}
-		if cmd.Auth && !fc.authd {
-			fc.Send(530, "Please login with USER and PASS.")
-			continue
+		root = NewMountDriverFactory(root, mounts)
+	}
+	if config.Encryption.Enable {
+		return NewEncryptDriverFactory(root, config.encryptionKey)
+	}
+	return root, nil
+}
+
+// newDriverFactory return the driver factory of Driver, the one of
+// SetDriverFactory for custom.
+func newDriverFactory(config *FtpdConfig) (DriverFactory, error) {
+	switch config.Driver {
+	case "file":
+		dirMode, inheritDirMode, _ := parseDirMode(config.FileDriver.DirMode)
+		return NewFileDriverFactoryWithOptions(config.FileDriver.BaseDir, FileDriverOptions{
+			MaxFilesPerDir: config.FileDriver.MaxFilesPerDir,
+			SnapshotList:   config.FileDriver.SnapshotList,
+			FollowSymlinks: config.FileDriver.FollowSymlinks,
+			DirMode:        dirMode,
+			InheritDirMode: inheritDirMode,
+		}), nil
+	case "minio":
+		factory := NewMinioDriverFactoryWithOptions(MinioDriverOptions{
+			Endpoint:        config.MinioDriver.Endpoint,
+			AccessKeyID:     config.MinioDriver.AccessKeyID,
+			SecretAccessKey: config.MinioDriver.SecretAccessKey,
+			UseSSL:          config.MinioDriver.UseSSL,
+			Bucket:          config.MinioDriver.Bucket,
+			PresignExpire:   config.MinioDriver.PresignExpire,
+			PartSize:        config.MinioDriver.PartSize,
+			SmallUploadSize: config.MinioDriver.SmallUploadSize,
+			Prefix:          config.MinioDriver.Prefix,
+			Users:           config.MinioDriver.Users,
+		})
+		if config.MinioDriver.CacheSize <= 0 {
+			return factory, nil
 		}
-		if err := cmd.Fn(fc); err != nil {
-			log.Printf("[%d] %s: %v\n", fc.id, command, err)
+		cache, err := openDiskCache(config.MinioDriver.CacheDir, int64(config.MinioDriver.CacheSize)<<20, time.Duration(config.MinioDriver.CacheTTL)*time.Second)
+		if err != nil {
+			return nil, err
 		}
+		return NewCacheDriverFactory(factory, cache, config.MinioDriver.Endpoint), nil
+	case "s3":
+		return NewS3DriverFactory(S3DriverOptions{
+			Endpoint:        config.S3Driver.Endpoint,
+			Region:          config.S3Driver.Region,
+			Bucket:          config.S3Driver.Bucket,
+			AccessKeyID:     config.S3Driver.AccessKeyID,
+			SecretAccessKey: config.S3Driver.SecretAccessKey,
+			RoleARNs:        config.S3Driver.RoleARNs,
+			ExternalID:      config.S3Driver.ExternalID,
+			STSEndpoint:     config.S3Driver.STSEndpoint,
+			UseSSL:          config.S3Driver.UseSSL,
+			PathStyle:       config.S3Driver.PathStyle,
+			SSE:             config.S3Driver.SSE,
+			SSEKMSKeyID:     config.S3Driver.SSEKMSKeyID,
+			PresignExpire:   config.S3Driver.PresignExpire,
+			PartSize:        config.S3Driver.PartSize,
+		})
+	case "sftp":
+		return NewSFTPDriverFactory(config.SFTPDriver.Addr, config.SFTPDriver.User, config.SFTPDriver.Password, config.SFTPDriver.KeyFile, config.SFTPDriver.KnownHostsFile, config.SFTPDriver.RootPath, config.SFTPDriver.Users), nil
+	case "gcs":
+		return NewGCSDriverFactory(config.GCSDriver.Bucket, config.GCSDriver.CredentialsFile), nil
+	case "custom":
+		return factory, nil
+	default:
+		return nil, fmt.Errorf("not supported driver: %s", config.Driver)
 	}
-	fc.Close()
 }
 
-// UserBeforeLogin register
-func UserBeforeLogin(handler func(string, string) bool) {
-	ftpHandler.UserBeforeLogin = handler
+// newConfigAuth return the authenticator of AuthFile, AuthWebhook, SQL or
+// LDAP, nil for Users.
+func newConfigAuth(config *FtpdConfig) (Authenticator, error) {
+	if len(config.AuthFile) > 0 {
+		return NewHtpasswdAuthenticator(config.AuthFile)
+	}
+	if len(config.AuthWebhook.URL) > 0 {
+		return NewWebhookAuthenticator(config.AuthWebhook.URL, config.AuthWebhook.Token, config.AuthWebhook.Timeout), nil
+	}
+	if config.SQL.Enable {
+		return NewSQLUserStore(config.SQL.Driver, config.SQL.DSN, config.SQL.Query, config.TOTPSkew, config.SQL.Timeout)
+	}
+	if config.LDAP.Enable {
+		return NewLDAPAuthenticator(LDAPOptions{
+			URL:            config.LDAP.URL,
+			StartTLS:       config.LDAP.StartTLS,
+			CAFile:         config.LDAP.CAFile,
+			BindDN:         config.LDAP.BindDN,
+			BindPassword:   config.LDAP.BindPassword,
+			BaseDN:         config.LDAP.BaseDN,
+			UserFilter:     config.LDAP.UserFilter,
+			GroupAttribute: config.LDAP.GroupAttribute,
+			Groups:         config.LDAP.Groups,
+			Timeout:        config.LDAP.Timeout,
+		})
+	}
+	return nil, nil
 }
 
-// UserAfterLogin register
-func UserAfterLogin(handler func(string)) {
-	ftpHandler.UserAfterLogin = handler
-}
+// Reload apply config to the sessions connected from now on, the ones
+// connected keep the old config so transfers in progress go on. Users,
+// limits, access lists, banner and authentication are replaced and the
+// certificate of AuthTLS is loaded again, while Bind, Driver, the driver
+// settings, AuthTLS.Enable and ACME.Enable need a restart. The current
+// config is kept if config is invalid.
+func (server *Server) Reload(config *FtpdConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	old := server.currentConfig()
+	if config.Bind != old.Bind || config.Driver != old.Driver || config.AuthTLS.Enable != old.AuthTLS.Enable ||
+		config.ACME.Enable != old.ACME.Enable || !bytes.Equal(config.encryptionKey, old.encryptionKey) {
+		return errors.New("Bind, Driver, AuthTLS.Enable, ACME.Enable and Encryption can not be reloaded, restart instead")
+	}
+	auth, err := newConfigAuth(config)
+	if err != nil {
+		return err
+	}
+	if config.AuthTLS.Enable && !config.ACME.Enable {
+		certs, err := loadHostCertificates(config)
+		if err == nil {
+			err = server.ReloadTLS(config.AuthTLS.CertFile, config.AuthTLS.KeyFile)
+		}
+		if err != nil {
+			if closer, ok := auth.(io.Closer); ok {
+				closer.Close()
+			}
+			return err
+		}
+		server.certLock.Lock()
+		server.hostCerts = certs
+		server.certLock.Unlock()
+	}
 
-// ClientBeforePasv register
-func ClientBeforePasv(handler func(string) bool) {
-	ftpHandler.ClientBeforePasv = handler
-}
+	server.lock.Lock()
+	oldAuth := server.auth
+	server.config = config
+	server.auth = auth
+	if config.Bandwidth.TotalKBps <= 0 {
+		server.bandwidth = nil
+	} else if server.bandwidth != nil {
+		server.bandwidth.setRate(config.Bandwidth.TotalKBps)
+	} else {
+		server.bandwidth = newBandwidthLimiter(config.Bandwidth.TotalKBps)
+	}
+	server.lock.Unlock()
 
-// ClientBeforePort register
-func ClientBeforePort(handler func(string) bool) {
-	ftpHandler.ClientBeforePort = handler
+	// a login in progress with the old authenticator fails.
+	if closer, ok := oldAuth.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
 }
 
-// FileBeforePut register
-func FileBeforePut(handler func(string, string) bool) {
-	ftpHandler.FileBeforePut = handler
+// currentConfig return the config of new sessions
+func (server *Server) currentConfig() *FtpdConfig {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.config
 }
 
-// FileAfterPut register
-func FileAfterPut(handler func(string, string)) {
-	ftpHandler.FileAfterPut = handler
+// authenticator return the authenticator of config if any
+func (server *Server) authenticator() Authenticator {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.auth
 }
 
-// FileBeforeGet register
-func FileBeforeGet(handler func(string, string) bool) {
-	ftpHandler.FileBeforeGet = handler
+// bandwidthLimiter return the shared bandwidth limiter if any
+func (server *Server) bandwidthLimiter() *bandwidthLimiter {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.bandwidth
 }
 
-// FileAfterGet register
-func FileAfterGet(handler func(string, string)) {
-	ftpHandler.FileAfterGet = handler
+// SetHandler set the hooks of the server instead of the global ones,
+// call it before Serve.
+func (server *Server) SetHandler(handler *FtpdHandler) {
+	server.handler = handler
 }
 
-// FileBeforeDelete register
-func FileBeforeDelete(handler func(string, string) bool) {
-	ftpHandler.FileBeforeDelete = handler
+// SetLogger set the logger of the server instead of the one of LogFormat
+// and LogLevel, call it before Serve.
+func (server *Server) SetLogger(logger Logger) {
+	server.logger = logger
 }
 
-// FileAfterDelete register
-func FileAfterDelete(handler func(string, string)) {
-	ftpHandler.FileAfterDelete = handler
+// tlsConfig return the tls config of AuthTLS, nil if not enabled
+func (server *Server) tlsConfig(config *FtpdConfig) *tls.Config {
+	if !config.AuthTLS.Enable {
+		return nil
+	}
+	return &tls.Config{
+		GetCertificate:   server.getCertificate,
+		MinVersion:       config.tlsMinVersion,
+		CipherSuites:     config.tlsCipherSuites,
+		CurvePreferences: config.tlsCurves,
+		ClientAuth:       config.tlsClientAuth,
+		ClientCAs:        config.tlsClientCAs,
+	}
 }
 
-// FileBeforeRename register
-func FileBeforeRename(handler func(string, string, string) bool) {
-	ftpHandler.FileBeforeRename = handler
+// getCertificate return the current certificate for a new handshake
+func (server *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if server.acme != nil {
+		if len(hello.ServerName) == 0 {
+			// most ftp clients send no SNI, use the first host.
+			named := *hello
+			named.ServerName = server.currentConfig().ACME.Hosts[0]
+			hello = &named
+		}
+		return server.acme.GetCertificate(hello)
+	}
+	server.certLock.RLock()
+	defer server.certLock.RUnlock()
+	if cert, ok := server.hostCerts[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	return server.cert, nil
 }
 
-// FileAfterRename register
-func FileAfterRename(handler func(string, string, string)) {
-	ftpHandler.FileAfterRename = handler
+// loadHostCertificates load the certificates of VirtualHosts by host name
+func loadHostCertificates(config *FtpdConfig) (map[string]*tls.Certificate, error) {
+	certs := make(map[string]*tls.Certificate)
+	for name, vh := range config.VirtualHosts {
+		if len(vh.CertFile) == 0 {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(vh.CertFile, vh.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VirtualHosts %s certificate: %v", name, err)
+		}
+		certs[strings.ToLower(name)] = &cert
+	}
+	return certs, nil
 }
 
-var factory DriverFactory
-
-// SetDriverFactory set a custom ftp driver factory
-func SetDriverFactory(customDriverFactory DriverFactory) {
-	factory = customDriverFactory
+// ReloadTLS load a new certificate and key for the following handshakes,
+// the connections already secured are not affected. The current certificate
+// is kept if the new pair fails to load.
+func (server *Server) ReloadTLS(certFile, keyFile string) error {
+	config := server.currentConfig()
+	if !config.AuthTLS.Enable {
+		return errors.New("auth tls not enabled")
+	} else if config.ACME.Enable {
+		return errors.New("certificate managed by acme")
+	}
+	return server.loadCertificate(certFile, keyFile)
 }
 
-// NewFtpdConfig return a ftd config
-func NewFtpdConfig() *FtpdConfig {
-	var cfg FtpdConfig
-
-	cfg.Bind = ":21"
-	cfg.Driver = "file"
-	cfg.HomeDir = true
-	cfg.Debug = true
-
-	cfg.Pasv.Enable = true
-	cfg.Pasv.IP = ""
-	cfg.Pasv.PortStart = 21000
-	cfg.Pasv.PortEnd = 21100
-	cfg.Pasv.ListenTimeout = 10
-
-	cfg.Port.Enable = true
-	cfg.Port.ConnectTimeout = 10
-
-	cfg.FileDriver.BaseDir = "kftpd-data"
-
-	cfg.MinioDriver.Endpoint = "127.0.0.1:9000"
-	cfg.MinioDriver.AccessKeyID = "minioadmin"
-	cfg.MinioDriver.SecretAccessKey = "minioadmin"
-	cfg.MinioDriver.Bucket = "kftpd-data"
-	cfg.MinioDriver.UseSSL = false
-
-	cfg.AuthTLS.Enable = false
-	cfg.AuthTLS.CertFile = ""
-	cfg.AuthTLS.KeyFile = ""
-
-	cfg.Users = map[string]string{
-		"kftpd": "kftpd",
+// newACMEManager return the autocert manager obtaining and renewing the
+// certificates of ACME Hosts, a reloaded config changes the hosts allowed.
+func (server *Server) newACMEManager(config *FtpdConfig) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(config.ACME.CacheDir),
+		Email:  config.ACME.Email,
+		HostPolicy: func(ctx context.Context, host string) error {
+			for _, h := range server.currentConfig().ACME.Hosts {
+				if strings.EqualFold(h, host) {
+					return nil
+				}
+			}
+			return fmt.Errorf("acme: host %q not configured", host)
+		},
 	}
-
-	if env, ok := os.LookupEnv("KFTPD_BIND"); ok {
-		cfg.Bind = env
+	if len(config.ACME.DirectoryURL) > 0 {
+		manager.Client = &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
 	}
+	return manager
+}
 
-	if env, ok := os.LookupEnv("KFTPD_DRIVER"); ok {
-		cfg.Driver = env
+// serveACMEChallenge answer the http-01 or tls-alpn-01 challenges of the
+// ACME server on ln until the server is closed.
+func (server *Server) serveACMEChallenge(ln net.Listener, challenge string) {
+	if challenge == "http-01" {
+		go (&http.Server{Handler: server.acme.HTTPHandler(nil)}).Serve(ln)
+		return
 	}
+	tlsConfig := server.acme.TLSConfig()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+				tls.Server(conn, tlsConfig).Handshake()
+			}()
+		}
+	}()
+}
 
-	if env, ok := os.LookupEnv("KFTPD_HOMEDIR"); ok {
-		cfg.HomeDir, _ = strconv.ParseBool(env)
+// loadCertificate load the certificate and key, remember their modify time
+func (server *Server) loadCertificate(certFile, keyFile string) error {
+	mod := certModTime(certFile, keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
 	}
+	server.certLock.Lock()
+	server.cert = &cert
+	server.certMod = mod
+	server.certLock.Unlock()
+	return nil
+}
 
-	if env, ok := os.LookupEnv("KFTPD_DEBUG"); ok {
-		cfg.Debug, _ = strconv.ParseBool(env)
+// certModTime return the latest modify time of the certificate and key,
+// zero if any of them can not stat.
+func certModTime(certFile, keyFile string) time.Time {
+	var mod time.Time
+	for _, name := range []string{certFile, keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
 	}
+	return mod
+}
 
-	if env, ok := os.LookupEnv("KFTPD_PASV_ENABLE"); ok {
-		cfg.Pasv.Enable, _ = strconv.ParseBool(env)
+// watchCertificate check the certificate and key of AuthTLS every
+// ReloadInterval seconds and load them again once modified, so a renewed
+// certificate is used by the following handshakes without a restart.
+func (server *Server) watchCertificate() {
+	// tick every second as a reloaded config may change the interval.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var checked time.Time
+	for {
+		var now time.Time
+		select {
+		case <-server.quit:
+			return
+		case now = <-ticker.C:
+		}
+		interval := server.currentConfig().AuthTLS.ReloadInterval
+		if interval <= 0 || now.Sub(checked) < time.Duration(interval)*time.Second {
+			continue
+		}
+		checked = now
+
+		config := server.currentConfig()
+		mod := certModTime(config.AuthTLS.CertFile, config.AuthTLS.KeyFile)
+		server.certLock.RLock()
+		changed := !mod.IsZero() && !mod.Equal(server.certMod)
+		server.certLock.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := server.loadCertificate(config.AuthTLS.CertFile, config.AuthTLS.KeyFile); err != nil {
+			server.logger.Log(LogError, "reload certificate fail", "err", err)
+			continue
+		}
+		server.logger.Log(LogInfo, "reload certificate", "file", config.AuthTLS.CertFile)
 	}
+}
 
-	if env, ok := os.LookupEnv("KFTPD_PASV_IP"); ok {
-		cfg.Pasv.IP = env
+// Shutdown stop accepting clients, close idle sessions and outstanding
+// passive listeners, then wait the busy sessions quit until ctx is done,
+// the rest sessions are closed forcibly.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lock.Lock()
+	if !server.closing {
+		server.closing = true
+		close(server.quit)
+		if server.listener != nil {
+			server.listener.Close()
+		}
+		if server.acmeLn != nil {
+			server.acmeLn.Close()
+		}
 	}
-
-	if env, ok := os.LookupEnv("KFTPD_PASV_PORTSTART"); ok {
-		cfg.Pasv.PortStart, _ = strconv.Atoi(env)
+	for fc := range server.sessions {
+		fc.shutdown()
 	}
-
-	if env, ok := os.LookupEnv("KFTPD_PASV_PORTEND"); ok {
-		cfg.Pasv.PortEnd, _ = strconv.Atoi(env)
+	empty := len(server.sessions) == 0
+	server.lock.Unlock()
+
+	if !empty {
+		select {
+		case <-server.done:
+		case <-ctx.Done():
+			server.lock.Lock()
+			for fc := range server.sessions {
+				fc.abort()
+			}
+			server.lock.Unlock()
+			return ctx.Err()
+		}
 	}
+	return nil
+}
 
-	if env, ok := os.LookupEnv("KFTPD_PASV_LISTEN_TIMEOUT"); ok {
-		cfg.Pasv.ListenTimeout, _ = strconv.Atoi(env)
+// Close stop accepting clients and close all sessions at once, a closed
+// server can not serve again, create a new one with NewServer to restart.
+func (server *Server) Close() error {
+	var err error
+	server.lock.Lock()
+	if !server.closing {
+		server.closing = true
+		close(server.quit)
+		if server.listener != nil {
+			err = server.listener.Close()
+		}
+		if server.acmeLn != nil {
+			server.acmeLn.Close()
+		}
 	}
-
-	if env, ok := os.LookupEnv("KFTPD_PORT_ENABLE"); ok {
-		cfg.Port.Enable, _ = strconv.ParseBool(env)
+	for fc := range server.sessions {
+		fc.abort()
 	}
+	server.lock.Unlock()
+	return err
+}
 
-	if env, ok := os.LookupEnv("KFTPD_PORT_CONNECT_TIMEOUT"); ok {
-		cfg.Port.ConnectTimeout, _ = strconv.Atoi(env)
-	}
+// isClosing return whether the server is shutting down
+func (server *Server) isClosing() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.closing
+}
 
-	if env, ok := os.LookupEnv("KFTPD_FILEDRIVER_BASEDIR"); ok {
-		cfg.FileDriver.BaseDir = env
+// addSession track a session, return false if the server is shutting down
+func (server *Server) addSession(fc *FtpConn) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.closing {
+		return false
 	}
+	server.sessions[fc] = struct{}{}
+	return true
+}
 
-	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_ENDPOINT"); ok {
-		cfg.MinioDriver.Endpoint = env
-	}
+// Session - a connected session, User is empty before login
+type Session struct {
+	ID        int
+	User      string
+	Remote    string
+	Connected time.Time
+}
 
-	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_ACCESSKEYID"); ok {
-		cfg.MinioDriver.AccessKeyID = env
+// Sessions return the connected sessions, sorted by id
+func (server *Server) Sessions() []Session {
+	server.lock.Lock()
+	sessions := make([]Session, 0, len(server.sessions))
+	for fc := range server.sessions {
+		fc.stateLock.Lock()
+		sessions = append(sessions, Session{fc.id, fc.loginUser, fc.remote, fc.connected})
+		fc.stateLock.Unlock()
 	}
+	server.lock.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
 
-	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_SECRETACCESSKEY"); ok {
-		cfg.MinioDriver.SecretAccessKey = env
+// Kick close the session of id with 421, return false if there is none
+func (server *Server) Kick(id int) bool {
+	var session *FtpConn
+	server.lock.Lock()
+	for fc := range server.sessions {
+		if fc.id == id {
+			session = fc
+			break
+		}
 	}
+	server.lock.Unlock()
 
-	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_BUCKET"); ok {
-		cfg.MinioDriver.Bucket = env
+	if session == nil {
+		return false
 	}
+	session.kick()
+	return true
+}
 
-	if env, ok := os.LookupEnv("KFTPD_MINIODRIVER_USESSL"); ok {
-		cfg.MinioDriver.UseSSL, _ = strconv.ParseBool(env)
+// KickUser close all sessions logged in as user with 421,
+// return the number of sessions closed.
+func (server *Server) KickUser(user string) int {
+	var sessions []*FtpConn
+	server.lock.Lock()
+	for fc := range server.sessions {
+		fc.stateLock.Lock()
+		if fc.loginUser == user {
+			sessions = append(sessions, fc)
+		}
+		fc.stateLock.Unlock()
 	}
+	server.lock.Unlock()
 
-	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_ENABLE"); ok {
-		cfg.AuthTLS.Enable, _ = strconv.ParseBool(env)
+	for _, fc := range sessions {
+		fc.kick()
 	}
+	return len(sessions)
+}
 
-	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_CERTFILE"); ok {
-		cfg.AuthTLS.CertFile = env
-	}
+// Ban - an ip banned for failed logins until the time
+type Ban struct {
+	IP    string
+	Until time.Time
+}
 
-	if env, ok := os.LookupEnv("KFTPD_AUTHTLS_KEYFILE"); ok {
-		cfg.AuthTLS.KeyFile = env
-	}
+// Upload - an upload in progress, or an interrupted one kept ResumeTimeout
+// for the client to resume, with the size of the partial file
+type Upload struct {
+	User    string
+	Path    string
+	Started time.Time
+	Partial bool
+	Size    int64
+}
 
-	if env, ok := os.LookupEnv("KFTPD_USERS"); ok {
-		cfg.Users = make(map[string]string)
-		arr := strings.Split(env, ",")
-		for _, v := range arr {
-			s := strings.Split(v, ":")
-			if len(s) == 2 {
-				cfg.Users[s[0]] = s[1]
-			}
-		}
-	}
+// Uploads return the uploads in progress and the interrupted ones
+func (server *Server) Uploads() []Upload {
+	return server.uploads.list()
+}
 
-	return &cfg
+// Bans return the ips banned for failed logins
+func (server *Server) Bans() []Ban {
+	return server.bans.list()
 }
 
-// LoadFtpdConfig return a ftd config loaded from config file
-func LoadFtpdConfig(configFile string) (*FtpdConfig, error) {
-	cfg := NewFtpdConfig()
+// Unban lift the ban of ip and forget its failed logins, return false if
+// the ip is not banned.
+func (server *Server) Unban(ip string) bool {
+	return server.bans.unban(ip)
+}
 
-	if len(configFile) > 0 {
-		data, err := ioutil.ReadFile(configFile)
-		if err != nil {
-			return nil, err
-		}
-		if err := yaml.Unmarshal(data, cfg); err != nil {
-			return nil, err
+// removeSession untrack a session, the last one wakes up Shutdown
+func (server *Server) removeSession(fc *FtpConn) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	delete(server.sessions, fc)
+	if server.closing && len(server.sessions) == 0 {
+		select {
+		case <-server.done:
+		default:
+			close(server.done)
 		}
 	}
-
-	return cfg, nil
 }
 
 // FtpdServe start the ftp server
 func FtpdServe(config *FtpdConfig) error {
-	var tlsConfig *tls.Config
-	if config.AuthTLS.Enable {
-		cert, err := tls.LoadX509KeyPair(config.AuthTLS.CertFile, config.AuthTLS.KeyFile)
-		if err != nil {
-			return err
-		}
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
-	} else {
-		tlsConfig = nil
-	}
-
-	switch config.Driver {
-	case "file":
-		factory = NewFileDriverFactory(config.FileDriver.BaseDir)
-	case "minio":
-		factory = NewMinioDriverFactory(config.MinioDriver.Endpoint, config.MinioDriver.AccessKeyID, config.MinioDriver.SecretAccessKey, config.MinioDriver.Bucket, config.MinioDriver.UseSSL)
-	case "custom":
-	default:
-		return fmt.Errorf("not supported driver: %s", config.Driver)
-	}
-
-	listener, err := net.Listen("tcp", config.Bind)
-	if err != nil {
-		return err
-	}
-
-	cid := 0
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
-		}
-		go NewFtpConn(cid, conn, config, tlsConfig, factory).Serve()
-		cid = cid + 1
-	}
+	return NewServer(config).Serve()
 }
@@ -0,0 +1,4946 @@
+package kftpd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSession - a session served on the server end of a connection, the
+// commands are written to the client end and the replies read from it.
+type testSession struct {
+	t      *testing.T
+	fc     *FtpConn
+	client net.Conn
+	reader *textproto.Reader
+}
+
+// testDriverFactory - factory handing out the same driver to every login
+type testDriverFactory struct {
+	driver Driver
+}
+
+func (f *testDriverFactory) NewDriver(user string) (Driver, error) {
+	return f.driver, nil
+}
+
+// newTestSession return a session of config logged in as user with
+// driver, or not logged in if driver is nil.
+func newTestSession(t *testing.T, config *FtpdConfig, user string, driver Driver) *testSession {
+	server, client := tcpPair(t, "127.0.0.1:0")
+	return newTestSessionOn(t, server, client, config, user, driver)
+}
+
+// newTestSessionOn return a session like newTestSession on the server end
+// of a connection, replies are read from its client end.
+func newTestSessionOn(t *testing.T, server, client net.Conn, config *FtpdConfig, user string, driver Driver) *testSession {
+	fc := NewFtpConn(1, server, config, nil, &testDriverFactory{driver})
+	if driver != nil {
+		fc.Login(user, driver)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go fc.Serve()
+	s := &testSession{t, fc, client, textproto.NewReader(bufio.NewReader(client))}
+	if _, err := s.read(); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return s
+}
+
+// tcpPair return both ends of a tcp connection to a listener at addr
+func tcpPair(t *testing.T, addr string) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// read return the next reply as "code message"
+func (s *testSession) read() (string, error) {
+	s.client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	code, msg, err := s.reader.ReadResponse(0)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// exec run a command line, return its replies up to the first one that
+// is not preliminary, or up to the end if the session closes.
+func (s *testSession) exec(line string) []string {
+	s.t.Helper()
+	if _, err := fmt.Fprintf(s.client, "%s\r\n", line); err != nil {
+		s.t.Fatalf("%s: %v", line, err)
+	}
+	var replies []string
+	for {
+		reply, err := s.read()
+		if err == io.EOF {
+			return replies
+		}
+		if err != nil {
+			s.t.Fatalf("%s: %v", line, err)
+		}
+		replies = append(replies, reply)
+		if reply[0] != '1' {
+			return replies
+		}
+	}
+}
+
+// expect run a command line and check its last reply starts with code
+func (s *testSession) expect(line, code string) []string {
+	s.t.Helper()
+	replies := s.exec(line)
+	if len(replies) == 0 || !strings.HasPrefix(replies[len(replies)-1], code+" ") {
+		s.t.Fatalf("%s: replies %q, want %s", line, replies, code)
+	}
+	return replies
+}
+
+// passive open a passive data connection with PASV
+func (s *testSession) passive() net.Conn {
+	s.t.Helper()
+	reply := s.expect("PASV", "227")[0]
+	var h1, h2, h3, h4, p1, p2 int
+	fmt.Sscanf(reply[strings.Index(reply, "(")+1:], "%d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2)
+	conn, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1*256+p2))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return conn
+}
+
+// waitDataConn wait until the session accepts the passive data connection
+func (s *testSession) waitDataConn() {
+	for open := false; !open; time.Sleep(time.Millisecond) {
+		s.fc.lock.Lock()
+		open = s.fc.dataConn != nil
+		s.fc.lock.Unlock()
+	}
+}
+
+// retrieve run a command transferring data to the client on a passive
+// connection, return its replies and the data.
+func (s *testSession) retrieve(line string) ([]string, string) {
+	s.t.Helper()
+	conn := s.passive()
+	data := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		data <- b
+	}()
+	replies := s.exec(line)
+	select {
+	case b := <-data:
+		return replies, string(b)
+	case <-time.After(5 * time.Second):
+		conn.Close()
+		return replies, string(<-data)
+	}
+}
+
+// store run a command transferring data from the client on a passive
+// connection, return its replies.
+func (s *testSession) store(line, data string) []string {
+	s.t.Helper()
+	conn := s.passive()
+	go func() {
+		conn.Write([]byte(data))
+		conn.Close()
+	}()
+	return s.exec(line)
+}
+
+// newTestFileDriver return a file driver of user rooted at a temporary dir
+func newTestFileDriver(t *testing.T, user string) (Driver, string) {
+	return newTestFileDriverOpts(t, user, FileDriverOptions{})
+}
+
+// newTestFileDriverOpts return a file driver of opts like newTestFileDriver
+func newTestFileDriverOpts(t *testing.T, user string, opts FileDriverOptions) (Driver, string) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	driver, err := NewFileDriverFactoryWithOptions(dir, opts).NewDriver(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver, dir
+}
+
+func TestTrailingSlash(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("MKD d/", "257")
+	s.expect("MKD /d/e/", "257")
+	s.expect("CWD d/", "250")
+	if reply := s.exec("PWD")[0]; reply != `257 "/d"` {
+		t.Errorf("PWD after CWD d/ = %s", reply)
+	}
+	s.expect("CWD e//", "250")
+	if reply := s.exec("PWD")[0]; reply != `257 "/d/e"` {
+		t.Errorf("PWD after CWD e// = %s", reply)
+	}
+	s.expect("CWD /d", "250")
+	s.expect("CWD /d/", "250")
+	s.expect("RMD e/", "250")
+	s.expect("CWD e", "550")
+
+	for path, want := range map[string]string{
+		"a/":    "/d/a",
+		"a//b/": "/d/a/b",
+		"/":     "/",
+		"/a/":   "/a",
+		"../":   "/",
+		"./":    "/d",
+	} {
+		if got := s.fc.buildPath(path); got != want {
+			t.Errorf("buildPath(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+// virtualDriver - driver adding a virtual file "status" of data to the root
+type virtualDriver struct {
+	Driver
+	info FileInfo
+	data string
+}
+
+func (d *virtualDriver) Stat(path string) (FileInfo, error) {
+	if path == "/status" {
+		return d.info, nil
+	}
+	return d.Driver.Stat(path)
+}
+
+func (d *virtualDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	if path == "/status" {
+		return int64(len(d.data)) - offset, ioutil.NopCloser(strings.NewReader(d.data[offset:])), nil
+	}
+	return d.Driver.GetFile(path, offset)
+}
+
+func (d *virtualDriver) ListDir(path string, callback func(FileInfo) error) error {
+	if err := d.Driver.ListDir(path, callback); err != nil {
+		return err
+	}
+	if path == "/" {
+		return callback(d.info)
+	}
+	return nil
+}
+
+func TestVirtualFileInfo(t *testing.T) {
+	size := int64(0)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := NewVirtualFileInfo("status", false, func() int64 {
+		size += 100
+		return size
+	}, func() time.Time { return mtime })
+	inner, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", &virtualDriver{inner, info, "ok\n"})
+
+	_, list := s.retrieve("LIST")
+	if !strings.Contains(list, " 100 ") || !strings.HasSuffix(strings.TrimSpace(list), " status") {
+		t.Errorf("LIST = %q", list)
+	}
+	if reply := s.exec("SIZE status"); reply[0] != "213 200" {
+		t.Errorf("SIZE = %q, want the size of a new call", reply)
+	}
+	if reply := s.exec("MDTM status"); reply[0] != "213 20200102030405" {
+		t.Errorf("MDTM = %q", reply)
+	}
+	mlst := strings.Join(s.expect("MLST status", "250"), "\n")
+	if !strings.Contains(mlst, "Size=300;") || !strings.Contains(mlst, "Type=file;") {
+		t.Errorf("MLST = %q", mlst)
+	}
+	_, mlsd := s.retrieve("MLSD")
+	if !strings.Contains(mlsd, "Size=400;") || !strings.Contains(mlsd, "Modify=20200102030405;") || !strings.HasSuffix(mlsd, " status\r\n") {
+		t.Errorf("MLSD = %q", mlsd)
+	}
+	if replies, data := s.retrieve("RETR status"); data != "ok\n" || !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("RETR = %q, %q", replies, data)
+	}
+	s.expect("REST 1", "350")
+	if _, data := s.retrieve("RETR status"); data != "k\n" {
+		t.Errorf("RETR from 1 = %q", data)
+	}
+
+	dir := NewVirtualFileInfo("dir", true, nil, nil)
+	if !dir.IsDir() || dir.Size() != 0 || !dir.ModTime().IsZero() || dir.Mode()&os.ModeDir == 0 {
+		t.Errorf("virtual dir = %v %d %v %v", dir.IsDir(), dir.Size(), dir.ModTime(), dir.Mode())
+	}
+}
+
+func TestStealth(t *testing.T) {
+	for _, stealth := range []bool{false, true} {
+		config := NewFtpdConfig()
+		config.Stealth = stealth
+		driver, _ := newTestFileDriver(t, "alice")
+		s := newTestSession(t, config, "alice", driver)
+
+		replies := strings.Join([]string{
+			s.expect("FEAT", "211")[0],
+			s.expect("HELP", "214")[0],
+			s.expect("STAT", "211")[0],
+			s.expect("CLNT lftp", "200")[0],
+			strings.Join(s.exec("SITE VERSION"), ""),
+			strings.Join(s.exec("SITE"), ""),
+		}, "\n")
+		if leaked := strings.Contains(replies, "KFtpd") || strings.Contains(replies, "zhoukk"); leaked != !stealth {
+			t.Errorf("stealth %v replies:\n%s", stealth, replies)
+		}
+		for _, feat := range []string{"MLST", "HASH", "CLNT", "TVFS"} {
+			if strings.Contains(replies, " "+feat) == stealth {
+				t.Errorf("stealth %v: FEAT or HELP has %s = %v", stealth, feat, !stealth)
+			}
+		}
+	}
+}
+
+func TestRenameState(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("MKD d", "257")
+	s.store("STOR a", "a")
+
+	// any command between RNFR and RNTO drops the pending rename
+	s.expect("RNFR a", "350")
+	s.expect("CWD d", "250")
+	s.expect("RNTO b", "503")
+	s.expect("CWD /", "250")
+
+	// so does a failed RNFR and a failed RNTO
+	s.expect("RNFR missing", "550")
+	s.expect("RNTO b", "503")
+	s.expect("RNFR a", "350")
+	s.expect("RNTO /missing/b", "550")
+	s.expect("RNTO b", "503")
+
+	s.expect("RNFR a", "350")
+	s.expect("RNTO d/b", "250")
+	s.expect("RNTO c", "503")
+	if _, err := os.Stat(filepath.Join(dir, "alice", "d", "b")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPasvAddress(t *testing.T) {
+	for _, c := range []struct {
+		local    string
+		ip       string
+		networks []PasvNetwork
+		want     string
+	}{
+		{"127.0.0.1:0", "", nil, "127,0,0,1,"},
+		{"127.0.0.2:0", "", nil, "127,0,0,2,"},
+		{"127.0.0.1:0", "10.1.2.3", nil, "10,1,2,3,"},
+		{"127.0.0.1:0", "10.1.2.3", []PasvNetwork{{Network: "127.0.0.0/8", Address: "192.168.1.10"}}, "192,168,1,10,"},
+		{"127.0.0.1:0", "10.1.2.3", []PasvNetwork{{Network: "192.168.0.0/16", Address: "192.168.1.10"}}, "10,1,2,3,"},
+	} {
+		config := NewFtpdConfig()
+		config.Pasv.IP = c.ip
+		config.Pasv.Networks = c.networks
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", c.local)
+		if err != nil {
+			// 127.0.0.2 is not a loopback address on every system.
+			t.Logf("skip %s: %v", c.local, err)
+			continue
+		}
+		l.Close()
+		driver, _ := newTestFileDriver(t, "alice")
+		server, client := tcpPair(t, c.local)
+		s := newTestSessionOn(t, server, client, config, "alice", driver)
+		reply := s.expect("PASV", "227")[0]
+		if !strings.Contains(reply, "("+c.want) {
+			t.Errorf("PASV on %s with IP %q and networks %v = %s, want %s", c.local, c.ip, c.networks, reply, c.want)
+		}
+		s.exec("ABOR")
+	}
+}
+
+func TestUploadNamePattern(t *testing.T) {
+	config := NewFtpdConfig()
+	config.UploadNamePattern = `^[a-z]+\.txt$`
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver, dir := newTestFileDriver(t, "alice")
+	s := newTestSession(t, config, "alice", driver)
+	s.expect("MKD d.exe", "257")
+
+	for line, code := range map[string]string{
+		"STOR a.txt":       "226",
+		"STOR d.exe/b.txt": "226",
+		"APPE a.txt":       "226",
+		"STOR a.exe":       "553",
+		"APPE A.TXT":       "553",
+		"STOR d.exe/b.exe": "553",
+	} {
+		replies := s.store(line, "data")
+		if last := replies[len(replies)-1]; !strings.HasPrefix(last, code+" ") {
+			t.Errorf("%s: %q, want %s", line, replies, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "a.exe")); !os.IsNotExist(err) {
+		t.Errorf("refused upload is stored: %v", err)
+	}
+
+	// a file can not be renamed to a refused name, a directory can.
+	s.expect("RNFR a.txt", "350")
+	s.expect("RNTO a.exe", "553")
+	s.expect("RNFR a.txt", "350")
+	s.expect("RNTO d.exe/c.txt", "250")
+	s.expect("RNFR d.exe", "350")
+	s.expect("RNTO e.exe", "250")
+	if _, err := os.Stat(filepath.Join(dir, "alice", "e.exe", "c.txt")); err != nil {
+		t.Errorf("renamed file: %v", err)
+	}
+
+	// the pattern of a user replaces the global one.
+	config.Users = map[string]FtpdUser{"bob": {UploadNamePattern: `\.csv$`}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver, _ = newTestFileDriver(t, "bob")
+	s = newTestSession(t, config, "bob", driver)
+	for line, code := range map[string]string{
+		"STOR a.csv": "226",
+		"STOR a.txt": "553",
+	} {
+		replies := s.store(line, "data")
+		if last := replies[len(replies)-1]; !strings.HasPrefix(last, code+" ") {
+			t.Errorf("bob %s: %q, want %s", line, replies, code)
+		}
+	}
+	s.expect("RNFR a.csv", "350")
+	s.expect("RNTO b.txt", "553")
+
+	config.Users = map[string]FtpdUser{"bob": {UploadNamePattern: `[a-z`}}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate accepted a bad UploadNamePattern of user")
+	}
+	config.Users = nil
+	config.UploadNamePattern = `[a-z`
+	if err := config.Validate(); err == nil {
+		t.Error("Validate accepted a bad UploadNamePattern")
+	}
+}
+
+func TestNonTCPControl(t *testing.T) {
+	config := NewFtpdConfig()
+	driver, _ := newTestFileDriver(t, "alice")
+	server, client := net.Pipe()
+	s := newTestSessionOn(t, server, client, config, "alice", driver)
+
+	// no local ipv4 to advertise
+	s.expect("PASV", "425")
+	if stat := s.expect("STAT", "211")[0]; !strings.Contains(stat, "Connected to pipe") {
+		t.Errorf("STAT = %q", stat)
+	}
+
+	// a configured address is advertised, the port listens on all addresses
+	config.Pasv.IP = "127.0.0.1"
+	replies, list := s.retrieve("LIST")
+	if !strings.HasPrefix(replies[len(replies)-1], "226 ") || len(list) != 0 {
+		t.Errorf("LIST = %q, %q", replies, list)
+	}
+	if replies := s.store("STOR a", "data"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("STOR = %q", replies)
+	}
+}
+
+func TestTransferCompleteVeto(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	var calls []string
+	s.fc.handler = &FtpdHandler{TransferComplete: func(user, path string, size int64) error {
+		calls = append(calls, fmt.Sprintf("%s %s %d", user, path, size))
+		if strings.HasPrefix(filepath.Base(path), "bad") {
+			return errors.New("rejected")
+		}
+		return nil
+	}}
+	s.expect("TYPE I", "200")
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", name))
+		return string(data)
+	}
+
+	if replies := s.store("STOR good", "data"); replies[len(replies)-1] != "226 Transfer complete." {
+		t.Errorf("STOR good = %q", replies)
+	}
+	if replies := s.store("STOR bad", "data"); replies[len(replies)-1] != "550 Transfer rejected." {
+		t.Errorf("STOR bad = %q", replies)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "bad")); !os.IsNotExist(err) {
+		t.Errorf("rejected upload is kept: %v", err)
+	}
+
+	// a rejected resumed upload keeps the file uploaded before
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "bad-resumed"), []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("REST 4", "350")
+	if replies := s.store("STOR bad-resumed", "efgh"); replies[len(replies)-1] != "550 Transfer rejected." {
+		t.Errorf("STOR resumed = %q", replies)
+	}
+	if data := read("bad-resumed"); !strings.HasPrefix(data, "abcd") {
+		t.Errorf("rejected resumed upload left %q", data)
+	}
+
+	if replies, data := s.retrieve("RETR good"); replies[len(replies)-1] != "226 Transfer complete." || data != "data" {
+		t.Errorf("RETR good = %q, %q", replies, data)
+	}
+	if replies, _ := s.retrieve("RETR bad-resumed"); replies[len(replies)-1] != "451 Transfer rejected." {
+		t.Errorf("RETR bad = %q", replies)
+	}
+
+	want := []string{"alice /good 4", "alice /bad 4", "alice /bad-resumed 4", "alice /good 4", "alice /bad-resumed 8"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestMaxFilesPerDir(t *testing.T) {
+	driver, _ := newTestFileDriverOpts(t, "alice", FileDriverOptions{MaxFilesPerDir: 2})
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+	s.expect("MKD d", "257")
+	for line, code := range map[string]string{
+		"STOR a":   "226",
+		"STOR d/x": "226",
+		"STOR d/y": "226",
+	} {
+		if replies := s.store(line, "data"); !strings.HasPrefix(replies[len(replies)-1], code+" ") {
+			t.Fatalf("%s = %q", line, replies)
+		}
+	}
+	// the root holds d and a, d holds x and y
+	if replies := s.store("STOR b", "data"); replies[len(replies)-1] != "552 Too many files in directory." {
+		t.Errorf("STOR over limit = %q", replies)
+	}
+	if replies := s.store("STOR a", "data"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("STOR replacing a file = %q", replies)
+	}
+	s.expect("MKD e", "552")
+	s.expect("RNFR a", "350")
+	s.expect("RNTO d/a", "552")
+	s.expect("RNFR a", "350")
+	s.expect("RNTO c", "250")
+	s.expect("RNFR c", "350")
+	s.expect("RNTO d/x", "250")
+}
+
+// failDriver - driver whose PutFile stores the first 2 bytes then fails
+// like a broken data connection
+type failDriver struct {
+	Driver
+}
+
+func (d *failDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	n, err := d.Driver.PutFile(path, offset, io.LimitReader(reader, 2))
+	if err != nil {
+		return n, err
+	}
+	io.Copy(ioutil.Discard, reader)
+	return n, errors.New("connection reset by peer")
+}
+
+func TestDeletePartialUploads(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		config := NewFtpdConfig()
+		config.DeletePartialUploads = remove
+		inner, dir := newTestFileDriver(t, "alice")
+		s := newTestSession(t, config, "alice", &failDriver{inner})
+		s.expect("TYPE I", "200")
+
+		if replies := s.store("STOR a", "data"); replies[len(replies)-1] != "426 Failure reading network stream." {
+			t.Errorf("STOR = %q", replies)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "alice", "a")); os.IsNotExist(err) != remove {
+			t.Errorf("DeletePartialUploads %v: stat partial upload = %v", remove, err)
+		}
+
+		// a resumed upload is always kept
+		if err := ioutil.WriteFile(filepath.Join(dir, "alice", "b"), []byte("abcd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s.expect("REST 4", "350")
+		s.store("STOR b", "efgh")
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "b")); string(data) != "abcdef" {
+			t.Errorf("DeletePartialUploads %v: resumed upload = %q", remove, data)
+		}
+	}
+}
+
+// fakeS3 - s3 API of buckets and objects in memory, enough for the minio
+// client of the minio driver, requests are not authenticated.
+type fakeS3 struct {
+	lock    sync.Mutex
+	buckets map[string]bool
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// puts - "single" or "multipart" and the key of every object put
+	puts []string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets: map[string]bool{},
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+// s3Time - time of every object, s3 times have milliseconds only
+var s3Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// body return the data of a request body, decoding the chunks of a
+// streaming signed upload.
+func (f *fakeS3) body(r *http.Request) []byte {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		data, _ := ioutil.ReadAll(r.Body)
+		return data
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		// chunk header: hex size;chunk-signature=...
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return data
+		}
+		var size int
+		fmt.Sscanf(header, "%x;", &size)
+		if size == 0 {
+			return data
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return data
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+	if key == "" {
+		f.serveBucket(w, r, bucket, query)
+		return
+	}
+	if !f.buckets[bucket] {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	name := bucket + "/" + key
+	_, initiate := query["uploads"]
+	_, uploading := query["uploadId"]
+	switch {
+	case r.Method == "POST" && initiate:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		f.xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+	case r.Method == "PUT" && uploading:
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][n] = f.body(r)
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+	case r.Method == "POST" && uploading:
+		upload := f.uploads[query.Get("uploadId")]
+		var data []byte
+		for n := 1; n <= len(upload); n++ {
+			data = append(data, upload[n]...)
+		}
+		f.objects[name] = data
+		f.puts = append(f.puts, "multipart "+name)
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"etag"`})
+	case r.Method == "DELETE" && uploading:
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && len(r.Header.Get("X-Amz-Copy-Source")) > 0:
+		source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+		data, ok := f.objects[source]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[name] = data
+		f.xml(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified time.Time
+			ETag         string
+		}{LastModified: s3Time, ETag: `"etag"`})
+	case r.Method == "PUT":
+		f.objects[name] = f.body(r)
+		f.puts = append(f.puts, "single "+name)
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[name]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, key, s3Time, bytes.NewReader(data))
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	if _, ok := query["location"]; ok {
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Value   string   `xml:",chardata"`
+		}{Value: "us-east-1"})
+		return
+	}
+	if r.Method == "PUT" {
+		if f.buckets[bucket] {
+			f.error(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			return
+		}
+		f.buckets[bucket] = true
+		return
+	}
+	if !f.buckets[bucket] {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+	case "POST":
+		var del struct {
+			Object []struct{ Key string }
+		}
+		xml.NewDecoder(r.Body).Decode(&del)
+		for _, object := range del.Object {
+			delete(f.objects, bucket+"/"+object.Key)
+		}
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case "GET":
+		type content struct {
+			Key          string
+			LastModified time.Time
+			ETag         string
+			Size         int64
+		}
+		type prefix struct {
+			Prefix string
+		}
+		result := struct {
+			XMLName        xml.Name `xml:"ListBucketResult"`
+			Name           string
+			Prefix         string
+			Delimiter      string
+			IsTruncated    bool
+			Contents       []content
+			CommonPrefixes []prefix
+		}{Name: bucket, Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter")}
+		var names []string
+		for name := range f.objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		seen := map[string]bool{}
+		for _, name := range names {
+			key := strings.TrimPrefix(name, bucket+"/")
+			if !strings.HasPrefix(name, bucket+"/") || !strings.HasPrefix(key, result.Prefix) {
+				continue
+			}
+			if i := strings.Index(key[len(result.Prefix):], "/"); i >= 0 && len(result.Delimiter) > 0 {
+				if p := key[:len(result.Prefix)+i+1]; !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, prefix{p})
+				}
+				continue
+			}
+			result.Contents = append(result.Contents, content{key, s3Time, `"etag"`, int64(len(f.objects[name]))})
+		}
+		f.xml(w, result)
+	}
+}
+
+// newTestMinioFactory return a minio driver factory of opts on a fake s3
+func newTestMinioFactory(t *testing.T, opts MinioDriverOptions) (*fakeS3, DriverFactory) {
+	f := newFakeS3()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	opts.Endpoint = srv.Listener.Addr().String()
+	opts.AccessKeyID = "minio"
+	opts.SecretAccessKey = "minio123"
+	if len(opts.Bucket) == 0 {
+		opts.Bucket = "kftpd-data"
+	}
+	return f, NewMinioDriverFactoryWithOptions(opts)
+}
+
+func TestMinioGetURL(t *testing.T) {
+	f, factory := newTestMinioFactory(t, MinioDriverOptions{PresignExpire: 60})
+	driver, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	if replies := s.store("STOR a", "data"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Fatalf("STOR = %q", replies)
+	}
+	if _, ok := f.objects["kftpd-data/alice/a"]; !ok {
+		t.Fatalf("objects = %q", f.objects)
+	}
+
+	reply := s.expect("SITE GETURL a", "200")[0]
+	u, err := url.Parse(strings.TrimPrefix(reply, "200 "))
+	if err != nil || u.Path != "/kftpd-data/alice/a" || u.Query().Get("X-Amz-Expires") != "60" || len(u.Query().Get("X-Amz-Signature")) == 0 {
+		t.Errorf("SITE GETURL = %s", reply)
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "data" {
+		t.Errorf("GET presigned url = %q", data)
+	}
+	s.expect("SITE GETURL missing", "550")
+	if help := s.expect("SITE HELP", "214")[0]; !strings.Contains(help, "GETURL") {
+		t.Errorf("SITE HELP = %q", help)
+	}
+
+	_, factory = newTestMinioFactory(t, MinioDriverOptions{})
+	driver, err = factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("SITE GETURL a", "502")
+}
+
+func TestS3Driver(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	stsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		lock.Lock()
+		calls = append(calls, fmt.Sprintf("%s %s %s %s", r.Form.Get("RoleArn"), r.Header.Get("X-Amz-Security-Token"), r.Form.Get("ExternalId"), strings.Fields(r.Header.Get("Authorization"))[1]))
+		n := len(calls)
+		lock.Unlock()
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>
+<AccessKeyId>AK%d</AccessKeyId><SecretAccessKey>SK%d</SecretAccessKey><SessionToken>TOKEN%d</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, n, n, n, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer stsSrv.Close()
+
+	f := newFakeS3()
+	f.buckets["kftpd-data"] = true
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r)
+		lock.Unlock()
+		f.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	factory, err := NewS3DriverFactory(S3DriverOptions{
+		Endpoint:        srv.Listener.Addr().String(),
+		Region:          "us-east-1",
+		Bucket:          "kftpd-data",
+		AccessKeyID:     "BASE",
+		SecretAccessKey: "secret",
+		RoleARNs:        []string{"arn:aws:iam::1:role/a", "arn:aws:iam::2:role/b"},
+		ExternalID:      "ext",
+		STSEndpoint:     stsSrv.URL,
+		PathStyle:       true,
+		SSE:             "aws:kms",
+		SSEKMSKeyID:     "key1",
+		PresignExpire:   60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := factory.NewDriver("bob"); err != nil {
+		t.Fatal(err)
+	}
+	driver, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.store("STOR a", "data")
+	s.expect("MKD d", "257")
+	s.expect("RNFR a", "350")
+	s.expect("RNTO d/b", "250")
+	s.expect("REST 4", "350")
+	s.store("STOR d/b", "more")
+	if _, data := s.retrieve("RETR d/b"); data != "datamore" {
+		t.Errorf("RETR d/b = %q", data)
+	}
+	s.expect("REST 4", "350")
+	if _, data := s.retrieve("RETR d/b"); data != "more" {
+		t.Errorf("RETR d/b from 4 = %q", data)
+	}
+	if _, list := s.retrieve("NLST d"); list != "b\r\n" {
+		t.Errorf("NLST d = %q", list)
+	}
+	reply := s.expect("SITE GETURL d/b", "200")[0]
+	if u, err := url.Parse(strings.TrimPrefix(reply, "200 ")); err != nil || u.Path != "/kftpd-data/alice/d/b" || u.Query().Get("X-Amz-Expires") != "60" {
+		t.Errorf("SITE GETURL = %s", reply)
+	}
+	s.expect("DELE d/b", "250")
+	s.expect("RMD d", "250")
+	if len(f.objects) != 0 {
+		t.Errorf("objects = %q", f.objects)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{
+		"arn:aws:iam::1:role/a   Credential=BASE/",
+		"arn:aws:iam::2:role/b TOKEN1 ext Credential=AK1/",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("sts calls = %q", calls)
+	}
+	for i := range want {
+		if !strings.HasPrefix(calls[i], want[i]) {
+			t.Errorf("sts call %d = %q, want prefix %q", i, calls[i], want[i])
+		}
+	}
+	buckets := 0
+	for _, r := range requests {
+		line := r.Method + " " + r.URL.String()
+		if r.Host != srv.Listener.Addr().String() || !strings.HasPrefix(r.URL.Path, "/kftpd-data") {
+			t.Errorf("%s to %s, want the bucket in path", line, r.Host)
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AK2/") || r.Header.Get("X-Amz-Security-Token") != "TOKEN2" {
+			t.Errorf("%s signed by %q, want the last role", line, r.Header.Get("Authorization"))
+		}
+		if r.Method == "HEAD" && r.URL.Path == "/kftpd-data" {
+			buckets++
+		}
+		if r.Method == "PUT" && (r.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" || r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "key1") {
+			t.Errorf("%s without SSE-KMS headers: %v", line, r.Header)
+		}
+	}
+	if buckets != 1 {
+		t.Errorf("bucket checked %d times, want once by the factory", buckets)
+	}
+}
+
+func TestReplyCodes(t *testing.T) {
+	config := NewFtpdConfig()
+	config.ReplyCodes = map[string]int{"CWD_250": 200, "RMD_550": 521}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, config, "alice", driver)
+	s.expect("MKD d", "257")
+	s.expect("RMD missing", "521")
+	s.expect("CWD d", "200")
+	s.expect("CDUP", "250")
+	s.expect("CWD missing", "550")
+
+	config.ReplyCodes = map[string]int{"CWD_250": 700}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate accepted reply code 700")
+	}
+}
+
+// newTestLoginSession return a session of config not logged in, logins
+// get drivers of a file driver factory rooted at the returned dir.
+func newTestLoginSession(t *testing.T, config *FtpdConfig) (*testSession, string) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s := newTestSession(t, config, "", nil)
+	s.fc.factory = NewFileDriverFactory(dir)
+	return s, dir
+}
+
+func TestUserAgain(t *testing.T) {
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}, "bob": {Password: "secret2"}}
+	s, dir := newTestLoginSession(t, config)
+
+	s.expect("USER alice", "331")
+	s.expect("PASS secret", "230")
+	s.expect("MKD d", "257")
+	s.expect("CWD d", "250")
+	s.expect("REST 2", "350")
+	conn := s.passive()
+	defer conn.Close()
+	s.waitDataConn()
+
+	// a new USER drops the login, the directory, REST and the data connection
+	s.expect("USER bob", "331")
+	s.expect("PWD", "530")
+	s.expect("PASS secret2", "230")
+	if reply := s.exec("PWD")[0]; reply != `257 "/"` {
+		t.Errorf("PWD after USER again = %s", reply)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("data connection of previous login: %v, want closed", err)
+	}
+	if replies := s.store("STOR x", "data"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("STOR = %q", replies)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "bob", "x")); string(data) != "data" {
+		t.Errorf("STOR after USER again stored %q, want it at offset 0 of bob", data)
+	}
+
+	s.expect("USER alice", "331")
+	s.expect("PASS wrong", "530")
+	s.expect("MKD e", "530")
+}
+
+func TestListBatchSize(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	for i := 0; i < 50; i++ {
+		if err := driver.MakeDir(fmt.Sprintf("/d%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want string
+	for _, batch := range []int{0, 1, 7, 50, 1000} {
+		config := NewFtpdConfig()
+		config.ListBatchSize = batch
+		s := newTestSession(t, config, "alice", driver)
+		replies, data := s.retrieve("NLST")
+		if !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+			t.Fatalf("batch %d: NLST = %q", batch, replies)
+		}
+		if batch == 0 {
+			want = data
+			if n := strings.Count(data, "\r\n"); n != 50 {
+				t.Fatalf("NLST listed %d lines, want 50", n)
+			}
+		} else if data != want {
+			t.Errorf("batch %d: NLST = %q, want %q", batch, data, want)
+		}
+	}
+}
+
+// benchmarkListWriter write listing lines flushed every batch lines to a
+// tcp data connection.
+func benchmarkListWriter(b *testing.B, batch int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	config := NewFtpdConfig()
+	config.Debug = false
+	config.ListBatchSize = batch
+	server, client := net.Pipe()
+	defer client.Close()
+	fc := NewFtpConn(1, server, config, nil, nil)
+	fc.dataConn = conn
+	lines := make([]string, 1000)
+	for j := range lines {
+		lines[j] = "-rw-r--r-- 1 ftp ftp         1024 Jan 02 03:04 file.txt"
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fc.WriteListTransfer(lines)
+	}
+}
+
+func BenchmarkListPerLine(b *testing.B) { benchmarkListWriter(b, 1) }
+
+func BenchmarkListBatched(b *testing.B) { benchmarkListWriter(b, 100) }
+
+func TestNlstClassify(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	if err := driver.MakeDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.PutFile("/file", 0, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	nlst := func(classify bool, line string) []string {
+		config := NewFtpdConfig()
+		config.NlstClassify = classify
+		s := newTestSession(t, config, "alice", driver)
+		_, data := s.retrieve(line)
+		names := strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n")
+		sort.Strings(names)
+		return names
+	}
+	for _, c := range []struct {
+		classify bool
+		line     string
+		want     []string
+	}{
+		{false, "NLST", []string{"dir", "file"}},
+		{false, "NLST -F", []string{"dir/", "file"}},
+		{true, "NLST", []string{"dir/", "file"}},
+	} {
+		if names := nlst(c.classify, c.line); !reflect.DeepEqual(names, c.want) {
+			t.Errorf("NlstClassify %v, %s = %q, want %q", c.classify, c.line, names, c.want)
+		}
+	}
+}
+
+// startTestServer serve config on a local port, return the server and
+// its address.
+func startTestServer(t *testing.T, config *FtpdConfig) (*Server, string) {
+	config.Bind = "127.0.0.1:0"
+	server := NewServer(config)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve() }()
+	t.Cleanup(func() {
+		server.Close()
+		<-errc
+	})
+	for {
+		server.lock.Lock()
+		listener := server.listener
+		server.lock.Unlock()
+		if listener != nil {
+			return server, listener.Addr().String()
+		}
+		select {
+		case err := <-errc:
+			t.Fatal(err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// dialLogin return a control connection to addr logged in as user
+func dialLogin(t *testing.T, addr, user, password string) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, c := range []struct {
+		line string
+		code int
+	}{{"", 220}, {"USER " + user, 331}, {"PASS " + password, 230}} {
+		if len(c.line) > 0 {
+			conn.PrintfLine("%s", c.line)
+		}
+		if _, _, err := conn.ReadResponse(c.code); err != nil {
+			t.Fatalf("%s: %v", c.line, err)
+		}
+	}
+	return conn
+}
+
+func TestShutdownPasvAccept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	config.Pasv.ListenTimeout = 30
+	server, addr := startTestServer(t, config)
+
+	conn := dialLogin(t, addr, "alice", "secret")
+	conn.PrintfLine("EPSV")
+	if _, _, err := conn.ReadResponse(229); err != nil {
+		t.Fatal(err)
+	}
+	// STOR waits the data connection never made.
+	conn.PrintfLine("STOR x")
+	for busy := false; !busy; time.Sleep(time.Millisecond) {
+		server.lock.Lock()
+		for fc := range server.sessions {
+			fc.stateLock.Lock()
+			busy = fc.busy
+			fc.stateLock.Unlock()
+		}
+		server.lock.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Shutdown took %v waiting the passive accept", elapsed)
+	}
+	if code, msg, _ := conn.ReadResponse(0); code < 400 {
+		t.Errorf("STOR on shutdown replied %d %s, want failed", code, msg)
+	}
+}
+
+func TestMinioHomeDir(t *testing.T) {
+	for _, c := range []struct {
+		homeDir bool
+		key     string
+	}{{true, "kftpd-data/alice/a"}, {false, "kftpd-data/a"}} {
+		f, factory := newTestMinioFactory(t, MinioDriverOptions{})
+		config := NewFtpdConfig()
+		config.HomeDir = c.homeDir
+		config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+		s := newTestSession(t, config, "", nil)
+		s.fc.factory = factory
+		s.expect("USER alice", "331")
+		s.expect("PASS secret", "230")
+
+		if replies := s.store("STOR /a", "data"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+			t.Fatalf("HomeDir %v: STOR = %q", c.homeDir, replies)
+		}
+		var keys []string
+		for key := range f.objects {
+			keys = append(keys, key)
+		}
+		if len(keys) != 1 || keys[0] != c.key {
+			t.Errorf("HomeDir %v: objects %q, want %s", c.homeDir, keys, c.key)
+		}
+		if _, data := s.retrieve("NLST /"); data != "a\r\n" {
+			t.Errorf("HomeDir %v: NLST / = %q", c.homeDir, data)
+		}
+		if _, data := s.retrieve("RETR /a"); data != "data" {
+			t.Errorf("HomeDir %v: RETR /a = %q", c.homeDir, data)
+		}
+	}
+}
+
+func TestLoginMessage(t *testing.T) {
+	login := func(config *FtpdConfig) string {
+		config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+		s, _ := newTestLoginSession(t, config)
+		s.expect("USER alice", "331")
+		replies := s.expect("PASS secret", "230")
+		if len(replies) != 1 {
+			t.Fatalf("PASS replies %q, want one", replies)
+		}
+		return replies[0]
+	}
+
+	if reply := login(NewFtpdConfig()); reply != "230 Login successful." {
+		t.Errorf("login reply without message = %q", reply)
+	}
+
+	config := NewFtpdConfig()
+	config.LoginMessage = "Welcome %u\nNo quota."
+	if reply := login(config); reply != "230 Welcome alice\n No quota.\nLogin successful." {
+		t.Errorf("login reply with LoginMessage = %q", reply)
+	}
+
+	// LoginMessageFile replaces LoginMessage and is read every login.
+	file, err := ioutil.TempFile("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	config.LoginMessageFile = file.Name()
+	for _, msg := range []string{"Maintenance at 10pm.\n", "Maintenance done.\n"} {
+		if err := ioutil.WriteFile(file.Name(), []byte(msg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if reply, want := login(config), "230 "+msg+"Login successful."; reply != want {
+			t.Errorf("login reply with LoginMessageFile = %q, want %q", reply, want)
+		}
+	}
+}
+
+// shortConn - data connection accepting no more than left bytes, then
+// writing nothing without an error.
+type shortConn struct {
+	net.Conn
+	left int
+	data bytes.Buffer
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	c.left -= len(p)
+	return c.data.Write(p)
+}
+
+func TestListShortWrite(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if err := driver.MakeDir(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &shortConn{Conn: server, left: 4}
+	s.fc.OpenFileTransfer(conn)
+	s.fc.notify <- 1
+	s.expect("NLST", "426")
+	if conn.data.String() != "a\r\nb" {
+		t.Errorf("NLST wrote %q", conn.data.String())
+	}
+}
+
+func TestBandwidthShare(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	data := strings.Repeat("x", 128<<10)
+	if _, err := driver.PutFile("/f", 0, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	config := NewFtpdConfig()
+	config.Bandwidth.TotalKBps = 256
+	config.Bandwidth.Weights = map[string]int{"alice": 3}
+	server := NewServer(config)
+	server.bandwidth = newBandwidthLimiter(config.Bandwidth.TotalKBps)
+
+	// alice of weight 3 downloads at 192KB/s while bob of weight 1 does,
+	// then bob at 256KB/s alone, so 256KB take one second in total.
+	start := time.Now()
+	elapsed := map[string]time.Duration{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, user := range []string{"alice", "bob"} {
+		s := newTestSession(t, config, user, driver)
+		s.fc.server = server
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if _, got := s.retrieve("RETR f"); got != data {
+				t.Errorf("%s: RETR f got %d bytes", user, len(got))
+			}
+			lock.Lock()
+			elapsed[user] = time.Since(start)
+			lock.Unlock()
+		}(user)
+	}
+	wg.Wait()
+
+	if total := time.Since(start); total < 800*time.Millisecond {
+		t.Errorf("256KB downloaded in %v over a 256KB/s total", total)
+	}
+	if elapsed["alice"] >= elapsed["bob"] {
+		t.Errorf("alice of weight 3 took %v, bob of weight 1 %v", elapsed["alice"], elapsed["bob"])
+	}
+}
+
+func TestListMissing(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	for _, line := range []string{"LIST missing", "NLST missing", "MLSD missing", "LIST /missing/*"} {
+		conn := s.passive()
+		replies := s.expect(line, "550")
+		if len(replies) != 1 {
+			t.Errorf("%s: replies %q, want 550 only", line, replies)
+		}
+		s.fc.lock.Lock()
+		port := s.fc.pasvPort
+		s.fc.lock.Unlock()
+		if port != 0 {
+			t.Errorf("%s: passive port %d not released", line, port)
+		}
+		conn.Close()
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test secret "12345678901234567890", code 287082 at 59s.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	at := time.Unix(59, 0)
+	for _, c := range []struct {
+		now  time.Time
+		skew int
+		ok   bool
+	}{
+		{at, 0, true},
+		{at.Add(totpPeriod * time.Second), 1, true},
+		{at.Add(totpPeriod * time.Second), 0, false},
+		{at.Add(2 * totpPeriod * time.Second), 1, false},
+	} {
+		if ok, err := verifyTOTP(secret, "287082", c.skew, c.now); ok != c.ok || err != nil {
+			t.Errorf("verifyTOTP at %v skew %d = %v, %v, want %v", c.now.Unix(), c.skew, ok, err, c.ok)
+		}
+	}
+	if _, err := verifyTOTP("not base32!", "287082", 1, at); err == nil {
+		t.Error("verifyTOTP of an invalid secret succeeded")
+	}
+
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret", TOTPSecret: secret}}
+	auth := NewConfigAuthenticator(config)
+	key, _ := base32.StdEncoding.DecodeString(secret)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	expired := totpCode(key, time.Now().Unix()/totpPeriod-3)
+	for _, c := range []struct {
+		pass string
+		ok   bool
+	}{
+		{"secret" + code, true},
+		{"secret" + expired, false},
+		{"wrong" + code, false},
+		{"secret", false},
+		{code, false},
+	} {
+		if ok, err := auth.Authenticate("alice", c.pass); ok != c.ok || err != nil {
+			t.Errorf("Authenticate %q = %v, %v, want %v", c.pass, ok, err, c.ok)
+		}
+	}
+}
+
+func TestSessionGoroutines(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	config := NewFtpdConfig()
+	if config.MaxSessionGoroutines != 0 {
+		t.Errorf("default MaxSessionGoroutines = %d, want 0", config.MaxSessionGoroutines)
+	}
+	s := newTestSession(t, config, "alice", driver)
+
+	// a PASV replacing the previous one stops its accept goroutine.
+	for i := 0; i < 50; i++ {
+		s.expect("PASV", "227")
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.fc.Goroutines() > 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutines = %d after 50 PASV, want 1", s.fc.Goroutines())
+		}
+	}
+
+	// goroutines over the cap refuse the data setup.
+	config.MaxSessionGoroutines = 2
+	block := make(chan struct{})
+	defer close(block)
+	for s.fc.Goroutines() > 0 {
+		s.fc.resetFileTransfer()
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if !s.fc.spawn(func() { <-block }) {
+			t.Fatalf("spawn %d refused under the cap", i)
+		}
+	}
+	s.expect("PASV", "425")
+	if n := s.fc.Goroutines(); n != 2 {
+		t.Errorf("Goroutines = %d, want 2", n)
+	}
+}
+
+func TestRequireStrongPasswords(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("x"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		strong bool
+		users  map[string]FtpdUser
+		ok     bool
+	}{
+		{false, map[string]FtpdUser{"alice": {}}, true},
+		{true, map[string]FtpdUser{"alice": {}}, false},
+		{true, map[string]FtpdUser{"alice": {Password: "short"}}, false},
+		{true, map[string]FtpdUser{"alice": {Password: "longenough"}}, true},
+		{true, map[string]FtpdUser{"alice": {Password: string(hash)}}, true},
+		// a reused password is warned only.
+		{true, map[string]FtpdUser{"alice": {Password: "longenough"}, "bob": {Password: "longenough"}}, true},
+	} {
+		config := NewFtpdConfig()
+		config.RequireStrongPasswords = c.strong
+		config.Users = c.users
+		if err := config.Validate(); (err == nil) != c.ok {
+			t.Errorf("RequireStrongPasswords %v, users %v: Validate = %v", c.strong, c.users, err)
+		}
+	}
+}
+
+func TestPasvIPv6(t *testing.T) {
+	for _, ip := range []string{"::1", "ftp.example.com"} {
+		config := NewFtpdConfig()
+		config.Pasv.IP = ip
+		if err := config.Validate(); err == nil {
+			t.Errorf("Validate of Pasv.IP %s succeeded", ip)
+		}
+
+		// a config not validated fails PASV cleanly, EPSV still works.
+		driver, _ := newTestFileDriver(t, "alice")
+		server, client := tcpPair(t, "127.0.0.1:0")
+		s := newTestSessionOn(t, server, client, config, "alice", driver)
+		s.expect("PASV", "425")
+		s.expect("EPSV", "229")
+		s.exec("ABOR")
+	}
+}
+
+// removingDriver - driver removing a file once the first entry of a
+// listing is sent, as another session would in the middle of it.
+type removingDriver struct {
+	Driver
+	remove string
+}
+
+func (d *removingDriver) ListDir(path string, callback func(FileInfo) error) error {
+	first := true
+	return d.Driver.ListDir(path, func(fi FileInfo) error {
+		if first {
+			first = false
+			if err := d.Driver.DeleteFile(d.remove); err != nil {
+				return err
+			}
+		}
+		return callback(fi)
+	})
+}
+
+func TestSnapshotList(t *testing.T) {
+	driver, _ := newTestFileDriverOpts(t, "alice", FileDriverOptions{SnapshotList: true})
+	for _, name := range []string{"/a", "/b", "/c"} {
+		if _, err := driver.PutFile(name, 0, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", &removingDriver{driver, "/b"})
+	replies, data := s.retrieve("NLST")
+	if reply := replies[len(replies)-1]; reply != "226 Directory send OK." {
+		t.Errorf("NLST = %q", replies)
+	}
+	if data != "a\r\nc\r\n" {
+		t.Errorf("NLST = %q, want the removed file skipped", data)
+	}
+
+	// a file is listed as itself with or without a snapshot.
+	for _, snapshot := range []bool{false, true} {
+		driver, _ := newTestFileDriverOpts(t, "alice", FileDriverOptions{SnapshotList: snapshot})
+		if _, err := driver.PutFile("/a", 0, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+		if _, data := s.retrieve("NLST a"); data != "a\r\n" {
+			t.Errorf("SnapshotList %v: NLST a = %q", snapshot, data)
+		}
+	}
+}
+
+func TestDriverCapabilities(t *testing.T) {
+	_, factory := newTestMinioFactory(t, MinioDriverOptions{})
+	minio, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, dir := newTestFileDriver(t, "alice")
+	if _, err := file.PutFile("/a", 0, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if caps := Capabilities(minio); caps != (DriverCapabilities{}) {
+		t.Errorf("Capabilities of minio driver = %+v", caps)
+	}
+	if caps := Capabilities(file); caps != (DriverCapabilities{Chtimes: true, Chmod: true}) {
+		t.Errorf("Capabilities of file driver = %+v", caps)
+	}
+
+	s := newTestSession(t, NewFtpdConfig(), "alice", minio)
+	if feat := strings.Join(s.expect("FEAT", "211"), "\n"); strings.Contains(feat, "MFMT") {
+		t.Errorf("FEAT of minio driver = %q", feat)
+	}
+	s.expect("MFMT 20200102030405 a", "502")
+	s.expect("SITE CHMOD 644 a", "502")
+	if help := s.expect("SITE HELP", "214")[0]; strings.Contains(help, "CHMOD") || strings.Contains(help, "GETURL") {
+		t.Errorf("SITE HELP of minio driver = %q", help)
+	}
+
+	s = newTestSession(t, NewFtpdConfig(), "alice", file)
+	if feat := strings.Join(s.expect("FEAT", "211"), "\n"); !strings.Contains(feat, "MFMT") {
+		t.Errorf("FEAT of file driver = %q", feat)
+	}
+	s.expect("MFMT 20200102030405 a", "213")
+	s.expect("SITE CHMOD 600 a", "200")
+	if fi, err := os.Stat(filepath.Join(dir, "alice", "a")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("SITE CHMOD 600 a changed mode to %v", fi.Mode())
+	}
+	if help := s.expect("SITE HELP", "214")[0]; !strings.Contains(help, "CHMOD") {
+		t.Errorf("SITE HELP of file driver = %q", help)
+	}
+}
+
+// slowFactory - driver factory taking delay to create a driver, counting
+// the drivers created and closed.
+type slowFactory struct {
+	DriverFactory
+	delay   time.Duration
+	created int32
+	closed  int32
+}
+
+func (f *slowFactory) NewDriver(home string) (Driver, error) {
+	time.Sleep(f.delay)
+	driver, err := f.DriverFactory.NewDriver(home)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&f.created, 1)
+	return &closingDriver{driver, &f.closed}, nil
+}
+
+// closingDriver - driver counting its Close
+type closingDriver struct {
+	Driver
+	closed *int32
+}
+
+func (d *closingDriver) Close() error {
+	atomic.AddInt32(d.closed, 1)
+	return nil
+}
+
+func TestDriverLatency(t *testing.T) {
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	config.DriverTimeout = 1
+	s, dir := newTestLoginSession(t, config)
+	factory := &slowFactory{DriverFactory: NewFileDriverFactory(dir), delay: 1500 * time.Millisecond}
+	s.fc.factory = factory
+
+	s.expect("USER alice", "331")
+	start := time.Now()
+	s.expect("PASS secret", "421")
+	if elapsed := time.Since(start); elapsed > 1400*time.Millisecond {
+		t.Errorf("PASS replied in %v over DriverTimeout", elapsed)
+	}
+	// the driver created too late is closed.
+	for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&factory.closed) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("late driver not closed, %d created", atomic.LoadInt32(&factory.created))
+		}
+	}
+
+	// a lazy driver is created by the first command needs login.
+	config = NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	config.LazyDriver = true
+	s, dir = newTestLoginSession(t, config)
+	factory = &slowFactory{DriverFactory: NewFileDriverFactory(dir), delay: 300 * time.Millisecond}
+	s.fc.factory = factory
+	s.expect("USER alice", "331")
+	start = time.Now()
+	s.expect("PASS secret", "230")
+	if elapsed, n := time.Since(start), atomic.LoadInt32(&factory.created); elapsed > 200*time.Millisecond || n != 0 {
+		t.Errorf("PASS of LazyDriver replied in %v, %d drivers created", elapsed, n)
+	}
+	s.expect("PWD", "257")
+	if n := atomic.LoadInt32(&factory.created); n != 1 {
+		t.Errorf("%d drivers created by PWD, want 1", n)
+	}
+}
+
+func TestOPTS(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	if reply := s.expect("OPTS CSID Name=WinSCP; Version=5.17;", "200")[0]; reply != "200 Name=KFtpd; Version="+Version+";" {
+		t.Errorf("OPTS CSID = %s", reply)
+	}
+	if s.fc.clnt != "Name=WinSCP; Version=5.17;" {
+		t.Errorf("client of OPTS CSID = %q", s.fc.clnt)
+	}
+	s.expect("OPTS VENDOR-X on", "501")
+	s.expect("OPTS", "501")
+	s.expect("NOOP", "200")
+
+	config := NewFtpdConfig()
+	config.Stealth = true
+	s = newTestSession(t, config, "alice", driver)
+	if reply := s.expect("OPTS CSID Name=WinSCP;", "200")[0]; strings.Contains(reply, "KFtpd") {
+		t.Errorf("OPTS CSID in stealth = %s", reply)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	for _, follow := range []bool{false, true} {
+		driver, dir := newTestFileDriverOpts(t, "alice", FileDriverOptions{FollowSymlinks: follow})
+		if _, err := driver.PutFile("/target", 0, strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("target", filepath.Join(dir, "alice", "link")); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+		// the lines of link in LIST and MLSD
+		line := func(cmd, suffix string) string {
+			_, data := s.retrieve(cmd)
+			for _, line := range strings.Split(data, "\r\n") {
+				if strings.Contains(line, suffix) {
+					return line
+				}
+			}
+			return ""
+		}
+		list, entry := line("LIST", " link"), line("MLSD", " link")
+		if follow {
+			if !strings.HasPrefix(list, "-") || strings.Contains(list, "->") || !strings.HasSuffix(list, " link") {
+				t.Errorf("LIST following symlinks = %q", list)
+			}
+			if !strings.Contains(entry, "Type=file;") || !strings.Contains(entry, "Size=5;") {
+				t.Errorf("MLSD following symlinks = %q", entry)
+			}
+		} else {
+			if !strings.HasPrefix(list, "l") || !strings.HasSuffix(list, " link -> target") {
+				t.Errorf("LIST of symlinks = %q", list)
+			}
+			if !strings.Contains(entry, "Type=OS.unix=symlink;") {
+				t.Errorf("MLSD of symlinks = %q", entry)
+			}
+		}
+	}
+}
+
+func TestSiteVersion(t *testing.T) {
+	defer func(v, b string) { Version, BuildTime = v, b }(Version, BuildTime)
+	Version, BuildTime = "1.2.3", "2020-01-02T03:04:05Z"
+	want := "KFtpd 1.2.3 (built 2020-01-02T03:04:05Z)"
+
+	driver, _ := newTestFileDriver(t, "alice")
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	if reply := s.expect("SITE VERSION", "200")[0]; reply != "200 "+want {
+		t.Errorf("SITE VERSION = %s", reply)
+	}
+	if stat := s.expect("STAT", "211")[0]; !strings.Contains(stat, want) {
+		t.Errorf("STAT = %q", stat)
+	}
+	BuildTime = ""
+	if reply := s.expect("SITE VERSION", "200")[0]; reply != "200 KFtpd 1.2.3" {
+		t.Errorf("SITE VERSION without build time = %s", reply)
+	}
+
+	config := NewFtpdConfig()
+	config.Stealth = true
+	s = newTestSession(t, config, "alice", driver)
+	s.expect("SITE VERSION", "202")
+	if stat := s.expect("STAT", "211")[0]; strings.Contains(stat, "1.2.3") {
+		t.Errorf("STAT in stealth = %q", stat)
+	}
+}
+
+// slowDriver - driver whose PutFile reads slowly, sampling how many bytes
+// the client has written ahead of the driver.
+type slowDriver struct {
+	Driver
+	written *int64
+	ahead   int64
+}
+
+func (d *slowDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	var read int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := reader.Read(buf)
+		read += int64(n)
+		if ahead := atomic.LoadInt64(d.written) - read; ahead > d.ahead {
+			d.ahead = ahead
+		}
+		if read%(256<<10) < int64(n) {
+			time.Sleep(time.Millisecond)
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+func TestSTORBoundedMemory(t *testing.T) {
+	config := NewFtpdConfig()
+	inner, _ := newTestFileDriver(t, "alice")
+	driver := &slowDriver{Driver: inner, written: new(int64)}
+	s := newTestSession(t, config, "alice", driver)
+	s.expect("TYPE A", "200")
+
+	const size = 64 << 20
+	conn := s.passive()
+	// done is closed once all bytes are written, the upload takes as long
+	// as the race detector makes it, only the final reply is awaited with
+	// the read deadline.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		chunk := bytes.Repeat([]byte("0123456789abcde\n"), 4<<10)
+		for sent := 0; sent < size; sent += len(chunk) {
+			n, err := conn.Write(chunk)
+			atomic.AddInt64(driver.written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fmt.Fprintf(s.client, "STOR big\r\n")
+	if reply, err := s.read(); err != nil || !strings.HasPrefix(reply, "150 ") {
+		t.Fatalf("STOR big: %q, %v", reply, err)
+	}
+	<-done
+	if reply, err := s.read(); err != nil || !strings.HasPrefix(reply, "226 ") {
+		t.Fatalf("STOR big: %q, %v", reply, err)
+	}
+	runtime.ReadMemStats(&after)
+	if written := atomic.LoadInt64(driver.written); written != size {
+		t.Errorf("client wrote %d bytes of %d", written, size)
+	}
+
+	// the client is held back by the socket buffers only, no layer of the
+	// upload reader keeps what the driver has not read yet.
+	if driver.ahead > 16<<20 {
+		t.Errorf("client wrote %d bytes ahead of the driver", driver.ahead)
+	}
+	if after.TotalAlloc-before.TotalAlloc > 16<<20 {
+		t.Errorf("upload of %d bytes allocated %d bytes", size, after.TotalAlloc-before.TotalAlloc)
+	}
+}
+
+func TestUserPasvPorts(t *testing.T) {
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{
+		"alice": {Password: "secret", PasvPortStart: 23000, PasvPortEnd: 23009},
+		"bob":   {Password: "secret", PasvPortStart: 23010, PasvPortEnd: 23019},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user       string
+		start, end int
+	}{{"alice", 23000, 23009}, {"bob", 23010, 23019}, {"carol", config.Pasv.PortStart, config.Pasv.PortEnd}} {
+		driver, _ := newTestFileDriver(t, c.user)
+		s := newTestSession(t, config, c.user, driver)
+		for i := 0; i < 3; i++ {
+			reply := s.expect("PASV", "227")[0]
+			var p1, p2 int
+			fmt.Sscanf(reply[strings.Index(reply, "(")+1:], "%d,%d,%d,%d,%d,%d", new(int), new(int), new(int), new(int), &p1, &p2)
+			if port := p1*256 + p2; port < c.start || port > c.end {
+				t.Errorf("%s: PASV port %d out of %d-%d", c.user, port, c.start, c.end)
+			}
+		}
+	}
+
+	config.Users["bob"] = FtpdUser{Password: "secret", PasvPortStart: 23019, PasvPortEnd: 23010}
+	if err := config.Validate(); err == nil {
+		t.Error("Validate of a reversed passive port range succeeded")
+	}
+}
+
+func TestMLSDirSize(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	if err := driver.MakeDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.PutFile("/file", 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	_, data := s.retrieve("MLSD")
+	entries := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n") {
+		if i := strings.Index(line, " "); i >= 0 {
+			entries[line[i+1:]] = line[:i]
+		}
+	}
+	if facts := entries["dir"]; !strings.Contains(facts, "Type=dir;") || strings.Contains(facts, "Size=") {
+		t.Errorf("MLSD of dir = %q", facts)
+	}
+	if facts := entries["file"]; !strings.Contains(facts, "Type=file;") || !strings.Contains(facts, "Size=5;") {
+		t.Errorf("MLSD of file = %q", facts)
+	}
+	if reply := s.expect("MLST dir", "250")[0]; strings.Contains(reply, "Size=") {
+		t.Errorf("MLST dir = %q", reply)
+	}
+
+	// minio directories are common prefixes of no size at all.
+	_, factory := newTestMinioFactory(t, MinioDriverOptions{})
+	minio, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := minio.MakeDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestSession(t, NewFtpdConfig(), "alice", minio)
+	if _, data := s.retrieve("MLSD"); !strings.Contains(data, "Type=dir;") || strings.Contains(data, "Size=") {
+		t.Errorf("MLSD of minio dir = %q", data)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	defer SetUsageStore(usageStore)
+	SetUsageStore(NewMemoryUsageStore())
+
+	alice, _ := newTestFileDriver(t, "alice")
+	bob, _ := newTestFileDriver(t, "bob")
+	s := newTestSession(t, NewFtpdConfig(), "alice", alice)
+	s2 := newTestSession(t, NewFtpdConfig(), "bob", bob)
+	s.store("STOR a", "hello")
+	s.retrieve("RETR a")
+	s.retrieve("RETR a")
+	s2.store("STOR b", "0123456789")
+
+	if in, out := Usage("alice"); in != 5 || out != 10 {
+		t.Errorf("Usage of alice = %d in, %d out, want 5, 10", in, out)
+	}
+	if in, out := Usage("bob"); in != 10 || out != 0 {
+		t.Errorf("Usage of bob = %d in, %d out, want 10, 0", in, out)
+	}
+	if in, out := Usage("carol"); in != 0 || out != 0 {
+		t.Errorf("Usage of carol = %d in, %d out", in, out)
+	}
+}
+
+func TestCWDMessages(t *testing.T) {
+	file, _ := newTestFileDriver(t, "alice")
+	_, factory := newTestMinioFactory(t, MinioDriverOptions{})
+	minio, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, driver := range map[string]Driver{"file": file, "minio": minio} {
+		if _, err := driver.PutFile("/file", 0, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+		for _, c := range []struct{ line, want string }{
+			{"CWD file", "550 Not a directory."},
+			{"CWD missing", "550 No such directory."},
+			{"CWD /", "250 Directory successfully changed."},
+		} {
+			if reply := s.exec(c.line)[0]; reply != c.want {
+				t.Errorf("%s driver: %s = %s, want %s", name, c.line, reply, c.want)
+			}
+		}
+		if pwd := s.exec("PWD")[0]; pwd != `257 "/"` {
+			t.Errorf("%s driver: PWD after failed CWD = %s", name, pwd)
+		}
+	}
+}
+
+func TestMinioSmallUpload(t *testing.T) {
+	small := strings.Repeat("s", 1000)
+	large := strings.Repeat("l", 3000)
+	for _, c := range []struct {
+		size int
+		want []string
+	}{
+		{0, []string{"multipart kftpd-data/alice/small", "multipart kftpd-data/alice/large"}},
+		{2, []string{"single kftpd-data/alice/small", "multipart kftpd-data/alice/large"}},
+	} {
+		f, factory := newTestMinioFactory(t, MinioDriverOptions{SmallUploadSize: c.size})
+		driver, err := factory.NewDriver("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+		s.store("STOR small", small)
+		s.store("STOR large", large)
+		if !reflect.DeepEqual(f.puts, c.want) {
+			t.Errorf("SmallUploadSize %d: puts %q, want %q", c.size, f.puts, c.want)
+		}
+		if string(f.objects["kftpd-data/alice/small"]) != small || string(f.objects["kftpd-data/alice/large"]) != large {
+			t.Errorf("SmallUploadSize %d: objects not uploaded whole", c.size)
+		}
+	}
+}
+
+// writeTestCert write a self-signed certificate of common name cn and its
+// key to files in dir, return their names.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReloadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCert, oldKey := writeTestCert(t, dir, "old.example.com")
+	newCert, newKey := writeTestCert(t, dir, "new.example.com")
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.AuthTLS.Enable = true
+	config.AuthTLS.CertFile, config.AuthTLS.KeyFile = oldCert, oldKey
+	server, addr := startTestServer(t, config)
+
+	// dial return a control connection after AUTH TLS and the common name
+	// of the server certificate.
+	dial := func() (*textproto.Conn, string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		tc := textproto.NewConn(conn)
+		if _, _, err := tc.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		tc.PrintfLine("AUTH TLS")
+		if _, _, err := tc.ReadResponse(234); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return textproto.NewConn(tlsConn), tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	before, cn := dial()
+	if cn != "old.example.com" {
+		t.Fatalf("certificate before reload of %s", cn)
+	}
+	// a mismatched pair is refused and the certificate kept.
+	if err := server.ReloadTLS(oldCert, newKey); err == nil {
+		t.Error("ReloadTLS of a mismatched key succeeded")
+	}
+	if _, cn := dial(); cn != "old.example.com" {
+		t.Errorf("certificate after failed reload of %s", cn)
+	}
+	if err := server.ReloadTLS(newCert, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, cn := dial(); cn != "new.example.com" {
+		t.Errorf("certificate after reload of %s", cn)
+	}
+
+	before.PrintfLine("NOOP")
+	if _, _, err := before.ReadResponse(200); err != nil {
+		t.Errorf("connection before reload: %v", err)
+	}
+}
+
+func TestDataModePolicy(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	feat := func(s *testSession) map[string]bool {
+		feats := map[string]bool{}
+		for _, line := range strings.Split(s.expect("FEAT", "211")[0], "\n") {
+			feats[strings.TrimSpace(line)] = true
+		}
+		return feats
+	}
+
+	config := NewFtpdConfig()
+	config.Pasv.Enable = false
+	s := newTestSession(t, config, "alice", driver)
+	s.expect("PASV", "502")
+	s.expect("EPSV", "502")
+	s.expect("NOOP", "200")
+	if feats := feat(s); feats["PASV"] || feats["EPSV"] || !feats["EPRT"] {
+		t.Errorf("FEAT of active mode only = %v", feats)
+	}
+
+	config = NewFtpdConfig()
+	config.Port.Enable = false
+	s = newTestSession(t, config, "alice", driver)
+	s.expect("PORT 127,0,0,1,4,1", "502")
+	s.expect("EPRT |1|127.0.0.1|1025|", "502")
+	s.expect("NOOP", "200")
+	if feats := feat(s); !feats["PASV"] || !feats["EPSV"] || feats["EPRT"] {
+		t.Errorf("FEAT of passive mode only = %v", feats)
+	}
+
+	config.Pasv.Enable = false
+	if err := config.Validate(); err == nil {
+		t.Error("Validate with both data modes disabled succeeded")
+	}
+}
+
+func TestTransferStallTimeout(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	config := NewFtpdConfig()
+	config.TransferStallTimeout = 1
+	s := newTestSession(t, config, "alice", driver)
+
+	// upload write each chunk after a pause
+	upload := func(name string, pause time.Duration, chunks ...string) []string {
+		conn := s.passive()
+		go func() {
+			defer conn.Close()
+			for _, chunk := range chunks {
+				time.Sleep(pause)
+				if _, err := conn.Write([]byte(chunk)); err != nil {
+					return
+				}
+			}
+		}()
+		return s.exec("STOR " + name)
+	}
+
+	// slow but moving all the time, longer than the timeout in total.
+	replies := upload("slow", 400*time.Millisecond, "a", "b", "c", "d")
+	if !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("STOR of a slow upload = %q", replies)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "slow")); string(data) != "abcd" {
+		t.Errorf("slow upload stored %q", data)
+	}
+
+	replies = upload("stalled", 1500*time.Millisecond, "a")
+	if !strings.HasPrefix(replies[len(replies)-1], "426 ") {
+		t.Errorf("STOR of a stalled upload = %q", replies)
+	}
+}
+
+func TestExec(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	if _, err := driver.PutFile("/file", 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.MakeDir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	fc := NewFtpConn(1, server, NewFtpdConfig(), nil, nil)
+	reader := textproto.NewReader(bufio.NewReader(client))
+
+	// exec run line by Exec, return the only reply and its error
+	exec := func(line string) (string, error) {
+		errc := make(chan error, 1)
+		go func() { errc <- fc.Exec(line) }()
+		code, msg, err := reader.ReadResponse(0)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return fmt.Sprintf("%d %s", code, msg), <-errc
+	}
+
+	if reply, _ := exec("SIZE file"); reply != "530 Please login with USER and PASS." {
+		t.Errorf("SIZE before Login = %s", reply)
+	}
+	fc.Login("alice", driver)
+	for _, c := range []struct{ line, want string }{
+		{"SIZE file", "213 5"},
+		{"CWD dir", "250 Directory successfully changed."},
+		{"PWD", `257 "/dir"`},
+		{"SIZE ../file", "213 5"},
+		{"CDUP", "250 Directory successfully changed."},
+	} {
+		if reply, err := exec(c.line); err != nil || reply != c.want {
+			t.Errorf("%s = %s, %v, want %s", c.line, reply, err, c.want)
+		}
+	}
+	if reply, err := exec("CWD missing"); err == nil || !strings.HasPrefix(reply, "550 ") {
+		t.Errorf("CWD missing = %s, %v", reply, err)
+	}
+	if reply, err := exec("QUIT"); reply != "221 Goodbye." {
+		t.Errorf("QUIT = %s, %v", reply, err)
+	}
+}
+
+func TestBannerSyst(t *testing.T) {
+	// greet serve a session of config, return the greeting and SYST reply
+	greet := func(config *FtpdConfig) (string, string) {
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		server, client := net.Pipe()
+		defer client.Close()
+		go NewFtpConn(1, server, config, nil, nil).Serve()
+		conn := textproto.NewConn(client)
+		_, greeting, err := conn.ReadResponse(220)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.PrintfLine("SYST")
+		_, syst, err := conn.ReadResponse(215)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return greeting, syst
+	}
+
+	if greeting, syst := greet(NewFtpdConfig()); greeting != "KFtpd" || syst != "UNIX Type: L8" {
+		t.Errorf("default greeting %q, SYST %q", greeting, syst)
+	}
+	config := NewFtpdConfig()
+	config.Banner = "Welcome to example.com"
+	config.Syst = "Windows_NT"
+	if greeting, syst := greet(config); greeting != config.Banner || syst != "Windows_NT" {
+		t.Errorf("greeting %q, SYST %q", greeting, syst)
+	}
+
+	config.Syst = "BeOS"
+	if err := config.Validate(); err == nil {
+		t.Error("Validate of an unknown SYST name succeeded")
+	}
+}
+
+func TestAuthTLSInjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	config.AuthTLS.Enable = true
+	config.AuthTLS.CertFile, config.AuthTLS.KeyFile = writeTestCert(t, dir, "ftp.example.com")
+	_, addr := startTestServer(t, config)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	plain := textproto.NewConn(conn)
+	if _, _, err := plain.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// USER injected in the same segment as AUTH TLS before the handshake.
+	if _, err := conn.Write([]byte("AUTH TLS\r\nUSER alice\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := plain.ReadResponse(234); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	secure := textproto.NewConn(tlsConn)
+	secure.PrintfLine("PASS secret")
+	if code, msg, _ := secure.ReadResponse(0); code == 230 {
+		t.Errorf("PASS after injected USER = %d %s", code, msg)
+	}
+	secure.PrintfLine("USER alice")
+	if _, _, err := secure.ReadResponse(331); err != nil {
+		t.Fatal(err)
+	}
+	secure.PrintfLine("PASS secret")
+	if _, _, err := secure.ReadResponse(230); err != nil {
+		t.Errorf("PASS after USER over tls: %v", err)
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		mode    os.FileMode
+		inherit bool
+		ok      bool
+	}{
+		{"", 0, false, true},
+		{"inherit", 0, true, true},
+		{"755", 0755, false, true},
+		{"2775", 0775 | os.ModeSetgid, false, true},
+		{"888", 0, false, false},
+		{"17777", 0, false, false},
+	} {
+		mode, inherit, err := parseDirMode(c.s)
+		if mode != c.mode || inherit != c.inherit || (err == nil) != c.ok {
+			t.Errorf("parseDirMode(%q) = %v, %v, %v", c.s, mode, inherit, err)
+		}
+	}
+
+	driver, dir := newTestFileDriverOpts(t, "alice", FileDriverOptions{DirMode: 0700})
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("MKD fixed", "257")
+	if fi, err := os.Stat(filepath.Join(dir, "alice", "fixed")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf("MKD with DirMode 700 made mode %v", fi.Mode())
+	}
+
+	driver, dir = newTestFileDriverOpts(t, "alice", FileDriverOptions{InheritDirMode: true})
+	parent := filepath.Join(dir, "alice", "shared")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(parent, 0750|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("MKD shared/sub", "257")
+	if fi, err := os.Stat(filepath.Join(parent, "sub")); err != nil {
+		t.Error(err)
+	} else if mode := fi.Mode() & (os.ModePerm | os.ModeSetgid); mode != 0750|os.ModeSetgid {
+		t.Errorf("MKD inheriting the mode of parent made mode %v", mode)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	if _, err := driver.PutFile("/f", 0, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	config := NewFtpdConfig()
+	server := NewServer(config)
+	s := newTestSession(t, config, "alice", driver)
+	s.fc.server = server
+	server.addSession(s.fc)
+
+	// an upload in progress when Shutdown is called.
+	conn := s.passive()
+	s.waitDataConn()
+	done := make(chan []string)
+	go func() { done <- s.exec("STOR x") }()
+	for busy := false; !busy; time.Sleep(time.Millisecond) {
+		s.fc.stateLock.Lock()
+		busy = s.fc.busy
+		s.fc.stateLock.Unlock()
+	}
+	errc := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errc <- server.Shutdown(ctx)
+	}()
+	for !server.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Write([]byte("data"))
+	conn.Close()
+
+	// the upload finishes, then the session is closed.
+	replies := <-done
+	if len(replies) != 2 || !strings.HasPrefix(replies[1], "226 ") {
+		t.Errorf("STOR during Shutdown = %q", replies)
+	}
+	if reply, _ := s.read(); reply != "421 Server shutting down." {
+		t.Errorf("reply after STOR during Shutdown = %q", reply)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "x")); string(data) != "data" {
+		t.Errorf("upload during Shutdown stored %q", data)
+	}
+	server.removeSession(s.fc)
+	if err := <-errc; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+
+	// no new transfer starts in a session still open.
+	s = newTestSession(t, config, "alice", driver)
+	s.fc.server = server
+	s.expect("PASV", "421")
+}
+
+func TestHomeDirCeiling(t *testing.T) {
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	s, dir := newTestLoginSession(t, config)
+	if err := os.MkdirAll(filepath.Join(dir, "bob"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bob", "private"), []byte("bob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("USER alice", "331")
+	s.expect("PASS secret", "230")
+	s.expect("MKD sub", "257")
+
+	for _, line := range []string{"CDUP", "CWD ..", "CWD ../..", "CWD /../../"} {
+		s.exec(line)
+		if pwd := s.exec("PWD")[0]; pwd != `257 "/"` {
+			t.Errorf("PWD after %s = %s", line, pwd)
+		}
+	}
+	s.expect("CWD sub", "250")
+	s.expect("CWD ../..", "250")
+	if pwd := s.exec("PWD")[0]; pwd != `257 "/"` {
+		t.Errorf("PWD after CWD ../.. from /sub = %s", pwd)
+	}
+
+	s.expect("CWD ../bob", "550")
+	s.expect("SIZE ../bob/private", "550")
+	if _, data := s.retrieve("RETR ../bob/private"); len(data) > 0 {
+		t.Errorf("RETR of another user home = %q", data)
+	}
+	if _, data := s.retrieve("NLST .."); data != "sub\r\n" {
+		t.Errorf("NLST .. = %q", data)
+	}
+}
+
+func TestKickUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}, "bob": {Password: "secret"}}
+	server, addr := startTestServer(t, config)
+
+	alice := []*textproto.Conn{dialLogin(t, addr, "alice", "secret"), dialLogin(t, addr, "alice", "secret")}
+	bob := dialLogin(t, addr, "bob", "secret")
+
+	if n := server.KickUser("alice"); n != 2 {
+		t.Errorf("KickUser closed %d sessions, want 2", n)
+	}
+	for i, conn := range alice {
+		if _, _, err := conn.ReadResponse(421); err != nil {
+			t.Errorf("session %d of alice: %v", i, err)
+		}
+		if _, err := conn.ReadLine(); err != io.EOF {
+			t.Errorf("session %d of alice not closed: %v", i, err)
+		}
+	}
+	bob.PrintfLine("NOOP")
+	if _, _, err := bob.ReadResponse(200); err != nil {
+		t.Errorf("session of bob: %v", err)
+	}
+	if n := server.KickUser("carol"); n != 0 {
+		t.Errorf("KickUser of no session closed %d", n)
+	}
+}
+
+func TestMinioSize(t *testing.T) {
+	f, factory := newTestMinioFactory(t, MinioDriverOptions{})
+	driver, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.objects["kftpd-data/alice/dir/file"] = []byte("12345678901")
+	f.objects["kftpd-data/alice/empty"] = nil
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	for _, c := range []struct{ line, want string }{
+		{"SIZE dir/file", "213 11"},
+		{"SIZE /dir/file", "213 11"},
+		{"SIZE empty", "213 0"},
+	} {
+		if reply := s.exec(c.line)[0]; reply != c.want {
+			t.Errorf("%s = %s, want %s", c.line, reply, c.want)
+		}
+	}
+	for _, line := range []string{"SIZE dir", "SIZE dir/", "SIZE missing"} {
+		s.expect(line, "550")
+	}
+}
+
+func TestListTimeZone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	driver, dir := newTestFileDriver(t, "alice")
+	if _, err := driver.PutFile("/f", 0, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "alice", "f"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	modify := mtime.UTC().Format("20060102150405")
+
+	for _, c := range []struct {
+		zone string
+		loc  *time.Location
+	}{{"UTC", time.UTC}, {"Asia/Tokyo", tokyo}} {
+		config := NewFtpdConfig()
+		config.ListTimeZone = c.zone
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSession(t, config, "alice", driver)
+		if _, list := s.retrieve("LIST"); !strings.Contains(list, mtime.In(c.loc).Format(" Jan _2 15:04 ")) {
+			t.Errorf("LIST in %s = %q", c.zone, list)
+		}
+		// MLSD, MLST and MDTM are always UTC as RFC 3659 requires.
+		if _, mlsd := s.retrieve("MLSD"); !strings.Contains(mlsd, "Modify="+modify+";") {
+			t.Errorf("MLSD in %s = %q", c.zone, mlsd)
+		}
+		if mlst := s.expect("MLST f", "250")[0]; !strings.Contains(mlst, "Modify="+modify+";") {
+			t.Errorf("MLST in %s = %q", c.zone, mlst)
+		}
+		if mdtm := s.exec("MDTM f")[0]; mdtm != "213 "+modify {
+			t.Errorf("MDTM in %s = %s", c.zone, mdtm)
+		}
+	}
+
+	config := NewFtpdConfig()
+	config.ListTimeZone = "Nowhere/City"
+	if err := config.Validate(); err == nil {
+		t.Error("Validate of an unknown ListTimeZone succeeded")
+	}
+}
+
+// fakeGCS - gcs JSON API and oauth2 token endpoint over a map of objects
+type fakeGCS struct {
+	t       *testing.T
+	key     *rsa.PublicKey
+	lock    sync.Mutex
+	objects map[string][]byte
+	tokens  int
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, sum[:], sig); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, f.tokens)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token1" {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	object := func(name string) {
+		fmt.Fprintf(w, `{"name":%q,"size":"%d","updated":"2020-01-02T03:04:05Z"}`, name, len(f.objects[name]))
+	}
+	const objects = "/storage/v1/b/bucket/o"
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/upload"+objects && r.Method == "POST":
+		name := r.URL.Query().Get("name")
+		f.objects[name], _ = ioutil.ReadAll(r.Body)
+		object(name)
+	case path == objects && r.Method == "GET":
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		var names []string
+		prefixes := map[string]bool{}
+		for name := range f.objects {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if i := strings.Index(name[len(prefix):], "/"); i >= 0 && len(prefix)+i+1 < len(name) {
+				prefixes[name[:len(prefix)+i+1]] = true
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		// two objects a page after the last name of previous one to
+		// exercise pageToken
+		token := query.Get("pageToken")
+		start := sort.SearchStrings(names, token)
+		if start < len(names) && names[start] == token {
+			start++
+		}
+		end, next := start+2, ""
+		if end < len(names) {
+			next = names[end-1]
+		} else {
+			end = len(names)
+		}
+		var items []string
+		for _, name := range names[start:end] {
+			items = append(items, fmt.Sprintf(`{"name":%q,"size":"%d"}`, name, len(f.objects[name])))
+		}
+		var subdirs []string
+		if len(token) == 0 {
+			for prefix := range prefixes {
+				subdirs = append(subdirs, strconv.Quote(prefix))
+			}
+		}
+		fmt.Fprintf(w, `{"items":[%s],"prefixes":[%s],"nextPageToken":%q}`, strings.Join(items, ","), strings.Join(subdirs, ","), next)
+	case strings.HasPrefix(path, objects+"/"):
+		parts := strings.Split(strings.TrimPrefix(path, objects+"/"), "/")
+		for i := range parts {
+			parts[i], _ = url.PathUnescape(parts[i])
+		}
+		name := parts[0]
+		data, ok := f.objects[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == "DELETE":
+			delete(f.objects, name)
+		case len(parts) == 1 && r.URL.Query().Get("alt") == "media":
+			var offset int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+			w.Write(data[offset:])
+		case len(parts) == 1:
+			object(name)
+		case parts[1] == "rewriteTo" && r.Method == "POST":
+			f.objects[parts[5]] = data
+			fmt.Fprint(w, `{"done":true}`)
+		case parts[1] == "compose" && r.Method == "POST":
+			var compose struct {
+				SourceObjects []struct {
+					Name string `json:"name"`
+				} `json:"sourceObjects"`
+			}
+			json.NewDecoder(r.Body).Decode(&compose)
+			var composed []byte
+			for _, source := range compose.SourceObjects {
+				composed = append(composed, f.objects[source.Name]...)
+			}
+			f.objects[name] = composed
+			object(name)
+		default:
+			f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	}
+}
+
+func TestGCSDriver(t *testing.T) {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeGCS{t: t, key: &key.PublicKey, objects: map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	account, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "kftpd@example.iam.gserviceaccount.com",
+		"private_key":  string(pemKey),
+		"token_uri":    srv.URL + "/token",
+	})
+	credentialsFile := filepath.Join(dir, "account.json")
+	if err := ioutil.WriteFile(credentialsFile, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := NewGCSDriverFactory("bucket", credentialsFile).(*GCSDriverFactory)
+	factory.endpoint = srv.URL
+	driver, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.MakeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := driver.PutFile("/d/a", 0, strings.NewReader("hello")); err != nil || n != 5 {
+		t.Fatalf("PutFile = %d, %v", n, err)
+	}
+	if n, err := driver.PutFile("/d/a", 5, strings.NewReader(" world")); err != nil || n != 11 {
+		t.Fatalf("PutFile append = %d, %v", n, err)
+	}
+	if _, ok := f.objects["alice/d/a.tmp"]; ok {
+		t.Error("temporary object of append is left")
+	}
+	size, reader, err := driver.GetFile("/d/a", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if size != 5 || string(data) != "world" {
+		t.Errorf("GetFile = %d, %q", size, data)
+	}
+
+	for _, name := range []string{"/d/b", "/d/c", "/d/sub/e"} {
+		if _, err := driver.PutFile(name, 0, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	err = driver.ListDir("/d", func(info FileInfo) error {
+		names = append(names, fmt.Sprintf("%s:%v", info.Name(), info.IsDir()))
+		return nil
+	})
+	sort.Strings(names)
+	if err != nil || strings.Join(names, " ") != "a:false b:false c:false sub:true" {
+		t.Errorf("ListDir = %q, %v", names, err)
+	}
+
+	if info, err := driver.Stat("/d/sub"); err != nil || !info.IsDir() {
+		t.Errorf("Stat dir = %v, %v", info, err)
+	}
+	if info, err := driver.Stat("/d/a"); err != nil || info.IsDir() || info.Size() != 11 {
+		t.Errorf("Stat file = %v, %v", info, err)
+	}
+	if _, err := driver.Stat("/x"); !os.IsNotExist(err) {
+		t.Errorf("Stat missing = %v", err)
+	}
+
+	if err := driver.Rename("/d/a", "/d/z"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["alice/d/a"]; ok || string(f.objects["alice/d/z"]) != "hello world" {
+		t.Errorf("Rename left %q", f.objects)
+	}
+
+	// objects of sub dirs are kept like minio driver
+	if err := driver.DeleteDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	for name := range f.objects {
+		if name != "alice/d/sub/e" {
+			t.Errorf("DeleteDir left %s", name)
+		}
+	}
+	if f.tokens != 1 {
+		t.Errorf("tokens = %d, want the cached one", f.tokens)
+	}
+}
+
+// startSSH start a ssh server of the sftp subsystem on the local file
+// system, return its address and a known hosts file of its key.
+func startSSH(t *testing.T, dir, user, password string) (string, string) {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for req := range requests {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if ok {
+								server, _ := sftp.NewServer(channel)
+								go func() {
+									server.Serve()
+									channel.Close()
+								}()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, signer.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String(), knownHosts
+}
+
+func TestSFTPDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, knownHosts := startSSH(t, dir, "upstream", "secret")
+	root := filepath.Join(dir, "root")
+
+	factory := NewSFTPDriverFactory(addr, "upstream", "secret", "", knownHosts, root, map[string]string{"bob": "upstream"})
+	d, err := factory.NewDriver("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := d.(*SFTPDriver)
+	defer driver.Close()
+	if driver.root != filepath.ToSlash(filepath.Join(root, "alice")) {
+		t.Errorf("root = %s", driver.root)
+	}
+
+	if err := driver.MakeDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	if n, err := driver.PutFile("/d/a", 0, bytes.NewReader(data[:50000])); err != nil || n != 50000 {
+		t.Fatalf("PutFile = %d, %v", n, err)
+	}
+	if n, err := driver.PutFile("/d/a", 50000, bytes.NewReader(data[50000:])); err != nil || n != 50000 {
+		t.Fatalf("PutFile append = %d, %v", n, err)
+	}
+	size, reader, err := driver.GetFile("/d/a", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if size != int64(len(data)-1000) || !bytes.Equal(got, data[1000:]) {
+		t.Errorf("GetFile = %d, %d bytes", size, len(got))
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := driver.Chtimes("/d/a", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Chmod("/d/a", 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := driver.Stat("/d/a")
+	if err != nil || info.Size() != int64(len(data)) || !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0600 {
+		t.Errorf("Stat = %v, %v", info, err)
+	}
+	if info, err := driver.Stat("/"); err != nil || info.Name() != "/" || !info.IsDir() {
+		t.Errorf("Stat root = %v, %v", info, err)
+	}
+	if _, err := driver.Stat("/x"); !os.IsNotExist(err) {
+		t.Errorf("Stat missing = %v", err)
+	}
+
+	if err := driver.Rename("/d/a", "/d/b"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = driver.ListDir("/d", func(info FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	})
+	if err != nil || strings.Join(names, " ") != "b" {
+		t.Errorf("ListDir = %q, %v", names, err)
+	}
+	if err := driver.DeleteFile("/d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.DeleteDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+
+	// user names are a single element under root, mapped users are at root
+	for user, want := range map[string]string{
+		"..":     "_",
+		"../etc": ".._etc",
+		"a/b":    "a_b",
+		"bob":    "",
+	} {
+		d, err := factory.NewDriver(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.(*SFTPDriver).root; got != filepath.ToSlash(filepath.Join(root, want)) {
+			t.Errorf("root of %q = %s", user, got)
+		}
+		closeDriver(d)
+	}
+}
+
+// fakeLDAP - ldap server of entries by uid answering binds and searches
+// of filter (uid=...), passwords and memberOf by dn
+type fakeLDAP struct {
+	passwords map[string]string
+	groups    map[string][]string
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if pass, ok := f.passwords[dn]; ok && pass == op.Children[2].Data.String() {
+				code = ldap.LDAPResultSuccess
+			}
+			f.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for dn := range f.passwords {
+				if filter != "(uid="+strings.SplitN(strings.TrimPrefix(dn, "uid="), ",", 2)[0]+")" {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", ""))
+				values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+				for _, group := range f.groups[dn] {
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, ""))
+				}
+				attr.AppendChild(values)
+				attrs.AppendChild(attr)
+				entry.AppendChild(attrs)
+				f.send(conn, id, entry)
+			}
+			f.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+func (f *fakeLDAP) reply(conn net.Conn, id int64, tag ber.Tag, code uint16) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	f.send(conn, id, op)
+}
+
+func (f *fakeLDAP) send(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := &fakeLDAP{
+		passwords: map[string]string{
+			"cn=svc,dc=example":              "svcpass",
+			"uid=alice,ou=people,dc=example": "secret",
+			"uid=bob,ou=people,dc=example":   "secret",
+		},
+		groups: map[string][]string{
+			"uid=alice,ou=people,dc=example": {"CN=FTP,dc=example"},
+			"uid=bob,ou=people,dc=example":   {"cn=staff,dc=example"},
+		},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	opts := LDAPOptions{
+		URL:            "ldap://" + l.Addr().String(),
+		BindDN:         "cn=svc,dc=example",
+		BindPassword:   "svcpass",
+		BaseDN:         "dc=example",
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		Groups:         []string{"cn=ftp,dc=example"},
+		Timeout:        5,
+	}
+	auth, err := NewLDAPAuthenticator(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"*", "secret", false},
+	} {
+		ok, err := auth.Authenticate(c.user, c.pass)
+		if err != nil || ok != c.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, %v, want %v", c.user, c.pass, ok, err, c.ok)
+		}
+	}
+
+	opts.BindPassword = "wrong"
+	auth, _ = NewLDAPAuthenticator(opts)
+	if _, err := auth.Authenticate("alice", "secret"); err == nil {
+		t.Error("Authenticate with invalid BindDN credentials succeeded")
+	}
+
+	opts.UserFilter = "(uid=%s"
+	if _, err := NewLDAPAuthenticator(opts); err == nil {
+		t.Error("NewLDAPAuthenticator accepted a bad filter")
+	}
+}
+
+func TestEPSV(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+	cases := []struct {
+		line string
+		code string
+	}{
+		{"EPSV", "229"},
+		{"EPSV 1", "229"},
+		{"EPSV 2", "229"},
+		{"EPSV 3", "522"},
+		{"EPSV x", "522"},
+	}
+	for _, c := range cases {
+		reply := s.expect(c.line, c.code)[0]
+		if c.code != "229" {
+			continue
+		}
+		var port int
+		if _, err := fmt.Sscanf(reply[strings.Index(reply, "(|||")+4:], "%d|)", &port); err != nil || port <= 0 {
+			t.Errorf("%s = %q", c.line, reply)
+			continue
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			data <- b
+		}()
+		if replies := s.exec("RETR f"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+			t.Errorf("RETR after %s = %q", c.line, replies)
+		}
+		if b := <-data; string(b) != "data" {
+			t.Errorf("RETR after %s read %q", c.line, b)
+		}
+	}
+
+	// EPSV ALL locks the session to EPSV.
+	s.expect("EPSV ALL", "200")
+	s.expect("PASV", "501")
+	s.expect("PORT 127,0,0,1,4,1", "501")
+	s.expect("EPRT |1|127.0.0.1|1025|", "501")
+	s.expect("EPSV", "229")
+	s.exec("ABOR")
+}
+
+func TestEPRT(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listen := func(addr string) (net.Listener, int) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, 0
+		}
+		t.Cleanup(func() { l.Close() })
+		return l, l.Addr().(*net.TCPAddr).Port
+	}
+	l4, p4 := listen("127.0.0.1:0")
+	l6, p6 := listen("[::1]:0")
+
+	// with BounceProtection the data connection goes to the client ip, so
+	// the ipv6 cases run on a control connection over ipv6.
+	s4 := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	var s6 *testSession
+	if l6 != nil {
+		server, client := tcpPair(t, "[::1]:0")
+		s6 = newTestSessionOn(t, server, client, NewFtpdConfig(), "alice", driver)
+	}
+
+	cases := []struct {
+		v6   bool
+		arg  string
+		l    net.Listener
+		code string
+	}{
+		{false, fmt.Sprintf("|1|127.0.0.1|%d|", p4), l4, "200"},
+		{false, fmt.Sprintf("!1!127.0.0.1!%d!", p4), l4, "200"},
+		{true, fmt.Sprintf("|2|::1|%d|", p6), l6, "200"},
+		{false, fmt.Sprintf("|3|127.0.0.1|%d|", p4), nil, "522"},
+		{false, fmt.Sprintf("|2|127.0.0.1|%d|", p4), nil, "501"},
+		{true, fmt.Sprintf("|1|::1|%d|", p6), nil, "501"},
+		{false, "|1|127.0.0.1|0|", nil, "501"},
+		{false, "|1|127.0.0.1|65536|", nil, "501"},
+		{false, "|1|127.0.0.1|21|", nil, "501"},
+		{false, "|1|localhost|1025|", nil, "501"},
+		{false, "|1|127.0.0.1|1025", nil, "501"},
+		{false, "", nil, "501"},
+	}
+	for _, c := range cases {
+		s := s4
+		if c.v6 {
+			if s6 == nil {
+				// no ipv6 loopback
+				continue
+			}
+			s = s6
+		}
+		s.expect("EPRT "+c.arg, c.code)
+		if c.l == nil {
+			continue
+		}
+		conn, err := c.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			data <- b
+		}()
+		if replies := s.exec("RETR f"); !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+			t.Errorf("RETR after EPRT %s = %q", c.arg, replies)
+		}
+		if b := <-data; string(b) != "data" {
+			t.Errorf("RETR after EPRT %s read %q", c.arg, b)
+		}
+	}
+}
+
+func TestPORT(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+	for _, c := range []struct {
+		arg  string
+		code string
+	}{
+		{"127,0,0,1,4", "501"},
+		{"127,0,0,1,4,1,1", "501"},
+		{"127,0,0,256,4,1", "501"},
+		{"127,0,0,1,-1,1", "501"},
+		{"127,0,0,1,4,1x", "501"},
+		{"127,0,0, 1,4,1", "501"},
+		{"127,0,0,1,0,0", "501"},
+		{"", "501"},
+		{"127,0,0,1,0,21", "500"},
+		{"10,0,0,1,4,1", "500"},
+	} {
+		s.expect("PORT "+c.arg, c.code)
+	}
+
+	s.expect(fmt.Sprintf("PORT 127,0,0,1,%d,%d", port/256, port%256), "200")
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		data <- b
+	}()
+	s.expect("RETR f", "226")
+	if b := <-data; string(b) != "data" {
+		t.Errorf("RETR after PORT read %q", b)
+	}
+}
+
+func TestABORRetrieve(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+	// the client does not read, so RETR blocks writing the data.
+	conn := s.passive()
+	defer conn.Close()
+	fmt.Fprintf(s.client, "RETR big\r\n")
+	if reply, err := s.read(); err != nil || !strings.HasPrefix(reply, "150 ") {
+		t.Fatalf("RETR = %q, %v", reply, err)
+	}
+	fmt.Fprintf(s.client, "ABOR\r\n")
+	var replies []string
+	for i := 0; i < 2; i++ {
+		reply, err := s.read()
+		if err != nil {
+			t.Fatalf("replies %q: %v", replies, err)
+		}
+		replies = append(replies, reply)
+	}
+	if !strings.HasPrefix(replies[0], "426 ") || !strings.HasPrefix(replies[1], "226 ") {
+		t.Errorf("RETR and ABOR = %q, want 426 then 226", replies)
+	}
+
+	// the data connection is closed before the whole file is sent.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(ioutil.Discard, conn)
+	if ne, ok := err.(net.Error); (ok && ne.Timeout()) || n >= int64(len(data)) {
+		t.Errorf("data connection read %d of %d bytes: %v", n, len(data), err)
+	}
+	s.expect("NOOP", "200")
+}
+
+func TestThrottleShared(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	data := strings.Repeat("x", 64<<10)
+	if _, err := driver.PutFile("/f", 0, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	config := NewFtpdConfig()
+	config.Throttle.DownloadKBps = 128
+	throttles := newThrottleLimiters()
+
+	// two sessions of alice share 128KB/s, so 128KB take one second
+	// instead of half a second each on a limiter of their own.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		s := newTestSession(t, config, "alice", driver)
+		s.fc.throttles = throttles
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, got := s.retrieve("RETR f"); got != data {
+				t.Errorf("RETR f got %d bytes", len(got))
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("2 sessions downloaded 128KB in %v over a shared 128KB/s", elapsed)
+	}
+
+	throttles.lock.Lock()
+	n := len(throttles.limiters)
+	throttles.lock.Unlock()
+	if n != 1 {
+		t.Errorf("%d limiters, want 1 of alice downloading", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	if config := NewFtpdConfig(); config.IdleTimeout != 0 {
+		t.Errorf("default IdleTimeout = %d, want 0", config.IdleTimeout)
+	}
+	data := strings.Repeat("x", 64<<10)
+	if _, err := driver.PutFile("/f", 0, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	config := NewFtpdConfig()
+	config.IdleTimeout = 1
+	config.Throttle.DownloadKBps = 32
+	s := newTestSession(t, config, "alice", driver)
+
+	// commands and transfers longer than IdleTimeout keep the session open.
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		s.expect("NOOP", "200")
+	}
+	if replies, got := s.retrieve("RETR f"); got != data || !strings.HasPrefix(replies[len(replies)-1], "226 ") {
+		t.Errorf("RETR f over IdleTimeout = %q, %d bytes", replies, len(got))
+	}
+
+	start := time.Now()
+	if reply, err := s.read(); err != nil || reply != "421 Timeout." {
+		t.Fatalf("idle session = %q, %v", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("idle session closed after %v, want 1s", elapsed)
+	}
+	if reply, err := s.read(); err != io.EOF {
+		t.Errorf("read after timeout = %q, %v, want EOF", reply, err)
+	}
+}
+
+// recordLogger - logger keeping the entries in memory
+type recordLogger struct {
+	lock    sync.Mutex
+	entries []string
+}
+
+func (l *recordLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, strings.TrimSpace(fmt.Sprintln(append([]interface{}{msg}, keyvals...)...)))
+}
+
+func TestLogSendData(t *testing.T) {
+	driver, _ := newTestFileDriver(t, "alice")
+	if err := driver.MakeDir("/private-name"); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	logger := &recordLogger{}
+	s.fc.logger = logger
+	if _, data := s.retrieve("NLST"); data != "private-name\r\n" {
+		t.Fatalf("NLST = %q", data)
+	}
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	sent := false
+	for _, entry := range logger.entries {
+		if strings.Contains(entry, "private-name") {
+			t.Errorf("listing logged: %s", entry)
+		}
+		if strings.HasPrefix(entry, "send data") && strings.Contains(entry, "bytes 14") {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Errorf("no send data entry with the byte count in %q", logger.entries)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	driver, dir := newTestFileDriver(t, "alice")
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "x", QuotaBytes: 10, QuotaFiles: 2}}
+	s := newTestSession(t, config, "alice", driver)
+	quota := func(want string) {
+		t.Helper()
+		if reply := s.expect("SITE QUOTA", "200")[0]; reply != "200 Quota: "+want+"." {
+			t.Errorf("SITE QUOTA = %q, want %s", reply, want)
+		}
+	}
+	last := func(replies []string) string {
+		return replies[len(replies)-1][:3]
+	}
+	quota("0/10 bytes, 0/2 files")
+
+	if code := last(s.store("STOR a", "12345")); code != "226" {
+		t.Fatalf("STOR a = %s", code)
+	}
+	quota("5/10 bytes, 1/2 files")
+
+	// an overwrite is charged the size change only.
+	if code := last(s.store("STOR a", "1234567")); code != "226" {
+		t.Fatalf("STOR a again = %s", code)
+	}
+	quota("7/10 bytes, 1/2 files")
+
+	// over the byte quota the upload is rejected and removed.
+	if code := last(s.store("STOR b", "12345")); code != "552" {
+		t.Errorf("STOR b over QuotaBytes = %s, want 552", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "b")); !os.IsNotExist(err) {
+		t.Errorf("upload over quota left: %v", err)
+	}
+	quota("7/10 bytes, 1/2 files")
+	if code := last(s.store("STOR b", "123")); code != "226" {
+		t.Fatalf("STOR b of exactly the quota = %s", code)
+	}
+	quota("10/10 bytes, 2/2 files")
+
+	// over the file quota no new file is created.
+	if code := last(s.store("STOR c", "")); code != "552" {
+		t.Errorf("STOR c over QuotaFiles = %s, want 552", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "c")); !os.IsNotExist(err) {
+		t.Errorf("file over quota created: %v", err)
+	}
+
+	// DELE gives the usage back.
+	s.expect("DELE b", "250")
+	quota("7/10 bytes, 1/2 files")
+
+	// APPE is charged the bytes appended.
+	if code := last(s.store("APPE c", "12")); code != "226" {
+		t.Fatalf("APPE c = %s", code)
+	}
+	quota("9/10 bytes, 2/2 files")
+	s.expect("REST 2", "350")
+	if code := last(s.store("APPE c", "3")); code != "226" {
+		t.Fatalf("APPE c at 2 = %s", code)
+	}
+	quota("10/10 bytes, 2/2 files")
+	s.expect("REST 3", "350")
+	if code := last(s.store("APPE c", "45")); code != "552" {
+		t.Errorf("APPE c over QuotaBytes = %s, want 552", code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "c")); string(data) != "123" {
+		t.Errorf("APPE over quota left c = %q", data)
+	}
+	quota("10/10 bytes, 2/2 files")
+}
+
+func TestHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	// entries of htpasswd -m (apr1), openssl passwd -1 and htpasswd -s.
+	entries := "apr:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" +
+		"md5:$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/\n" +
+		"sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" +
+		"des:rl0uE2wcmpd7I\n"
+	if err := ioutil.WriteFile(file, []byte(entries), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewHtpasswdAuthenticator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"apr", "myPassword", true},
+		{"apr", "mypassword", false},
+		{"md5", "password", true},
+		{"md5", "Password", false},
+		{"sha", "password", true},
+		{"sha", "password1", false},
+		{"nobody", "password", false},
+	} {
+		if ok, err := auth.Authenticate(c.user, c.pass); ok != c.ok || err != nil {
+			t.Errorf("Authenticate(%s, %s) = %v, %v, want %v", c.user, c.pass, ok, err, c.ok)
+		}
+	}
+	if ok, err := auth.Authenticate("des", "password"); ok || !errors.Is(err, errHtpasswdHash) {
+		t.Errorf("Authenticate of crypt(3) DES = %v, %v", ok, err)
+	}
+
+	// a rewrite of the same size and mtime is still picked up.
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := strings.Replace(entries, "sha:", "ahs:", 1)
+	if err := ioutil.WriteFile(file, []byte(rewritten), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := auth.Authenticate("sha", "password"); ok {
+		t.Error("user removed from rewritten htpasswd still authenticated")
+	}
+	if ok, _ := auth.Authenticate("ahs", "password"); !ok {
+		t.Error("user added to rewritten htpasswd not authenticated")
+	}
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.User == "alice" && req.Password == "secret":
+			fmt.Fprintf(w, `{"allow":true,"home":"/shared","quota_files":3,"read_only":true,"can_list":false,"allowed_networks":["%s/32"]}`, req.IP)
+		case req.User == "bob" && req.Password == "secret":
+			fmt.Fprint(w, `{"allow":true}`)
+		case req.User == "broken":
+			http.Error(w, "backend down", http.StatusBadGateway)
+		case req.User == "slow":
+			<-r.Context().Done()
+		default:
+			fmt.Fprint(w, `{"allow":false,"home":"/shared"}`)
+		}
+	}))
+	defer srv.Close()
+
+	auth := NewWebhookAuthenticator(srv.URL, "token", 1).(LoginAuthenticator)
+	user, err := auth.Login("alice", "secret", "10.0.0.1")
+	if err != nil || user == nil {
+		t.Fatalf("Login allowed = %v, %v", user, err)
+	}
+	if user.Home != "/shared" || user.QuotaFiles != 3 || !user.ReadOnly ||
+		user.CanList == nil || *user.CanList || user.CanUpload != nil ||
+		len(user.AllowedNetworks) != 1 || user.AllowedNetworks[0] != "10.0.0.1/32" {
+		t.Errorf("Login settings = %+v", user)
+	}
+	if user, err := auth.Login("alice", "wrong", "10.0.0.1"); user != nil || err != nil {
+		t.Errorf("Login denied = %v, %v", user, err)
+	}
+	if ok, err := auth.Authenticate("alice", "wrong"); ok || err != nil {
+		t.Errorf("Authenticate denied = %v, %v", ok, err)
+	}
+	if user, err := auth.Login("broken", "secret", ""); user != nil || err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Login on non-200 = %v, %v", user, err)
+	}
+	if user, err := NewWebhookAuthenticator(srv.URL, "", 1).(LoginAuthenticator).Login("alice", "secret", ""); user != nil || err == nil {
+		t.Errorf("Login without token = %v, %v", user, err)
+	}
+	start := time.Now()
+	if user, err := auth.Login("slow", "secret", ""); user != nil || err == nil {
+		t.Errorf("Login on timeout = %v, %v", user, err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Login on timeout took %v", d)
+	}
+
+	// an allowed user with an empty home gets the default home.
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.HomeDir = true
+	config.AuthWebhook.URL = srv.URL
+	config.AuthWebhook.Token = "token"
+	_, addr := startTestServer(t, config)
+	conn := dialLogin(t, addr, "bob", "secret")
+	conn.PrintfLine("MKD d")
+	if _, _, err := conn.ReadResponse(257); err != nil {
+		t.Fatalf("MKD d: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "bob", "d")); err != nil || !fi.IsDir() {
+		t.Errorf("MKD of user with empty home: %v", err)
+	}
+}
+
+func TestLoginFailDelay(t *testing.T) {
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	config.LoginBan.FailDelay = 1
+	s, _ := newTestLoginSession(t, config)
+	s.expect("USER alice", "331")
+	start := time.Now()
+	s.expect("PASS wrong", "530")
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("530 after %v, want FailDelay of 1s", d)
+	}
+
+	// a session closed during the delay does not wait it out.
+	config.LoginBan.FailDelay = 60
+	server, client := tcpPair(t, "127.0.0.1:0")
+	defer client.Close()
+	fc := NewFtpConn(1, server, config, nil, NewFileDriverFactory(os.TempDir()))
+	done := make(chan struct{})
+	go func() {
+		fc.Serve()
+		close(done)
+	}()
+	r := textproto.NewReader(bufio.NewReader(client))
+	r.ReadLine()
+	fmt.Fprintf(client, "USER alice\r\nPASS wrong\r\n")
+	if line, err := r.ReadLine(); err != nil || !strings.HasPrefix(line, "331") {
+		t.Fatalf("USER alice = %q, %v", line, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	fc.abort()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session closed during FailDelay still waiting")
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	for _, c := range []struct {
+		addr     string
+		networks []string
+		code     string
+	}{
+		{"127.0.0.1:0", nil, "230"},
+		{"127.0.0.1:0", []string{"127.0.0.0/8"}, "230"},
+		{"127.0.0.1:0", []string{"10.0.0.0/8", "127.0.0.1"}, "230"},
+		{"127.0.0.1:0", []string{"10.0.0.0/8"}, "530"},
+		{"127.0.0.1:0", []string{"::1/128"}, "530"},
+		{"[::1]:0", []string{"::1/128"}, "230"},
+		{"[::1]:0", []string{"10.0.0.0/8", "::1"}, "230"},
+		{"[::1]:0", []string{"fe80::/10"}, "530"},
+		{"[::1]:0", []string{"127.0.0.0/8"}, "530"},
+	} {
+		config := NewFtpdConfig()
+		config.Users = map[string]FtpdUser{"alice": {Password: "secret", AllowedNetworks: c.networks}}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s %q: %v", c.addr, c.networks, err)
+		}
+		server, client := tcpPair(t, c.addr)
+		s := newTestSessionOn(t, server, client, config, "", nil)
+		s.fc.factory = NewFileDriverFactory(os.TempDir())
+		s.expect("USER alice", "331")
+		if code := s.exec("PASS secret")[0][:3]; code != c.code {
+			t.Errorf("login from %s with AllowedNetworks %q = %s, want %s", c.addr, c.networks, code, c.code)
+		}
+	}
+
+	for _, networks := range [][]string{{"10.0.0.0/33"}, {"10.0.0/8"}, {"bogus"}, {"::1/129"}, {"127.0.0.1", "fe80::/x"}} {
+		config := NewFtpdConfig()
+		config.Users = map[string]FtpdUser{"alice": {Password: "secret", AllowedNetworks: networks}}
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "AllowedNetworks") {
+			t.Errorf("Validate of AllowedNetworks %q = %v", networks, err)
+		}
+	}
+}
+
+func TestModeZ(t *testing.T) {
+	config := NewFtpdConfig()
+	driver, dir := newTestFileDriver(t, "alice")
+	s := newTestSession(t, config, "alice", driver)
+	s.expect("MODE Z", "504")
+	last := func(replies []string) string {
+		return replies[len(replies)-1][:3]
+	}
+
+	config.ModeZ.Enable = true
+	s.expect("OPTS MODE Z LEVEL 10", "501")
+	s.expect("OPTS MODE Z LEVEL 9", "200")
+	s.expect("MODE Z", "200")
+	plain := strings.Repeat("kftpd mode z round trip\n", 4096)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte(plain))
+	zw.Close()
+	if code := last(s.store("STOR a", z.String())); code != "226" {
+		t.Fatalf("STOR a in MODE Z = %s", code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "a")); string(data) != plain {
+		t.Errorf("MODE Z upload stored %d bytes, want %d", len(data), len(plain))
+	}
+
+	replies, data := s.retrieve("RETR a")
+	if code := last(replies); code != "226" {
+		t.Fatalf("RETR a in MODE Z = %s", code)
+	}
+	if len(data) >= len(plain)/10 {
+		t.Errorf("MODE Z download of %d bytes sent %d bytes", len(plain), len(data))
+	}
+	zr, err := zlib.NewReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(zr); err != nil || string(b) != plain {
+		t.Errorf("MODE Z download = %d bytes, %v", len(b), err)
+	}
+	_, data = s.retrieve("NLST")
+	if zr, err = zlib.NewReader(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(zr); err != nil || string(b) != "a\r\n" {
+		t.Errorf("MODE Z NLST = %q, %v", b, err)
+	}
+
+	s.expect("MODE S", "200")
+	if _, data := s.retrieve("RETR a"); data != plain {
+		t.Errorf("RETR a in MODE S = %d bytes", len(data))
+	}
+
+	// a level zlib refuses fails the transfer rather than sending plain.
+	s.fc.zlevel = 0
+	config.ModeZ.Level = 10
+	s.expect("MODE Z", "200")
+	if replies, data := s.retrieve("RETR a"); last(replies)[0] == '2' || len(data) > 0 {
+		t.Errorf("RETR a at a bad level = %q, %d bytes", replies, len(data))
+	}
+	if replies, _ := s.retrieve("NLST"); last(replies)[0] == '2' {
+		t.Errorf("NLST at a bad level = %q", replies)
+	}
+}
+
+func TestProtPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "ftp.example.com")
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.HomeDir = true
+	config.AuthTLS.Enable = true
+	config.AuthTLS.CertFile, config.AuthTLS.KeyFile = certFile, keyFile
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	_, addr := startTestServer(t, config)
+	expect := func(tc *textproto.Conn, line string, code int) string {
+		t.Helper()
+		tc.PrintfLine("%s", line)
+		_, msg, err := tc.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return msg
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// PROT and PBSZ are refused before AUTH, PROT before PBSZ.
+	expect(tc, "PBSZ 0", 550)
+	expect(tc, "PROT P", 550)
+	expect(tc, "AUTH TLS", 234)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tc = textproto.NewConn(tlsConn)
+	expect(tc, "PROT P", 503)
+	expect(tc, "PBSZ 0", 200)
+	expect(tc, "PROT P", 200)
+	expect(tc, "USER alice", 331)
+	expect(tc, "PASS secret", 230)
+
+	// passive return the data connection of PASV
+	passive := func() net.Conn {
+		msg := expect(tc, "PASV", 227)
+		var h1, h2, h3, h4, p1, p2 int
+		fmt.Sscanf(msg[strings.Index(msg, "(")+1:], "%d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2)
+		data, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1*256+p2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	data := tls.Client(passive(), tlsConfig)
+	tc.PrintfLine("STOR f")
+	if _, _, err := tc.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte("private data")); err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+	if _, _, err := tc.ReadResponse(226); err != nil {
+		t.Fatalf("STOR over tls: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "alice", "f")); string(b) != "private data" {
+		t.Errorf("STOR over tls stored %q", b)
+	}
+
+	data = tls.Client(passive(), tlsConfig)
+	tc.PrintfLine("RETR f")
+	if _, _, err := tc.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(data)
+	data.Close()
+	if err != nil || string(b) != "private data" {
+		t.Errorf("RETR over tls = %q, %v", b, err)
+	}
+	if _, _, err := tc.ReadResponse(226); err != nil {
+		t.Fatalf("RETR over tls: %v", err)
+	}
+
+	// a client not speaking tls on the data connection fails the transfer.
+	plain := passive()
+	tc.PrintfLine("RETR f")
+	if _, _, err := tc.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+	plain.Write([]byte("plain\r\n"))
+	plain.Close()
+	if code, _, _ := tc.ReadResponse(0); code/100 == 2 {
+		t.Errorf("RETR over a plain data connection = %d", code)
+	}
+}
+
+// readConverted return all of a line ending converter reading in of
+// src, src handed to the converter's bufio.Reader one byte or one 16 byte
+// buffer at a time, read by the caller size bytes at a time.
+func readConverted(t *testing.T, convert func(*bufio.Reader) io.Reader, in string, oneByte bool, size int) string {
+	var src io.Reader = strings.NewReader(in)
+	if oneByte {
+		src = iotest.OneByteReader(src)
+	}
+	r := convert(bufio.NewReaderSize(src, 16))
+	var out []byte
+	p := make([]byte, size)
+	for {
+		n, err := r.Read(p)
+		out = append(out, p[:n]...)
+		if err == io.EOF {
+			return string(out)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLineEndingReaders(t *testing.T) {
+	pad := strings.Repeat("x", 15)
+	lf := func(br *bufio.Reader) io.Reader { return &lfReader{reader: br} }
+	crlf := func(br *bufio.Reader) io.Reader { return &crlfReader{reader: br} }
+	for _, c := range []struct {
+		name    string
+		convert func(*bufio.Reader) io.Reader
+		in, out string
+	}{
+		{"lf", lf, "a\r\nb\r\n", "a\nb\n"},
+		{"lf", lf, "a\nb\n", "a\nb\n"},
+		{"lf", lf, "a\rb\r", "a\rb\r"},
+		{"lf", lf, "\r\r\n\r", "\r\n\r"},
+		{"lf", lf, pad + "\r\n" + pad + "\r", pad + "\n" + pad + "\r"},
+		{"lf", lf, "", ""},
+		{"crlf", crlf, "a\nb\n", "a\r\nb\r\n"},
+		{"crlf", crlf, "a\r\nb\r\n", "a\r\nb\r\n"},
+		{"crlf", crlf, "a\rb\r", "a\rb\r"},
+		{"crlf", crlf, "\n\n\r", "\r\n\r\n\r"},
+		{"crlf", crlf, pad + "\r\n" + pad + "\n", pad + "\r\n" + pad + "\r\n"},
+		{"crlf", crlf, "", ""},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			for _, size := range []int{1, 2, 3, 16, 4096} {
+				if out := readConverted(t, c.convert, c.in, oneByte, size); out != c.out {
+					t.Errorf("%s of %q (one byte %v, read %d) = %q, want %q", c.name, c.in, oneByte, size, out, c.out)
+				}
+			}
+		}
+	}
+}
+
+func TestASCIIMode(t *testing.T) {
+	config := NewFtpdConfig()
+	driver, dir := newTestFileDriver(t, "alice")
+	s := newTestSession(t, config, "alice", driver)
+	last := func(replies []string) string {
+		return replies[len(replies)-1][:3]
+	}
+	stored := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "alice", name))
+		return string(data)
+	}
+
+	// the ASCII type a session starts in converts nothing.
+	if code := last(s.store("STOR a", "1\r\n2\r\n")); code != "226" || stored("a") != "1\r\n2\r\n" {
+		t.Errorf("STOR before TYPE = %s, %q", code, stored("a"))
+	}
+	s.expect("TYPE A", "200")
+	if code := last(s.store("STOR b", "1\r\n2\r\n")); code != "226" || stored("b") != "1\n2\n" {
+		t.Errorf("STOR in TYPE A = %s, %q", code, stored("b"))
+	}
+	if _, data := s.retrieve("RETR b"); data != "1\r\n2\r\n" {
+		t.Errorf("RETR in TYPE A = %q", data)
+	}
+	s.expect("TYPE I", "200")
+	if _, data := s.retrieve("RETR b"); data != "1\n2\n" {
+		t.Errorf("RETR in TYPE I = %q", data)
+	}
+
+	// opted out, TYPE A transfers are not converted.
+	config.AsciiUpload = false
+	config.AsciiDownload = false
+	s.expect("TYPE A", "200")
+	if code := last(s.store("STOR c", "1\r\n")); code != "226" || stored("c") != "1\r\n" {
+		t.Errorf("STOR in TYPE A opted out = %s, %q", code, stored("c"))
+	}
+	if _, data := s.retrieve("RETR b"); data != "1\n2\n" {
+		t.Errorf("RETR in TYPE A opted out = %q", data)
+	}
+}
+
+func TestHOST(t *testing.T) {
+	dirs := make(map[string]string)
+	for _, name := range []string{"base", "a", "b"} {
+		dir, err := ioutil.TempDir("", "kftpd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[name] = dir
+	}
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dirs["base"]
+	config.VirtualHosts = map[string]VirtualHost{
+		"a.example.com": {BaseDir: dirs["a"], Users: map[string]FtpdUser{"alice": {Password: "secret-a"}}},
+		"b.example.com": {BaseDir: dirs["b"], Users: map[string]FtpdUser{"alice": {Password: "secret-b"}}},
+	}
+	_, addr := startTestServer(t, config)
+	dial := func() *textproto.Conn {
+		conn, err := textproto.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, _, err := conn.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	expect := func(conn *textproto.Conn, line string, code int) {
+		t.Helper()
+		conn.PrintfLine("%s", line)
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+
+	// HOST before USER selects the users and the root of the host.
+	conn := dial()
+	expect(conn, "HOST unknown.example.com", 504)
+	expect(conn, "HOST B.example.com", 220)
+	expect(conn, "USER alice", 331)
+	expect(conn, "PASS secret-a", 530)
+	expect(conn, "USER alice", 331)
+	expect(conn, "PASS secret-b", 230)
+	expect(conn, "MKD d", 257)
+	if _, err := os.Stat(filepath.Join(dirs["b"], "alice", "d")); err != nil {
+		t.Errorf("MKD on host b: %v", err)
+	}
+	// HOST after login is refused and the host kept.
+	expect(conn, "HOST a.example.com", 503)
+	expect(conn, "MKD e", 257)
+	if _, err := os.Stat(filepath.Join(dirs["b"], "alice", "e")); err != nil {
+		t.Errorf("MKD on host b after HOST a: %v", err)
+	}
+
+	// HOST after USER is refused too.
+	conn = dial()
+	expect(conn, "USER alice", 331)
+	expect(conn, "HOST a.example.com", 503)
+
+	conn = dial()
+	expect(conn, "HOST a.example.com", 220)
+	expect(conn, "USER alice", 331)
+	expect(conn, "PASS secret-a", 230)
+	expect(conn, "MKD d", 257)
+	if _, err := os.Stat(filepath.Join(dirs["a"], "alice", "d")); err != nil {
+		t.Errorf("MKD on host a: %v", err)
+	}
+	if fis, _ := ioutil.ReadDir(dirs["base"]); len(fis) > 0 {
+		t.Errorf("virtual hosts wrote to the default root: %d entries", len(fis))
+	}
+}
+
+func TestMountDriver(t *testing.T) {
+	dirs := make(map[string]string)
+	for _, name := range []string{"root", "data", "archive", "docs"} {
+		dir, err := ioutil.TempDir("", "kftpd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[name] = dir
+	}
+	factory := NewMountDriverFactory(NewFileDriverFactory(dirs["root"]), []MountPoint{
+		{Path: "/data", Factory: NewFileDriverFactory(dirs["data"])},
+		{Path: "/data/archive", Factory: NewFileDriverFactory(dirs["archive"])},
+		{Path: "/pub/docs", Factory: NewFileDriverFactory(dirs["docs"]), ReadOnly: true},
+	})
+	driver, err := factory.NewDriver("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs["root"], "top"), []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs["docs"], "readme"), []byte("docs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+
+	// the longest mount path serves a path.
+	for _, c := range []struct{ path, dir, file string }{
+		{"/f", "root", "f"},
+		{"/data/f", "data", "f"},
+		{"/data/archive/f", "archive", "f"},
+		{"/data/archived", "data", "archived"},
+	} {
+		if code := s.store("STOR "+c.path, c.path)[1][:3]; code != "226" {
+			t.Fatalf("STOR %s = %s", c.path, code)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dirs[c.dir], c.file)); err != nil || string(data) != c.path {
+			t.Errorf("STOR %s stored in %s: %q, %v", c.path, c.dir, data, err)
+		}
+		if _, data := s.retrieve("RETR " + c.path); data != c.path {
+			t.Errorf("RETR %s = %q", c.path, data)
+		}
+	}
+	if replies := s.store("STOR /pub/docs/new", "new"); replies[len(replies)-1][0] == '2' {
+		t.Errorf("STOR in a read only mount = %q", replies)
+	}
+	if _, err := os.Stat(filepath.Join(dirs["docs"], "new")); !os.IsNotExist(err) {
+		t.Errorf("STOR in a read only mount: %v", err)
+	}
+
+	// the root listing shows the mount points and the directories leading
+	// to them.
+	if _, data := s.retrieve("NLST /"); data != "f\r\ntop\r\ndata\r\npub\r\n" {
+		t.Errorf("NLST / = %q", data)
+	}
+	if _, data := s.retrieve("NLST /pub"); data != "docs\r\n" {
+		t.Errorf("NLST /pub = %q", data)
+	}
+	if _, data := s.retrieve("NLST /data"); data != "archived\r\nf\r\narchive\r\n" {
+		t.Errorf("NLST /data = %q", data)
+	}
+	if _, data := s.retrieve("NLST /pub/docs"); data != "readme\r\n" {
+		t.Errorf("NLST /pub/docs = %q", data)
+	}
+	s.expect("CWD /pub", "250")
+	s.expect("CWD docs", "250")
+	s.expect("CWD /", "250")
+
+	// a rename across mounts or of a mount point is refused.
+	for _, c := range [][2]string{{"/f", "/data/g"}, {"/data/f", "/data/archive/g"}, {"/data/archive/f", "/g"}, {"/data", "/d"}, {"/pub", "/p"}} {
+		s.expect("RNFR "+c[0], "350")
+		s.expect("RNTO "+c[1], "550")
+	}
+	if err := driver.Rename("/f", "/data/g"); err != ErrCrossMount {
+		t.Errorf("Rename across mounts = %v", err)
+	}
+	for _, name := range []string{filepath.Join(dirs["root"], "f"), filepath.Join(dirs["data"], "f"), filepath.Join(dirs["archive"], "f")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("file renamed across mounts: %v", err)
+		}
+	}
+	s.expect("RNFR /data/f", "350")
+	s.expect("RNTO /data/g", "250")
+	if _, err := os.Stat(filepath.Join(dirs["data"], "g")); err != nil {
+		t.Errorf("rename within a mount: %v", err)
+	}
+	s.expect("RMD /data/archive", "550")
+	s.expect("RMD /pub", "550")
+}
+
+func TestEncryptDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	factory, err := NewEncryptDriverFactory(NewFileDriverFactory(dir), bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := factory.NewDriver("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, offset int64) (int64, string, error) {
+		size, reader, err := driver.GetFile(path, offset)
+		if err != nil {
+			return 0, "", err
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		return size, string(data), err
+	}
+	plain := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7 % 251)
+		}
+		return string(b)
+	}
+
+	for _, n := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 2*encryptChunkSize + encryptChunkSize/2} {
+		data := plain(n)
+		if written, err := driver.PutFile("/f", 0, strings.NewReader(data)); err != nil || written != int64(n) {
+			t.Fatalf("PutFile of %d bytes = %d, %v", n, written, err)
+		}
+		if fi, err := driver.Stat("/f"); err != nil || fi.Size() != int64(n) {
+			t.Errorf("Stat of %d bytes: %v", n, err)
+		}
+		if size, got, err := get("/f", 0); err != nil || size != int64(n) || got != data {
+			t.Errorf("GetFile of %d bytes = %d, %d bytes, %v", n, size, len(got), err)
+		}
+		stored, _ := ioutil.ReadFile(filepath.Join(dir, "f"))
+		if n > 16 && bytes.Contains(stored, []byte(data[:16])) {
+			t.Errorf("file of %d bytes stored in plaintext", n)
+		}
+	}
+
+	// an offset inside a chunk skips its start, past the end reads nothing.
+	data := plain(2*encryptChunkSize + encryptChunkSize/2)
+	for _, offset := range []int64{5, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 100, int64(len(data)) - 1, int64(len(data))} {
+		if size, got, err := get("/f", offset); err != nil || size != int64(len(data))-offset || got != data[offset:] {
+			t.Errorf("GetFile at %d = %d, %d bytes, %v", offset, size, len(got), err)
+		}
+	}
+
+	// a truncated file, or one missing its last chunk, fails to decrypt.
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := encryptChunkSize + encryptTagSize
+	for _, size := range []int{len(stored) - 1, len(stored) - 100, encryptHeaderSize + 2*sealed, encryptHeaderSize + sealed} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "g"), stored[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := get("/g", 0); err != ErrDecrypt {
+			t.Errorf("GetFile of %d of %d bytes: %v, want ErrDecrypt", size, len(stored), err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "g"), []byte("plain text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := get("/g", 0); err != ErrDecrypt {
+		t.Errorf("GetFile of a plaintext file: %v, want ErrDecrypt", err)
+	}
+
+	// a resumed upload is refused and leaves the file as it is.
+	if _, err := driver.PutFile("/f", 10, strings.NewReader("more")); err != ErrResumeUnsupported {
+		t.Errorf("PutFile at offset = %v, want ErrResumeUnsupported", err)
+	}
+	if _, got, err := get("/f", 0); err != nil || got != data {
+		t.Errorf("file after a refused resume = %d bytes, %v", len(got), err)
+	}
+	s := newTestSession(t, NewFtpdConfig(), "alice", driver)
+	s.expect("REST 10", "350")
+	if replies := s.store("STOR f", "more"); !strings.HasPrefix(replies[len(replies)-1], "550 ") {
+		t.Errorf("REST STOR on encrypted files = %q", replies)
+	}
+	if code := s.store("STOR h", "new")[1]; !strings.HasPrefix(code, "226 ") {
+		t.Errorf("STOR after refused resume = %q", code)
+	}
+	if _, got := s.retrieve("RETR h"); got != "new" {
+		t.Errorf("RETR h = %q", got)
+	}
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 3 {
+		t.Errorf("files left: %d, want f, g and h", len(fis))
+	}
+}
+
+// countGetDriver - driver counting the GetFile calls reaching it
+type countGetDriver struct {
+	Driver
+	gets int
+}
+
+func (d *countGetDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	d.gets++
+	return d.Driver.GetFile(path, offset)
+}
+
+func TestCacheDriver(t *testing.T) {
+	inner, dir := newTestFileDriver(t, "")
+	cacheDir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cache, err := NewDiskCache(cacheDir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countGetDriver{Driver: inner}
+	driver, err := NewCacheDriverFactory(&testDriverFactory{counted}, cache, "test").NewDriver("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc", "big": "0123456789a"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// get read path from offset, return its data and whether inner driver
+	// served it.
+	get := func(path string, offset int64) (string, bool) {
+		t.Helper()
+		gets := counted.gets
+		size, reader, err := driver.GetFile(path, offset)
+		if err != nil {
+			t.Fatalf("GetFile %s at %d: %v", path, offset, err)
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil || size != int64(len(data)) {
+			t.Fatalf("GetFile %s at %d = %d, %q, %v", path, offset, size, data, err)
+		}
+		return string(data), counted.gets > gets
+	}
+	cached := func() int {
+		files, _ := filepath.Glob(filepath.Join(cacheDir, "*.cache"))
+		return len(files)
+	}
+
+	if data, miss := get("/a", 0); data != "aaaa" || !miss {
+		t.Errorf("first GetFile a = %q, miss %v", data, miss)
+	}
+	if data, miss := get("/a", 0); data != "aaaa" || miss {
+		t.Errorf("second GetFile a = %q, miss %v", data, miss)
+	}
+	// a ranged read is served from the cached file.
+	if data, miss := get("/a", 2); data != "aa" || miss {
+		t.Errorf("GetFile a at 2 = %q, miss %v", data, miss)
+	}
+	// a ranged read of a file not cached does not cache it.
+	if data, miss := get("/b", 1); data != "bbb" || !miss {
+		t.Errorf("GetFile b at 1 = %q, miss %v", data, miss)
+	}
+	if _, miss := get("/b", 0); !miss {
+		t.Error("GetFile b after a ranged read not from inner driver")
+	}
+	// a file larger than the cache is not cached.
+	get("/big", 0)
+	if _, miss := get("/big", 0); !miss || cached() != 2 {
+		t.Errorf("file over cache size cached: miss %v, %d files", miss, cached())
+	}
+
+	// at capacity the least recently used file is evicted.
+	get("/a", 0)
+	get("/c", 0)
+	if cached() != 2 {
+		t.Errorf("%d files cached over capacity, want 2", cached())
+	}
+	if _, miss := get("/a", 0); miss {
+		t.Error("recently used a evicted")
+	}
+	if _, miss := get("/c", 0); miss {
+		t.Error("c just cached evicted")
+	}
+	if _, miss := get("/b", 0); !miss {
+		t.Error("least recently used b not evicted")
+	}
+
+	// writes, deletes and renames through the driver drop the cached files.
+	if _, err := driver.PutFile("/b", 0, strings.NewReader("BB")); err != nil {
+		t.Fatal(err)
+	}
+	if data, miss := get("/b", 0); data != "BB" || !miss {
+		t.Errorf("GetFile b after PutFile = %q, miss %v", data, miss)
+	}
+	get("/c", 0)
+	if err := driver.DeleteFile("/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := driver.GetFile("/c", 0); err == nil {
+		t.Error("GetFile c after DeleteFile served")
+	}
+	get("/b", 0)
+	if err := driver.Rename("/b", "/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := driver.GetFile("/b", 0); err == nil {
+		t.Error("GetFile b after Rename served")
+	}
+	if data, _ := get("/d", 0); data != "BB" {
+		t.Errorf("GetFile d after Rename = %q", data)
+	}
+	get("/a", 0)
+	if err := driver.Rename("/d", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if data, miss := get("/a", 0); data != "BB" || !miss {
+		t.Errorf("GetFile a after Rename over it = %q, miss %v", data, miss)
+	}
+}
+
+// countWriteDriver - driver counting the calls writing to it
+type countWriteDriver struct {
+	Driver
+	writes int64
+}
+
+func (d *countWriteDriver) PutFile(path string, offset int64, reader io.Reader) (int64, error) {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.PutFile(path, offset, reader)
+}
+
+func (d *countWriteDriver) DeleteFile(path string) error {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.DeleteFile(path)
+}
+
+func (d *countWriteDriver) DeleteDir(path string) error {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.DeleteDir(path)
+}
+
+func (d *countWriteDriver) Rename(from, to string) error {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.Rename(from, to)
+}
+
+func (d *countWriteDriver) MakeDir(path string) error {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.MakeDir(path)
+}
+
+func (d *countWriteDriver) Chtimes(path string, atime, mtime time.Time) error {
+	atomic.AddInt64(&d.writes, 1)
+	return d.Driver.Chtimes(path, atime, mtime)
+}
+
+func TestReadOnlyUser(t *testing.T) {
+	inner, dir := newTestFileDriver(t, "alice")
+	if err := os.Mkdir(filepath.Join(dir, "alice", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver := &countWriteDriver{Driver: inner}
+	config := NewFtpdConfig()
+	config.Users = map[string]FtpdUser{"alice": {ReadOnly: true}}
+	s := newTestSession(t, config, "alice", driver)
+	for _, line := range []string{"STOR a", "APPE f", "DELE f", "RNFR f", "RNTO g", "MKD e", "XMKD e", "RMD d", "XRMD d", "MFMT 20200102030405 f"} {
+		s.expect(line, "550")
+	}
+	if _, data := s.retrieve("RETR f"); data != "data" {
+		t.Errorf("RETR f = %q", data)
+	}
+	if _, list := s.retrieve("NLST"); list != "d\r\nf\r\n" {
+		t.Errorf("NLST = %q", list)
+	}
+	s.expect("CWD d", "250")
+	if n := atomic.LoadInt64(&driver.writes); n != 0 {
+		t.Errorf("driver written %d times", n)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "alice", "f")); err != nil || string(data) != "data" {
+		t.Errorf("f = %q, %v", data, err)
+	}
+
+	// the wrapper refuses writes itself, without calling the inner driver.
+	ro := NewReadOnlyDriver(driver)
+	if _, err := ro.PutFile("/f", 0, strings.NewReader("x")); err != ErrReadOnly {
+		t.Errorf("PutFile = %v", err)
+	}
+	if err := ro.DeleteFile("/f"); err != ErrReadOnly {
+		t.Errorf("DeleteFile = %v", err)
+	}
+	if err := ro.Rename("/f", "/g"); err != ErrReadOnly {
+		t.Errorf("Rename = %v", err)
+	}
+	if err := ro.MakeDir("/e"); err != ErrReadOnly {
+		t.Errorf("MakeDir = %v", err)
+	}
+	if err := ro.DeleteDir("/d"); err != ErrReadOnly {
+		t.Errorf("DeleteDir = %v", err)
+	}
+	if n := atomic.LoadInt64(&driver.writes); n != 0 {
+		t.Errorf("read-only driver written %d times", n)
+	}
+	if _, rc, err := ro.GetFile("/f", 0); err != nil {
+		t.Errorf("GetFile = %v", err)
+	} else {
+		rc.Close()
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	lines := map[string]string{
+		"STOR": "STOR a", "APPE": "APPE f", "RETR": "RETR f",
+		"DELE": "DELE f", "RMD": "RMD d", "XRMD": "XRMD d",
+		"RNFR": "RNFR f", "RNTO": "RNTO g", "XCRC": "XCRC f",
+		"XMD5": "XMD5 f", "XSHA1": "XSHA1 f", "XSHA256": "XSHA256 f",
+		"HASH": "HASH f", "MKD": "MKD e", "XMKD": "XMKD e",
+		"LIST": "LIST", "NLST": "NLST", "MLSD": "MLSD", "MLST": "MLST f",
+	}
+	for command := range permCmds {
+		if _, ok := lines[command]; !ok {
+			t.Fatalf("no test line of %s", command)
+		}
+	}
+	deny := false
+	flags := map[string]func(*FtpdUser){
+		"CanUpload":   func(u *FtpdUser) { u.CanUpload = &deny },
+		"CanDownload": func(u *FtpdUser) { u.CanDownload = &deny },
+		"CanDelete":   func(u *FtpdUser) { u.CanDelete = &deny },
+		"CanRename":   func(u *FtpdUser) { u.CanRename = &deny },
+		"CanMkdir":    func(u *FtpdUser) { u.CanMkdir = &deny },
+		"CanList":     func(u *FtpdUser) { u.CanList = &deny },
+	}
+	for name, set := range flags {
+		inner, dir := newTestFileDriver(t, "alice")
+		if err := os.Mkdir(filepath.Join(dir, "alice", "d"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "alice", "f"), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		driver := &countWriteDriver{Driver: inner}
+		var user FtpdUser
+		set(&user)
+		config := NewFtpdConfig()
+		config.Users = map[string]FtpdUser{"alice": user}
+		s := newTestSession(t, config, "alice", driver)
+		denied := 0
+		for command, perm := range permCmds {
+			if flag := perm(user); flag != nil && !*flag {
+				s.expect(lines[command], "550")
+				denied++
+			}
+		}
+		if denied == 0 {
+			t.Errorf("%s false denies no command", name)
+		}
+		if n := atomic.LoadInt64(&driver.writes); n != 0 {
+			t.Errorf("%s false: driver written %d times", name, n)
+		}
+		// the other flags are unset and allow their commands.
+		if name != "CanMkdir" {
+			s.expect("MKD e", "257")
+		}
+		if name != "CanList" {
+			s.expect("MLST f", "250")
+		}
+		if name != "CanDownload" {
+			s.expect("XMD5 f", "250")
+		}
+	}
+}
+
+func TestWriteOnlyDirs(t *testing.T) {
+	last := func(replies []string) string { return replies[len(replies)-1][:3] }
+	config := NewFtpdConfig()
+	config.WriteOnlyDirs = []string{"drop"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver, dir := newTestFileDriver(t, "alice")
+	if err := os.Mkdir(filepath.Join(dir, "alice", "drop"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, config, "alice", driver)
+
+	if code := last(s.store("STOR drop/a", "data")); code != "226" {
+		t.Fatalf("STOR drop/a = %s", code)
+	}
+	s.expect("MKD drop/sub", "257")
+	if code := last(s.store("STOR drop/sub/b", "data")); code != "226" {
+		t.Errorf("STOR drop/sub/b = %s", code)
+	}
+	for _, line := range []string{"LIST drop", "NLST drop", "MLSD drop", "NLST drop/sub"} {
+		if replies, list := s.retrieve(line); last(replies) != "226" || len(list) != 0 {
+			t.Errorf("%s = %q, %q", line, replies, list)
+		}
+	}
+	if replies, data := s.retrieve("RETR drop/a"); last(replies) != "550" || len(data) != 0 {
+		t.Errorf("RETR drop/a = %q, %q", replies, data)
+	}
+	s.expect("DELE drop/a", "550")
+	s.expect("RNFR drop/a", "550")
+	s.expect("SIZE drop/a", "550")
+	s.expect("RMD drop/sub", "550")
+
+	// an existing file can not be overwritten or appended to.
+	if code := last(s.store("STOR drop/a", "other")); code != "550" {
+		t.Errorf("STOR over drop/a = %s", code)
+	}
+	if code := last(s.store("APPE drop/a", "other")); code != "550" {
+		t.Errorf("APPE drop/a = %s", code)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "alice", "drop", "a")); err != nil || string(data) != "data" {
+		t.Errorf("drop/a = %q, %v", data, err)
+	}
+
+	// outside the write-only dirs files are read as usual.
+	if code := last(s.store("STOR f", "data")); code != "226" {
+		t.Errorf("STOR f = %s", code)
+	}
+	s.expect("RNFR f", "350")
+	s.expect("RNTO drop/a", "550")
+	if _, list := s.retrieve("NLST"); list != "drop\r\nf\r\n" {
+		t.Errorf("NLST = %q", list)
+	}
+}
+
+func TestCertLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// issue return a client certificate signed by the test ca
+	serial := int64(1)
+	issue := func(cn string, emails, dnsNames []string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		der, err := x509.CreateCertificate(crand.Reader, &x509.Certificate{
+			SerialNumber:   big.NewInt(serial),
+			Subject:        pkix.Name{CommonName: cn},
+			NotBefore:      time.Now().Add(-time.Hour),
+			NotAfter:       time.Now().Add(time.Hour),
+			EmailAddresses: emails,
+			DNSNames:       dnsNames,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	certFile, keyFile := writeTestCert(t, dir, "server.example.com")
+
+	// start return the address of a server verifying client certificates
+	// of the test ca, mapped to user names by certUser.
+	start := func(certUser string) string {
+		config := NewFtpdConfig()
+		config.FileDriver.BaseDir = dir
+		config.AuthTLS.Enable = true
+		config.AuthTLS.CertFile, config.AuthTLS.KeyFile = certFile, keyFile
+		config.AuthTLS.ClientAuth = "optional"
+		config.AuthTLS.ClientCAFile = caFile
+		config.AuthTLS.ClientCertUser = certUser
+		config.Users = map[string]FtpdUser{
+			"alice":             {Password: "secret", CertLogin: true},
+			"bob":               {Password: "secret"},
+			"eve":               {Password: "secret", CertLogin: true, AllowedNetworks: []string{"10.0.0.0/8"}},
+			"carol@example.com": {Password: "secret", CertLogin: true},
+			"dave.example.com":  {Password: "secret", CertLogin: true},
+		}
+		_, addr := startTestServer(t, config)
+		return addr
+	}
+	// dial return a control connection of addr after AUTH TLS with certs
+	dial := func(addr string, certs ...tls.Certificate) *textproto.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		tc := textproto.NewConn(conn)
+		if _, _, err := tc.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		tc.PrintfLine("AUTH TLS")
+		if _, _, err := tc.ReadResponse(234); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return textproto.NewConn(tlsConn)
+	}
+	expect := func(tc *textproto.Conn, line string, code int) {
+		t.Helper()
+		tc.PrintfLine("%s", line)
+		if _, msg, err := tc.ReadResponse(code); err != nil {
+			t.Errorf("%s = %v %s", line, err, msg)
+		}
+	}
+
+	addr := start("CN")
+	alice := issue("alice", nil, nil)
+	tc := dial(addr, alice)
+	expect(tc, "USER alice", 232)
+	expect(tc, "PWD", 257)
+
+	// a user without CertLogin still gives the password.
+	tc = dial(addr, issue("bob", nil, nil))
+	expect(tc, "USER bob", 331)
+	expect(tc, "PASS secret", 230)
+
+	// the certificate of another user is no login for USER.
+	tc = dial(addr, alice)
+	expect(tc, "USER bob", 331)
+	expect(tc, "PASS wrong", 530)
+	expect(tc, "USER bob", 331)
+	expect(tc, "PASS secret", 230)
+
+	// without a certificate CertLogin users give the password.
+	tc = dial(addr)
+	expect(tc, "USER alice", 331)
+	expect(tc, "PASS secret", 230)
+
+	// AllowedNetworks is enforced on a certificate login.
+	tc = dial(addr, issue("eve", nil, nil))
+	expect(tc, "USER eve", 331)
+	expect(tc, "PASS secret", 530)
+
+	addr = start("SAN")
+	both := issue("alice", []string{"carol@example.com"}, []string{"dave.example.com"})
+	tc = dial(addr, both)
+	expect(tc, "USER carol@example.com", 232)
+	tc = dial(addr, both)
+	expect(tc, "USER dave.example.com", 331)
+	expect(tc, "USER alice", 331)
+	tc = dial(addr, issue("alice", nil, []string{"dave.example.com"}))
+	expect(tc, "USER dave.example.com", 232)
+}
+
+func TestAuthTLSForce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "ftp.example.com")
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.AuthTLS.Enable = true
+	config.AuthTLS.Force = true
+	config.AuthTLS.CertFile, config.AuthTLS.KeyFile = certFile, keyFile
+	config.Users = map[string]FtpdUser{"alice": {Password: "secret"}}
+	_, addr := startTestServer(t, config)
+	expect := func(tc *textproto.Conn, line string, code int) string {
+		t.Helper()
+		tc.PrintfLine("%s", line)
+		_, msg, err := tc.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return msg
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// USER and PASS are refused on the plaintext control connection.
+	if msg := expect(tc, "USER alice", 550); msg != "Use AUTH TLS first." {
+		t.Errorf("USER on plaintext = %q", msg)
+	}
+	if msg := expect(tc, "PASS secret", 550); msg != "Use AUTH TLS first." {
+		t.Errorf("PASS on plaintext = %q", msg)
+	}
+	expect(tc, "PWD", 530)
+
+	expect(tc, "AUTH TLS", 234)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tc = textproto.NewConn(tlsConn)
+	expect(tc, "USER alice", 331)
+	expect(tc, "PASS secret", 230)
+	expect(tc, "PBSZ 0", 200)
+	// clear data connections are not allowed under Force.
+	if msg := expect(tc, "PROT C", 534); msg != "Clear protection level not allowed." {
+		t.Errorf("PROT C = %q", msg)
+	}
+	expect(tc, "PROT P", 200)
+	expect(tc, "PROT C", 534)
+}
+
+func TestSiteWhoKick(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := NewFtpdConfig()
+	config.FileDriver.BaseDir = dir
+	config.Users = map[string]FtpdUser{
+		"root": {Password: "secret", Admin: true},
+		"bob":  {Password: "secret"},
+	}
+	_, addr := startTestServer(t, config)
+	// who return the session ids by user of SITE WHO
+	who := func(conn *textproto.Conn) map[string]int {
+		t.Helper()
+		conn.PrintfLine("SITE WHO")
+		_, msg, err := conn.ReadResponse(200)
+		if err != nil {
+			t.Fatalf("SITE WHO: %v", err)
+		}
+		ids := map[string]int{}
+		for _, line := range strings.Split(msg, "\n")[1:] {
+			var id int
+			var user string
+			if n, _ := fmt.Sscanf(strings.TrimSpace(line), "%d %s", &id, &user); n == 2 {
+				ids[user] = id
+			}
+		}
+		return ids
+	}
+
+	bob := dialLogin(t, addr, "bob", "secret")
+	for _, line := range []string{"SITE WHO", "SITE KICK 1"} {
+		bob.PrintfLine("%s", line)
+		if _, _, err := bob.ReadResponse(550); err != nil {
+			t.Errorf("%s by non-admin: %v", line, err)
+		}
+	}
+
+	root := dialLogin(t, addr, "root", "secret")
+	ids := who(root)
+	bobID, ok := ids["bob"]
+	if !ok || ids["root"] == 0 {
+		t.Fatalf("SITE WHO = %v", ids)
+	}
+	for _, c := range []struct {
+		line string
+		code int
+	}{
+		{"SITE KICK x", 501},
+		{"SITE KICK 9999", 550},
+		{fmt.Sprintf("SITE KICK %d", ids["root"]), 550},
+		{fmt.Sprintf("SITE KICK %d", bobID), 200},
+	} {
+		root.PrintfLine("%s", c.line)
+		if _, msg, err := root.ReadResponse(c.code); err != nil {
+			t.Errorf("%s = %v %s", c.line, err, msg)
+		}
+	}
+
+	// the kicked session is told and closed.
+	if _, _, err := bob.ReadResponse(421); err != nil {
+		t.Errorf("kicked session reply: %v", err)
+	}
+	if line, err := bob.ReadLine(); err == nil {
+		t.Errorf("kicked session read after 421: %q", line)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := who(root)["bob"]; !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("kicked session still in SITE WHO")
+		}
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	for _, c := range []struct {
+		home, user, group, want string
+	}{
+		{"%u", "alice", "", "alice"},
+		{"home/%g/%u", "alice", "dev", "home/dev/alice"},
+		{"100%%/%u", "alice", "", "100%/alice"},
+		{"%%u", "alice", "", "%u"},
+		{"%u", "a/b", "", "a_b"},
+		{"%u", `a\b`, "", "a_b"},
+		{"%u", "..", "", "_"},
+		{"%u", ".", "", "_"},
+		{"%u", "../etc", "", ".._etc"},
+		{"%g/%u", "alice", "..", "_/alice"},
+		{"%g/%u", "alice", "a/../b", "a_.._b/alice"},
+		{"fixed", "alice", "dev", "fixed"},
+	} {
+		if got := expandHome(c.home, c.user, c.group); got != c.want {
+			t.Errorf("expandHome(%q, %q, %q) = %q, want %q", c.home, c.user, c.group, got, c.want)
+		}
+	}
+}
+
+func TestDriverHome(t *testing.T) {
+	for _, c := range []struct {
+		homeDir  bool
+		template string
+		user     string
+		settings FtpdUser
+		want     string
+	}{
+		{true, "", "alice", FtpdUser{}, "alice"},
+		{false, "", "alice", FtpdUser{}, ""},
+		{false, "home/%g/%u", "alice", FtpdUser{Group: "dev"}, "home/dev/alice"},
+		{true, "home/%u", "alice", FtpdUser{}, "home/alice"},
+		{true, "", "a/b", FtpdUser{}, "a_b"},
+		{true, "", "..", FtpdUser{}, "_"},
+		{false, "%u/%g", "../../etc", FtpdUser{Group: ".."}, ".._.._etc/_"},
+		{false, "%%/%u", "alice", FtpdUser{}, "%/alice"},
+		{true, "home/%u", "alice", FtpdUser{Home: "/shared"}, "shared"},
+		{false, "", "alice", FtpdUser{Home: "%u/in"}, "alice/in"},
+		{true, "", "alice", FtpdUser{Home: "../../etc"}, "etc"},
+		{true, "", "alice", FtpdUser{Home: "/a/../../b"}, "b"},
+		{true, "", "alice", FtpdUser{Home: "/"}, ""},
+	} {
+		config := NewFtpdConfig()
+		config.HomeDir = c.homeDir
+		config.HomeTemplate = c.template
+		config.Users = map[string]FtpdUser{c.user: c.settings}
+		server, client := tcpPair(t, "127.0.0.1:0")
+		server.Close()
+		client.Close()
+		fc := NewFtpConn(1, server, config, nil, nil)
+		fc.user = c.user
+		home := fc.driverHome()
+		if home != c.want {
+			t.Errorf("HomeDir %v HomeTemplate %q user %q %+v: home %q, want %q", c.homeDir, c.template, c.user, c.settings, home, c.want)
+		}
+		if home == ".." || strings.HasPrefix(home, "../") || strings.HasPrefix(home, "/") {
+			t.Errorf("user %q %+v: home %q not under the driver root", c.user, c.settings, home)
+		}
+	}
+}
@@ -1,72 +1,134 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/zhoukk/kftpd"
 )
 
 func main() {
 	var configFile string
+	var check bool
 	flag.StringVar(&configFile, "c", "kftpd.yaml", "config file")
+	flag.BoolVar(&check, "t", false, "check config and exit")
 	flag.Parse()
 
 	config, err := kftpd.LoadFtpdConfig(configFile)
+	if err != nil && check {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "config %s check failed\n", configFile)
+		os.Exit(1)
+	}
 	if err != nil {
 		log.Println(err)
 		flag.Usage()
 		return
 	}
 
+	if check {
+		errs := config.Check()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "config %s check failed\n", configFile)
+			os.Exit(1)
+		}
+		fmt.Printf("config %s is ok\n", configFile)
+		return
+	}
+
 	if config.Debug {
 		log.Printf("%+v\n", config)
 	}
 
-	// kftpd.UserBeforeLogin(func(user, pass string) bool {
-	// 	log.Printf("UserBeforeLogin %s %s\n", user, pass)
-	// 	return true
-	// })
-
-	// kftpd.UserAfterLogin(func(user string) {
-	// 	log.Printf("UserAfterLogin %s\n", user)
-	// })
-
-	// kftpd.FileBeforePut(func(user, path string) bool {
-	// 	log.Printf("FileBeforePut %s %s\n", user, path)
-	// 	return true
-	// })
-
-	// kftpd.FileAfterPut(func(user, path string) {
-	// 	log.Printf("FileAfterPut %s %s\n", user, path)
-	// })
-
-	// kftpd.FileBeforeGet(func(user, path string) bool {
-	// 	log.Printf("FileBeforeGet %s %s\n", user, path)
-	// 	return true
+	server := kftpd.NewServer(config)
+
+	// server.SetLogger(kftpd.NewJSONLogger(os.Stdout, kftpd.LogInfo))
+
+	// server.SetHandler(&kftpd.FtpdHandler{
+	// 	UserBeforeLogin: func(user, pass string) bool {
+	// 		log.Printf("UserBeforeLogin %s %s\n", user, pass)
+	// 		return true
+	// 	},
+	// 	UserAfterLogin: func(user string) {
+	// 		log.Printf("UserAfterLogin %s\n", user)
+	// 	},
+	// 	FileBeforePut: func(user, path string) bool {
+	// 		log.Printf("FileBeforePut %s %s\n", user, path)
+	// 		return true
+	// 	},
+	// 	FileAfterPut: func(user, path string) {
+	// 		log.Printf("FileAfterPut %s %s\n", user, path)
+	// 	},
+	// 	FileBeforeGet: func(user, path string) bool {
+	// 		log.Printf("FileBeforeGet %s %s\n", user, path)
+	// 		return true
+	// 	},
+	// 	FileAfterGet: func(user, path string) {
+	// 		log.Printf("FileAfterGet %s %s\n", user, path)
+	// 	},
+	// 	FileBeforeDelete: func(user, path string) bool {
+	// 		log.Printf("FileBeforeDelete %s %s\n", user, path)
+	// 		return true
+	// 	},
+	// 	FileAfterDelete: func(user, path string) {
+	// 		log.Printf("FileAfterDelete %s %s\n", user, path)
+	// 	},
+	// 	FileBeforeRename: func(user, from, to string) bool {
+	// 		log.Printf("FileBeforeRename %s %s %s\n", user, from, to)
+	// 		return true
+	// 	},
+	// 	FileAfterRename: func(user, from, to string) {
+	// 		log.Printf("FileAfterRename %s %s %s\n", user, from, to)
+	// 	},
+	// 	TransferComplete: func(user, path string, size int64) error {
+	// 		log.Printf("TransferComplete %s %s %d\n", user, path, size)
+	// 		return nil
+	// 	},
 	// })
 
-	// kftpd.FileAfterGet(func(user, path string) {
-	// 	log.Printf("FileAfterGet %s %s\n", user, path)
-	// })
-
-	// kftpd.FileBeforeDelete(func(user, path string) bool {
-	// 	log.Printf("FileBeforeDelete %s %s\n", user, path)
-	// 	return true
-	// })
-
-	// kftpd.FileAfterDelete(func(user, path string) {
-	// 	log.Printf("FileAfterDelete %s %s\n", user, path)
-	// })
-
-	// kftpd.FileBeforeRename(func(user, from, to string) bool {
-	// 	log.Printf("FileBeforeRename %s %s %s\n", user, from, to)
-	// 	return true
-	// })
-
-	// kftpd.FileAfterRename(func(user, from, to string) {
-	// 	log.Printf("FileAfterRename %s %s %s\n", user, from, to)
-	// })
-
-	log.Fatal(kftpd.FtpdServe(config))
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			config, err := kftpd.LoadFtpdConfig(configFile)
+			if err != nil {
+				log.Println("reload config fail:", err)
+				continue
+			}
+			if err := server.Reload(config); err != nil {
+				log.Println("reload config fail:", err)
+				continue
+			}
+			log.Println("config reloaded")
+		}
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if err := server.Serve(); err != kftpd.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,8 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// The database/sql driver of SQL Driver mysql, built in by
+// go build -tags mysql ./main
+import _ "github.com/go-sql-driver/mysql"
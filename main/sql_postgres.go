@@ -0,0 +1,8 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// The database/sql driver of SQL Driver postgres, built in by
+// go build -tags postgres ./main
+import _ "github.com/lib/pq"
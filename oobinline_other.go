@@ -0,0 +1,9 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package kftpd
+
+import "net"
+
+// setOOBInline is not supported on this platform
+func setOOBInline(conn net.Conn) {}
@@ -0,0 +1,19 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package kftpd
+
+import (
+	"os"
+	"syscall"
+)
+
+// statInfo return device, inode and owner uid of file from the stat of
+// system, false if the file is not from the local file system.
+func statInfo(fi os.FileInfo) (uint64, uint64, uint32, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), st.Uid, true
+}
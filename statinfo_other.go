@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package kftpd
+
+import "os"
+
+// statInfo is not supported on this platform
+func statInfo(fi os.FileInfo) (uint64, uint64, uint32, bool) {
+	return 0, 0, 0, false
+}